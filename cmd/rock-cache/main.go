@@ -1,74 +1,28 @@
 package main
 
 import (
-	"crypto/sha256"
-	"encoding/hex"
 	"encoding/json"
 	"fmt"
-	"io"
 	"os"
-	"path/filepath"
 	"sort"
-	"strings"
 	"time"
+
+	"github.com/rock-os/tools/pkg/cache"
 )
 
 const (
 	Version   = "1.0.0"
 	BuildTime = "2025-01-01T00:00:00Z"
 	GitCommit = "dev"
-
-	// Default cache directory
-	DefaultCacheDir = ".rock-cache"
-
-	// Cache subdirectories
-	ArtifactsDir = "artifacts"
-	MetadataDir  = "metadata"
-
-	// Default cache expiration (7 days)
-	DefaultMaxAge = 7 * 24 * time.Hour
 )
 
-// CacheEntry represents metadata for a cached artifact
-type CacheEntry struct {
-	Key         string    `json:"key"`
-	Filename    string    `json:"filename"`
-	Size        int64     `json:"size"`
-	Hash        string    `json:"hash"`
-	Timestamp   time.Time `json:"timestamp"`
-	Description string    `json:"description,omitempty"`
-	Tags        []string  `json:"tags,omitempty"`
-	AccessCount int       `json:"access_count"`
-	LastAccess  time.Time `json:"last_access"`
-}
-
-// CacheStats represents cache statistics
-type CacheStats struct {
-	TotalEntries int    `json:"total_entries"`
-	TotalSize    int64  `json:"total_size"`
-	OldestEntry  time.Time `json:"oldest_entry,omitempty"`
-	NewestEntry  time.Time `json:"newest_entry,omitempty"`
-}
-
 var (
-	cacheDir     string
-	artifactsDir string
-	metadataDir  string
-	verboseMode  bool
-	jsonOutput   bool
+	store       *cache.Store
+	verboseMode bool
+	jsonOutput  bool
 )
 
 func init() {
-	// Set up cache directories
-	cacheDir = os.Getenv("ROCK_CACHE_DIR")
-	if cacheDir == "" {
-		homeDir, _ := os.UserHomeDir()
-		cacheDir = filepath.Join(homeDir, DefaultCacheDir)
-	}
-
-	artifactsDir = filepath.Join(cacheDir, ArtifactsDir)
-	metadataDir = filepath.Join(cacheDir, MetadataDir)
-
 	// Check for verbose mode
 	if os.Getenv("ROCK_VERBOSE") == "true" {
 		verboseMode = true
@@ -87,7 +41,8 @@ func main() {
 	}
 
 	// Initialize cache directories
-	if err := initializeCacheDir(); err != nil {
+	var err error
+	if store, err = cache.Open(cache.Dir()); err != nil {
 		fmt.Fprintf(os.Stderr, "Error initializing cache: %v\n", err)
 		os.Exit(1)
 	}
@@ -119,7 +74,7 @@ func main() {
 		cmdList()
 
 	case "clean":
-		maxAge := DefaultMaxAge
+		maxAge := cache.DefaultMaxAge
 		if len(os.Args) >= 3 {
 			days := 0
 			if _, err := fmt.Sscanf(os.Args[2], "%d", &days); err == nil {
@@ -206,65 +161,19 @@ Examples:
   rock-cache stats`)
 }
 
-func initializeCacheDir() error {
-	// Create cache directories if they don't exist
-	dirs := []string{cacheDir, artifactsDir, metadataDir}
-	for _, dir := range dirs {
-		if err := os.MkdirAll(dir, 0755); err != nil {
-			return fmt.Errorf("failed to create directory %s: %v", dir, err)
-		}
-	}
-	return nil
-}
-
 func cmdStore(key, filePath string) {
 	// Validate key
-	if !isValidKey(key) {
+	if !cache.ValidKey(key) {
 		fmt.Fprintf(os.Stderr, "Error: invalid key format. Use alphanumeric, dash, underscore, and dot only\n")
 		os.Exit(1)
 	}
 
-	// Check if file exists
-	fileInfo, err := os.Stat(filePath)
+	entry, err := store.Put(key, filePath)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error: cannot access file %s: %v\n", filePath, err)
-		os.Exit(1)
-	}
-
-	// Calculate file hash
-	hash, err := calculateFileHash(filePath)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error calculating hash: %v\n", err)
-		os.Exit(1)
-	}
-
-	// Create cache entry
-	entry := &CacheEntry{
-		Key:         key,
-		Filename:    filepath.Base(filePath),
-		Size:        fileInfo.Size(),
-		Hash:        hash,
-		Timestamp:   time.Now(),
-		AccessCount: 0,
-		LastAccess:  time.Now(),
-	}
-
-	// Copy file to cache
-	artifactPath := filepath.Join(artifactsDir, key)
-	if err := copyFile(filePath, artifactPath); err != nil {
 		fmt.Fprintf(os.Stderr, "Error storing artifact: %v\n", err)
 		os.Exit(1)
 	}
 
-	// Save metadata
-	metadataPath := filepath.Join(metadataDir, key+".json")
-	if err := saveMetadata(entry, metadataPath); err != nil {
-		// Clean up artifact if metadata save fails
-		os.Remove(artifactPath)
-		fmt.Fprintf(os.Stderr, "Error saving metadata: %v\n", err)
-		os.Exit(1)
-	}
-
 	if jsonOutput {
 		json.NewEncoder(os.Stdout).Encode(entry)
 	} else {
@@ -276,43 +185,15 @@ func cmdStore(key, filePath string) {
 }
 
 func cmdGet(key, destPath string) {
-	// Validate key
-	if !isValidKey(key) {
-		fmt.Fprintf(os.Stderr, "Error: invalid key format\n")
-		os.Exit(1)
-	}
-
-	// Load metadata
-	metadataPath := filepath.Join(metadataDir, key+".json")
-	entry, err := loadMetadata(metadataPath)
+	entry, err := store.Get(key, destPath)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error: artifact '%s' not found in cache\n", key)
-		os.Exit(1)
-	}
-
-	// Check if artifact exists
-	artifactPath := filepath.Join(artifactsDir, key)
-	if _, err := os.Stat(artifactPath); err != nil {
-		fmt.Fprintf(os.Stderr, "Error: artifact file missing for '%s'\n", key)
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
 	}
-
-	// Determine destination path
 	if destPath == "" {
 		destPath = entry.Filename
 	}
 
-	// Copy artifact to destination
-	if err := copyFile(artifactPath, destPath); err != nil {
-		fmt.Fprintf(os.Stderr, "Error retrieving artifact: %v\n", err)
-		os.Exit(1)
-	}
-
-	// Update access metadata
-	entry.AccessCount++
-	entry.LastAccess = time.Now()
-	saveMetadata(entry, metadataPath)
-
 	if jsonOutput {
 		result := map[string]interface{}{
 			"key":         key,
@@ -330,7 +211,7 @@ func cmdGet(key, destPath string) {
 }
 
 func cmdList() {
-	entries, err := listAllEntries()
+	entries, err := store.List()
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error listing cache: %v\n", err)
 		os.Exit(1)
@@ -375,28 +256,17 @@ func cmdList() {
 }
 
 func cmdClean(maxAge time.Duration) {
-	entries, err := listAllEntries()
+	entries, err := store.Clean(maxAge)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error listing cache: %v\n", err)
 		os.Exit(1)
 	}
 
-	cutoff := time.Now().Add(-maxAge)
 	var removed []string
 	var totalSize int64
-
 	for _, entry := range entries {
-		if entry.Timestamp.Before(cutoff) {
-			// Remove artifact and metadata
-			artifactPath := filepath.Join(artifactsDir, entry.Key)
-			metadataPath := filepath.Join(metadataDir, entry.Key+".json")
-
-			os.Remove(artifactPath)
-			os.Remove(metadataPath)
-
-			removed = append(removed, entry.Key)
-			totalSize += entry.Size
-		}
+		removed = append(removed, entry.Key)
+		totalSize += entry.Size
 	}
 
 	if jsonOutput {
@@ -425,24 +295,17 @@ func cmdClean(maxAge time.Duration) {
 
 func cmdRemove(key string) {
 	// Validate key
-	if !isValidKey(key) {
+	if !cache.ValidKey(key) {
 		fmt.Fprintf(os.Stderr, "Error: invalid key format\n")
 		os.Exit(1)
 	}
 
-	// Check if entry exists
-	metadataPath := filepath.Join(metadataDir, key+".json")
-	entry, err := loadMetadata(metadataPath)
+	entry, err := store.Remove(key)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error: artifact '%s' not found\n", key)
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
 	}
 
-	// Remove artifact and metadata
-	artifactPath := filepath.Join(artifactsDir, key)
-	os.Remove(artifactPath)
-	os.Remove(metadataPath)
-
 	if jsonOutput {
 		result := map[string]interface{}{
 			"removed": key,
@@ -456,35 +319,12 @@ func cmdRemove(key string) {
 }
 
 func cmdStats() {
-	entries, err := listAllEntries()
+	stats, err := store.Stats()
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error gathering stats: %v\n", err)
 		os.Exit(1)
 	}
 
-	stats := &CacheStats{
-		TotalEntries: len(entries),
-	}
-
-	if len(entries) > 0 {
-		// Find oldest and newest
-		oldest := entries[0].Timestamp
-		newest := entries[0].Timestamp
-
-		for _, entry := range entries {
-			stats.TotalSize += entry.Size
-			if entry.Timestamp.Before(oldest) {
-				oldest = entry.Timestamp
-			}
-			if entry.Timestamp.After(newest) {
-				newest = entry.Timestamp
-			}
-		}
-
-		stats.OldestEntry = oldest
-		stats.NewestEntry = newest
-	}
-
 	if jsonOutput {
 		json.NewEncoder(os.Stdout).Encode(stats)
 	} else {
@@ -502,24 +342,18 @@ func cmdStats() {
 				formatDuration(time.Since(stats.NewestEntry)))
 		}
 
-		fmt.Printf("Cache location: %s\n", cacheDir)
+		fmt.Printf("Cache location: %s\n", store.Dir)
 	}
 }
 
 func cmdVerify(key string) {
-	// Load metadata
-	metadataPath := filepath.Join(metadataDir, key+".json")
-	entry, err := loadMetadata(metadataPath)
+	entry, currentHash, err := store.Verify(key)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error: artifact '%s' not found\n", key)
-		os.Exit(1)
-	}
-
-	// Calculate current hash
-	artifactPath := filepath.Join(artifactsDir, key)
-	currentHash, err := calculateFileHash(artifactPath)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error verifying artifact: %v\n", err)
+		if entry == nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		} else {
+			fmt.Fprintf(os.Stderr, "Error verifying artifact: %v\n", err)
+		}
 		os.Exit(1)
 	}
 
@@ -548,28 +382,13 @@ func cmdVerify(key string) {
 }
 
 func cmdExport(outputDir string) {
-	// Create output directory
-	if err := os.MkdirAll(outputDir, 0755); err != nil {
-		fmt.Fprintf(os.Stderr, "Error creating output directory: %v\n", err)
-		os.Exit(1)
-	}
-
-	// Copy entire cache directory
-	artifactsOut := filepath.Join(outputDir, "artifacts")
-	metadataOut := filepath.Join(outputDir, "metadata")
-
-	if err := copyDir(artifactsDir, artifactsOut); err != nil {
-		fmt.Fprintf(os.Stderr, "Error exporting artifacts: %v\n", err)
-		os.Exit(1)
-	}
-
-	if err := copyDir(metadataDir, metadataOut); err != nil {
-		fmt.Fprintf(os.Stderr, "Error exporting metadata: %v\n", err)
+	if err := store.Export(outputDir); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
 	}
 
 	// Count exported items
-	entries, _ := listAllEntries()
+	entries, _ := store.List()
 
 	if jsonOutput {
 		result := map[string]interface{}{
@@ -583,48 +402,14 @@ func cmdExport(outputDir string) {
 }
 
 func cmdImport(inputDir string) {
-	// Check if input directory exists
-	if _, err := os.Stat(inputDir); err != nil {
-		fmt.Fprintf(os.Stderr, "Error: input directory not found: %s\n", inputDir)
-		os.Exit(1)
-	}
-
-	artifactsIn := filepath.Join(inputDir, "artifacts")
-	metadataIn := filepath.Join(inputDir, "metadata")
-
-	// Import artifacts
-	imported := 0
-	entries, err := os.ReadDir(metadataIn)
+	imported, err := store.Import(inputDir, func(key string, err error) {
+		fmt.Fprintf(os.Stderr, "Warning: failed to import %s: %v\n", key, err)
+	})
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error reading import directory: %v\n", err)
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
 	}
 
-	for _, entry := range entries {
-		if filepath.Ext(entry.Name()) == ".json" {
-			key := strings.TrimSuffix(entry.Name(), ".json")
-
-			// Copy artifact
-			srcArtifact := filepath.Join(artifactsIn, key)
-			dstArtifact := filepath.Join(artifactsDir, key)
-			if err := copyFile(srcArtifact, dstArtifact); err != nil {
-				fmt.Fprintf(os.Stderr, "Warning: failed to import %s: %v\n", key, err)
-				continue
-			}
-
-			// Copy metadata
-			srcMetadata := filepath.Join(metadataIn, entry.Name())
-			dstMetadata := filepath.Join(metadataDir, entry.Name())
-			if err := copyFile(srcMetadata, dstMetadata); err != nil {
-				os.Remove(dstArtifact) // Clean up artifact if metadata fails
-				fmt.Fprintf(os.Stderr, "Warning: failed to import metadata for %s: %v\n", key, err)
-				continue
-			}
-
-			imported++
-		}
-	}
-
 	if jsonOutput {
 		result := map[string]interface{}{
 			"imported_from": inputDir,
@@ -638,129 +423,6 @@ func cmdImport(inputDir string) {
 
 // Helper functions
 
-func isValidKey(key string) bool {
-	// Allow alphanumeric, dash, underscore, and dot
-	for _, r := range key {
-		if !((r >= 'a' && r <= 'z') ||
-			 (r >= 'A' && r <= 'Z') ||
-			 (r >= '0' && r <= '9') ||
-			 r == '-' || r == '_' || r == '.') {
-			return false
-		}
-	}
-	return len(key) > 0 && len(key) <= 255
-}
-
-func calculateFileHash(filePath string) (string, error) {
-	file, err := os.Open(filePath)
-	if err != nil {
-		return "", err
-	}
-	defer file.Close()
-
-	hash := sha256.New()
-	if _, err := io.Copy(hash, file); err != nil {
-		return "", err
-	}
-
-	return hex.EncodeToString(hash.Sum(nil)), nil
-}
-
-func copyFile(src, dst string) error {
-	sourceFile, err := os.Open(src)
-	if err != nil {
-		return err
-	}
-	defer sourceFile.Close()
-
-	// Create destination directory if needed
-	dstDir := filepath.Dir(dst)
-	if err := os.MkdirAll(dstDir, 0755); err != nil {
-		return err
-	}
-
-	destFile, err := os.Create(dst)
-	if err != nil {
-		return err
-	}
-	defer destFile.Close()
-
-	_, err = io.Copy(destFile, sourceFile)
-	return err
-}
-
-func copyDir(src, dst string) error {
-	// Create destination directory
-	if err := os.MkdirAll(dst, 0755); err != nil {
-		return err
-	}
-
-	entries, err := os.ReadDir(src)
-	if err != nil {
-		return err
-	}
-
-	for _, entry := range entries {
-		srcPath := filepath.Join(src, entry.Name())
-		dstPath := filepath.Join(dst, entry.Name())
-
-		if entry.IsDir() {
-			if err := copyDir(srcPath, dstPath); err != nil {
-				return err
-			}
-		} else {
-			if err := copyFile(srcPath, dstPath); err != nil {
-				return err
-			}
-		}
-	}
-
-	return nil
-}
-
-func saveMetadata(entry *CacheEntry, path string) error {
-	data, err := json.MarshalIndent(entry, "", "  ")
-	if err != nil {
-		return err
-	}
-	return os.WriteFile(path, data, 0644)
-}
-
-func loadMetadata(path string) (*CacheEntry, error) {
-	data, err := os.ReadFile(path)
-	if err != nil {
-		return nil, err
-	}
-
-	var entry CacheEntry
-	if err := json.Unmarshal(data, &entry); err != nil {
-		return nil, err
-	}
-
-	return &entry, nil
-}
-
-func listAllEntries() ([]*CacheEntry, error) {
-	files, err := os.ReadDir(metadataDir)
-	if err != nil {
-		return nil, err
-	}
-
-	var entries []*CacheEntry
-	for _, file := range files {
-		if filepath.Ext(file.Name()) == ".json" {
-			path := filepath.Join(metadataDir, file.Name())
-			entry, err := loadMetadata(path)
-			if err != nil {
-				continue // Skip corrupted metadata
-			}
-			entries = append(entries, entry)
-		}
-	}
-
-	return entries, nil
-}
-
 func formatSize(bytes int64) string {
 	const unit = 1024
 	if bytes < unit {
@@ -788,4 +450,4 @@ func formatDuration(d time.Duration) string {
 		}
 		return fmt.Sprintf("%d days", days)
 	}
-}
\ No newline at end of file
+}
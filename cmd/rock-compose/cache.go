@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/rock-os/tools/pkg/cache"
+)
+
+// stepCachePrefix starts the cache keys of step manifests
+const stepCachePrefix = "step-"
+
+// cacheManifest is stored in the cache under a step's key. The artifacts
+// themselves are stored under their content hash, so identical files
+// produced by different steps or runs are kept once.
+type cacheManifest struct {
+	Step      string            `json:"step"`
+	Outputs   map[string]string `json:"outputs,omitempty"`
+	Artifacts []Artifact        `json:"artifacts,omitempty"`
+}
+
+// cacheable reports whether a step's result can be restored from the
+// cache. A step with inputs but nothing to restore is run every time,
+// since whatever it does would be skipped on a hit.
+func (s Step) cacheable() bool {
+	return len(s.Inputs) > 0 && (len(s.Artifacts) > 0 || len(s.Outputs) > 0)
+}
+
+// cacheKey derives a step's cache key from the tool binary, arguments,
+// working directory, pipeline variables and the contents of its inputs
+func cacheKey(spec *commandSpec, step Step, scope *Scope) (string, error) {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "tool=%s\n", filepath.Base(spec.path))
+	if filepath.IsAbs(spec.path) {
+		// A rebuilt tool may produce different output
+		sum, err := cache.HashFile(spec.path)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(hash, "tool-sha256=%s\n", sum)
+	}
+	fmt.Fprintf(hash, "dir=%s\n", spec.dir)
+	for _, arg := range spec.args {
+		fmt.Fprintf(hash, "arg=%s\n", arg)
+	}
+
+	defined, err := scope.Defined()
+	if err != nil {
+		return "", err
+	}
+	for _, env := range defined {
+		fmt.Fprintf(hash, "env=%s\n", env)
+	}
+
+	files, err := inputFiles(step, scope)
+	if err != nil {
+		return "", err
+	}
+	for _, path := range files {
+		sum, err := hashInput(path)
+		if err != nil {
+			return "", fmt.Errorf("input %s: %v", path, err)
+		}
+		fmt.Fprintf(hash, "input=%s %s\n", path, sum)
+	}
+
+	return stepCachePrefix + hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// inputFiles expands a step's input globs to the sorted list of files
+// they name. Directories are walked.
+func inputFiles(step Step, scope *Scope) ([]string, error) {
+	seen := make(map[string]bool)
+	var files []string
+	for _, pattern := range step.Inputs {
+		pattern, err := scope.Expand(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("input: %v", err)
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("input %s: %v", pattern, err)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("input %s matches no files", pattern)
+		}
+		for _, match := range matches {
+			err := filepath.WalkDir(match, func(path string, d fs.DirEntry, err error) error {
+				if err != nil {
+					return err
+				}
+				if !d.IsDir() && !seen[path] {
+					seen[path] = true
+					files = append(files, path)
+				}
+				return nil
+			})
+			if err != nil {
+				return nil, fmt.Errorf("input %s: %v", match, err)
+			}
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// hashInput hashes a file's contents, or a symlink's target
+func hashInput(path string) (string, error) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return "", err
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(path)
+		if err != nil {
+			return "", err
+		}
+		return "symlink:" + target, nil
+	}
+	if !info.Mode().IsRegular() {
+		return info.Mode().Type().String(), nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s %o", hex.EncodeToString(hash.Sum(nil)), info.Mode().Perm()), nil
+}
+
+// restoreFromCache copies a step's artifacts back from the cache. It
+// returns nil if the step has not been cached under key.
+func (r *runner) restoreFromCache(key string) (*cacheManifest, error) {
+	data, err := r.store.ReadFile(key)
+	if err != nil {
+		return nil, nil
+	}
+	var manifest cacheManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("invalid cache entry %s: %v", key, err)
+	}
+
+	for _, artifact := range manifest.Artifacts {
+		if _, err := r.store.Get(cache.ContentKey(artifact.SHA256), artifact.Path); err != nil {
+			return nil, err
+		}
+		if sum, err := cache.HashFile(artifact.Path); err != nil || sum != artifact.SHA256 {
+			return nil, fmt.Errorf("cached artifact %s is corrupted", artifact.Path)
+		}
+	}
+	return &manifest, nil
+}
+
+// saveToCache stores a successful step's artifacts and outputs under key
+func (r *runner) saveToCache(key string, step Step, result ExecutionResult) error {
+	for _, artifact := range result.Artifacts {
+		if _, err := r.store.PutContent(artifact.Path); err != nil {
+			return fmt.Errorf("failed to cache %s: %w", artifact.Path, err)
+		}
+	}
+
+	manifest := cacheManifest{
+		Step:      stepID(step),
+		Outputs:   result.Outputs,
+		Artifacts: result.Artifacts,
+	}
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if _, err := r.store.PutReader(key, key+".json", bytes.NewReader(data)); err != nil {
+		return fmt.Errorf("failed to cache step: %w", err)
+	}
+	return nil
+}
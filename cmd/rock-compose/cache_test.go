@@ -0,0 +1,73 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rock-os/tools/pkg/cache"
+)
+
+func TestStepCache(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "config.yaml")
+	artifact := filepath.Join(dir, "out", "config.json")
+	runs := filepath.Join(dir, "runs")
+	if err := os.WriteFile(input, []byte("mode: debug\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := cache.Open(filepath.Join(dir, "cache"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := newRunner(&Pipeline{Name: "cache"}, 1)
+	r.store = store
+
+	step := Step{
+		Name:      "generate",
+		Shell:     "sh",
+		Command:   "echo run >> " + runs + "; mkdir -p " + filepath.Dir(artifact) + "; cp " + input + " " + artifact,
+		Inputs:    []string{input},
+		Artifacts: []string{artifact},
+	}
+	run := func(step Step, wantRuns int, wantCached bool) {
+		t.Helper()
+		result := r.executeStep("config", step, r.scope, "")
+		if !result.Success {
+			t.Fatalf("step failed: %s\n%s", result.Error, result.Output)
+		}
+		if result.Cached != wantCached {
+			t.Errorf("cached = %v, want %v", result.Cached, wantCached)
+		}
+		data, _ := os.ReadFile(runs)
+		if got := strings.Count(string(data), "run"); got != wantRuns {
+			t.Errorf("step ran %d times, want %d", got, wantRuns)
+		}
+	}
+
+	// Miss, then a hit that restores the deleted artifact without running
+	run(step, 1, false)
+	if err := os.Remove(artifact); err != nil {
+		t.Fatal(err)
+	}
+	run(step, 1, true)
+	if data, err := os.ReadFile(artifact); err != nil || string(data) != "mode: debug\n" {
+		t.Errorf("artifact not restored: %q %v", data, err)
+	}
+
+	// Changing an input changes the key
+	if err := os.WriteFile(input, []byte("mode: production\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	run(step, 2, false)
+	run(step, 2, true)
+
+	// With nothing to restore, a step with inputs always runs
+	step.Artifacts = nil
+	run(step, 3, false)
+	run(step, 4, false)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// defaultGracePeriod is how long steps of a cancelled run get to exit
+// after SIGTERM before their process groups are killed
+const defaultGracePeriod = 10 * time.Second
+
+var (
+	// errCancelled is the cause of a run's context when it is interrupted
+	errCancelled = errors.New("run cancelled")
+	// errKilled is the cause when a second interrupt cuts the grace period short
+	errKilled = errors.New("run killed")
+)
+
+// cancellation is how a step's process is stopped
+type cancellation struct {
+	ctx   context.Context // Done when the step must stop
+	grace time.Duration   // For a cancelled run: time between SIGTERM and SIGKILL
+	kill  <-chan struct{} // Closed to kill without waiting out the grace period
+}
+
+// cancelled reports whether the run was interrupted rather than timed out
+func (c cancellation) cancelled() bool {
+	return errors.Is(context.Cause(c.ctx), errCancelled) || errors.Is(context.Cause(c.ctx), errKilled)
+}
+
+// sleep waits for d, or until the step must stop. It returns false if the
+// step must stop.
+func (c cancellation) sleep(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-c.ctx.Done():
+		return false
+	}
+}
+
+// initCancellation prepares the contexts that interrupting a run cancels
+func (r *runner) initCancellation(grace time.Duration) {
+	r.grace = grace
+	r.stop, r.cancel = context.WithCancelCause(context.Background())
+	r.hookStop, r.hookCancel = context.WithCancelCause(context.Background())
+	r.kill = make(chan struct{})
+}
+
+// cancelled reports whether the run has been interrupted
+func (r *runner) cancelled() bool {
+	return r.stop.Err() != nil
+}
+
+// stepCancellation returns how steps of a stage are stopped. Stages stop
+// when the run is cancelled; hooks still run then, and stop only on a
+// second interrupt.
+func (r *runner) stepCancellation(stage string) cancellation {
+	if isHook(stage) {
+		return cancellation{ctx: r.hookStop, grace: r.grace, kill: r.kill}
+	}
+	return cancellation{ctx: r.stop, grace: r.grace, kill: r.kill}
+}
+
+// trapSignals cancels the run on SIGINT or SIGTERM: running steps get
+// SIGTERM, and SIGKILL after the grace period. A second signal kills them
+// at once. The returned function stops trapping.
+func (r *runner) trapSignals() func() {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	done := make(chan struct{})
+
+	go func() {
+		select {
+		case sig := <-signals:
+			fmt.Fprintf(r.out, "\n🛑 %s: cancelling run; steps have %s to exit (signal again to kill them)\n", sig, r.grace)
+			r.events.emit(Event{Type: EventRunCancelled, Pipeline: r.pipeline.Name, Error: sig.String()})
+			r.cancel(errCancelled)
+		case <-done:
+			return
+		}
+		select {
+		case sig := <-signals:
+			fmt.Fprintf(r.out, "\n🛑 %s: killing running steps\n", sig)
+			close(r.kill)
+			r.hookCancel(errKilled)
+		case <-done:
+		}
+	}()
+
+	return func() {
+		signal.Stop(signals)
+		close(done)
+	}
+}
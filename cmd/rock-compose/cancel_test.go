@@ -0,0 +1,27 @@
+//go:build unix
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRunAttemptCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	stop := cancellation{ctx: ctx, grace: 200 * time.Millisecond, kill: make(chan struct{})}
+	spec := &commandSpec{path: "sh", args: []string{"-c", "trap '' TERM; sleep 30"}}
+
+	time.AfterFunc(100*time.Millisecond, func() { cancel(errCancelled) })
+	start := time.Now()
+	record, _, _ := spec.runAttempt(stop, Step{Name: "stubborn"}, 1, func(string, string) {})
+
+	if !record.Cancelled || record.Error != "cancelled" {
+		t.Errorf("record = %+v, want cancelled", record)
+	}
+	// The step ignores SIGTERM, so it only ends when killed after the grace period
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond || elapsed > 10*time.Second {
+		t.Errorf("step stopped after %s", elapsed)
+	}
+}
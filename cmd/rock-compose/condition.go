@@ -0,0 +1,500 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+)
+
+// Conditions decide whether a stage or step runs. The language is small:
+//
+//	always, never, true, false
+//	${VAR}, $VAR                  a variable; true when it is not empty
+//	"text", 'text', 42            literals
+//	os, arch                      the platform (runtime.GOOS, runtime.GOARCH)
+//	steps.<id>.success            a step's outcome: success, failure, skipped,
+//	                              or status (succeeded, failed, skipped)
+//	steps.<id>.outputs.<key>      a step output
+//	exists(<path>)                whether a file exists; the path is expanded
+//	a == b, a != b                string comparison
+//	!a, a && b, a || b, (a)
+//
+// Unknown names and syntax are errors, reported by validate.
+
+// condNode is a parsed condition
+type condNode struct {
+	op          string // "||", "&&", "!", "==", "!=", "lit", "var", "name" or "exists"
+	text        string // Literal, variable reference, name or exists() argument
+	left, right *condNode
+}
+
+// condValue is the value of a condition or one of its operands
+type condValue struct {
+	str    string
+	isBool bool
+	b      bool
+}
+
+func (v condValue) String() string {
+	if v.isBool {
+		return fmt.Sprint(v.b)
+	}
+	return v.str
+}
+
+// truth is a value used as a condition: a boolean, or a non-empty string
+func (v condValue) truth() bool {
+	if v.isBool {
+		return v.b
+	}
+	return v.str != ""
+}
+
+// condEnv is what conditions are evaluated against
+type condEnv struct {
+	scope  *Scope
+	status func(id string) string // Status of a step, or "" if it has not run
+}
+
+// stepOutcomes are the fields of steps.<id>
+var stepOutcomes = map[string]bool{"success": true, "failure": true, "skipped": true, "status": true}
+
+// parseCondition parses a condition
+func parseCondition(condition string) (*condNode, error) {
+	p := &condParser{src: condition}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	if p.tok == "" {
+		return nil, fmt.Errorf("empty condition")
+	}
+	node, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.tok != "" {
+		return nil, fmt.Errorf("unexpected %s at column %d", p.tok, p.start+1)
+	}
+	return node, nil
+}
+
+// condParser is a recursive descent parser over condition tokens
+type condParser struct {
+	src   string
+	pos   int
+	start int    // Offset of tok
+	tok   string // Current token; "" at the end
+	kind  string // "op", "str", "var", "word" or "call"
+	text  string // Value of str, var, word and call tokens
+}
+
+// next reads the next token
+func (p *condParser) next() error {
+	for p.pos < len(p.src) && strings.ContainsRune(" \t\n\r", rune(p.src[p.pos])) {
+		p.pos++
+	}
+	p.start = p.pos
+	p.tok, p.kind, p.text = "", "", ""
+	if p.pos == len(p.src) {
+		return nil
+	}
+
+	rest := p.src[p.pos:]
+	for _, op := range []string{"&&", "||", "==", "!=", "!", "(", ")"} {
+		if strings.HasPrefix(rest, op) {
+			p.pos += len(op)
+			p.tok, p.kind = op, "op"
+			return nil
+		}
+	}
+
+	switch c := rest[0]; {
+	case c == '"' || c == '\'':
+		end := strings.IndexByte(rest[1:], c)
+		if end < 0 {
+			return fmt.Errorf("unterminated string at column %d", p.start+1)
+		}
+		p.pos += end + 2
+		p.kind, p.text = "str", rest[1:end+1]
+
+	case c == '$':
+		end := 1
+		if len(rest) > 1 && rest[1] == '{' {
+			if end = closingBrace(rest, 1); end < 0 {
+				return fmt.Errorf("unterminated ${ at column %d", p.start+1)
+			}
+			end++
+		} else {
+			for end < len(rest) && isNameChar(rest[end]) {
+				end++
+			}
+			if end == 1 {
+				return fmt.Errorf("unexpected $ at column %d", p.start+1)
+			}
+		}
+		p.pos += end
+		p.kind, p.text = "var", rest[:end]
+
+	case isWordChar(c):
+		end := 0
+		for end < len(rest) && isWordChar(rest[end]) {
+			end++
+		}
+		p.pos += end
+		p.kind, p.text = "word", rest[:end]
+
+		// A call takes everything up to the matching ) as its argument
+		if p.text == "exists" && p.pos < len(p.src) && p.src[p.pos] == '(' {
+			depth, i := 0, p.pos
+			for ; i < len(p.src); i++ {
+				if p.src[i] == '(' {
+					depth++
+				} else if p.src[i] == ')' {
+					if depth--; depth == 0 {
+						break
+					}
+				}
+			}
+			if i == len(p.src) {
+				return fmt.Errorf("missing ) after exists( at column %d", p.start+1)
+			}
+			arg := strings.TrimSpace(p.src[p.pos+1 : i])
+			if len(arg) >= 2 && (arg[0] == '"' || arg[0] == '\'') && arg[len(arg)-1] == arg[0] {
+				arg = arg[1 : len(arg)-1]
+			}
+			if arg == "" {
+				return fmt.Errorf("exists() needs a path at column %d", p.start+1)
+			}
+			p.pos = i + 1
+			p.kind, p.text = "call", arg
+		}
+
+	default:
+		return fmt.Errorf("unexpected %q at column %d", c, p.start+1)
+	}
+	p.tok = p.src[p.start:p.pos]
+	return nil
+}
+
+func isWordChar(c byte) bool {
+	return isNameChar(c) || c == '.' || c == '-' || c == '/'
+}
+
+// or parses a || b
+func (p *condParser) or() (*condNode, error) {
+	return p.binary([]string{"||"}, p.and)
+}
+
+// and parses a && b
+func (p *condParser) and() (*condNode, error) {
+	return p.binary([]string{"&&"}, p.comparison)
+}
+
+// comparison parses a == b and a != b
+func (p *condParser) comparison() (*condNode, error) {
+	return p.binary([]string{"==", "!="}, p.unary)
+}
+
+// binary parses operands joined by left-associative operators
+func (p *condParser) binary(ops []string, operand func() (*condNode, error)) (*condNode, error) {
+	left, err := operand()
+	if err != nil {
+		return nil, err
+	}
+	for p.kind == "op" && containsString(ops, p.tok) {
+		op := p.tok
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		right, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		left = &condNode{op: op, left: left, right: right}
+	}
+	return left, nil
+}
+
+// unary parses !a, (a) and single operands
+func (p *condParser) unary() (*condNode, error) {
+	tok, kind, text, start := p.tok, p.kind, p.text, p.start
+	if tok == "" {
+		return nil, fmt.Errorf("unexpected end of condition")
+	}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case tok == "!":
+		operand, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return &condNode{op: "!", left: operand}, nil
+
+	case tok == "(":
+		node, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if p.tok != ")" {
+			return nil, fmt.Errorf("missing ) for ( at column %d", start+1)
+		}
+		return node, p.next()
+
+	case kind == "str":
+		return &condNode{op: "lit", text: text}, nil
+	case kind == "var":
+		return &condNode{op: "var", text: text}, nil
+	case kind == "call":
+		return &condNode{op: "exists", text: text}, nil
+	case kind == "word":
+		return parseName(text, start)
+	}
+	return nil, fmt.Errorf("unexpected %s at column %d", tok, start+1)
+}
+
+// parseName checks a bare word: a keyword, number, platform or step field
+func parseName(word string, start int) (*condNode, error) {
+	switch word {
+	case "always", "true", "never", "false", "os", "arch":
+		return &condNode{op: "name", text: word}, nil
+	}
+	if strings.Trim(word, "0123456789.-") == "" {
+		return &condNode{op: "lit", text: word}, nil
+	}
+	if id, field, ok := stepField(word); ok {
+		if id == "" || !(stepOutcomes[field] || field == "outputs") {
+			return nil, fmt.Errorf("bad step reference %s at column %d (use steps.<id>.success, failure, skipped, status or outputs.<key>)", word, start+1)
+		}
+		return &condNode{op: "name", text: word}, nil
+	}
+	return nil, fmt.Errorf("unknown name %s at column %d", word, start+1)
+}
+
+// stepField splits steps.<id>.<field>; for outputs, field is "outputs"
+func stepField(word string) (id, field string, ok bool) {
+	if id, _, ok := outputRef(word); ok {
+		return id, "outputs", true
+	}
+	rest, ok := strings.CutPrefix(word, "steps.")
+	if !ok {
+		return "", "", false
+	}
+	i := strings.LastIndexByte(rest, '.')
+	if i < 0 {
+		return rest, "", true
+	}
+	return rest[:i], rest[i+1:], true
+}
+
+// eval evaluates a condition
+func (n *condNode) eval(env condEnv) (condValue, error) {
+	boolean := func(b bool) condValue { return condValue{isBool: true, b: b} }
+
+	switch n.op {
+	case "||", "&&":
+		left, err := n.left.eval(env)
+		if err != nil {
+			return condValue{}, err
+		}
+		if left.truth() == (n.op == "||") {
+			return boolean(left.truth()), nil
+		}
+		right, err := n.right.eval(env)
+		if err != nil {
+			return condValue{}, err
+		}
+		return boolean(right.truth()), nil
+
+	case "!":
+		operand, err := n.left.eval(env)
+		if err != nil {
+			return condValue{}, err
+		}
+		return boolean(!operand.truth()), nil
+
+	case "==", "!=":
+		left, err := n.left.eval(env)
+		if err != nil {
+			return condValue{}, err
+		}
+		right, err := n.right.eval(env)
+		if err != nil {
+			return condValue{}, err
+		}
+		return boolean((left.String() == right.String()) == (n.op == "==")), nil
+
+	case "lit":
+		return condValue{str: n.text}, nil
+
+	case "var":
+		// ${VAR} and $VAR are empty when unset rather than an error
+		name := strings.TrimPrefix(n.text, "$")
+		if strings.HasPrefix(name, "{") {
+			name = name[1 : len(name)-1]
+		}
+		if validVarName(name) {
+			value, _, err := env.scope.Lookup(name)
+			return condValue{str: value}, err
+		}
+		value, err := env.scope.Expand(n.text)
+		return condValue{str: value}, err
+
+	case "exists":
+		path, err := env.scope.Expand(n.text)
+		if err != nil {
+			return condValue{}, err
+		}
+		_, err = os.Stat(path)
+		return boolean(err == nil), nil
+	}
+
+	switch n.text {
+	case "always", "true":
+		return boolean(true), nil
+	case "never", "false":
+		return boolean(false), nil
+	case "os":
+		return condValue{str: runtime.GOOS}, nil
+	case "arch":
+		return condValue{str: runtime.GOARCH}, nil
+	}
+
+	id, field, _ := stepField(n.text)
+	if field == "outputs" {
+		value, _, err := env.scope.Lookup(n.text)
+		return condValue{str: value}, err
+	}
+	status := env.status(id)
+	switch field {
+	case "success":
+		return boolean(status == StepSucceeded), nil
+	case "failure":
+		return boolean(status == StepFailed), nil
+	case "skipped":
+		return boolean(status == StepSkipped), nil
+	}
+	if status == "" {
+		status = StepSkipped
+	}
+	return condValue{str: status}, nil
+}
+
+// stepRefs returns the ids of the steps a condition refers to
+func (n *condNode) stepRefs() []string {
+	if n == nil {
+		return nil
+	}
+	refs := append(n.left.stepRefs(), n.right.stepRefs()...)
+	if n.op == "name" {
+		if id, _, ok := stepField(n.text); ok {
+			refs = append(refs, id)
+		}
+	}
+	return refs
+}
+
+// evaluateCondition reports whether a condition holds
+func evaluateCondition(condition string, env condEnv) (bool, error) {
+	node, err := parseCondition(condition)
+	if err != nil {
+		return false, err
+	}
+	value, err := node.eval(env)
+	if err != nil {
+		return false, err
+	}
+	return value.truth(), nil
+}
+
+// conditionEnv returns the environment conditions are evaluated in
+func (r *runner) conditionEnv(scope *Scope) condEnv {
+	return condEnv{scope: scope, status: r.stepStatus}
+}
+
+// stageConditionMet evaluates a stage's condition, once the stages it
+// depends on have finished
+func (r *runner) stageConditionMet(stage Stage) (bool, error) {
+	if stage.Condition == "" {
+		return true, nil
+	}
+	return evaluateCondition(stage.Condition, r.conditionEnv(r.stageScope(stage)))
+}
+
+// setStatus records how a step finished, for steps.<id> conditions
+func (r *runner) setStatus(step Step, status string) {
+	if status == StepReused {
+		status = StepSucceeded
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.status[stepID(step)] = status
+}
+
+// stepStatus returns how a step finished, or "" if it has not run
+func (r *runner) stepStatus(id string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.status[id]
+}
+
+// checkConditions reports conditions that do not parse, that refer to
+// steps the pipeline does not have, or that refer to steps that have not
+// finished when the condition is evaluated: a stage or step may only test
+// steps of stages upstream of it, and steps before it in a sequential
+// stage. Hooks run after every stage and may test any step.
+func checkConditions(pipeline *Pipeline) []Issue {
+	places := make(map[string]bool)
+	for _, stage := range pipeline.Stages {
+		for _, step := range stage.Steps {
+			places[stepID(step)] = true
+		}
+	}
+	finished := stepsFinished(pipeline)
+
+	var issues []Issue
+	check := func(issue Issue, where, condition string, ready func(id string) bool) {
+		if condition == "" {
+			return
+		}
+		node, err := parseCondition(condition)
+		if err != nil {
+			issue.Message = fmt.Sprintf("%s: invalid condition %q: %v", where, condition, err)
+			issues = append(issues, issue)
+			return
+		}
+		for _, id := range node.stepRefs() {
+			if !places[id] {
+				issue.Message = fmt.Sprintf("%s: condition %q refers to unknown step %s", where, condition, id)
+				issues = append(issues, issue)
+			} else if ready != nil && !ready(id) {
+				issue.Message = fmt.Sprintf("%s: condition %q refers to step %s, which does not run before it", where, condition, id)
+				issues = append(issues, issue)
+			}
+		}
+	}
+
+	for _, stage := range pipeline.Stages {
+		stage := stage
+		check(Issue{Stage: stage.Name}, "Stage "+stage.Name, stage.Condition,
+			func(id string) bool { return finished(id, stage, -1) })
+		for i, step := range stage.Steps {
+			i := i
+			check(Issue{Stage: stage.Name, Step: step.Name}, stepWhere(stage.Name, step.Name), step.Condition,
+				func(id string) bool { return finished(id, stage, i) })
+		}
+	}
+	for _, step := range pipeline.OnSuccess {
+		check(Issue{Stage: hookOnSuccess, Step: step.Name}, stepWhere(hookOnSuccess, step.Name), step.Condition, nil)
+	}
+	for _, step := range pipeline.OnFailure {
+		check(Issue{Stage: hookOnFailure, Step: step.Name}, stepWhere(hookOnFailure, step.Name), step.Condition, nil)
+	}
+	for _, step := range pipeline.Finally {
+		check(Issue{Stage: hookFinally, Step: step.Name}, stepWhere(hookFinally, step.Name), step.Condition, nil)
+	}
+	return issues
+}
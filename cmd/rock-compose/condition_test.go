@@ -0,0 +1,113 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestEvaluateCondition(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "vmlinuz"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	env := condEnv{
+		scope: newScope(nil, map[string]string{"BUILD_MODE": "production", "OUTPUT_DIR": dir, "EMPTY": ""}),
+		status: func(id string) string {
+			return map[string]string{"fetch-kernel": StepSucceeded, "sign": StepFailed}[id]
+		},
+	}
+
+	tests := map[string]bool{
+		`always`:                                    true,
+		`never`:                                     false,
+		`${BUILD_MODE} == "production"`:             true,
+		`$BUILD_MODE != 'production'`:               false,
+		`${UNSET}`:                                  false,
+		`${EMPTY} || ${BUILD_MODE}`:                 true,
+		`${UNSET:-debug} == "debug"`:                true,
+		`exists(${OUTPUT_DIR}/vmlinuz)`:             true,
+		`!exists("${OUTPUT_DIR}/missing")`:          true,
+		`steps.fetch-kernel.success`:                true,
+		`steps.sign.failure && !steps.sign.success`: true,
+		`steps.publish.skipped`:                     false,
+		`steps.publish.status == "skipped"`:         true,
+		`os == "` + runtime.GOOS + `"`:              true,
+		`(os == "plan9" || arch == "` + runtime.GOARCH + `") && ${BUILD_MODE} == "production"`: true,
+	}
+	for condition, want := range tests {
+		got, err := evaluateCondition(condition, env)
+		if err != nil || got != want {
+			t.Errorf("evaluateCondition(%s) = %v, %v; want %v", condition, got, err, want)
+		}
+	}
+
+	errors := map[string]string{
+		``:                            "empty condition",
+		`BUILD_MODE == production`:    "unknown name BUILD_MODE",
+		`${BUILD_MODE} = "x"`:         `unexpected '='`,
+		`steps.fetch-kernel.done`:     "bad step reference",
+		`(os == "linux"`:              "missing )",
+		`os == "linux`:                "unterminated string",
+		`exists()`:                    "needs a path",
+		`os == "linux" ${BUILD_MODE}`: "unexpected ${BUILD_MODE}",
+	}
+	for condition, want := range errors {
+		if _, err := parseCondition(condition); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("parseCondition(%s) error = %v, want %q", condition, err, want)
+		}
+	}
+}
+
+func TestCheckConditions(t *testing.T) {
+	pipeline := &Pipeline{Stages: []Stage{
+		{Name: "kernel", Steps: []Step{{Name: "fetch-kernel", Command: "true"}}},
+		{Name: "image", Condition: `steps.fetch-kernel.success && steps.missing.success`, Steps: []Step{
+			{Name: "create", Command: "true", Condition: `$MODE == debug`},
+		}},
+	}}
+	issues := checkConditions(pipeline)
+	if len(issues) != 2 {
+		t.Fatalf("issues = %v", issues)
+	}
+	if issues[0].Stage != "image" || !strings.Contains(issues[0].Message, "unknown step missing") {
+		t.Errorf("issue 0 = %+v", issues[0])
+	}
+	if issues[1].Step != "create" || !strings.Contains(issues[1].Message, "unknown name debug") {
+		t.Errorf("issue 1 = %+v", issues[1])
+	}
+}
+
+func TestCheckConditionsOrder(t *testing.T) {
+	pipeline := &Pipeline{
+		Stages: []Stage{
+			{Name: "kernel", Steps: []Step{{Name: "fetch-kernel", Command: "true"}}},
+			{Name: "image", DependsOn: []string{"kernel"}, Parallel: true, Condition: `steps.create.success`, Steps: []Step{
+				{Name: "create", Command: "true", Condition: `steps.fetch-kernel.success`},
+				{Name: "sign", Command: "true", Condition: `steps.create.success`},
+			}},
+			{Name: "docs", DependsOn: []string{"kernel"}, Condition: `steps.sign.success`, Steps: []Step{
+				{Name: "render", Command: "true"},
+			}},
+			{Name: "publish", DependsOn: []string{"image"}, Steps: []Step{
+				{Name: "pack", Command: "true", Condition: `steps.upload.success`},
+				{Name: "upload", Command: "true", Condition: `steps.pack.success && steps.sign.success`},
+			}},
+		},
+		Finally: []Step{{Name: "notify", Command: "true", Condition: `steps.render.failure`}},
+	}
+
+	var got []string
+	for _, issue := range checkConditions(pipeline) {
+		if !strings.Contains(issue.Message, "does not run before it") {
+			t.Errorf("unexpected issue: %s", issue.Message)
+		}
+		got = append(got, issue.Stage+"/"+issue.Step)
+	}
+	want := "image/ image/sign docs/ publish/pack"
+	if strings.Join(got, " ") != want {
+		t.Errorf("issues at %v, want %s", got, want)
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event types written to a run's event log
+const (
+	EventRunStarted    = "run_started"
+	EventStageStarted  = "stage_started"
+	EventStepStarted   = "step_started"
+	EventOutputLine    = "output_line"
+	EventStepFinished  = "step_finished"
+	EventStageFinished = "stage_finished"
+	EventRunCancelled  = "run_cancelled" // SIGINT or SIGTERM received; Error names the signal
+	EventRunFinished   = "run_finished"
+)
+
+// Event is one line of a run's events.jsonl
+type Event struct {
+	Time     time.Time `json:"time"`
+	Type     string    `json:"type"`
+	Pipeline string    `json:"pipeline,omitempty"`
+	Stage    string    `json:"stage,omitempty"`
+	Step     string    `json:"step,omitempty"`
+	Attempt  int       `json:"attempt,omitempty"`
+	Stream   string    `json:"stream,omitempty"` // stdout or stderr
+	Line     string    `json:"line,omitempty"`
+	Status   string    `json:"status,omitempty"` // succeeded, failed, reused, cached, skipped, cancelled
+	ExitCode int       `json:"exit_code,omitempty"`
+	Duration float64   `json:"duration,omitempty"` // Seconds
+	Error    string    `json:"error,omitempty"`
+}
+
+// eventLog appends events to <run>/events.jsonl. A nil log discards them.
+type eventLog struct {
+	mu   sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+}
+
+// openEventLog opens the event log of a run for appending, so a resumed
+// run continues the same stream
+func openEventLog(runID string) (*eventLog, error) {
+	dir := runDir(runID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create run directory: %w", err)
+	}
+	file, err := os.OpenFile(filepath.Join(dir, "events.jsonl"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open event log: %w", err)
+	}
+	return &eventLog{file: file, enc: json.NewEncoder(file)}, nil
+}
+
+// emit timestamps and writes an event
+func (l *eventLog) emit(e Event) {
+	if l == nil {
+		return
+	}
+	e.Time = time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.enc.Encode(e)
+}
+
+// close closes the log file
+func (l *eventLog) close() {
+	if l != nil {
+		l.file.Close()
+	}
+}
+
+// stepLogPath returns the log file of a step within a run
+func stepLogPath(runID, stage string, step Step) string {
+	return filepath.Join(runDir(runID), "logs", logName(stage), logName(stepID(step))+".log")
+}
+
+// logName turns a stage or step name into a file name
+func logName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == ' ' || r == ':' {
+			return '_'
+		}
+		return r
+	}, name)
+}
+
+// openStepLog opens a step's log for appending; retries and resumed runs
+// add to the same file
+func (r *runner) openStepLog(stage string, step Step) *os.File {
+	if r.state == nil {
+		return nil
+	}
+	path := stepLogPath(r.state.ID, stage, step)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil
+	}
+	return file
+}
+
+// outputSink receives a step's output one line at a time
+type outputSink func(stream, line string)
+
+// lineWriter splits output into lines for an outputSink
+type lineWriter struct {
+	stream string
+	sink   outputSink
+	buf    []byte
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.sink(w.stream, strings.TrimSuffix(string(w.buf[:i]), "\r"))
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// flush passes on a final line without a newline
+func (w *lineWriter) flush() {
+	if len(w.buf) > 0 {
+		w.sink(w.stream, string(w.buf))
+		w.buf = nil
+	}
+}
+
+// cmdLogs shows the events of a run, or the log of one of its steps
+func cmdLogs(runID, step string) {
+	if _, err := loadRunState(runID); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if step != "" {
+		showStepLogs(runID, step)
+		return
+	}
+
+	path := filepath.Join(runDir(runID), "events.jsonl")
+	file, err := os.Open(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: no event log for run %s: %v\n", runID, err)
+		os.Exit(1)
+	}
+	defer file.Close()
+
+	jsonOutput := os.Getenv("ROCK_OUTPUT") == "json"
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		if jsonOutput {
+			fmt.Println(scanner.Text())
+			continue
+		}
+		var e Event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			continue
+		}
+		if line := formatEvent(e); line != "" {
+			fmt.Printf("%s %s\n", e.Time.Format("15:04:05"), line)
+		}
+	}
+}
+
+// formatEvent renders an event for `rock-compose logs`
+func formatEvent(e Event) string {
+	switch e.Type {
+	case EventRunStarted:
+		return fmt.Sprintf("🚀 Run of %s started", e.Pipeline)
+	case EventStageStarted:
+		return fmt.Sprintf("📦 Stage %s", e.Stage)
+	case EventStepStarted:
+		return fmt.Sprintf("   ▶ %s/%s (attempt %d)", e.Stage, e.Step, e.Attempt)
+	case EventOutputLine:
+		return fmt.Sprintf("     │ [%s] %s", e.Step, e.Line)
+	case EventStepFinished:
+		switch e.Status {
+		case StepFailed:
+			return fmt.Sprintf("     ❌ %s/%s: %s", e.Stage, e.Step, e.Error)
+		case StepSucceeded:
+			return fmt.Sprintf("     ✅ %s/%s (%.2fs)", e.Stage, e.Step, e.Duration)
+		default:
+			return fmt.Sprintf("     ⏭️  %s/%s %s", e.Stage, e.Step, e.Status)
+		}
+	case EventStageFinished:
+		return fmt.Sprintf("📦 Stage %s %s", e.Stage, e.Status)
+	case EventRunCancelled:
+		return fmt.Sprintf("🛑 Run cancelled (%s)", e.Error)
+	case EventRunFinished:
+		return fmt.Sprintf("🏁 Run %s (%.2fs)", e.Status, e.Duration)
+	}
+	return ""
+}
+
+// showStepLogs prints the log of every step in a run matching name, which
+// may be a step ID, a step name or stage/step
+func showStepLogs(runID, name string) {
+	state, _ := loadRunState(runID)
+	keys := make([]string, 0, len(state.Steps))
+	for key := range state.Steps {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	found := false
+	for _, key := range keys {
+		step := state.Steps[key]
+		if name != key && name != step.Step && name != strings.TrimPrefix(key, step.Stage+"/") {
+			continue
+		}
+		found = true
+		path := stepLogPath(runID, step.Stage, Step{ID: strings.TrimPrefix(key, step.Stage+"/")})
+		data, err := os.ReadFile(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "⚠️  %s: no log: %v\n", key, err)
+			continue
+		}
+		fmt.Printf("==> %s (%s) <==\n", key, step.Status)
+		os.Stdout.Write(data)
+	}
+
+	if !found {
+		fmt.Fprintf(os.Stderr, "Error: run %s has no step %s\n", runID, name)
+		os.Exit(1)
+	}
+}
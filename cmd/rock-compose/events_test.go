@@ -0,0 +1,22 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLineWriter(t *testing.T) {
+	var lines []string
+	w := &lineWriter{stream: "stdout", sink: func(stream, line string) {
+		lines = append(lines, stream+": "+line)
+	}}
+
+	w.Write([]byte("first\nsec"))
+	w.Write([]byte("ond\r\n\nlast"))
+	w.flush()
+
+	want := []string{"stdout: first", "stdout: second", "stdout: ", "stdout: last"}
+	if !reflect.DeepEqual(lines, want) {
+		t.Errorf("lines = %q, want %q", lines, want)
+	}
+}
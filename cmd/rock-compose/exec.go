@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// Backoff strategies between retry attempts
+const (
+	BackoffFixed       = "fixed"       // Wait retry_delay every time (default)
+	BackoffExponential = "exponential" // Double the wait after every attempt
+	BackoffJitter      = "jitter"      // Exponential, randomized to avoid retrying in lockstep
+)
+
+const (
+	// defaultRetryDelay is used when a step sets retries but no retry_delay
+	defaultRetryDelay = time.Second
+	// maxRetryDelay caps exponential backoff
+	maxRetryDelay = 5 * time.Minute
+	// killWaitDelay bounds how long we wait for output after killing a step
+	killWaitDelay = 5 * time.Second
+)
+
+// commandSpec is everything needed to start a step's process. A fresh
+// exec.Cmd is built from it for every attempt.
+type commandSpec struct {
+	path string
+	args []string
+	dir  string
+	env  []string
+
+	// hangup holds the process's stdin open while it runs; a remote step
+	// is stopped on its host when its stdin closes
+	hangup bool
+}
+
+// commandFor resolves the program, arguments and environment for a step,
+// expanding variables in the step's scope
+func commandFor(step Step, tools *ToolResolver, scope *Scope) (*commandSpec, error) {
+	spec := &commandSpec{}
+	var err error
+
+	if step.Tool != "" {
+		// Use rock-* tool; a remote step's tool is found on its host
+		spec.path = normalizeToolName(step.Tool)
+		if step.Host == "" {
+			if spec.path, err = tools.Resolve(step.Tool); err != nil {
+				return nil, err
+			}
+		}
+		if step.Command != "" {
+			spec.args = append(spec.args, step.Command)
+		}
+		spec.args = append(spec.args, step.Args...)
+
+		// Expand variables in args
+		for i, arg := range spec.args {
+			if spec.args[i], err = scope.Expand(arg); err != nil {
+				return nil, err
+			}
+		}
+	} else if step.Shell != "" {
+		// Shell script; pipeline variables are in the environment, so the
+		// shell expands them along with its own variables. Step outputs
+		// are not valid shell names and are substituted here.
+		script, err := expandOutputs(step.Command, scope)
+		if err != nil {
+			return nil, err
+		}
+		spec.path = step.Shell
+		spec.args = []string{"-c", script}
+	} else if step.Command != "" {
+		// Direct command
+		command, err := scope.Expand(step.Command)
+		if err != nil {
+			return nil, err
+		}
+		spec.path = "sh"
+		spec.args = []string{"-c", command}
+	} else {
+		return nil, fmt.Errorf("No tool or command specified")
+	}
+
+	// Set working directory
+	if step.WorkDir != "" {
+		if spec.dir, err = scope.Expand(step.WorkDir); err != nil {
+			return nil, err
+		}
+	}
+
+	// Set environment: every variable in scope, expanded
+	if spec.env, err = scope.Environ(); err != nil {
+		return nil, err
+	}
+	if step.Tool != "" && step.wantsJSON() {
+		// Outputs are read from the tool's JSON result
+		spec.env = append(spec.env, "ROCK_OUTPUT=json")
+	}
+
+	return spec, nil
+}
+
+// lockedWriter serializes writes from the stdout and stderr copiers
+type lockedWriter struct {
+	mu *sync.Mutex
+	w  io.Writer
+}
+
+func (l *lockedWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Write(p)
+}
+
+// runAttempt runs the command once, stopping its process group if the
+// step's timeout expires. Output is passed to sink line by line as it is
+// produced. It returns the combined output and stdout alone.
+func (spec *commandSpec) runAttempt(stop cancellation, step Step, attempt int, sink outputSink) (AttemptResult, string, string) {
+	record := AttemptResult{Attempt: attempt, Timestamp: time.Now()}
+
+	ctx, cancel := stop.ctx, context.CancelFunc(func() {})
+	if step.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(step.Timeout)*time.Second)
+	}
+	defer cancel()
+	stop.ctx = ctx
+
+	cmd := exec.CommandContext(ctx, spec.path, spec.args...)
+	cmd.Dir = spec.dir
+	cmd.Env = spec.env
+	cmd.WaitDelay = stop.grace + killWaitDelay
+	setProcessGroup(cmd, stop)
+	if spec.hangup {
+		// The write end closes when the command returns or when this
+		// process dies, whichever is first
+		stdin, hold, err := os.Pipe()
+		if err != nil {
+			record.ExitCode = -1
+			record.Error = err.Error()
+			return record, "", ""
+		}
+		defer stdin.Close()
+		defer hold.Close()
+		cmd.Stdin = stdin
+	}
+
+	var combined, stdout bytes.Buffer
+	var mu sync.Mutex
+	stdoutLines := &lineWriter{stream: "stdout", sink: sink}
+	stderrLines := &lineWriter{stream: "stderr", sink: sink}
+	cmd.Stdout = &lockedWriter{mu: &mu, w: io.MultiWriter(&combined, &stdout, stdoutLines)}
+	cmd.Stderr = &lockedWriter{mu: &mu, w: io.MultiWriter(&combined, stderrLines)}
+
+	err := cmd.Run()
+	stdoutLines.flush()
+	stderrLines.flush()
+	record.Duration = time.Since(record.Timestamp)
+
+	var exitError *exec.ExitError
+	switch {
+	case stop.cancelled():
+		record.Cancelled = true
+		record.ExitCode = -1
+		record.Error = "cancelled"
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		record.TimedOut = true
+		record.ExitCode = -1
+		record.Error = fmt.Sprintf("timed out after %ds", step.Timeout)
+	case errors.As(err, &exitError):
+		record.ExitCode = exitError.ExitCode()
+		record.Error = err.Error()
+	case err != nil:
+		record.ExitCode = -1
+		record.Error = err.Error()
+	}
+
+	return record, combined.String(), stdout.String()
+}
+
+// retryDelay returns how long to wait before retry number n (1-based)
+func retryDelay(step Step, n int) time.Duration {
+	base := defaultRetryDelay
+	if step.RetryDelay > 0 {
+		base = time.Duration(step.RetryDelay) * time.Second
+	}
+
+	switch step.Backoff {
+	case BackoffExponential, BackoffJitter:
+		delay := base
+		for i := 1; i < n && delay < maxRetryDelay; i++ {
+			delay *= 2
+		}
+		if delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
+		if step.Backoff == BackoffJitter {
+			// Equal jitter: keep half, randomize the other half
+			delay = delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+		}
+		return delay
+	default:
+		return base
+	}
+}
+
+// validBackoff reports whether a backoff strategy is known
+func validBackoff(backoff string) bool {
+	switch backoff {
+	case "", BackoffFixed, BackoffExponential, BackoffJitter:
+		return true
+	}
+	return false
+}
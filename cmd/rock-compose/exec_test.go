@@ -0,0 +1,107 @@
+//go:build unix
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		step Step
+		n    int
+		want time.Duration
+	}{
+		{Step{}, 1, defaultRetryDelay},
+		{Step{}, 3, defaultRetryDelay},
+		{Step{RetryDelay: 5, Backoff: BackoffFixed}, 4, 5 * time.Second},
+		{Step{RetryDelay: 2, Backoff: BackoffExponential}, 1, 2 * time.Second},
+		{Step{RetryDelay: 2, Backoff: BackoffExponential}, 4, 16 * time.Second},
+		{Step{RetryDelay: 60, Backoff: BackoffExponential}, 20, maxRetryDelay},
+	}
+	for _, tt := range tests {
+		if got := retryDelay(tt.step, tt.n); got != tt.want {
+			t.Errorf("retryDelay(%+v, %d) = %s, want %s", tt.step, tt.n, got, tt.want)
+		}
+	}
+
+	// Jitter keeps at least half of the exponential delay
+	step := Step{RetryDelay: 4, Backoff: BackoffJitter}
+	for i := 0; i < 100; i++ {
+		if got := retryDelay(step, 2); got < 4*time.Second || got > 8*time.Second {
+			t.Fatalf("retryDelay(jitter, 2) = %s, want 4s..8s", got)
+		}
+	}
+}
+
+func TestRunAttemptTimeout(t *testing.T) {
+	// The shell's background child is in the same process group and must
+	// be killed with it
+	pidFile := filepath.Join(t.TempDir(), "pid")
+	stop := cancellation{ctx: context.Background(), grace: 100 * time.Millisecond, kill: make(chan struct{})}
+	spec := &commandSpec{path: "sh", args: []string{"-c", "sleep 30 & echo $! > " + pidFile + "; wait"}}
+
+	start := time.Now()
+	record, _, _ := spec.runAttempt(stop, Step{Name: "slow", Timeout: 1}, 1, func(string, string) {})
+	if !record.TimedOut || record.Error != "timed out after 1s" {
+		t.Errorf("record = %+v, want timed out", record)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("step stopped after %s", elapsed)
+	}
+
+	data, err := os.ReadFile(pidFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid, _ := strconv.Atoi(strings.TrimSpace(string(data)))
+	// The child may linger briefly as a zombie until init reaps it
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(50 * time.Millisecond) {
+		if syscall.Kill(pid, 0) != nil || zombie(pid) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Errorf("background process %d survived the timeout", pid)
+			syscall.Kill(pid, syscall.SIGKILL)
+			break
+		}
+	}
+}
+
+// zombie reports whether pid has exited but not been reaped (Linux only;
+// elsewhere it reports false)
+func zombie(pid int) bool {
+	data, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return false
+	}
+	fields := strings.Fields(string(data[strings.LastIndexByte(string(data), ')')+1:]))
+	return len(fields) > 0 && fields[0] == "Z"
+}
+
+func TestExecuteStepRetries(t *testing.T) {
+	// Fails on the first attempt, succeeds on the second: each attempt
+	// must run a fresh command
+	counter := filepath.Join(t.TempDir(), "attempts")
+	step := Step{
+		Name:    "flaky",
+		Shell:   "sh",
+		Command: "echo x >> " + counter + "; [ $(wc -l < " + counter + ") -ge 2 ]",
+		Retries: 2,
+	}
+	r := newRunner(&Pipeline{Name: "retries"}, 1)
+	result := r.executeStep("fetch", step, r.scope, "")
+	if !result.Success {
+		t.Fatalf("step failed: %s", result.Error)
+	}
+	if len(result.Attempts) != 2 || result.Attempts[0].ExitCode != 1 || result.Attempts[1].ExitCode != 0 {
+		t.Errorf("attempts = %+v, want a failure then a success", result.Attempts)
+	}
+}
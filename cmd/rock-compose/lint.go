@@ -0,0 +1,380 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Position is a place in a pipeline file
+type Position struct {
+	File   string
+	Line   int
+	Column int
+}
+
+func (p Position) String() string {
+	return fmt.Sprintf("%s:%d:%d", p.File, p.Line, p.Column)
+}
+
+// Issue is a problem found by validate. Stage, Step and Variable say what
+// it is about, so it can be reported at the line that defines it.
+type Issue struct {
+	Pos      Position
+	Stage    string // Stage name, or on_success/on_failure for hooks
+	Step     string
+	Variable string
+	Message  string
+}
+
+func (i Issue) String() string {
+	if i.Pos.Line == 0 {
+		return i.Message
+	}
+	return i.Pos.String() + ": " + i.Message
+}
+
+// stepWhere describes a step in issue messages
+func stepWhere(stage, step string) string {
+	if isHook(stage) {
+		return fmt.Sprintf("%s step %s", stage, step)
+	}
+	return fmt.Sprintf("Stage %s step %s", stage, step)
+}
+
+// sourceIndex maps stages, steps, templates and variables to where they are
+// defined. Keys are "stage/<name>", "stage/<name>/step/<step>",
+// "stage/<name>/var/<var>", "template/<name>/..." and "var/<var>".
+type sourceIndex map[string]Position
+
+// checkSchema validates a pipeline file, and the files it includes, against
+// the pipeline schema. It also returns an index of the definitions in them.
+func checkSchema(path string) ([]Issue, sourceIndex, error) {
+	s, err := loadPipelineSchema()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var issues []Issue
+	index := make(sourceIndex)
+	seen := make(map[string]bool)
+
+	var visit func(path string) error
+	visit = func(path string) error {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var doc yaml.Node
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		if len(doc.Content) == 0 {
+			return nil // Empty; loading the pipeline reports it
+		}
+		root := doc.Content[0]
+
+		// Included files first, so definitions in this file take precedence
+		if include := mappingValue(root, "include"); include != nil && include.Kind == yaml.SequenceNode {
+			for _, item := range include.Content {
+				included := item.Value
+				if !filepath.IsAbs(included) {
+					included = filepath.Join(filepath.Dir(path), included)
+				}
+				abs, err := filepath.Abs(included)
+				if err != nil || seen[abs] {
+					continue // Loading the pipeline reports cycles
+				}
+				seen[abs] = true
+				err = visit(included)
+				delete(seen, abs)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		checker := &schemaChecker{root: s, file: path}
+		checker.check(root, s, "")
+		issues = append(issues, checker.issues...)
+		index.add(path, root)
+		return nil
+	}
+
+	if abs, err := filepath.Abs(path); err == nil {
+		seen[abs] = true
+	}
+	if err := visit(path); err != nil {
+		return nil, nil, err
+	}
+	return issues, index, nil
+}
+
+// add records the definitions in a pipeline document
+func (idx sourceIndex) add(file string, root *yaml.Node) {
+	at := func(node *yaml.Node) Position {
+		return Position{File: file, Line: node.Line, Column: node.Column}
+	}
+	addVars := func(prefix string, vars *yaml.Node) {
+		if vars == nil || vars.Kind != yaml.MappingNode {
+			return
+		}
+		for i := 0; i+1 < len(vars.Content); i += 2 {
+			idx[prefix+"var/"+vars.Content[i].Value] = at(vars.Content[i])
+		}
+	}
+	addSteps := func(prefix string, steps *yaml.Node) {
+		if steps == nil || steps.Kind != yaml.SequenceNode {
+			return
+		}
+		for _, step := range steps.Content {
+			if name := mappingValue(step, "name"); name != nil {
+				idx[prefix+"step/"+name.Value] = at(step)
+			}
+		}
+	}
+	addStage := func(prefix, name string, stage *yaml.Node) {
+		idx[strings.TrimSuffix(prefix, "/")] = at(stage)
+		addVars(prefix, mappingValue(stage, "variables"))
+		addSteps(prefix, mappingValue(stage, "steps"))
+		// A flat stage is a step with the stage's name
+		if mappingValue(stage, "tool") != nil || mappingValue(stage, "command") != nil {
+			idx[prefix+"step/"+name] = at(stage)
+			addVars(prefix, mappingValue(stage, "env"))
+		}
+	}
+
+	addVars("", mappingValue(root, "variables"))
+	addVars("", mappingValue(root, "env"))
+
+	if stages := mappingValue(root, "stages"); stages != nil && stages.Kind == yaml.SequenceNode {
+		for _, stage := range stages.Content {
+			if name := mappingValue(stage, "name"); name != nil {
+				addStage("stage/"+name.Value+"/", name.Value, stage)
+			}
+		}
+	}
+	if templates := mappingValue(root, "templates"); templates != nil && templates.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(templates.Content); i += 2 {
+			name := templates.Content[i].Value
+			addStage("template/"+name+"/", name, templates.Content[i+1])
+			idx["template/"+name] = at(templates.Content[i])
+		}
+	}
+
+	addSteps("stage/"+hookOnSuccess+"/", mappingValue(root, hookOnSuccess))
+	addSteps("stage/"+hookOnFailure+"/", mappingValue(root, hookOnFailure))
+	addSteps("stage/"+hookFinally+"/", mappingValue(root, hookFinally))
+	if actions := mappingValue(root, "post_actions"); actions != nil {
+		for hook, key := range map[string]string{hookOnSuccess: "success", hookOnFailure: "failure"} {
+			if lines := mappingValue(actions, key); lines != nil {
+				for _, line := range lines.Content {
+					idx["stage/"+hook+"/step/"+strings.TrimSpace(line.Value)] = at(line)
+				}
+			}
+		}
+	}
+}
+
+// locate sets the position of issues that do not have one from what they
+// are about. Stages expanded from a matrix or template are found through
+// the stage or template they came from.
+func (idx sourceIndex) locate(pipeline *Pipeline, issues []Issue) {
+	for i := range issues {
+		issue := &issues[i]
+		if issue.Pos.Line != 0 {
+			continue
+		}
+
+		origin, template := issue.Stage, ""
+		for _, stage := range pipeline.Stages {
+			if stage.Name == issue.Stage {
+				if stage.origin != "" {
+					origin = stage.origin
+				}
+				template = stage.Template
+				break
+			}
+		}
+
+		var keys []string
+		if issue.Step != "" {
+			keys = append(keys, "stage/"+origin+"/step/"+issue.Step)
+			if template != "" {
+				keys = append(keys, "template/"+template+"/step/"+issue.Step, "template/"+template)
+			}
+		}
+		if issue.Variable != "" {
+			keys = append(keys, "stage/"+origin+"/var/"+issue.Variable)
+			if template != "" {
+				keys = append(keys, "template/"+template+"/var/"+issue.Variable)
+			}
+			keys = append(keys, "var/"+issue.Variable)
+		}
+		if issue.Stage != "" {
+			keys = append(keys, "stage/"+origin)
+		}
+
+		for _, key := range keys {
+			if pos, ok := idx[key]; ok {
+				issue.Pos = pos
+				break
+			}
+		}
+	}
+}
+
+// mappingValue returns the value of key in a mapping node, or nil
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// toolCommands lists the commands each rock-* tool accepts, and under
+// "<tool> <command>" the subcommands of a command. Tools that are not
+// listed are not checked.
+var toolCommands = map[string][]string{
+	"rock-build":      {"init", "manager", "agent", "all", "check", "setup", "clean", "list", "version"},
+	"rock-cache":      {"store", "get", "list", "clean", "remove", "stats", "verify", "export", "import", "version"},
+	"rock-compose":    {"run", "resume", "watch", "logs", "validate", "list", "generate", "dry-run", "schema", "version"},
+	"rock-config":     {"generate", "validate", "encrypt", "decrypt", "merge", "init", "check", "version"},
+	"rock-deps":       {"scan", "copy", "verify", "check", "alpine", "version"},
+	"rock-image":      {"compose", "cpio", "diff", "inspect", "structure", "version"},
+	"rock-image cpio": {"create", "extract", "verify"},
+	"rock-kernel":     {"fetch", "extract", "list", "cmdline"},
+	"rock-registry":   {"list", "add", "get", "search", "remove", "update", "deps", "export", "import", "init", "stats", "version"},
+	"rock-security":   {"keygen", "sign", "verify", "hash", "encrypt", "decrypt", "check", "init", "rotate", "export", "version"},
+	"rock-verify":     {"integration", "structure", "dependencies", "boot", "version"},
+}
+
+// imageCommands are the rock-image commands that produce an image
+var imageCommands = map[string]bool{
+	"cpio create": true,
+}
+
+// toolWords returns the command line a tool step passes to its tool
+func toolWords(step Step) []string {
+	if step.Command != "" {
+		return append([]string{step.Command}, step.Args...)
+	}
+	return step.Args
+}
+
+// runsTool reports whether a step runs the given rock-* tool with a
+// command line starting with words
+func runsTool(step Step, tool string, words ...string) bool {
+	if step.Tool == "" || normalizeToolName(step.Tool) != tool {
+		return false
+	}
+	args := toolWords(step)
+	if len(args) < len(words) {
+		return false
+	}
+	for i, word := range words {
+		if args[i] != word {
+			return false
+		}
+	}
+	return true
+}
+
+// checkToolCommands reports steps that pass a rock-* tool a command it does
+// not accept. Commands taken from variables are not checked.
+func checkToolCommands(pipeline *Pipeline) []Issue {
+	var issues []Issue
+	check := func(stage string, steps []Step) {
+		for _, step := range steps {
+			if step.Tool == "" {
+				continue
+			}
+			words := toolWords(step)
+			key := normalizeToolName(step.Tool)
+			for depth := 0; ; depth++ {
+				commands, ok := toolCommands[key]
+				if !ok {
+					break
+				}
+				if depth == len(words) {
+					issues = append(issues, Issue{Stage: stage, Step: step.Name,
+						Message: fmt.Sprintf("%s: %s needs a command (%s)", stepWhere(stage, step.Name), key, strings.Join(commands, ", "))})
+					break
+				}
+				word := words[depth]
+				if strings.Contains(word, "$") {
+					break
+				}
+				if !containsString(commands, word) {
+					issues = append(issues, Issue{Stage: stage, Step: step.Name,
+						Message: fmt.Sprintf("%s: %s has no command %q (use %s)", stepWhere(stage, step.Name), key, word, strings.Join(commands, ", "))})
+					break
+				}
+				key += " " + word
+			}
+		}
+	}
+
+	for _, stage := range pipeline.Stages {
+		check(stage.Name, stage.Steps)
+	}
+	check(hookOnSuccess, pipeline.OnSuccess)
+	check(hookOnFailure, pipeline.OnFailure)
+	check(hookFinally, pipeline.Finally)
+	return issues
+}
+
+// checkImageVerification reports rock-image steps that create an image
+// without a rock-verify integration step after them: later in the same
+// sequential stage, or in a stage that runs after it
+func checkImageVerification(pipeline *Pipeline) []Issue {
+	verifies := func(steps []Step) bool {
+		for _, step := range steps {
+			if runsTool(step, "rock-verify", "integration") {
+				return true
+			}
+		}
+		return false
+	}
+
+	var issues []Issue
+	for _, stage := range pipeline.Stages {
+		after := downstream(pipeline.Stages, stage.Name)
+		for i, step := range stage.Steps {
+			words := toolWords(step)
+			if !runsTool(step, "rock-image") || len(words) < 2 || !imageCommands[words[0]+" "+words[1]] {
+				continue
+			}
+
+			verified := !stage.Parallel && verifies(stage.Steps[i+1:])
+			for _, other := range pipeline.Stages {
+				if other.Name != stage.Name && after[other.Name] && verifies(other.Steps) {
+					verified = true
+				}
+			}
+			if !verified {
+				issues = append(issues, Issue{Stage: stage.Name, Step: step.Name,
+					Message: fmt.Sprintf("%s: the image is never verified; add a rock-verify integration step after it", stepWhere(stage.Name, step.Name))})
+			}
+		}
+	}
+	return issues
+}
+
+// containsString reports whether list contains s
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLintPipeline(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pipeline.yaml")
+	err := os.WriteFile(path, []byte(`name: lint
+stages:
+  - name: image
+    retries: -1
+    steps:
+      - name: create
+        tool: image
+        args: [cpio, create, rootfs]
+        timout: 60
+      - name: kernel
+        tool: rock-kernel
+        command: modules
+  - name: verify
+    depends_on: [image]
+    tool: rock-verify
+    args: [structure, initrd.cpio.gz]
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	issues, index, err := checkSchema(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		path + `:4:14: stages[0].retries: -1 is less than 0`,
+		path + `:9:9: stages[0].steps[0]: unknown field "timout"`,
+	}
+	if len(issues) != len(want) {
+		t.Fatalf("schema issues = %v", issues)
+	}
+	for i, issue := range issues {
+		if issue.String() != want[i] {
+			t.Errorf("schema issue %d = %s\nwant %s", i, issue, want[i])
+		}
+	}
+
+	pipeline, err := parsePipelineFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := prepareSteps(pipeline); err != nil {
+		t.Fatal(err)
+	}
+	lints := append(checkToolCommands(pipeline), checkImageVerification(pipeline)...)
+	index.locate(pipeline, lints)
+	want = []string{
+		path + `:10:9: Stage image step kernel: rock-kernel has no command "modules"`,
+		path + `:6:9: Stage image step create: the image is never verified`,
+	}
+	if len(lints) != len(want) {
+		t.Fatalf("lint issues = %v", lints)
+	}
+	for i, issue := range lints {
+		if !strings.HasPrefix(issue.String(), want[i]) {
+			t.Errorf("lint issue %d = %s\nwant %s...", i, issue, want[i])
+		}
+	}
+
+	// A dependent stage running rock-verify integration verifies the image
+	pipeline.Stages[1].Steps[0].Args[0] = "integration"
+	if lints := checkImageVerification(pipeline); len(lints) > 0 {
+		t.Errorf("verified image reported: %v", lints)
+	}
+}
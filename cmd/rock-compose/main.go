@@ -4,11 +4,15 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/rock-os/tools/pkg/cache"
 )
 
 var (
@@ -19,63 +23,131 @@ var (
 
 // Pipeline represents a complete pipeline definition
 type Pipeline struct {
-	Name        string                 `json:"name"`
-	Version     string                 `json:"version"`
-	Description string                 `json:"description"`
-	Variables   map[string]string      `json:"variables"`
-	Stages      []Stage                `json:"stages"`
-	OnSuccess   []Step                 `json:"on_success,omitempty"`
-	OnFailure   []Step                 `json:"on_failure,omitempty"`
-	Settings    map[string]interface{} `json:"settings,omitempty"`
+	Name        string                   `json:"name"`
+	Version     string                   `json:"version"`
+	Description string                   `json:"description"`
+	Include     []string                 `json:"include,omitempty"` // Pipeline files merged in first, relative to this one
+	Variables   map[string]string        `json:"variables"`
+	Templates   map[string]StageTemplate `json:"templates,omitempty"` // Reusable stages, by name
+	Stages      []Stage                  `json:"stages"`
+	OnSuccess   []Step                   `json:"on_success,omitempty"`
+	OnFailure   []Step                   `json:"on_failure,omitempty"`
+	Finally     []Step                   `json:"finally,omitempty"` // Run last, whatever the outcome
+	Settings    map[string]interface{}   `json:"settings,omitempty"`
 }
 
 // Stage represents a pipeline stage
 type Stage struct {
-	Name      string   `json:"name"`
-	Steps     []Step   `json:"steps"`
-	Parallel  bool     `json:"parallel,omitempty"`
-	DependsOn []string `json:"depends_on,omitempty"`
-	Condition string   `json:"condition,omitempty"`
+	Name        string            `json:"name"`
+	Description string            `json:"description,omitempty"`
+	Steps       []Step            `json:"steps"`
+	Parallel    bool              `json:"parallel,omitempty"`
+	DependsOn   []string          `json:"depends_on,omitempty"`
+	Condition   string            `json:"condition,omitempty"`
+	Variables   map[string]string `json:"variables,omitempty"` // Override pipeline variables for this stage
+	Template    string            `json:"template,omitempty"`  // Template the stage is an instance of
+	With        map[string]string `json:"with,omitempty"`      // Template parameters
+	Matrix      Matrix            `json:"matrix,omitempty"`    // Run one stage per combination of values
+
+	instance []matrixValue // Matrix values of an expanded stage
+	origin   string        // Stage an expanded stage was made from
+}
+
+// StageTemplate is a stage that other stages instantiate with template:.
+// ${params.<name>} in it is replaced by the instance's with: value or the
+// parameter's default.
+type StageTemplate struct {
+	Stage
+	Params map[string]string `json:"params,omitempty"` // Parameter -> default value
 }
 
 // Step represents a single execution step
 type Step struct {
 	Name        string            `json:"name"`
+	ID          string            `json:"id,omitempty"` // Name used in ${steps.<id>.outputs.<key>} (default: name)
 	Tool        string            `json:"tool"`
 	Command     string            `json:"command"`
+	Shell       string            `json:"shell,omitempty"` // Interpreter for command when there is no tool (default sh)
 	Args        []string          `json:"args,omitempty"`
 	Environment map[string]string `json:"env,omitempty"`
 	WorkDir     string            `json:"workdir,omitempty"`
+	Host        string            `json:"host,omitempty"`      // Run on this host, e.g. ssh://user@builder/dir; see remote.go
+	Condition   string            `json:"condition,omitempty"` // Run the step only when this holds
 	ContinueOn  string            `json:"continue_on,omitempty"`
-	Timeout     int               `json:"timeout,omitempty"`
-	Retries     int               `json:"retries,omitempty"`
+	Timeout     int               `json:"timeout,omitempty"`     // Seconds per attempt; 0 means no limit
+	Retries     int               `json:"retries,omitempty"`     // Extra attempts after a failure
+	RetryDelay  int               `json:"retry_delay,omitempty"` // Seconds before the first retry (default 1)
+	Backoff     string            `json:"backoff,omitempty"`     // fixed, exponential or jitter
+	Outputs     map[string]string `json:"outputs,omitempty"`     // Key -> JSON path in stdout, or file:<path>
+	Artifacts   []string          `json:"artifacts,omitempty"`   // Files (globs) produced by the step
+	Inputs      []string          `json:"inputs,omitempty"`      // Files, directories (globs) the step reads, for the cache key
+}
+
+// ContinueOn values. A failed step with one of these does not stop its
+// stage or fail the pipeline.
+const (
+	ContinueOnFailure = "failure" // Keep going (on_failure: continue)
+	ContinueOnError   = "error"   // Alias for failure
+	ContinueOnWarning = "warning" // Keep going and report a warning (on_failure: warn)
+)
+
+// allowsFailure reports whether the pipeline carries on when the step fails
+func (s Step) allowsFailure() bool {
+	switch s.ContinueOn {
+	case ContinueOnFailure, ContinueOnError, ContinueOnWarning:
+		return true
+	}
+	return false
 }
 
 // ExecutionResult represents the result of a step execution
 type ExecutionResult struct {
-	Step      string        `json:"step"`
-	Success   bool          `json:"success"`
+	Step      string            `json:"step"`
+	Success   bool              `json:"success"`
+	ExitCode  int               `json:"exit_code"`
+	Duration  time.Duration     `json:"duration"`
+	Output    string            `json:"output,omitempty"`
+	Error     string            `json:"error,omitempty"`
+	Timestamp time.Time         `json:"timestamp"`
+	Attempts  []AttemptResult   `json:"attempts,omitempty"`
+	Outputs   map[string]string `json:"outputs,omitempty"`
+	Artifacts []Artifact        `json:"artifacts,omitempty"`
+	Reused    bool              `json:"reused,omitempty"`    // Result carried over from an earlier run
+	Cached    bool              `json:"cached,omitempty"`    // Artifacts restored from the cache
+	Skipped   bool              `json:"skipped,omitempty"`   // Condition not met; the step did not run
+	Cancelled bool              `json:"cancelled,omitempty"` // Stopped because the run was cancelled
+}
+
+// AttemptResult records a single attempt of a step
+type AttemptResult struct {
+	Attempt   int           `json:"attempt"`
 	ExitCode  int           `json:"exit_code"`
 	Duration  time.Duration `json:"duration"`
-	Output    string        `json:"output,omitempty"`
 	Error     string        `json:"error,omitempty"`
+	TimedOut  bool          `json:"timed_out,omitempty"`
+	Cancelled bool          `json:"cancelled,omitempty"`
 	Timestamp time.Time     `json:"timestamp"`
 }
 
 // PipelineResult represents the complete pipeline execution result
 type PipelineResult struct {
-	Pipeline    string            `json:"pipeline"`
-	Success     bool              `json:"success"`
-	StartTime   time.Time         `json:"start_time"`
-	EndTime     time.Time         `json:"end_time"`
-	Duration    time.Duration     `json:"duration"`
+	Pipeline     string                       `json:"pipeline"`
+	RunID        string                       `json:"run_id,omitempty"`
+	Success      bool                         `json:"success"`
+	Cancelled    bool                         `json:"cancelled,omitempty"` // Interrupted by SIGINT or SIGTERM
+	StartTime    time.Time                    `json:"start_time"`
+	EndTime      time.Time                    `json:"end_time"`
+	Duration     time.Duration                `json:"duration"`
 	StageResults map[string][]ExecutionResult `json:"stage_results"`
-	Artifacts   []string          `json:"artifacts,omitempty"`
+	Artifacts    []Artifact                   `json:"artifacts,omitempty"`
 }
 
 // Default pipelines directory
 const DefaultPipelinesDir = "./pipelines"
 
+// pipelineExtensions are tried in order when a pipeline is given by name
+var pipelineExtensions = []string{".json", ".yaml", ".yml"}
+
 // Built-in example pipelines
 var builtInPipelines = map[string]*Pipeline{
 	"build-image": {
@@ -249,11 +321,65 @@ func main() {
 
 	switch command {
 	case "run":
+		pipelinePath, opts, err := parseRunArgs(os.Args[2:])
+		if err == nil && pipelinePath == "" {
+			err = fmt.Errorf("run requires a pipeline file or name")
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		cmdRun(pipelinePath, opts)
+
+	case "resume":
+		runID, opts, err := parseRunArgs(os.Args[2:])
+		switch {
+		case err != nil:
+		case runID == "":
+			err = fmt.Errorf("resume requires a run ID")
+		case opts.from != "":
+			err = fmt.Errorf("--from cannot be used with resume")
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		cmdResume(runID, opts)
+
+	case "watch":
+		var args []string
+		smoke := true
+		for _, arg := range os.Args[2:] {
+			if arg == "--no-smoke-test" {
+				smoke = false
+			} else {
+				args = append(args, arg)
+			}
+		}
+		pipelinePath, opts, err := parseRunArgs(args)
+		switch {
+		case err != nil:
+		case pipelinePath == "":
+			err = fmt.Errorf("watch requires a pipeline file or name")
+		case opts.from != "":
+			err = fmt.Errorf("--from cannot be used with watch")
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		cmdWatch(pipelinePath, opts, smoke)
+
+	case "logs":
 		if len(os.Args) < 3 {
-			fmt.Fprintf(os.Stderr, "Error: run requires a pipeline file or name\n")
+			fmt.Fprintf(os.Stderr, "Error: logs requires a run ID\n")
 			os.Exit(1)
 		}
-		cmdRun(os.Args[2])
+		step := ""
+		if len(os.Args) > 3 {
+			step = os.Args[3]
+		}
+		cmdLogs(os.Args[2], step)
 
 	case "validate":
 		if len(os.Args) < 3 {
@@ -265,6 +391,9 @@ func main() {
 	case "list":
 		cmdList()
 
+	case "schema":
+		os.Stdout.Write(pipelineSchemaJSON)
+
 	case "generate":
 		if len(os.Args) < 3 {
 			cmdGenerate("example")
@@ -298,20 +427,82 @@ Ensures proper integration and verification at each stage.
 
 Usage:
   rock-compose run <pipeline>      Execute pipeline
-  rock-compose validate <pipeline> Validate pipeline syntax
+    --jobs=N                       Run at most N stages at once (default: CPU count)
+    --from <stage>                 Run <stage> and everything after it, reusing
+                                   the latest run's results for earlier stages
+    --no-cache                     Do not restore or store cached step outputs
+    --report <file>                Write a JUnit (.xml) or HTML (.html) report
+    --grace=SECONDS                On Ctrl-C/SIGTERM, give running steps this long
+                                   to exit before killing them (default: 10)
+  rock-compose resume <run-id>     Continue a run; steps that succeeded and whose
+                                   args, env and files are unchanged are skipped
+  rock-compose watch <pipeline>    Run the pipeline, then rerun it when the sources
+                                   it reads change: rock-build component trees
+                                   under ROCK_SOURCE_ROOT, rootfs overlays, config
+                                   files and step inputs. Only stages reading a
+                                   changed source, and those after them, run
+                                   again; each run ends by booting the image
+    --no-smoke-test                Do not boot the image after each run
+                                   (also accepts run's --jobs, --no-cache,
+                                   --report and --grace)
+  rock-compose logs <run-id> [step]
+                                   Show a run's events, or the log of one step
+  rock-compose validate <pipeline> Check the pipeline against the schema, then
+                                   lint it: dependencies, variables, tools and
+                                   their commands, and that every image built
+                                   is verified; issues show file:line:column
+  rock-compose schema              Print the pipeline JSON Schema
   rock-compose list                Show available pipelines
   rock-compose generate [name]     Generate example pipeline
   rock-compose dry-run <pipeline>  Show execution plan
   rock-compose version            Show version
 
 Pipeline Format:
-  Pipelines are defined in JSON format with:
+  Pipelines are defined in JSON or YAML (.yaml/.yml) with:
   - stages: Sequential or parallel execution stages
   - steps: Individual tool executions
-  - dependencies: Stage dependencies
-  - variables: Environment substitution
+  - dependencies: Stage dependencies; independent stages run concurrently.
+    Once a stage lists depends_on (an empty list declares none), stages
+    without it start immediately; a pipeline where no stage lists any
+    runs its stages in file order.
+  - variables: ${VAR}, ${VAR:-default} and ${VAR:?error} substitution.
+    Step env overrides stage variables, which override pipeline variables.
+    ${steps.<id>.outputs.<key>} is an output of a step that runs before
+    it; a variable that does not resolve yet is left out of the
+    environment of steps that do not use it. Shell scripts (bash, sh)
+    get their ${steps.<id>.outputs.<key>} references substituted before
+    they run; every other $ is left to the shell.
+  - caching: a step that lists inputs (files, directories, globs) and
+    artifacts or outputs is cached under a key of its tool, args, variables
+    and input contents; on a hit its artifacts and outputs are restored
+    instead of running it. A step with inputs alone always runs.
+  - include: other pipeline files merged in first; later stages with the
+    same name replace included ones
+  - templates: reusable stages; a stage with template: <name> and with:
+    parameters gets a copy with ${params.<name>} filled in
+  - matrix: axis: [values] expands a stage into one parallel stage per
+    combination (e.g. build-qemu-debug) with ${matrix.<axis>} filled in
+    and each axis set as a variable; dry-run shows the expanded plan
+  - condition: run a stage or step only when an expression holds:
+    ${VAR} == "value", !=, &&, ||, !, exists(<path>), os == "linux",
+    arch, steps.<id>.success/failure/skipped/status of a step that runs
+    before it; a bare ${VAR} is true when set and not empty. Unknown
+    syntax is a validation error
+  - hooks: on_success or on_failure steps run after the stages, then
+    finally steps; they see ${PIPELINE_STATUS} and ${FAILED_STAGE}
+  - host: run a step on [ssh://][user@]host[:port][/dir] over ssh (set
+    ROCK_SSH to change the ssh command). Inputs are copied up first and
+    artifacts and file: outputs copied back; relative paths live under
+    the host's dir (default ~/.rock-compose/<pipeline>). Inputs must be
+    relative; absolute artifacts and outputs keep their path. The tool
+    is found in the host's PATH
   - verification: Always runs verification
 
+Tool Resolution:
+  "build" and "rock-build" both run the rock-build binary, found in:
+  settings.tools_dir, $ROCK_TOOLS_DIR, bin/<os>, then $PATH.
+  Tools "bash" and "sh" run the step's command as a script.
+
 Built-in Pipelines:
   build-image    Complete image build and verification
   quick-check    Quick environment check
@@ -322,6 +513,7 @@ Examples:
 
   # Run custom pipeline
   rock-compose run my-pipeline.json
+  rock-compose run pipelines/build-rock-os.yaml
 
   # Validate pipeline
   rock-compose validate pipeline.json
@@ -331,8 +523,13 @@ Examples:
 
 Environment:
   ROCK_PIPELINES_DIR   Pipeline directory (default: ./pipelines)
+  ROCK_TOOLS_DIR       Directory containing rock-* tools
+  ROCK_RUNS_DIR        Run state directory (default: ./.rock-runs)
+  ROCK_CACHE_DIR       Step cache, shared with rock-cache (default: ~/.rock-cache)
   ROCK_OUTPUT=json     JSON output format
-  ROCK_VERBOSE=1       Verbose output
+  ROCK_OUTPUT=junit    JUnit XML report of the run on stdout (progress on stderr)
+  ROCK_OUTPUT=html     Self-contained HTML report of the run on stdout
+  ROCK_VERBOSE=1       Show step output as it is produced
   ROCK_DRY_RUN=1       Dry run mode
 
 Critical Integration:
@@ -342,7 +539,66 @@ Critical Integration:
   • Validates all configurations`)
 }
 
-func cmdRun(pipelinePath string) {
+// runOptions are the flags accepted by run and resume
+type runOptions struct {
+	jobs    int           // Maximum number of stages running at once
+	from    string        // Stage to start from, reusing earlier results upstream
+	noCache bool          // Run steps with inputs even if their outputs are cached
+	report  string        // JUnit (.xml) or HTML (.html) report file
+	grace   time.Duration // How long steps of a cancelled run get to exit before they are killed
+}
+
+// parseRunArgs parses "[--jobs=N] [--from <stage>] [--no-cache] [--report <file>] [--grace=SECONDS] <pipeline|run-id>"
+func parseRunArgs(args []string) (string, runOptions, error) {
+	opts := runOptions{jobs: runtime.NumCPU(), grace: defaultGracePeriod}
+	pipelinePath := ""
+
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--from":
+			if i+1 == len(args) {
+				return "", opts, fmt.Errorf("--from requires a stage name")
+			}
+			i++
+			opts.from = args[i]
+		case strings.HasPrefix(arg, "--from="):
+			opts.from = strings.TrimPrefix(arg, "--from=")
+		case arg == "--no-cache":
+			opts.noCache = true
+		case arg == "--report":
+			if i+1 == len(args) {
+				return "", opts, fmt.Errorf("--report requires a file name")
+			}
+			i++
+			opts.report = args[i]
+		case strings.HasPrefix(arg, "--report="):
+			opts.report = strings.TrimPrefix(arg, "--report=")
+		case strings.HasPrefix(arg, "--jobs="):
+			jobs, err := strconv.Atoi(strings.TrimPrefix(arg, "--jobs="))
+			if err != nil || jobs < 1 {
+				return "", opts, fmt.Errorf("invalid --jobs value: %s", arg)
+			}
+			opts.jobs = jobs
+		case strings.HasPrefix(arg, "--grace="):
+			seconds, err := strconv.Atoi(strings.TrimPrefix(arg, "--grace="))
+			if err != nil || seconds < 0 {
+				return "", opts, fmt.Errorf("invalid --grace value: %s", arg)
+			}
+			opts.grace = time.Duration(seconds) * time.Second
+		case strings.HasPrefix(arg, "-"):
+			return "", opts, fmt.Errorf("unknown option: %s", arg)
+		case pipelinePath == "":
+			pipelinePath = arg
+		default:
+			return "", opts, fmt.Errorf("unexpected argument: %s", arg)
+		}
+	}
+
+	return pipelinePath, opts, nil
+}
+
+func cmdRun(pipelinePath string, opts runOptions) {
 	// Load pipeline
 	pipeline, err := loadPipeline(pipelinePath)
 	if err != nil {
@@ -350,117 +606,210 @@ func cmdRun(pipelinePath string) {
 		os.Exit(1)
 	}
 
-	fmt.Printf("🚀 Running pipeline: %s\n", pipeline.Name)
-	if pipeline.Description != "" {
-		fmt.Printf("   %s\n", pipeline.Description)
+	// With --from, stages upstream of the starting stage keep the results
+	// of the pipeline's latest run
+	var previous *RunState
+	var from map[string]bool
+	if opts.from != "" {
+		if !hasStage(pipeline, opts.from) {
+			fmt.Fprintf(os.Stderr, "Error: pipeline %s has no stage %s\n", pipeline.Name, opts.from)
+			os.Exit(1)
+		}
+		if previous = latestRunState(pipeline.Name); previous == nil {
+			fmt.Fprintf(os.Stderr, "Error: no earlier run of %s in %s to continue from\n", pipeline.Name, getRunsDir())
+			os.Exit(1)
+		}
+		from = downstream(pipeline.Stages, opts.from)
 	}
-	fmt.Println("=" + strings.Repeat("=", 60))
 
-	// Initialize result
-	result := &PipelineResult{
-		Pipeline:     pipeline.Name,
-		StartTime:    time.Now(),
-		StageResults: make(map[string][]ExecutionResult),
-	}
+	state := newRunState(pipeline, pipelineSource(pipelinePath))
+	executePipeline(pipeline, opts, state, previous, from)
+}
 
-	// Set up environment variables
-	for key, value := range pipeline.Variables {
-		os.Setenv(key, expandVariables(value))
+// cmdResume continues a run, skipping steps that succeeded and whose
+// inputs have not changed since
+func cmdResume(runID string, opts runOptions) {
+	previous, err := loadRunState(runID)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
 	}
 
-	// Execute stages
-	executedStages := make(map[string]bool)
-	success := true
-
-	for _, stage := range pipeline.Stages {
-		// Check dependencies
-		if !checkDependencies(stage.DependsOn, executedStages) {
-			fmt.Printf("⚠️  Skipping stage %s: dependencies not met\n", stage.Name)
-			continue
-		}
-
-		// Check condition
-		if stage.Condition != "" && !evaluateCondition(stage.Condition) {
-			fmt.Printf("⚠️  Skipping stage %s: condition not met\n", stage.Name)
-			continue
-		}
+	pipeline, err := loadPipeline(previous.Source)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading pipeline: %v\n", err)
+		os.Exit(1)
+	}
 
-		fmt.Printf("\n📦 Stage: %s\n", stage.Name)
-		fmt.Println("-" + strings.Repeat("-", 40))
+	executePipeline(pipeline, opts, previous.resumed(), previous, nil)
+}
 
-		var stageResults []ExecutionResult
+// executePipeline runs a pipeline, recording its progress in state, and
+// exits with the run's status
+func executePipeline(pipeline *Pipeline, opts runOptions, state, previous *RunState, from map[string]bool) {
+	result, err := runPipeline(pipeline, opts, state, previous, from, nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if result.Cancelled {
+		os.Exit(130) // As a shell reports a command ended by SIGINT
+	}
+	if !result.Success {
+		os.Exit(1)
+	}
+}
 
-		if stage.Parallel {
-			// Execute steps in parallel
-			stageResults = executeParallelSteps(stage.Steps)
-		} else {
-			// Execute steps sequentially
-			stageResults = executeSequentialSteps(stage.Steps)
+// runPipeline runs a pipeline, recording its progress in state. Steps of
+// stages in rerun always run; other steps are reused from previous when
+// allowed. It prints the result and writes the report. Before running
+// anything, it returns an error if a stage can never run or a condition
+// is invalid.
+func runPipeline(pipeline *Pipeline, opts runOptions, state, previous *RunState, from, rerun map[string]bool) (*PipelineResult, error) {
+	// Refuse stages that can never run and conditions that do not parse
+	// rather than fail mid-run
+	if issues := append(checkDependencies(pipeline), checkConditions(pipeline)...); len(issues) > 0 {
+		messages := make([]string, len(issues))
+		for i, issue := range issues {
+			messages[i] = issue.Message
 		}
+		return nil, fmt.Errorf("pipeline %s cannot run:\n  %s", pipeline.Name, strings.Join(messages, "\n  "))
+	}
 
-		result.StageResults[stage.Name] = stageResults
+	out := progressOutput()
+	fmt.Fprintf(out, "🚀 Running pipeline: %s\n", pipeline.Name)
+	if pipeline.Description != "" {
+		fmt.Fprintf(out, "   %s\n", pipeline.Description)
+	}
+	fmt.Fprintf(out, "   Run: %s\n", state.ID)
+	if from != nil {
+		fmt.Fprintf(out, "   Starting from stage %s, reusing run %s\n", opts.from, previous.ID)
+	}
+	fmt.Fprintln(out, "="+strings.Repeat("=", 60))
 
-		// Check if stage succeeded
-		stageFailed := false
-		for _, stepResult := range stageResults {
-			if !stepResult.Success {
-				stageFailed = true
-				success = false
-				break
-			}
-		}
+	// Initialize result
+	result := &PipelineResult{
+		Pipeline:     pipeline.Name,
+		RunID:        state.ID,
+		StartTime:    time.Now(),
+		StageResults: make(map[string][]ExecutionResult),
+	}
 
-		if stageFailed {
-			fmt.Printf("❌ Stage %s failed\n", stage.Name)
-			break
-		} else {
-			fmt.Printf("✅ Stage %s completed\n", stage.Name)
-			executedStages[stage.Name] = true
+	// Execute stages
+	r := newRunner(pipeline, opts.jobs)
+	r.out = out
+	r.state, r.previous, r.from, r.rerun = state, previous, from, rerun
+	r.grace = opts.grace
+	defer r.trapSignals()()
+	if events, err := openEventLog(state.ID); err != nil {
+		fmt.Fprintf(out, "⚠️  Event log disabled: %v\n", err)
+	} else {
+		r.events = events
+		defer events.close()
+	}
+	r.events.emit(Event{Type: EventRunStarted, Pipeline: pipeline.Name})
+	if !opts.noCache {
+		var err error
+		if r.store, err = cache.Open(cache.Dir()); err != nil {
+			fmt.Fprintf(out, "⚠️  Step cache disabled: %v\n", err)
 		}
 	}
+	success := r.runStages(result)
+	cancelled := r.cancelled()
+	status := StepSucceeded
+	switch {
+	case cancelled:
+		success = false
+		status = StepCancelled
+	case !success:
+		status = StepFailed
+	}
 
-	// Run on_success or on_failure hooks
+	// Run on_success or on_failure hooks; a cancelled run counts as failed.
+	// Hooks keep running after a cancellation, until a second signal.
+	hooks := hookScope(r.scope, status, r.failedStage)
 	if success && len(pipeline.OnSuccess) > 0 {
-		fmt.Println("\n🎉 Running success hooks...")
-		executeSequentialSteps(pipeline.OnSuccess)
+		fmt.Fprintln(out, "\n🎉 Running success hooks...")
+		r.executeSequentialSteps(hookOnSuccess, pipeline.OnSuccess, hooks)
 	} else if !success && len(pipeline.OnFailure) > 0 {
-		fmt.Println("\n🔧 Running failure hooks...")
-		executeSequentialSteps(pipeline.OnFailure)
+		fmt.Fprintln(out, "\n🔧 Running failure hooks...")
+		r.executeSequentialSteps(hookOnFailure, pipeline.OnFailure, hooks)
+	}
+	if len(pipeline.Finally) > 0 {
+		fmt.Fprintln(out, "\n🧹 Running finally hooks...")
+		r.executeSequentialSteps(hookFinally, pipeline.Finally, hooks)
+	}
+	r.finishRun(status)
+
+	// Collect artifacts in pipeline order
+	for _, stage := range pipeline.Stages {
+		for _, stepResult := range result.StageResults[stage.Name] {
+			result.Artifacts = append(result.Artifacts, stepResult.Artifacts...)
+		}
 	}
 
 	// Finalize result
 	result.EndTime = time.Now()
 	result.Duration = result.EndTime.Sub(result.StartTime)
 	result.Success = success
+	result.Cancelled = cancelled
+	r.events.emit(Event{Type: EventRunFinished, Pipeline: pipeline.Name, Status: r.state.Status, Duration: result.Duration.Seconds()})
 
 	// Output result
 	if os.Getenv("ROCK_OUTPUT") == "json" {
 		outputJSON(result)
 	} else {
-		fmt.Println("\n" + "=" + strings.Repeat("=", 60))
-		if success {
-			fmt.Printf("✅ Pipeline completed successfully\n")
-		} else {
-			fmt.Printf("❌ Pipeline failed\n")
+		fmt.Fprintln(out, "\n"+"="+strings.Repeat("=", 60))
+		switch {
+		case success:
+			fmt.Fprintf(out, "✅ Pipeline completed successfully\n")
+		case cancelled:
+			fmt.Fprintf(out, "🛑 Pipeline cancelled\n")
+		default:
+			fmt.Fprintf(out, "❌ Pipeline failed\n")
+		}
+		fmt.Fprintf(out, "   Duration: %.2fs\n", result.Duration.Seconds())
+		if !success {
+			fmt.Fprintf(out, "   Resume with: rock-compose resume %s\n", state.ID)
 		}
-		fmt.Printf("   Duration: %.2fs\n", result.Duration.Seconds())
-	}
-
-	if !success {
-		os.Exit(1)
 	}
+	writeReport(pipeline, result, opts, out)
+	return result, nil
 }
 
 func cmdValidate(pipelinePath string) {
+	// Check the file against the schema first, so issues point at the
+	// lines that cause them. Built-in pipelines have no file.
+	var issues []Issue
+	index := make(sourceIndex)
+	if _, ok := builtInPipelines[pipelinePath]; !ok {
+		var err error
+		issues, index, err = checkSchema(resolvePipelinePath(pipelinePath))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "❌ Invalid pipeline: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
 	// Load and validate pipeline
 	pipeline, err := loadPipeline(pipelinePath)
 	if err != nil {
+		if len(issues) > 0 {
+			printIssues(issues)
+		}
 		fmt.Fprintf(os.Stderr, "❌ Invalid pipeline: %v\n", err)
 		os.Exit(1)
 	}
 
 	// Validate structure
-	issues := validatePipeline(pipeline)
+	var lints []Issue
+	lints = append(lints, validatePipeline(pipeline)...)
+	lints = append(lints, checkVariables(pipeline)...)
+	lints = append(lints, unresolvedTools(pipeline, newToolResolver(pipeline, pipelineScope(pipeline, declaredOutputs(pipeline))))...)
+	lints = append(lints, checkToolCommands(pipeline)...)
+	lints = append(lints, checkImageVerification(pipeline)...)
+	index.locate(pipeline, lints)
+	issues = append(issues, lints...)
 
 	if len(issues) == 0 {
 		fmt.Printf("✅ Pipeline is valid\n")
@@ -473,14 +822,19 @@ func cmdValidate(pipelinePath string) {
 		}
 		fmt.Printf("   Total steps: %d\n", totalSteps)
 	} else {
-		fmt.Printf("❌ Pipeline has issues:\n")
-		for _, issue := range issues {
-			fmt.Printf("   • %s\n", issue)
-		}
+		printIssues(issues)
 		os.Exit(1)
 	}
 }
 
+// printIssues lists validation issues
+func printIssues(issues []Issue) {
+	fmt.Printf("❌ Pipeline has issues:\n")
+	for _, issue := range issues {
+		fmt.Printf("   • %s\n", issue)
+	}
+}
+
 func cmdList() {
 	fmt.Println("Available Pipelines:")
 	fmt.Println("=" + strings.Repeat("=", 60))
@@ -496,16 +850,17 @@ func cmdList() {
 	if files, err := os.ReadDir(pipelinesDir); err == nil && len(files) > 0 {
 		fmt.Printf("\nFrom %s:\n", pipelinesDir)
 		for _, file := range files {
-			if strings.HasSuffix(file.Name(), ".json") ||
-			   strings.HasSuffix(file.Name(), ".yaml") ||
-			   strings.HasSuffix(file.Name(), ".yml") {
-				path := filepath.Join(pipelinesDir, file.Name())
-				if pipeline, err := loadPipeline(path); err == nil {
-					fmt.Printf("  • %-15s %s\n",
-						strings.TrimSuffix(file.Name(), filepath.Ext(file.Name())),
-						pipeline.Description)
-				}
+			if file.IsDir() || !isPipelineFile(file.Name()) {
+				continue
+			}
+			name := strings.TrimSuffix(file.Name(), filepath.Ext(file.Name()))
+			path := filepath.Join(pipelinesDir, file.Name())
+			pipeline, err := loadPipeline(path)
+			if err != nil {
+				fmt.Printf("  • %-15s ❌ %s: %v\n", name, file.Name(), err)
+				continue
 			}
+			fmt.Printf("  • %-15s %s\n", name, pipeline.Description)
 		}
 	}
 
@@ -543,15 +898,47 @@ func cmdDryRun(pipelinePath string) {
 	}
 
 	fmt.Printf("🔍 Dry run for pipeline: %s\n", pipeline.Name)
+	if len(pipeline.Include) > 0 {
+		fmt.Printf("   Includes: %s\n", strings.Join(pipeline.Include, ", "))
+	}
 	fmt.Println("=" + strings.Repeat("=", 60))
+	tools := newToolResolver(pipeline, pipelineScope(pipeline, declaredOutputs(pipeline)))
+
+	// Show the order the scheduler will use
+	levels, err := stageLevels(pipeline.Stages)
+	fmt.Println("\nExecution Levels:")
+	for i, level := range levels {
+		fmt.Printf("  %d. %s\n", i+1, strings.Join(level, ", "))
+	}
+	if err != nil {
+		fmt.Printf("  ❌ %v\n", err)
+	}
 
 	// Show execution plan
+	graph := stageGraph(pipeline.Stages)
 	fmt.Println("\nExecution Plan:")
 	for i, stage := range pipeline.Stages {
 		fmt.Printf("\n%d. Stage: %s\n", i+1, stage.Name)
+		if stage.Description != "" {
+			fmt.Printf("   %s\n", stage.Description)
+		}
+		if stage.Template != "" {
+			fmt.Printf("   Template: %s\n", stage.Template)
+		}
+		if len(stage.instance) > 0 {
+			values := make([]string, len(stage.instance))
+			for i, v := range stage.instance {
+				values[i] = v.axis + "=" + v.value
+			}
+			fmt.Printf("   Matrix: %s\n", strings.Join(values, ", "))
+		}
 
-		if len(stage.DependsOn) > 0 {
-			fmt.Printf("   Dependencies: %s\n", strings.Join(stage.DependsOn, ", "))
+		if deps := graph[stage.Name]; len(deps) > 0 {
+			fmt.Printf("   Dependencies: %s\n", strings.Join(deps, ", "))
+		}
+
+		if stage.Condition != "" {
+			fmt.Printf("   Condition: %s\n", stage.Condition)
 		}
 
 		if stage.Parallel {
@@ -563,11 +950,50 @@ func cmdDryRun(pipelinePath string) {
 		fmt.Println("   Steps:")
 		for j, step := range stage.Steps {
 			fmt.Printf("      %d.%d. %s\n", i+1, j+1, step.Name)
-			fmt.Printf("           Tool: %s %s", step.Tool, step.Command)
-			if len(step.Args) > 0 {
-				fmt.Printf(" %s", strings.Join(step.Args, " "))
+			if step.Condition != "" {
+				fmt.Printf("           Condition: %s\n", step.Condition)
+			}
+			if step.Host != "" {
+				fmt.Printf("           Host: %s\n", step.Host)
+			}
+			if step.Tool == "" {
+				shell := step.Shell
+				if shell == "" {
+					shell = "sh"
+				}
+				script := strings.TrimSpace(step.Command)
+				fmt.Printf("           Shell (%s): %s\n", shell,
+					strings.ReplaceAll(script, "\n", "\n             "))
+			} else {
+				invocation := append([]string{step.Tool}, step.Args...)
+				if step.Command != "" {
+					invocation = append([]string{step.Tool, step.Command}, step.Args...)
+				}
+				fmt.Printf("           Tool: %s\n", strings.Join(invocation, " "))
+				// A remote step's tool is found on its host
+				if step.Host == "" {
+					if path, err := tools.Resolve(step.Tool); err != nil {
+						fmt.Printf("           ⚠️  %v\n", err)
+					} else {
+						fmt.Printf("           Path: %s\n", path)
+					}
+				}
+			}
+
+			keys := make([]string, 0, len(step.Outputs))
+			for key := range step.Outputs {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				fmt.Printf("           Output: steps.%s.outputs.%s <- %s\n", stepID(step), key, step.Outputs[key])
+			}
+			for _, artifact := range step.Artifacts {
+				fmt.Printf("           Artifact: %s\n", artifact)
+			}
+			for _, input := range step.Inputs {
+				fmt.Printf("           Input: %s\n", input)
 			}
-			fmt.Println()
 		}
 	}
 
@@ -587,107 +1013,202 @@ func loadPipeline(path string) (*Pipeline, error) {
 	if pipeline, ok := builtInPipelines[path]; ok {
 		return pipeline, nil
 	}
+	path = resolvePipelinePath(path)
 
-	// Check in pipelines directory
-	if !strings.Contains(path, "/") && !strings.HasSuffix(path, ".json") {
-		pipelinesDir := getPipelinesDir()
-		possiblePath := filepath.Join(pipelinesDir, path+".json")
-		if _, err := os.Stat(possiblePath); err == nil {
-			path = possiblePath
-		}
+	pipeline, err := parsePipelineFile(path)
+	if err != nil {
+		return nil, err
 	}
 
-	// Read file
-	data, err := os.ReadFile(path)
+	// Merge includes, then instantiate templates and expand matrices
+	abs, err := filepath.Abs(path)
 	if err != nil {
 		return nil, err
 	}
+	if err := includePipelines(pipeline, filepath.Dir(path), map[string]bool{abs: true}); err != nil {
+		return nil, err
+	}
+	if err := expandStages(pipeline); err != nil {
+		return nil, err
+	}
 
-	// Parse pipeline
-	var pipeline Pipeline
-	if err := json.Unmarshal(data, &pipeline); err != nil {
-		return nil, fmt.Errorf("invalid JSON: %v", err)
+	if err := prepareSteps(pipeline); err != nil {
+		return nil, err
 	}
+	return pipeline, nil
+}
 
-	return &pipeline, nil
+// resolvePipelinePath looks up a bare pipeline name in the pipelines directory
+func resolvePipelinePath(path string) string {
+	if !strings.Contains(path, "/") && filepath.Ext(path) == "" {
+		pipelinesDir := getPipelinesDir()
+		for _, ext := range pipelineExtensions {
+			possiblePath := filepath.Join(pipelinesDir, path+ext)
+			if _, err := os.Stat(possiblePath); err == nil {
+				return possiblePath
+			}
+		}
+	}
+	return path
 }
 
-func validatePipeline(pipeline *Pipeline) []string {
-	issues := []string{}
+// pipelineSource returns how to load a pipeline again when resuming: the
+// built-in name, or the absolute path of its file
+func pipelineSource(path string) string {
+	if _, ok := builtInPipelines[path]; ok {
+		return path
+	}
+	path = resolvePipelinePath(path)
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return path
+}
+
+// hasStage reports whether a pipeline has a stage with the given name
+func hasStage(pipeline *Pipeline, name string) bool {
+	for _, stage := range pipeline.Stages {
+		if stage.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// isPipelineFile reports whether a file name has a pipeline extension
+func isPipelineFile(name string) bool {
+	for _, ext := range pipelineExtensions {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+func validatePipeline(pipeline *Pipeline) []Issue {
+	issues := []Issue{}
 
 	if pipeline.Name == "" {
-		issues = append(issues, "Pipeline name is required")
+		issues = append(issues, Issue{Message: "Pipeline name is required"})
 	}
 
 	if len(pipeline.Stages) == 0 {
-		issues = append(issues, "Pipeline must have at least one stage")
+		issues = append(issues, Issue{Message: "Pipeline must have at least one stage"})
 	}
 
-	// Check stage dependencies
-	stageNames := make(map[string]bool)
+	// Check stages
 	for _, stage := range pipeline.Stages {
 		if stage.Name == "" {
-			issues = append(issues, "Stage name is required")
+			issues = append(issues, Issue{Message: "Stage name is required"})
 		}
-		stageNames[stage.Name] = true
 
 		if len(stage.Steps) == 0 {
-			issues = append(issues, fmt.Sprintf("Stage %s has no steps", stage.Name))
+			issues = append(issues, Issue{Stage: stage.Name, Message: fmt.Sprintf("Stage %s has no steps", stage.Name)})
 		}
 
 		// Validate steps
 		for _, step := range stage.Steps {
 			if step.Tool == "" && step.Command == "" {
-				issues = append(issues, fmt.Sprintf("Step %s must have tool or command", step.Name))
+				issues = append(issues, Issue{Stage: stage.Name, Step: step.Name, Message: fmt.Sprintf("Step %s must have tool or command", step.Name)})
+			}
+			if step.Timeout < 0 || step.Retries < 0 || step.RetryDelay < 0 {
+				issues = append(issues, Issue{Stage: stage.Name, Step: step.Name, Message: fmt.Sprintf("Step %s: timeout, retries and retry_delay cannot be negative", step.Name)})
+			}
+			if !validBackoff(step.Backoff) {
+				issues = append(issues, Issue{Stage: stage.Name, Step: step.Name, Message: fmt.Sprintf("Step %s: unknown backoff %q (use fixed, exponential or jitter)", step.Name, step.Backoff)})
+			}
+			// Hosts taken from variables are checked when the step runs
+			if step.Host != "" && !strings.Contains(step.Host, "$") {
+				host, err := parseHost(step.Host)
+				if err != nil {
+					issues = append(issues, Issue{Stage: stage.Name, Step: step.Name, Message: fmt.Sprintf("Step %s: %v", step.Name, err)})
+				} else if host.Scheme != "local" {
+					for _, input := range step.Inputs {
+						if filepath.IsAbs(input) {
+							issues = append(issues, Issue{Stage: stage.Name, Step: step.Name, Message: fmt.Sprintf("Step %s: input %s is absolute; inputs of remote steps must be relative paths", step.Name, input)})
+						}
+					}
+				}
 			}
 		}
 	}
 
-	// Check dependencies exist
+	// Check that outputs can be referenced unambiguously
+	outputSteps := make(map[string]bool)
+	for _, stage := range pipeline.Stages {
+		for _, step := range stage.Steps {
+			if len(step.Outputs) == 0 {
+				continue
+			}
+			if outputSteps[stepID(step)] {
+				issues = append(issues, Issue{Stage: stage.Name, Step: step.Name, Message: fmt.Sprintf("Step id %s is used by more than one step with outputs", stepID(step))})
+			}
+			outputSteps[stepID(step)] = true
+		}
+	}
+
+	// Check dependencies exist and can be ordered
+	issues = append(issues, checkDependencies(pipeline)...)
+
+	// Check conditions parse and refer to existing steps
+	issues = append(issues, checkConditions(pipeline)...)
+
+	return issues
+}
+
+// checkDependencies returns an issue for every dependency on an unknown
+// stage and for a dependency cycle; either leaves stages that can never run
+func checkDependencies(pipeline *Pipeline) []Issue {
+	var issues []Issue
+	stageNames := make(map[string]bool)
+	for _, stage := range pipeline.Stages {
+		stageNames[stage.Name] = true
+	}
 	for _, stage := range pipeline.Stages {
 		for _, dep := range stage.DependsOn {
 			if !stageNames[dep] {
-				issues = append(issues, fmt.Sprintf("Stage %s depends on unknown stage: %s", stage.Name, dep))
+				issues = append(issues, Issue{Stage: stage.Name, Message: fmt.Sprintf("Stage %s depends on unknown stage: %s", stage.Name, dep)})
 			}
 		}
 	}
 
 	// Check for cycles
 	if hasCycle(pipeline.Stages) {
-		issues = append(issues, "Pipeline has circular dependencies")
+		issues = append(issues, Issue{Message: "Pipeline has circular dependencies"})
 	}
-
 	return issues
 }
 
-func executeSequentialSteps(steps []Step) []ExecutionResult {
+func (r *runner) executeSequentialSteps(stage string, steps []Step, scope *Scope) []ExecutionResult {
 	results := []ExecutionResult{}
 
 	for _, step := range steps {
-		fmt.Printf("   ▶ %s\n", step.Name)
-		result := executeStep(step)
+		fmt.Fprintf(r.out, "   ▶ %s\n", step.Name)
+		result := r.executeStep(stage, step, scope, "")
 		results = append(results, result)
 
-		if !result.Success {
-			if step.ContinueOn != "error" && step.ContinueOn != "failure" {
-				break
-			}
+		if !result.Success && !step.allowsFailure() {
+			break
 		}
 	}
 
 	return results
 }
 
-func executeParallelSteps(steps []Step) []ExecutionResult {
+func (r *runner) executeParallelSteps(stage string, steps []Step, scope *Scope) []ExecutionResult {
 	results := make([]ExecutionResult, len(steps))
 	var wg sync.WaitGroup
 
+	// Announce the steps in pipeline order; their progress lines carry
+	// the step name so concurrent steps can be told apart
+	for _, step := range steps {
+		fmt.Fprintf(r.out, "   ▶ %s (parallel)\n", step.Name)
+	}
 	for i, step := range steps {
 		wg.Add(1)
 		go func(index int, s Step) {
 			defer wg.Done()
-			fmt.Printf("   ▶ %s (parallel)\n", s.Name)
-			results[index] = executeStep(s)
+			results[index] = r.executeStep(stage, s, scope, s.Name)
 		}(i, step)
 	}
 
@@ -695,129 +1216,271 @@ func executeParallelSteps(steps []Step) []ExecutionResult {
 	return results
 }
 
-func executeStep(step Step) ExecutionResult {
+// executeStep runs one step. Its environment is the step's env layered
+// over scope; nothing is shared through the process environment. A step
+// whose earlier result can be reused is not run again. Progress lines are
+// prefixed with label when it is set.
+func (r *runner) executeStep(stage string, step Step, scope *Scope, label string) ExecutionResult {
 	startTime := time.Now()
 	result := ExecutionResult{
 		Step:      step.Name,
 		Timestamp: startTime,
 	}
+	say := func(format string, args ...interface{}) {
+		prefix := "     "
+		if label != "" {
+			prefix += "[" + label + "] "
+		}
+		fmt.Fprintf(r.out, prefix+format+"\n", args...)
+	}
+
+	// A cancelled run starts no more steps
+	stop := r.stepCancellation(stage)
+	if stop.ctx.Err() != nil {
+		result.ExitCode = -1
+		result.Error = "cancelled"
+		result.Cancelled = true
+		r.finishStep(stage, step, &result, "", say)
+		return result
+	}
 
 	// Determine command
-	var cmd *exec.Cmd
-	if step.Tool != "" {
-		// Use rock-* tool
-		toolPath := fmt.Sprintf("./bin/darwin/rock-%s", step.Tool)
-		args := []string{}
-		if step.Command != "" {
-			args = append(args, step.Command)
+	stepScope := newScope(scope, step.Environment)
+	if step.Condition != "" {
+		met, err := evaluateCondition(step.Condition, r.conditionEnv(stepScope))
+		if err != nil {
+			result.ExitCode = -1
+			result.Error = fmt.Sprintf("condition %q: %v", step.Condition, err)
+			r.finishStep(stage, step, &result, "", say)
+			return result
 		}
-		args = append(args, step.Args...)
-
-		// Expand variables in args
-		for i, arg := range args {
-			args[i] = expandVariables(arg)
+		if !met {
+			result.Success = true
+			result.Skipped = true
+			r.finishStep(stage, step, &result, "", say)
+			return result
 		}
+	}
+	spec, err := commandFor(step, r.tools, stepScope)
+	var remote *remoteStep
+	if err == nil {
+		if remote, err = remoteFor(step, stepScope, r.pipeline.Name); remote != nil {
+			spec, err = remote.command(step, spec, stepScope)
+		}
+	}
+	if err != nil {
+		result.ExitCode = -1
+		result.Error = err.Error()
+		r.finishStep(stage, step, &result, "", say)
+		return result
+	}
 
-		cmd = exec.Command(toolPath, args...)
-	} else if step.Command != "" {
-		// Direct command
-		cmd = exec.Command("sh", "-c", expandVariables(step.Command))
-	} else {
-		result.Success = false
-		result.Error = "No tool or command specified"
+	// Skip the step if nothing it depends on has changed
+	inputs := r.fingerprint(spec, step, stepScope, say)
+	if prev := r.reusable(stage, step, inputs); prev != nil {
+		result.Success = true
+		result.Reused = true
+		result.Outputs = prev.Outputs
+		result.Artifacts = prev.Artifacts
+		r.setOutputs(step, prev.Outputs)
+		r.setStatus(step, StepReused)
+		r.reuseStep(stage, step, prev)
+		r.events.emit(Event{Type: EventStepFinished, Stage: stage, Step: stepID(step), Status: StepReused})
+		say("⏭️  Unchanged since %s, reusing result", prev.FinishedAt.Format(time.RFC3339))
 		return result
 	}
 
-	// Set working directory
-	if step.WorkDir != "" {
-		cmd.Dir = expandVariables(step.WorkDir)
+	// Restore the step's artifacts from the cache if it ran before with
+	// the same tool, arguments, variables and inputs
+	var key string
+	if step.cacheable() && r.store != nil {
+		if key, err = cacheKey(spec, step, stepScope); err != nil {
+			result.ExitCode = -1
+			result.Error = err.Error()
+			r.finishStep(stage, step, &result, "", say)
+			return result
+		}
+		manifest, err := r.restoreFromCache(key)
+		if err != nil {
+			say("⚠️  Cache: %v", err)
+		} else if manifest != nil {
+			result.Success = true
+			result.Cached = true
+			result.Outputs = manifest.Outputs
+			result.Artifacts = manifest.Artifacts
+			r.setOutputs(step, manifest.Outputs)
+			inputs = r.fingerprint(spec, step, stepScope, say)
+			r.finishStep(stage, step, &result, inputs, say)
+			return result
+		}
 	}
 
-	// Set environment
-	cmd.Env = os.Environ()
-	for key, value := range step.Environment {
-		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", key, expandVariables(value)))
+	// Every attempt is appended to the step's log, and each output line
+	// becomes an event; with ROCK_VERBOSE=1 it is also shown live
+	logFile := r.openStepLog(stage, step)
+	if logFile != nil {
+		defer logFile.Close()
+	}
+	verbose := os.Getenv("ROCK_VERBOSE") == "1"
+	sink := func(stream, line string) {
+		if logFile != nil {
+			fmt.Fprintln(logFile, line)
+		}
+		r.events.emit(Event{Type: EventOutputLine, Stage: stage, Step: stepID(step), Stream: stream, Line: line})
+		if verbose {
+			say("│ %s", line)
+		}
 	}
 
-	// Execute with retries
-	maxRetries := 1
+	// A remote step's inputs go to its host once, before the first attempt
+	if remote != nil && len(step.Inputs) > 0 {
+		files, err := inputFiles(step, stepScope)
+		if err == nil {
+			say("📤 Uploading %d inputs to %s", len(files), remote.host)
+			err = remote.upload(stop, files)
+		}
+		if err != nil {
+			result.ExitCode = -1
+			result.Error = err.Error()
+			result.Cancelled = stop.cancelled()
+			r.finishStep(stage, step, &result, "", say)
+			return result
+		}
+	}
+
+	// Execute with retries; every attempt starts a fresh process
+	maxAttempts := 1
 	if step.Retries > 0 {
-		maxRetries = step.Retries + 1
+		maxAttempts = step.Retries + 1
 	}
 
-	for attempt := 1; attempt <= maxRetries; attempt++ {
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
 		if attempt > 1 {
-			fmt.Printf("     Retry %d/%d\n", attempt-1, step.Retries)
+			delay := retryDelay(step, attempt-1)
+			say("Retry %d/%d in %s", attempt-1, step.Retries, delay)
+			if !stop.sleep(delay) {
+				result.Error = "cancelled"
+				result.Cancelled = true
+				break
+			}
 		}
 
-		// Execute command
-		output, err := cmd.CombinedOutput()
-		result.Output = string(output)
-		result.Duration = time.Since(startTime)
+		r.events.emit(Event{Type: EventStepStarted, Stage: stage, Step: stepID(step), Attempt: attempt})
+		if logFile != nil {
+			fmt.Fprintf(logFile, "=== %s attempt %d at %s: %s %s\n", stepKey(stage, step), attempt,
+				time.Now().Format(time.RFC3339), spec.path, strings.Join(spec.args, " "))
+		}
 
-		if err != nil {
-			if exitError, ok := err.(*exec.ExitError); ok {
-				result.ExitCode = exitError.ExitCode()
+		record, output, stdout := spec.runAttempt(stop, step, attempt, sink)
+		result.Attempts = append(result.Attempts, record)
+		result.Output = output
+		result.ExitCode = record.ExitCode
+		result.Error = record.Error
+		result.Success = record.Error == ""
+		result.Cancelled = record.Cancelled
+
+		if logFile != nil {
+			if record.Error != "" {
+				fmt.Fprintf(logFile, "=== failed: %s\n", record.Error)
 			} else {
-				result.ExitCode = -1
+				fmt.Fprintf(logFile, "=== succeeded in %.2fs\n", record.Duration.Seconds())
 			}
-			result.Error = err.Error()
-			result.Success = false
+		}
 
-			// Check if should retry
-			if attempt < maxRetries {
-				time.Sleep(time.Second * time.Duration(attempt))
-				continue
+		if result.Success && remote != nil {
+			// Bring what a remote step produced back before reading it
+			patterns, err := remotePatterns(step, stepScope)
+			if err == nil && len(patterns) > 0 {
+				say("📥 Downloading %s from %s", strings.Join(patterns, ", "), remote.host)
+				err = remote.download(stop, patterns)
 			}
-		} else {
-			result.Success = true
-			result.ExitCode = 0
+			if err != nil {
+				result.Success = false
+				result.Error = err.Error()
+				result.Cancelled = stop.cancelled()
+				break
+			}
+		}
+		if result.Success {
+			// Capture declared outputs and artifacts for later steps
+			outputs, artifacts, err := collectOutputs(step, stepScope, stdout)
+			if err != nil {
+				result.Success = false
+				result.Error = err.Error()
+				break
+			}
+			result.Outputs = outputs
+			result.Artifacts = artifacts
+			r.setOutputs(step, outputs)
 			break
 		}
+		if record.Cancelled {
+			break
+		}
+		if attempt < maxAttempts {
+			say("⚠️  Attempt %d failed: %s", attempt, record.Error)
+		}
 	}
 
-	// Show result
+	// Fingerprint what the step left behind, so that resuming compares
+	// against the state after it ran
+	inputs = ""
 	if result.Success {
-		fmt.Printf("     ✅ Success (%.2fs)\n", result.Duration.Seconds())
-	} else {
-		fmt.Printf("     ❌ Failed: %s\n", result.Error)
-		if os.Getenv("ROCK_VERBOSE") == "1" && result.Output != "" {
-			fmt.Printf("     Output: %s\n", strings.TrimSpace(result.Output))
+		if key != "" {
+			if err := r.saveToCache(key, step, result); err != nil {
+				say("⚠️  Cache: %v", err)
+			}
 		}
+		inputs = r.fingerprint(spec, step, stepScope, say)
 	}
-
+	r.finishStep(stage, step, &result, inputs, say)
 	return result
 }
 
-func checkDependencies(deps []string, executed map[string]bool) bool {
-	for _, dep := range deps {
-		if !executed[dep] {
-			return false
-		}
+// finishStep records a step's result in the run state and event log and
+// shows it
+func (r *runner) finishStep(stage string, step Step, result *ExecutionResult, fingerprint string, say func(string, ...interface{})) {
+	result.Duration = time.Since(result.Timestamp)
+
+	status := StepSucceeded
+	switch {
+	case result.Skipped:
+		status = StepSkipped
+	case result.Cancelled:
+		status = StepCancelled
+	case !result.Success:
+		status = StepFailed
 	}
-	return true
-}
+	r.setStatus(step, status)
+	r.recordStep(stage, step, status, fingerprint, *result)
 
-func evaluateCondition(condition string) bool {
-	// Simple condition evaluation (can be extended)
-	if condition == "always" {
-		return true
-	}
-	if condition == "never" {
-		return false
+	event := Event{Type: EventStepFinished, Stage: stage, Step: stepID(step), Status: status,
+		ExitCode: result.ExitCode, Duration: result.Duration.Seconds(), Error: result.Error}
+	if result.Cached {
+		event.Status = "cached"
 	}
+	r.events.emit(event)
 
-	// Check environment variable
-	if strings.HasPrefix(condition, "$") {
-		varName := strings.TrimPrefix(condition, "$")
-		return os.Getenv(varName) != ""
+	// Show result
+	switch {
+	case result.Skipped:
+		say("⏭️  Skipped: condition not met")
+	case result.Cancelled:
+		say("🛑 Cancelled")
+	case result.Cached:
+		say("♻️  Cache hit, restored %d artifact(s)", len(result.Artifacts))
+	case result.Success:
+		say("✅ Success (%.2fs)", result.Duration.Seconds())
+	default:
+		say("❌ Failed: %s", result.Error)
+		if r.state != nil && len(result.Attempts) > 0 {
+			say("📄 Log: %s", stepLogPath(r.state.ID, stage, step))
+		}
 	}
-
-	return true
 }
 
 func hasCycle(stages []Stage) bool {
-	// Simple cycle detection (can be improved with topological sort)
+	graph := stageGraph(stages)
 	visited := make(map[string]bool)
 	recStack := make(map[string]bool)
 
@@ -826,24 +1489,13 @@ func hasCycle(stages []Stage) bool {
 		visited[name] = true
 		recStack[name] = true
 
-		// Find stage
-		var stage *Stage
-		for _, s := range stages {
-			if s.Name == name {
-				stage = &s
-				break
-			}
-		}
-
-		if stage != nil {
-			for _, dep := range stage.DependsOn {
-				if !visited[dep] {
-					if hasCycleUtil(dep) {
-						return true
-					}
-				} else if recStack[dep] {
+		for _, dep := range graph[name] {
+			if !visited[dep] {
+				if hasCycleUtil(dep) {
 					return true
 				}
+			} else if recStack[dep] {
+				return true
 			}
 		}
 
@@ -862,29 +1514,6 @@ func hasCycle(stages []Stage) bool {
 	return false
 }
 
-func expandVariables(s string) string {
-	// Expand ${VAR} style variables
-	result := s
-	for key, value := range getAllVariables() {
-		result = strings.ReplaceAll(result, "${"+key+"}", value)
-	}
-	return os.ExpandEnv(result)
-}
-
-func getAllVariables() map[string]string {
-	vars := make(map[string]string)
-
-	// Get all environment variables
-	for _, env := range os.Environ() {
-		parts := strings.SplitN(env, "=", 2)
-		if len(parts) == 2 {
-			vars[parts[0]] = parts[1]
-		}
-	}
-
-	return vars
-}
-
 func getPipelinesDir() string {
 	if dir := os.Getenv("ROCK_PIPELINES_DIR"); dir != "" {
 		return dir
@@ -898,7 +1527,7 @@ func generateExamplePipeline() *Pipeline {
 		Version:     "1.0",
 		Description: "Example pipeline showing basic structure",
 		Variables: map[string]string{
-			"BUILD_DIR": "./build",
+			"BUILD_DIR":  "./build",
 			"OUTPUT_DIR": "./output",
 		},
 		Stages: []Stage{
@@ -966,4 +1595,4 @@ func outputJSON(data interface{}) {
 	encoder := json.NewEncoder(os.Stdout)
 	encoder.SetIndent("", "  ")
 	encoder.Encode(data)
-}
\ No newline at end of file
+}
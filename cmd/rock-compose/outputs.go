@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Artifact is a file produced by a step, recorded with its hash
+type Artifact struct {
+	Path   string `json:"path"`
+	SHA256 string `json:"sha256"`
+	Size   int64  `json:"size"`
+	Step   string `json:"step"`
+}
+
+// fileOutputPrefix marks an output read from a file instead of JSON stdout
+const fileOutputPrefix = "file:"
+
+// stepID returns the name used to reference a step's outputs
+func stepID(step Step) string {
+	if step.ID != "" {
+		return step.ID
+	}
+	return step.Name
+}
+
+// wantsJSON reports whether any output is read from the tool's JSON stdout
+func (s Step) wantsJSON() bool {
+	for _, source := range s.Outputs {
+		if !strings.HasPrefix(source, fileOutputPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// outputRef splits "steps.<id>.outputs.<key>" into id and key
+func outputRef(name string) (id, key string, ok bool) {
+	rest, ok := strings.CutPrefix(name, "steps.")
+	if !ok {
+		return "", "", false
+	}
+	i := strings.LastIndex(rest, ".outputs.")
+	if i <= 0 {
+		return "", "", false
+	}
+	return rest[:i], rest[i+len(".outputs."):], true
+}
+
+// outputsScope returns a scope layer that resolves ${steps.<id>.outputs.<key>}
+// through lookup. Output values are used as is.
+func outputsScope(parent *Scope, lookup func(id, key string) (string, bool)) *Scope {
+	return &Scope{
+		parent:  parent,
+		literal: true,
+		dynamic: func(name string) (string, bool) {
+			id, key, ok := outputRef(name)
+			if !ok {
+				return "", false
+			}
+			return lookup(id, key)
+		},
+	}
+}
+
+// setOutputs records the outputs of a finished step
+func (r *runner) setOutputs(step Step, outputs map[string]string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.outputs[stepID(step)] = outputs
+}
+
+// lookupOutput returns an output of a step that has already run
+func (r *runner) lookupOutput(id, key string) (string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	value, ok := r.outputs[id][key]
+	return value, ok
+}
+
+// collectOutputs reads the outputs and artifacts a successful step declared
+func collectOutputs(step Step, scope *Scope, stdout string) (map[string]string, []Artifact, error) {
+	var outputs map[string]string
+	if len(step.Outputs) > 0 {
+		outputs = make(map[string]string, len(step.Outputs))
+	}
+
+	var document interface{}
+	if step.wantsJSON() {
+		var err error
+		if document, err = lastJSONValue(stdout); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	keys := make([]string, 0, len(step.Outputs))
+	for key := range step.Outputs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		source := step.Outputs[key]
+		if path, ok := strings.CutPrefix(source, fileOutputPrefix); ok {
+			path, err := scope.Expand(path)
+			if err != nil {
+				return nil, nil, fmt.Errorf("output %s: %v", key, err)
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return nil, nil, fmt.Errorf("output %s: %v", key, err)
+			}
+			outputs[key] = strings.TrimSpace(string(data))
+			continue
+		}
+
+		value, err := jsonField(document, source)
+		if err != nil {
+			return nil, nil, fmt.Errorf("output %s: %v", key, err)
+		}
+		outputs[key] = value
+	}
+
+	var artifacts []Artifact
+	for _, pattern := range step.Artifacts {
+		pattern, err := scope.Expand(pattern)
+		if err != nil {
+			return nil, nil, fmt.Errorf("artifact: %v", err)
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, nil, fmt.Errorf("artifact %s: %v", pattern, err)
+		}
+		if len(matches) == 0 {
+			return nil, nil, fmt.Errorf("declared artifact %s was not produced", pattern)
+		}
+		for _, path := range matches {
+			artifact, err := hashArtifact(path)
+			if err != nil {
+				return nil, nil, err
+			}
+			artifact.Step = stepID(step)
+			artifacts = append(artifacts, artifact)
+		}
+	}
+
+	return outputs, artifacts, nil
+}
+
+// hashArtifact computes the SHA256 and size of a file
+func hashArtifact(path string) (Artifact, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return Artifact{}, fmt.Errorf("failed to open artifact: %w", err)
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return Artifact{}, fmt.Errorf("failed to hash artifact %s: %w", path, err)
+	}
+	return Artifact{Path: path, SHA256: hex.EncodeToString(hash.Sum(nil)), Size: size}, nil
+}
+
+// lastJSONValue returns the JSON object or array a tool's stdout ends
+// with. Tools print progress before their JSON result, so lines that start
+// a JSON value are tried from the end until one holds a value that runs to
+// the end of the output.
+func lastJSONValue(stdout string) (interface{}, error) {
+	end := len(strings.TrimRight(stdout, " \t\r\n"))
+	for start := end; start > 0; {
+		start = strings.LastIndexByte(stdout[:start], '\n') + 1
+		line := strings.TrimLeft(stdout[start:end], " \t")
+		if strings.HasPrefix(line, "{") || strings.HasPrefix(line, "[") {
+			decoder := json.NewDecoder(strings.NewReader(stdout[start:end]))
+			decoder.UseNumber()
+			var value interface{}
+			// A value that ends earlier is nested in the result, or
+			// printed before it
+			if err := decoder.Decode(&value); err == nil && start+int(decoder.InputOffset()) == end {
+				return value, nil
+			}
+		}
+		start-- // Continue before the newline
+	}
+	return nil, fmt.Errorf("step printed no JSON output")
+}
+
+// jsonField walks a dotted path ("image.path", "files.0") through a
+// decoded JSON document and returns the value as a string
+func jsonField(document interface{}, path string) (string, error) {
+	value := document
+	if path != "" && path != "." {
+		for _, part := range strings.Split(strings.TrimPrefix(path, "."), ".") {
+			switch node := value.(type) {
+			case map[string]interface{}:
+				next, ok := node[part]
+				if !ok {
+					return "", fmt.Errorf("field %q not found in JSON output", path)
+				}
+				value = next
+			case []interface{}:
+				i, err := strconv.Atoi(part)
+				if err != nil || i < 0 || i >= len(node) {
+					return "", fmt.Errorf("index %q out of range in JSON output", part)
+				}
+				value = node[i]
+			default:
+				return "", fmt.Errorf("field %q not found in JSON output", path)
+			}
+		}
+	}
+
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	case nil:
+		return "", nil
+	default:
+		var b bytes.Buffer
+		encoder := json.NewEncoder(&b)
+		encoder.SetEscapeHTML(false)
+		if err := encoder.Encode(v); err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(b.String()), nil
+	}
+}
+
+// declaredOutputs returns a lookup that accepts every output a step in the
+// pipeline declares, for validation
+func declaredOutputs(pipeline *Pipeline) func(id, key string) (string, bool) {
+	declared := make(map[string]map[string]bool)
+	add := func(steps []Step) {
+		for _, step := range steps {
+			for key := range step.Outputs {
+				if declared[stepID(step)] == nil {
+					declared[stepID(step)] = make(map[string]bool)
+				}
+				declared[stepID(step)][key] = true
+			}
+		}
+	}
+	for _, stage := range pipeline.Stages {
+		add(stage.Steps)
+	}
+	add(pipeline.OnSuccess)
+	add(pipeline.OnFailure)
+	add(pipeline.Finally)
+
+	return func(id, key string) (string, bool) {
+		if declared[id][key] {
+			return "<" + id + "." + key + ">", true
+		}
+		return "", false
+	}
+}
+
+// stepsFinished returns a function reporting whether the stage step id
+// has finished when stage starts, or its step at index when index >= 0
+func stepsFinished(pipeline *Pipeline) func(id string, stage Stage, index int) bool {
+	type place struct {
+		stage string
+		index int
+	}
+	places := make(map[string]place)
+	for _, stage := range pipeline.Stages {
+		for i, step := range stage.Steps {
+			places[stepID(step)] = place{stage: stage.Name, index: i}
+		}
+	}
+
+	// after maps a stage to the stages downstream of it
+	after := make(map[string]map[string]bool)
+	return func(id string, stage Stage, index int) bool {
+		p, ok := places[id]
+		if !ok {
+			return false
+		}
+		if p.stage == stage.Name {
+			return !stage.Parallel && p.index < index
+		}
+		if after[p.stage] == nil {
+			after[p.stage] = downstream(pipeline.Stages, p.stage)
+		}
+		return after[p.stage][stage.Name]
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import "testing"
+
+func TestJSONOutputs(t *testing.T) {
+	stdout := "🔨 Creating image...\n{\"note\": \"progress\"}\n{\n  \"image\": {\"path\": \"out/rock-os.cpio.gz\", \"size\": 4096},\n  \"files\": [\"init\", \"busybox\"]\n}\n"
+	document, err := lastJSONValue(stdout)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]string{
+		"image.path": "out/rock-os.cpio.gz",
+		"image.size": "4096",
+		"files.1":    "busybox",
+		"files":      `["init","busybox"]`,
+	}
+	for path, want := range tests {
+		if got, err := jsonField(document, path); err != nil || got != want {
+			t.Errorf("jsonField(%q) = %q, %v; want %q", path, got, err, want)
+		}
+	}
+	if _, err := jsonField(document, "image.sha256"); err == nil {
+		t.Error("expected an error for a missing field")
+	}
+
+	if id, key, ok := outputRef("steps.create-image.outputs.path"); !ok || id != "create-image" || key != "path" {
+		t.Errorf("outputRef = %q %q %v", id, key, ok)
+	}
+}
+
+func TestLastJSONValue(t *testing.T) {
+	tests := map[string]string{
+		// Nested values on their own lines are part of the result
+		"[\n  {\"a\": 1},\n  {\"b\": 2}\n]\n":    `[{"a":1},{"b":2}]`,
+		"{\"progress\": 1}\n{\"result\": 2}\n\n": `{"result":2}`,
+		"building...\n  {\"ok\": true}\r\n":      `{"ok":true}`,
+	}
+	for stdout, want := range tests {
+		document, err := lastJSONValue(stdout)
+		if err != nil {
+			t.Errorf("lastJSONValue(%q): %v", stdout, err)
+			continue
+		}
+		if got, _ := jsonField(document, "."); got != want {
+			t.Errorf("lastJSONValue(%q) = %s, want %s", stdout, got, want)
+		}
+	}
+
+	for _, stdout := range []string{"", "no json\n", "{\"done\": true}\ntrailing text\n", "[broken\n"} {
+		if _, err := lastJSONValue(stdout); err == nil {
+			t.Errorf("lastJSONValue(%q) succeeded", stdout)
+		}
+	}
+}
+
+func TestDeclaredOutputs(t *testing.T) {
+	pipeline := &Pipeline{
+		Stages:  []Stage{{Name: "image", Steps: []Step{{Name: "create", Outputs: map[string]string{"path": "image.path"}}}}},
+		Finally: []Step{{Name: "upload", ID: "up", Outputs: map[string]string{"url": "file:url"}}},
+	}
+	lookup := declaredOutputs(pipeline)
+	for _, ref := range [][2]string{{"create", "path"}, {"up", "url"}} {
+		if _, ok := lookup(ref[0], ref[1]); !ok {
+			t.Errorf("output %s.%s not declared", ref[0], ref[1])
+		}
+	}
+	if _, ok := lookup("create", "size"); ok {
+		t.Error("undeclared output create.size accepted")
+	}
+}
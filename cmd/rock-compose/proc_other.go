@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+import "os/exec"
+
+// setProcessGroup is a no-op where process groups are unavailable;
+// cancellation kills only the direct child, without a grace period
+func setProcessGroup(cmd *exec.Cmd, stop cancellation) {}
@@ -0,0 +1,33 @@
+//go:build unix
+
+package main
+
+import (
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// setProcessGroup starts the command in its own process group and makes
+// cancellation stop the whole group, so a step cannot leave children
+// running. A timed-out step is killed at once; when the run is cancelled
+// the group gets SIGTERM, and SIGKILL after the grace period.
+func setProcessGroup(cmd *exec.Cmd, stop cancellation) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		group := -cmd.Process.Pid
+		if !stop.cancelled() || stop.grace <= 0 {
+			return syscall.Kill(group, syscall.SIGKILL)
+		}
+		go func() {
+			timer := time.NewTimer(stop.grace)
+			defer timer.Stop()
+			select {
+			case <-timer.C:
+			case <-stop.kill:
+			}
+			syscall.Kill(group, syscall.SIGKILL)
+		}()
+		return syscall.Kill(group, syscall.SIGTERM)
+	}
+}
@@ -0,0 +1,504 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// A step with host: runs on another machine. Its inputs are copied to the
+// host before it runs, its output streams back while it runs, and its
+// artifacts and file outputs are copied back once it succeeds. Files travel
+// as tar streams through the transport that runs the step, so a transport
+// only has to run a shell script on the host.
+
+// defaultRemoteDir holds the working directories of pipelines on hosts
+// that name no directory, relative to the login directory
+const defaultRemoteDir = ".rock-compose"
+
+// Transport runs shell scripts on remote hosts
+type Transport interface {
+	// Command returns the program and arguments that run script on host.
+	// The program's stdin, stdout and stderr are the script's.
+	Command(host *Host, script string) (string, []string)
+}
+
+// transports maps host URL schemes to the transports that reach them
+var transports = map[string]Transport{
+	"ssh":   sshTransport{},
+	"local": localTransport{},
+}
+
+// sshTransport runs scripts with ssh. ROCK_SSH replaces the ssh command,
+// e.g. "ssh -F ./ssh_config" to reach a test sshd.
+type sshTransport struct{}
+
+func (sshTransport) Command(host *Host, script string) (string, []string) {
+	command := []string{"ssh"}
+	if fields := strings.Fields(os.Getenv("ROCK_SSH")); len(fields) > 0 {
+		command = fields
+	}
+	// Never prompt: a pipeline has no one to answer
+	args := append(command[1:], "-o", "BatchMode=yes")
+	if host.Port != "" {
+		args = append(args, "-p", host.Port)
+	}
+	if host.User != "" {
+		args = append(args, "-l", host.User)
+	}
+	return command[0], append(args, "--", host.Name, script)
+}
+
+// localTransport runs scripts on this machine, in the host's directory.
+// It stands in for a remote host in tests.
+type localTransport struct{}
+
+func (localTransport) Command(host *Host, script string) (string, []string) {
+	return "sh", []string{"-c", script}
+}
+
+// Host is where a remote step runs
+type Host struct {
+	Scheme string // Transport
+	User   string
+	Name   string
+	Port   string
+	Dir    string // Working directory; empty for the default
+}
+
+// parseHost parses [ssh://][user@]host[:port][/dir] or local:///dir
+func parseHost(value string) (*Host, error) {
+	raw := value
+	if !strings.Contains(raw, "://") {
+		raw = "ssh://" + raw
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid host %q: %v", value, err)
+	}
+	if _, ok := transports[u.Scheme]; !ok {
+		return nil, fmt.Errorf("host %s: unknown transport %s", value, u.Scheme)
+	}
+
+	host := &Host{Scheme: u.Scheme, Name: u.Hostname(), Port: u.Port(), Dir: u.Path}
+	if u.User != nil {
+		host.User = u.User.Username()
+	}
+	if host.Scheme == "ssh" && host.Name == "" {
+		return nil, fmt.Errorf("host %s: no host name", value)
+	}
+	return host, nil
+}
+
+func (h *Host) String() string {
+	if h.Scheme == "local" {
+		return "local:" + h.Dir
+	}
+	name := h.Name
+	if h.User != "" {
+		name = h.User + "@" + name
+	}
+	if h.Port != "" {
+		name += ":" + h.Port
+	}
+	return name
+}
+
+// remoteStep is how a step reaches its host
+type remoteStep struct {
+	host      *Host
+	transport Transport
+	dir       string // Working directory on the host
+}
+
+// remoteFor returns how a step runs on its host, or nil for a local step
+func remoteFor(step Step, scope *Scope, pipeline string) (*remoteStep, error) {
+	if step.Host == "" {
+		return nil, nil
+	}
+	value, err := scope.Expand(step.Host)
+	if err != nil {
+		return nil, err
+	}
+	host, err := parseHost(value)
+	if err != nil {
+		return nil, err
+	}
+
+	dir := host.Dir
+	if dir == "" {
+		dir = path.Join(defaultRemoteDir, pipeline)
+	}
+	return &remoteStep{host: host, transport: transports[host.Scheme], dir: dir}, nil
+}
+
+// command wraps a step's command so that it runs on the host, in the
+// host's working directory, with the variables the pipeline defines. The
+// tool of a remote step is looked up in the host's PATH.
+//
+// The transport does not stop a command when it dies: ssh leaves it
+// running on the host when it is killed. So the script watches its stdin,
+// which this side holds open while the step runs, and sends SIGTERM to
+// its process group when the stdin closes before the command is done.
+func (rs *remoteStep) command(step Step, spec *commandSpec, scope *Scope) (*commandSpec, error) {
+	defined, err := scope.Defined()
+	if err != nil {
+		return nil, err
+	}
+
+	var script strings.Builder
+	fmt.Fprintf(&script, "mkdir -p %s && cd %s", shellQuote(rs.dir), shellQuote(rs.dir))
+	if spec.dir != "" {
+		fmt.Fprintf(&script, " && cd %s", shellQuote(spec.dir))
+	}
+	script.WriteString(" || exit\n")
+	script.WriteString("exec 3<&0 </dev/null\n")
+	script.WriteString("{ cat <&3 >/dev/null; kill -TERM 0; } >/dev/null 2>&1 &\n")
+	script.WriteString("watcher=$!\n")
+	script.WriteString("env")
+	for _, env := range defined {
+		script.WriteString(" " + shellQuote(env))
+	}
+	if step.Tool != "" && step.wantsJSON() {
+		script.WriteString(" ROCK_OUTPUT=json")
+	}
+	for _, arg := range append([]string{spec.path}, spec.args...) {
+		script.WriteString(" " + shellQuote(arg))
+	}
+	script.WriteString(" 3<&-\n")
+	script.WriteString("status=$?\n")
+	script.WriteString("kill $watcher 2>/dev/null\n")
+	script.WriteString("exit $status\n")
+
+	program, args := rs.transport.Command(rs.host, script.String())
+	return &commandSpec{path: program, args: args, env: spec.env, hangup: true}, nil
+}
+
+// syncGroup is a set of paths copied below one base directory on the host
+type syncGroup struct {
+	base  string // On the host
+	local string // Here
+	paths []string
+}
+
+// syncGroups groups paths for downloading: relative paths keep their place
+// below the working directory, and absolute paths keep their path. A local
+// host already has this machine's absolute paths.
+func (rs *remoteStep) syncGroups(paths []string) []syncGroup {
+	relative, absolute := splitPaths(paths)
+	groups := []syncGroup{{base: rs.dir, local: ".", paths: relative}}
+	if rs.host.Scheme != "local" {
+		groups = append(groups, syncGroup{base: "/", local: "/", paths: absolute})
+	}
+	return groups
+}
+
+// upload copies files to the host, below its working directory. Absolute
+// paths are refused: on a shared host they would overwrite the same path
+// for every user. A local host already has them.
+func (rs *remoteStep) upload(stop cancellation, files []string) error {
+	relative, absolute := splitPaths(files)
+	if len(absolute) > 0 && rs.host.Scheme != "local" {
+		return fmt.Errorf("refusing to upload %s to %s: inputs of remote steps must be relative paths", strings.Join(absolute, ", "), rs.host)
+	}
+	if len(relative) == 0 {
+		return nil
+	}
+
+	base := shellQuote(rs.dir)
+	script := fmt.Sprintf("mkdir -p %s && tar -xf - -C %s", base, base)
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(writeTar(writer, relative))
+	}()
+	err := rs.run(stop, script, reader, nil)
+	reader.Close()
+	if err != nil {
+		return fmt.Errorf("failed to upload inputs to %s: %w", rs.host, err)
+	}
+	return nil
+}
+
+// download copies the files matching patterns back from the host
+func (rs *remoteStep) download(stop cancellation, patterns []string) error {
+	for _, group := range rs.syncGroups(patterns) {
+		if len(group.paths) == 0 {
+			continue
+		}
+		relative := make([]string, len(group.paths))
+		globs := make([]string, len(group.paths))
+		for i, pattern := range group.paths {
+			relative[i] = strings.TrimPrefix(path.Clean(filepath.ToSlash(pattern)), "/")
+			globs[i] = globQuote(relative[i])
+		}
+		script := fmt.Sprintf("cd %s && tar -cf - -- %s", shellQuote(group.base), strings.Join(globs, " "))
+
+		reader, writer := io.Pipe()
+		extracted := make(chan error, 1)
+		go func(local string) {
+			err := extractTar(reader, local, relative)
+			if err == nil {
+				// tar pads the archive past its end marker
+				_, err = io.Copy(io.Discard, reader)
+			}
+			reader.CloseWithError(err)
+			extracted <- err
+		}(group.local)
+		err := rs.run(stop, script, nil, writer)
+		writer.Close()
+		if extractErr := <-extracted; err == nil {
+			err = extractErr
+		}
+		if err != nil {
+			return fmt.Errorf("failed to download %s from %s: %w", strings.Join(group.paths, ", "), rs.host, err)
+		}
+	}
+	return nil
+}
+
+// run runs a script on the host; stderr becomes part of the error
+func (rs *remoteStep) run(stop cancellation, script string, stdin io.Reader, stdout io.Writer) error {
+	program, args := rs.transport.Command(rs.host, script)
+	cmd := exec.CommandContext(stop.ctx, program, args...)
+	cmd.Stdin = stdin
+	cmd.Stdout = stdout
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	cmd.WaitDelay = stop.grace + killWaitDelay
+	setProcessGroup(cmd, stop)
+
+	if err := cmd.Run(); err != nil {
+		if message := strings.TrimSpace(stderr.String()); message != "" {
+			return fmt.Errorf("%v: %s", err, message)
+		}
+		return err
+	}
+	return nil
+}
+
+// remotePatterns returns the files a remote step declares it produces:
+// its artifacts and the files its outputs are read from
+func remotePatterns(step Step, scope *Scope) ([]string, error) {
+	var patterns []string
+	for _, artifact := range step.Artifacts {
+		pattern, err := scope.Expand(artifact)
+		if err != nil {
+			return nil, fmt.Errorf("artifact: %v", err)
+		}
+		patterns = append(patterns, pattern)
+	}
+	for key, source := range step.Outputs {
+		if file, ok := strings.CutPrefix(source, fileOutputPrefix); ok {
+			file, err := scope.Expand(file)
+			if err != nil {
+				return nil, fmt.Errorf("output %s: %v", key, err)
+			}
+			patterns = append(patterns, file)
+		}
+	}
+	sort.Strings(patterns)
+	return unique(patterns), nil
+}
+
+// splitPaths separates relative from absolute paths
+func splitPaths(paths []string) (relative, absolute []string) {
+	for _, p := range paths {
+		if filepath.IsAbs(p) {
+			absolute = append(absolute, p)
+		} else {
+			relative = append(relative, p)
+		}
+	}
+	return relative, absolute
+}
+
+// writeTar writes files to w as a tar stream. Absolute paths are stored
+// relative to /.
+func writeTar(w io.Writer, files []string) error {
+	tw := tar.NewWriter(w)
+	for _, file := range files {
+		info, err := os.Lstat(file)
+		if err != nil {
+			return err
+		}
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(file); err != nil {
+				return err
+			}
+		}
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		header.Name = strings.TrimPrefix(filepath.ToSlash(filepath.Clean(file)), "/")
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			continue
+		}
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(tw, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// extractTar unpacks a tar stream below dir. Only the paths matching
+// patterns, slash paths relative to dir, and the files below them are
+// extracted; any other entry, and any entry that would be written through
+// a symlink or replace a directory, is an error.
+func extractTar(r io.Reader, dir string, patterns []string) error {
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		name := path.Clean(header.Name)
+		if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return fmt.Errorf("refusing to extract %s outside %s", header.Name, dir)
+		}
+		root, ok := matchedRoot(name, patterns)
+		if !ok {
+			return fmt.Errorf("refusing to extract %s: it matches none of %s", header.Name, strings.Join(patterns, ", "))
+		}
+		target := filepath.Join(dir, filepath.FromSlash(name))
+		if err := makeTarParents(dir, root, name); err != nil {
+			return err
+		}
+		if err := clearTarget(target, header.Typeflag == tar.TypeDir); err != nil {
+			return err
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(target, os.FileMode(header.Mode).Perm())
+		case tar.TypeSymlink:
+			err = os.Symlink(header.Linkname, target)
+		case tar.TypeReg:
+			var f *os.File
+			if f, err = os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, os.FileMode(header.Mode).Perm()); err != nil {
+				return err
+			}
+			_, err = io.Copy(f, tr)
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// matchedRoot returns the shortest leading part of name that matches one
+// of patterns: the path that was asked for, which name is or is below
+func matchedRoot(name string, patterns []string) (string, bool) {
+	parts := strings.Split(name, "/")
+	for i := 1; i <= len(parts); i++ {
+		prefix := strings.Join(parts[:i], "/")
+		for _, pattern := range patterns {
+			if ok, _ := path.Match(pattern, prefix); ok {
+				return prefix, true
+			}
+		}
+	}
+	return "", false
+}
+
+// makeTarParents creates the parent directories of name below dir. The
+// directories above root are where the caller asked for files; from root
+// down the archive supplies them, so none of them may be a symlink.
+func makeTarParents(dir, root, name string) error {
+	if err := os.MkdirAll(filepath.Join(dir, filepath.FromSlash(path.Dir(root))), 0755); err != nil {
+		return err
+	}
+	parents := strings.Split(name, "/")
+	parents = parents[:len(parents)-1]
+	for i := strings.Count(root, "/") + 1; i <= len(parents); i++ {
+		parent := filepath.Join(dir, filepath.FromSlash(strings.Join(parents[:i], "/")))
+		info, err := os.Lstat(parent)
+		switch {
+		case os.IsNotExist(err):
+			if err := os.Mkdir(parent, 0755); err != nil {
+				return err
+			}
+		case err != nil:
+			return err
+		case info.Mode()&os.ModeSymlink != 0:
+			return fmt.Errorf("refusing to extract %s through symlink %s", name, parent)
+		case !info.IsDir():
+			return fmt.Errorf("refusing to extract %s: %s is not a directory", name, parent)
+		}
+	}
+	return nil
+}
+
+// clearTarget removes what is at target before an entry is extracted
+// there, so that a file or symlink is never written through an existing
+// symlink. A directory stays for a directory entry and is an error for
+// any other.
+func clearTarget(target string, dir bool) error {
+	info, err := os.Lstat(target)
+	switch {
+	case os.IsNotExist(err):
+		return nil
+	case err != nil:
+		return err
+	case info.IsDir() && dir:
+		return nil
+	case info.IsDir():
+		return fmt.Errorf("refusing to replace directory %s", target)
+	}
+	return os.Remove(target)
+}
+
+// shellQuote quotes s for a POSIX shell
+func shellQuote(s string) string {
+	if s != "" && strings.Trim(s, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_./=:,+@%") == "" {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// globQuote quotes a glob pattern for a POSIX shell, leaving its wildcards
+// for the shell to expand
+func globQuote(pattern string) string {
+	var quoted strings.Builder
+	literal := ""
+	for _, c := range pattern {
+		if strings.ContainsRune("*?[]", c) {
+			if literal != "" {
+				quoted.WriteString(shellQuote(literal))
+				literal = ""
+			}
+			quoted.WriteRune(c)
+			continue
+		}
+		literal += string(c)
+	}
+	if literal != "" {
+		quoted.WriteString(shellQuote(literal))
+	}
+	return quoted.String()
+}
@@ -0,0 +1,244 @@
+//go:build unix
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestParseHost(t *testing.T) {
+	tests := map[string]Host{
+		"builder":                       {Scheme: "ssh", Name: "builder"},
+		"rock@builder:2222":             {Scheme: "ssh", User: "rock", Name: "builder", Port: "2222"},
+		"ssh://rock@builder/srv/rock":   {Scheme: "ssh", User: "rock", Name: "builder", Dir: "/srv/rock"},
+		"local:///tmp/rock-remote-host": {Scheme: "local", Dir: "/tmp/rock-remote-host"},
+	}
+	for value, want := range tests {
+		if host, err := parseHost(value); err != nil || !reflect.DeepEqual(*host, want) {
+			t.Errorf("parseHost(%s) = %+v, %v; want %+v", value, host, err, want)
+		}
+	}
+	for _, value := range []string{"ftp://builder", "ssh:///srv/rock"} {
+		if _, err := parseHost(value); err == nil {
+			t.Errorf("parseHost(%s) succeeded", value)
+		}
+	}
+}
+
+func TestRemoteStep(t *testing.T) {
+	// Relative inputs and artifacts are relative to the working directory
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(cwd)
+
+	if err := os.MkdirAll(filepath.Join("src", "rock-init"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join("src", "rock-init", "main.rs"), []byte("fn main() {}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	host := filepath.Join(dir, "host")
+	pipeline := &Pipeline{Name: "remote", Variables: map[string]string{"TARGET": "x86_64-unknown-linux-musl"}}
+	step := Step{
+		Name:      "build",
+		Host:      "local://" + host,
+		Command:   `mkdir -p out && cp src/rock-init/main.rs "out/rock-init-$TARGET" && pwd > out/where && echo built`,
+		Inputs:    []string{"src"},
+		Artifacts: []string{"out/rock-init-*"},
+		Outputs:   map[string]string{"where": "file:out/where"},
+	}
+	r := newRunner(pipeline, 1)
+	result := r.executeStep("build", step, r.scope, "")
+	if !result.Success {
+		t.Fatalf("step failed: %s\n%s", result.Error, result.Output)
+	}
+
+	// The step ran on the host, with the inputs uploaded and its
+	// artifacts and file outputs downloaded
+	if strings.TrimSpace(result.Output) != "built" {
+		t.Errorf("output = %q", result.Output)
+	}
+	if _, err := os.Stat(filepath.Join(host, "src", "rock-init", "main.rs")); err != nil {
+		t.Errorf("input not uploaded: %v", err)
+	}
+	if len(result.Artifacts) != 1 || result.Artifacts[0].Path != "out/rock-init-x86_64-unknown-linux-musl" {
+		t.Errorf("artifacts = %+v", result.Artifacts)
+	}
+	if where, _ := filepath.EvalSymlinks(host); result.Outputs["where"] != where {
+		t.Errorf("outputs = %v, want where=%s", result.Outputs, where)
+	}
+
+	// A declared artifact the host did not produce fails the step
+	step.Artifacts = []string{"out/missing"}
+	if result := r.executeStep("build", step, r.scope, ""); result.Success || !strings.Contains(result.Error, "failed to download out/missing") {
+		t.Errorf("missing artifact: success=%v error=%q", result.Success, result.Error)
+	}
+
+	// Absolute inputs would land at the same path on a shared host
+	builder := &remoteStep{host: &Host{Scheme: "ssh", Name: "builder"}, transport: sshTransport{}, dir: "rock"}
+	if err := builder.upload(cancellation{}, []string{"src", "/etc/rock/config.yaml"}); err == nil || !strings.Contains(err.Error(), "must be relative") {
+		t.Errorf("absolute input: error = %v", err)
+	}
+	step.Host = "builder"
+	step.Inputs = []string{"src", "/etc/rock/config.yaml"}
+	issues := validatePipeline(&Pipeline{Name: "remote", Stages: []Stage{{Name: "build", Steps: []Step{step}}}})
+	if len(issues) != 1 || !strings.Contains(issues[0].Message, "input /etc/rock/config.yaml is absolute") {
+		t.Errorf("validate = %v", issues)
+	}
+}
+
+func TestRemoteCommandHangup(t *testing.T) {
+	// The transport dying closes the script's stdin; the command must not
+	// outlive it
+	host := t.TempDir()
+	rs := &remoteStep{host: &Host{Scheme: "local", Dir: host}, transport: localTransport{}, dir: host}
+	spec := &commandSpec{path: "sh", args: []string{"-c", "echo $$ > pid; sleep 30"}}
+	wrapped, err := rs.command(Step{Name: "slow"}, spec, newRunner(&Pipeline{Name: "remote"}, 1).scope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !wrapped.hangup {
+		t.Error("remote command does not hold its stdin open")
+	}
+
+	stdin, hold, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(wrapped.path, wrapped.args...)
+	cmd.Stdin = stdin
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	stdin.Close()
+	defer syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+
+	var pid int
+	for deadline := time.Now().Add(5 * time.Second); pid == 0; time.Sleep(20 * time.Millisecond) {
+		data, _ := os.ReadFile(filepath.Join(host, "pid"))
+		pid, _ = strconv.Atoi(strings.TrimSpace(string(data)))
+		if pid == 0 && time.Now().After(deadline) {
+			t.Fatal("command did not start")
+		}
+	}
+
+	hold.Close()
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("script succeeded after its stdin closed")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("script still running after its stdin closed")
+	}
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(50 * time.Millisecond) {
+		if syscall.Kill(pid, 0) != nil || zombie(pid) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Errorf("command %d survived its stdin closing", pid)
+			syscall.Kill(pid, syscall.SIGKILL)
+			break
+		}
+	}
+}
+
+// tarEntry is an entry of a test tar stream
+type tarEntry struct {
+	name, link, data string
+}
+
+func testTar(t *testing.T, entries ...tarEntry) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, entry := range entries {
+		header := &tar.Header{Name: entry.name, Mode: 0644, Typeflag: tar.TypeReg, Size: int64(len(entry.data))}
+		switch {
+		case entry.link != "":
+			header.Typeflag, header.Linkname, header.Size = tar.TypeSymlink, entry.link, 0
+		case strings.HasSuffix(entry.name, "/"):
+			header.Typeflag, header.Mode = tar.TypeDir, 0755
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(entry.data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func TestExtractTar(t *testing.T) {
+	dir := t.TempDir()
+	outside := t.TempDir()
+	patterns := []string{"out/rock-init-*", "logs"}
+
+	// Requested paths and the files below them are extracted
+	err := extractTar(testTar(t,
+		tarEntry{name: "out/rock-init-x86_64", data: "init"},
+		tarEntry{name: "logs/"},
+		tarEntry{name: "logs/build.log", data: "log"},
+	), dir, patterns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "logs", "build.log")); string(data) != "log" {
+		t.Errorf("logs/build.log = %q", data)
+	}
+
+	// A file already there as a symlink is replaced, not written through
+	target := filepath.Join(outside, "target")
+	os.WriteFile(target, []byte("keep"), 0644)
+	os.Symlink(target, filepath.Join(dir, "logs", "run.log"))
+	if err := extractTar(testTar(t, tarEntry{name: "logs/run.log", data: "run"}), dir, patterns); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(target); string(data) != "keep" {
+		t.Errorf("wrote through a symlink: target = %q", data)
+	}
+	if info, err := os.Lstat(filepath.Join(dir, "logs", "run.log")); err != nil || !info.Mode().IsRegular() {
+		t.Errorf("logs/run.log not replaced by a file: %v", err)
+	}
+
+	refused := map[string][]tarEntry{
+		"matches none of": {{name: "etc/passwd", data: "root"}},
+		"outside":         {{name: "../escape", data: "x"}},
+		"through symlink": {{name: "logs", link: outside}, {name: "logs/evil", data: "x"}},
+		"not a directory": {{name: "logs", data: "file"}, {name: "logs/evil", data: "x"}},
+	}
+	for want, entries := range refused {
+		os.RemoveAll(filepath.Join(dir, "logs"))
+		err := extractTar(testTar(t, entries...), dir, patterns)
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: error = %v, want %q", entries[len(entries)-1].name, err, want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(outside, "evil")); err == nil {
+		t.Error("extracted through a symlink")
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/rock-os/tools/pkg/report"
+)
+
+// pipelineReport turns a run into a report: each stage is a test suite and
+// each step a test case. Steps that never ran are reported as skipped.
+func pipelineReport(pipeline *Pipeline, result *PipelineResult) *report.Report {
+	rep := &report.Report{
+		Name:      pipeline.Name,
+		Timestamp: result.StartTime,
+		Duration:  result.Duration,
+	}
+
+	for _, stage := range pipeline.Stages {
+		suite := rep.Suite(stage.Name)
+		suite.Timestamp = time.Time{}
+		results := result.StageResults[stage.Name]
+		used := make([]bool, len(results))
+
+		for _, step := range stage.Steps {
+			c := report.Case{Name: step.Name, ClassName: pipeline.Name + "." + stage.Name}
+
+			found := -1
+			for i, res := range results {
+				if !used[i] && res.Step == step.Name {
+					found = i
+					break
+				}
+			}
+			if found < 0 {
+				c.Status = report.Skipped
+				if results == nil {
+					c.Message = "stage did not run"
+				} else {
+					c.Message = "step did not run"
+				}
+				suite.Cases = append(suite.Cases, c)
+				continue
+			}
+			used[found] = true
+
+			res := results[found]
+			c.Duration = res.Duration
+			c.Output = res.Output
+			if suite.Timestamp.IsZero() || res.Timestamp.Before(suite.Timestamp) {
+				suite.Timestamp = res.Timestamp
+			}
+			suite.Duration += res.Duration
+
+			switch {
+			case res.Skipped:
+				c.Status, c.Message = report.Skipped, "condition not met"
+			case res.Success && res.Reused:
+				c.Status, c.Message = report.Passed, "reused from an earlier run"
+			case res.Success && res.Cached:
+				c.Status, c.Message = report.Passed, "restored from the step cache"
+			case res.Success:
+				c.Status = report.Passed
+			case step.allowsFailure():
+				c.Status, c.Message = report.Warning, res.Error
+			default:
+				c.Status, c.Message = report.Failed, res.Error
+				c.Details = fmt.Sprintf("exit code %d after %d attempt(s)", res.ExitCode, len(res.Attempts))
+			}
+			suite.Cases = append(suite.Cases, c)
+		}
+		if suite.Timestamp.IsZero() {
+			suite.Timestamp = result.StartTime
+		}
+	}
+
+	return rep
+}
+
+// progressOutput returns where a run prints its progress: stderr when
+// ROCK_OUTPUT selects a report format, so the report is alone on stdout
+func progressOutput() io.Writer {
+	if report.IsFormat(os.Getenv("ROCK_OUTPUT")) {
+		return os.Stderr
+	}
+	return os.Stdout
+}
+
+// writeReport writes the run's report to the --report file, if one was
+// requested, and to stdout when ROCK_OUTPUT selects a report format.
+// Notes go to out.
+func writeReport(pipeline *Pipeline, result *PipelineResult, opts runOptions, out io.Writer) {
+	output := os.Getenv("ROCK_OUTPUT")
+	if opts.report == "" && !report.IsFormat(output) {
+		return
+	}
+
+	rep := pipelineReport(pipeline, result)
+	if opts.report != "" {
+		if err := report.WriteFile(opts.report, rep); err != nil {
+			fmt.Fprintf(os.Stderr, "⚠️  %v\n", err)
+		} else {
+			fmt.Fprintf(out, "   Report: %s\n", opts.report)
+		}
+	}
+	if report.IsFormat(output) {
+		if err := report.Write(os.Stdout, output, rep); err != nil {
+			fmt.Fprintf(os.Stderr, "⚠️  %v\n", err)
+		}
+	}
+}
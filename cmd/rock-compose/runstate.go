@@ -0,0 +1,361 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultRunsDir holds one directory per run, relative to the working directory
+const DefaultRunsDir = ".rock-runs"
+
+// Step status values in the run state
+const (
+	StepSucceeded = "succeeded"
+	StepFailed    = "failed"
+	StepReused    = "reused"    // Carried over from an earlier run without executing
+	StepSkipped   = "skipped"   // Condition not met
+	StepCancelled = "cancelled" // Stopped by SIGINT or SIGTERM
+)
+
+// RunState is the persisted record of a run, used to resume it
+type RunState struct {
+	ID        string                `json:"id"`
+	Pipeline  string                `json:"pipeline"`
+	Source    string                `json:"source"` // Pipeline file or built-in name
+	Status    string                `json:"status"` // running, succeeded or failed
+	StartTime time.Time             `json:"start_time"`
+	UpdatedAt time.Time             `json:"updated_at"`
+	Steps     map[string]*StepState `json:"steps"` // Keyed by stepKey
+}
+
+// StepState is the persisted record of one step
+type StepState struct {
+	Stage       string            `json:"stage"`
+	Step        string            `json:"step"`
+	Status      string            `json:"status"`
+	Fingerprint string            `json:"fingerprint,omitempty"` // Hash of args, env and referenced files
+	Outputs     map[string]string `json:"outputs,omitempty"`
+	Artifacts   []Artifact        `json:"artifacts,omitempty"`
+	FinishedAt  time.Time         `json:"finished_at"`
+}
+
+// getRunsDir returns the directory holding run state
+func getRunsDir() string {
+	if dir := os.Getenv("ROCK_RUNS_DIR"); dir != "" {
+		return dir
+	}
+	return DefaultRunsDir
+}
+
+// newRunID returns a sortable, unique run ID
+func newRunID() string {
+	suffix := make([]byte, 3)
+	rand.Read(suffix)
+	return time.Now().Format("20060102-150405") + "-" + hex.EncodeToString(suffix)
+}
+
+// newRunState starts the state for a new run
+func newRunState(pipeline *Pipeline, source string) *RunState {
+	now := time.Now()
+	return &RunState{
+		ID:        newRunID(),
+		Pipeline:  pipeline.Name,
+		Source:    source,
+		Status:    "running",
+		StartTime: now,
+		UpdatedAt: now,
+		Steps:     make(map[string]*StepState),
+	}
+}
+
+// runDir returns the directory of a run
+func runDir(id string) string {
+	return filepath.Join(getRunsDir(), id)
+}
+
+// loadRunState reads the state of a run
+func loadRunState(id string) (*RunState, error) {
+	data, err := os.ReadFile(filepath.Join(runDir(id), "state.json"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read run %s: %w", id, err)
+	}
+	var state RunState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("invalid state for run %s: %v", id, err)
+	}
+	if state.Steps == nil {
+		state.Steps = make(map[string]*StepState)
+	}
+	return &state, nil
+}
+
+// latestRunState returns the most recent run of a pipeline, or nil
+func latestRunState(pipeline string) *RunState {
+	entries, err := os.ReadDir(getRunsDir())
+	if err != nil {
+		return nil
+	}
+
+	var latest *RunState
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		state, err := loadRunState(entry.Name())
+		if err != nil || state.Pipeline != pipeline {
+			continue
+		}
+		if latest == nil || state.StartTime.After(latest.StartTime) {
+			latest = state
+		}
+	}
+	return latest
+}
+
+// save writes the state atomically
+func (s *RunState) save() error {
+	dir := runDir(s.ID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create run directory: %w", err)
+	}
+
+	s.UpdatedAt = time.Now()
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(dir, "state.json.tmp")
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write run state: %w", err)
+	}
+	return os.Rename(tmp, filepath.Join(dir, "state.json"))
+}
+
+// stepKey identifies a step within a run
+func stepKey(stage string, step Step) string {
+	return stage + "/" + stepID(step)
+}
+
+// fingerprint hashes what determines a step's result: the program and
+// arguments, the variables defined by the pipeline, and the contents of
+// files and directories named in the step's arguments or env
+func fingerprint(spec *commandSpec, step Step, scope *Scope) (string, error) {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "path=%s\ndir=%s\n", spec.path, spec.dir)
+	for _, arg := range spec.args {
+		fmt.Fprintf(hash, "arg=%s\n", arg)
+	}
+
+	defined, err := scope.Defined()
+	if err != nil {
+		return "", err
+	}
+	for _, env := range defined {
+		fmt.Fprintf(hash, "env=%s\n", env)
+	}
+
+	values := append([]string{}, spec.args...)
+	for name := range step.Environment {
+		value, _, err := scope.Lookup(name)
+		if err != nil {
+			return "", err
+		}
+		values = append(values, value)
+	}
+	for _, path := range referencedPaths(values, spec.dir) {
+		fmt.Fprintf(hash, "file=%s\n", path)
+		if err := hashPath(hash, path); err != nil {
+			return "", err
+		}
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// fingerprint returns the step's fingerprint, or "" after warning if it
+// cannot be computed; a step without one is never reused
+func (r *runner) fingerprint(spec *commandSpec, step Step, scope *Scope, say func(string, ...interface{})) string {
+	inputs, err := fingerprint(spec, step, scope)
+	if err != nil {
+		say("⚠️  Fingerprint: %v; the step will not be reused when resuming", err)
+		return ""
+	}
+	return inputs
+}
+
+// referencedPaths returns the existing files and directories named by
+// values, including the value part of --flag=value arguments
+func referencedPaths(values []string, dir string) []string {
+	seen := make(map[string]bool)
+	var paths []string
+	for _, value := range values {
+		candidates := []string{value}
+		if _, after, ok := strings.Cut(value, "="); ok {
+			candidates = append(candidates, after)
+		}
+		for _, candidate := range candidates {
+			if candidate == "" || strings.ContainsAny(candidate, "\n") {
+				continue
+			}
+			path := candidate
+			if !filepath.IsAbs(path) && dir != "" {
+				path = filepath.Join(dir, path)
+			}
+			path = filepath.Clean(path)
+			if path == "/" || path == "." || seen[path] {
+				continue
+			}
+			if _, err := os.Stat(path); err == nil {
+				seen[path] = true
+				paths = append(paths, path)
+			}
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// hashPath adds a file's contents, or a directory's listing, to hash
+func hashPath(hash io.Writer, path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	if !info.IsDir() {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		_, err = io.Copy(hash, file)
+		return err
+	}
+
+	// Directories are fingerprinted by metadata; hashing every file of a
+	// rootfs on every check would cost more than rerunning most steps.
+	// Every entry counts, so that no change goes unnoticed.
+	return filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(hash, "%s %o %d %d\n", p, info.Mode(), info.Size(), info.ModTime().UnixNano())
+		return nil
+	})
+}
+
+// Hook "stages" are recorded in the run state but always run again
+const (
+	hookOnSuccess = "on_success"
+	hookOnFailure = "on_failure"
+	hookFinally   = "finally"
+)
+
+// isHook reports whether a stage name is one of the hook lists
+func isHook(stage string) bool {
+	return stage == hookOnSuccess || stage == hookOnFailure || stage == hookFinally
+}
+
+// resumed returns a copy of a run's state to continue recording into
+func (s *RunState) resumed() *RunState {
+	state := *s
+	state.Status = "running"
+	state.Steps = make(map[string]*StepState, len(s.Steps))
+	for key, step := range s.Steps {
+		state.Steps[key] = step
+	}
+	return &state
+}
+
+// reusable returns the earlier result of a step if the step does not need
+// to run again. When resuming, that is when it succeeded with the same
+// fingerprint and its artifacts are intact. With --from, steps of stages
+// upstream of the starting stage are reused whenever they succeeded. In
+// watch mode, steps of stages whose sources changed always run.
+func (r *runner) reusable(stage string, step Step, fingerprint string) *StepState {
+	if r.previous == nil || isHook(stage) || r.rerun[stage] {
+		return nil
+	}
+	prev := r.previous.Steps[stepKey(stage, step)]
+	if prev == nil || (prev.Status != StepSucceeded && prev.Status != StepReused) {
+		return nil
+	}
+	if r.from != nil {
+		if r.from[stage] {
+			return nil
+		}
+		return prev
+	}
+	if prev.Fingerprint == "" || prev.Fingerprint != fingerprint {
+		return nil
+	}
+	for _, artifact := range prev.Artifacts {
+		if current, err := hashArtifact(artifact.Path); err != nil || current.SHA256 != artifact.SHA256 {
+			return nil
+		}
+	}
+	return prev
+}
+
+// recordStep saves the outcome of a step to the run state
+func (r *runner) recordStep(stage string, step Step, status, fingerprint string, result ExecutionResult) {
+	r.saveStep(stepKey(stage, step), &StepState{
+		Stage:       stage,
+		Step:        step.Name,
+		Status:      status,
+		Fingerprint: fingerprint,
+		Outputs:     result.Outputs,
+		Artifacts:   result.Artifacts,
+		FinishedAt:  time.Now(),
+	})
+}
+
+// reuseStep records that a step's earlier result was reused
+func (r *runner) reuseStep(stage string, step Step, prev *StepState) {
+	reused := *prev
+	reused.Status = StepReused
+	r.saveStep(stepKey(stage, step), &reused)
+}
+
+// saveStep stores one step's state and writes the run state
+func (r *runner) saveStep(key string, step *StepState) {
+	if r.state == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.state.Steps[key] = step
+	if err := r.state.save(); err != nil {
+		fmt.Fprintf(r.out, "     ⚠️  %v\n", err)
+	}
+}
+
+// finishRun records the final status of the run
+func (r *runner) finishRun(status string) {
+	if r.state == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.state.Status = status
+	if err := r.state.save(); err != nil {
+		fmt.Fprintf(r.out, "⚠️  %v\n", err)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFingerprint(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "rootfs.tar")
+	if err := os.WriteFile(input, []byte("v1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	scope := newScope(&Scope{vars: map[string]string{"HOME": "/root"}, literal: true},
+		map[string]string{"MODE": "release"})
+	step := Step{Tool: "rock-image", Args: []string{"--input=" + input}}
+	spec := &commandSpec{path: "/bin/rock-image", args: step.Args}
+
+	first, err := fingerprint(spec, step, scope)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The process environment does not affect the fingerprint
+	scope.parent.vars["HOME"] = "/home/rock"
+	if got, _ := fingerprint(spec, step, scope); got != first {
+		t.Error("fingerprint changed with the process environment")
+	}
+
+	// Referenced files and pipeline variables do
+	if err := os.WriteFile(input, []byte("v2"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	second, _ := fingerprint(spec, step, scope)
+	if second == first {
+		t.Error("fingerprint did not change with a referenced file")
+	}
+	scope.vars["MODE"] = "debug"
+	if got, _ := fingerprint(spec, step, scope); got == second {
+		t.Error("fingerprint did not change with a pipeline variable")
+	}
+}
+
+func TestDownstream(t *testing.T) {
+	stages := []Stage{
+		{Name: "build"},
+		{Name: "docs"},
+		{Name: "image", DependsOn: []string{"build"}},
+		{Name: "verify", DependsOn: []string{"image"}},
+	}
+	got := downstream(stages, "image")
+	if len(got) != 2 || !got["image"] || !got["verify"] {
+		t.Errorf("downstream(image) = %v", got)
+	}
+}
+
+func TestFingerprintLargeDirectory(t *testing.T) {
+	// A change anywhere in a large tree changes the fingerprint
+	dir := t.TempDir()
+	for i := 0; i < 10050; i++ {
+		if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("%05d", i)), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	step := Step{Tool: "rock-image", Args: []string{dir}}
+	spec := &commandSpec{path: "/bin/rock-image", args: step.Args}
+	scope := newScope(nil, nil)
+
+	first, err := fingerprint(spec, step, scope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "10049"), []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := fingerprint(spec, step, scope); got == first {
+		t.Error("fingerprint did not change with the last entry of the directory")
+	}
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rock-os/tools/pkg/cache"
+)
+
+// stageState tracks a stage through a run
+type stageState int
+
+const (
+	statePending stageState = iota
+	stateRunning
+	stateSucceeded
+	stateFailed
+	stateSkipped   // Condition not met, or a dependency was skipped
+	stateCancelled // A dependency failed
+)
+
+// stageDone reports a finished stage back to the scheduler
+type stageDone struct {
+	stage   Stage
+	results []ExecutionResult
+}
+
+// stageGraph returns the effective dependencies of every stage. Once any
+// stage declares depends_on, even an empty list, stages wait for exactly
+// the stages they declare and the others may start immediately. A
+// pipeline without any dependencies runs in file order, each stage waiting
+// for the one before it; instances of one matrix stage do not wait for
+// each other but all wait for the stage before the first.
+func stageGraph(stages []Stage) map[string][]string {
+	graph := make(map[string][]string, len(stages))
+	declared := declaresDependencies(stages)
+	for i, stage := range stages {
+		if declared {
+			graph[stage.Name] = stage.DependsOn
+			continue
+		}
+		previous := i - 1
+		for stage.origin != "" && previous >= 0 && stages[previous].origin == stage.origin {
+			previous--
+		}
+		if previous >= 0 {
+			graph[stage.Name] = []string{stages[previous].Name}
+		} else {
+			graph[stage.Name] = nil
+		}
+	}
+	return graph
+}
+
+// declaresDependencies reports whether any stage lists depends_on
+func declaresDependencies(stages []Stage) bool {
+	for _, stage := range stages {
+		if stage.DependsOn != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// downstream returns from and every stage that depends on it, directly or
+// indirectly
+func downstream(stages []Stage, from string) map[string]bool {
+	graph := stageGraph(stages)
+	selected := map[string]bool{from: true}
+	for changed := true; changed; {
+		changed = false
+		for _, stage := range stages {
+			if selected[stage.Name] {
+				continue
+			}
+			for _, dep := range graph[stage.Name] {
+				if selected[dep] {
+					selected[stage.Name] = true
+					changed = true
+					break
+				}
+			}
+		}
+	}
+	return selected
+}
+
+// stageLevels groups stages so that every stage's dependencies are in an
+// earlier level. Stages in the same level may run concurrently.
+func stageLevels(stages []Stage) ([][]string, error) {
+	graph := stageGraph(stages)
+	level := make(map[string]int, len(stages))
+	var levels [][]string
+
+	for placed := 0; placed < len(stages); {
+		var current []string
+		for _, stage := range stages {
+			if _, ok := level[stage.Name]; ok {
+				continue
+			}
+			ready := true
+			for _, dep := range graph[stage.Name] {
+				if l, ok := level[dep]; !ok || l == len(levels) {
+					ready = false
+					break
+				}
+			}
+			if ready {
+				current = append(current, stage.Name)
+			}
+		}
+		if len(current) == 0 {
+			return levels, fmt.Errorf("stages cannot be ordered: circular or unknown dependencies")
+		}
+		for _, name := range current {
+			level[name] = len(levels)
+		}
+		levels = append(levels, current)
+		placed += len(current)
+	}
+	return levels, nil
+}
+
+// stageOutcome reports whether a stage failed, and whether it passed only
+// because failing steps were allowed to fail with a warning
+func stageOutcome(stage Stage, results []ExecutionResult) (failed, warned bool) {
+	for i, stepResult := range results {
+		if stepResult.Success {
+			continue
+		}
+		if stage.Steps[i].allowsFailure() {
+			warned = warned || stage.Steps[i].ContinueOn == ContinueOnWarning
+			continue
+		}
+		return true, warned
+	}
+	return false, warned
+}
+
+// runner executes a pipeline's stages
+type runner struct {
+	pipeline    *Pipeline
+	scope       *Scope // Pipeline variables over the process environment
+	tools       *ToolResolver
+	jobs        int    // Maximum number of stages running at once
+	failedStage string // First stage that failed, for on_failure hooks
+
+	state    *RunState       // Persisted progress of this run
+	previous *RunState       // Earlier run whose results may be reused
+	from     map[string]bool // With --from: the stages that must run again
+	rerun    map[string]bool // In watch mode: stages whose sources changed
+	store    *cache.Store    // Step cache; nil when caching is off
+	events   *eventLog       // Event stream of the run; nil discards events
+	out      io.Writer       // Progress output
+
+	mu      sync.Mutex
+	outputs map[string]map[string]string // Step ID -> outputs
+	status  map[string]string            // Step ID -> how it finished, for conditions
+
+	// Cancellation on SIGINT/SIGTERM; see cancel.go
+	stop       context.Context         // Done when the run is cancelled
+	cancel     context.CancelCauseFunc // Cancels stop
+	hookStop   context.Context         // Done when hooks must stop too
+	hookCancel context.CancelCauseFunc // Cancels hookStop
+	kill       chan struct{}           // Closed to kill steps without a grace period
+	grace      time.Duration           // Time steps get between SIGTERM and SIGKILL
+}
+
+// newRunner prepares a pipeline for execution
+func newRunner(pipeline *Pipeline, jobs int) *runner {
+	r := &runner{
+		pipeline: pipeline,
+		jobs:     jobs,
+		out:      os.Stdout,
+		outputs:  make(map[string]map[string]string),
+		status:   make(map[string]string),
+	}
+	r.scope = pipelineScope(pipeline, r.lookupOutput)
+	r.tools = newToolResolver(pipeline, r.scope)
+	r.initCancellation(defaultGracePeriod)
+	return r
+}
+
+// runStages runs every stage as soon as its dependencies have succeeded,
+// with at most r.jobs stages in flight. A failed stage cancels only the
+// stages downstream of it. It returns false if any stage failed.
+func (r *runner) runStages(result *PipelineResult) bool {
+	stages := r.pipeline.Stages
+	graph := stageGraph(stages)
+	states := make(map[string]stageState, len(stages))
+	done := make(chan stageDone)
+	running := 0
+	success := true
+
+	for {
+		// Resolve pending stages until nothing changes: cancelling or
+		// skipping a stage can unblock decisions about its dependents
+		for changed := true; changed; {
+			changed = false
+			for _, stage := range stages {
+				if states[stage.Name] != statePending {
+					continue
+				}
+
+				blocked := false
+				var failedDep, skippedDep string
+				for _, dep := range graph[stage.Name] {
+					switch states[dep] {
+					case statePending, stateRunning:
+						blocked = true
+					case stateFailed, stateCancelled:
+						failedDep = dep
+					case stateSkipped:
+						skippedDep = dep
+					}
+				}
+
+				switch {
+				case r.cancelled():
+					fmt.Fprintf(r.out, "⏭️  Cancelling stage %s: run cancelled\n", stage.Name)
+					r.events.emit(Event{Type: EventStageFinished, Stage: stage.Name, Status: "cancelled"})
+					states[stage.Name] = stateCancelled
+					success = false
+					changed = true
+				case failedDep != "":
+					fmt.Fprintf(r.out, "⏭️  Cancelling stage %s: dependency %s failed\n", stage.Name, failedDep)
+					r.events.emit(Event{Type: EventStageFinished, Stage: stage.Name, Status: "cancelled"})
+					states[stage.Name] = stateCancelled
+					success = false
+					changed = true
+				case blocked || running >= r.jobs:
+					continue
+				case skippedDep != "":
+					fmt.Fprintf(r.out, "⚠️  Skipping stage %s: dependency %s was skipped\n", stage.Name, skippedDep)
+					r.events.emit(Event{Type: EventStageFinished, Stage: stage.Name, Status: "skipped"})
+					states[stage.Name] = stateSkipped
+					changed = true
+				default:
+					met, err := r.stageConditionMet(stage)
+					switch {
+					case err != nil:
+						fmt.Fprintf(r.out, "❌ Stage %s: condition %q: %v\n", stage.Name, stage.Condition, err)
+						r.events.emit(Event{Type: EventStageFinished, Stage: stage.Name, Status: StepFailed, Error: err.Error()})
+						if r.failedStage == "" {
+							r.failedStage = stage.Name
+						}
+						states[stage.Name] = stateFailed
+						success = false
+						changed = true
+					case !met:
+						fmt.Fprintf(r.out, "⚠️  Skipping stage %s: condition not met\n", stage.Name)
+						r.events.emit(Event{Type: EventStageFinished, Stage: stage.Name, Status: "skipped"})
+						states[stage.Name] = stateSkipped
+						changed = true
+					default:
+						states[stage.Name] = stateRunning
+						running++
+						go func(stage Stage) {
+							done <- stageDone{stage: stage, results: r.runStage(stage)}
+						}(stage)
+					}
+				}
+			}
+		}
+
+		if running == 0 {
+			break
+		}
+
+		finished := <-done
+		running--
+		stage := finished.stage
+		result.StageResults[stage.Name] = finished.results
+
+		failed, warned := stageOutcome(stage, finished.results)
+		cancelled := failed && r.cancelled()
+		status := StepSucceeded
+		switch {
+		case cancelled:
+			status = StepCancelled
+		case failed:
+			status = StepFailed
+		}
+		r.events.emit(Event{Type: EventStageFinished, Stage: stage.Name, Status: status})
+		switch {
+		case cancelled:
+			fmt.Fprintf(r.out, "🛑 Stage %s cancelled\n", stage.Name)
+			states[stage.Name] = stateCancelled
+			success = false
+		case failed:
+			fmt.Fprintf(r.out, "❌ Stage %s failed\n", stage.Name)
+			if r.failedStage == "" {
+				r.failedStage = stage.Name
+			}
+			states[stage.Name] = stateFailed
+			success = false
+		case warned:
+			fmt.Fprintf(r.out, "⚠️  Stage %s completed with warnings\n", stage.Name)
+			states[stage.Name] = stateSucceeded
+		default:
+			fmt.Fprintf(r.out, "✅ Stage %s completed\n", stage.Name)
+			states[stage.Name] = stateSucceeded
+		}
+	}
+
+	// runPipeline rejects unknown and circular dependencies, so nothing
+	// should be left waiting; if something is, the run did not complete
+	for _, stage := range stages {
+		if states[stage.Name] == statePending {
+			fmt.Fprintf(r.out, "❌ Stage %s never ran: dependencies not met\n", stage.Name)
+			success = false
+		}
+	}
+
+	return success
+}
+
+// runStage executes the steps of one stage
+func (r *runner) runStage(stage Stage) []ExecutionResult {
+	fmt.Fprintf(r.out, "\n📦 Stage: %s\n", stage.Name)
+	fmt.Fprintln(r.out, "-"+strings.Repeat("-", 40))
+	r.events.emit(Event{Type: EventStageStarted, Stage: stage.Name})
+
+	scope := r.stageScope(stage)
+	if stage.Parallel {
+		// Execute steps in parallel
+		return r.executeParallelSteps(stage.Name, stage.Steps, scope)
+	}
+	// Execute steps sequentially
+	return r.executeSequentialSteps(stage.Name, stage.Steps, scope)
+}
+
+// stageScope layers a stage's variables over the pipeline's
+func (r *runner) stageScope(stage Stage) *Scope {
+	return newScope(r.scope, stage.Variables)
+}
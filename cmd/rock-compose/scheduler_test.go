@@ -0,0 +1,161 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestStageLevels(t *testing.T) {
+	tests := []struct {
+		name   string
+		stages []Stage
+		want   [][]string
+		err    bool
+	}{
+		{
+			"file order",
+			[]Stage{{Name: "a"}, {Name: "b"}, {Name: "c"}},
+			[][]string{{"a"}, {"b"}, {"c"}},
+			false,
+		},
+		{
+			// Matrix instances wait for the stage before the first, not
+			// for each other
+			"file order with matrix",
+			[]Stage{{Name: "a"}, {Name: "b-x", origin: "b"}, {Name: "b-y", origin: "b"}, {Name: "c"}},
+			[][]string{{"a"}, {"b-x", "b-y"}, {"c"}},
+			false,
+		},
+		{
+			// Once dependencies are declared, stages without any are roots
+			"two roots",
+			[]Stage{{Name: "a"}, {Name: "b"}, {Name: "c", DependsOn: []string{"a", "b"}}},
+			[][]string{{"a", "b"}, {"c"}},
+			false,
+		},
+		{
+			"mixed",
+			[]Stage{
+				{Name: "prepare"},
+				{Name: "build"},
+				{Name: "docs", DependsOn: []string{"prepare"}},
+				{Name: "image", DependsOn: []string{"build"}},
+				{Name: "verify", DependsOn: []string{"image"}},
+			},
+			[][]string{{"prepare", "build"}, {"docs", "image"}, {"verify"}},
+			false,
+		},
+		{
+			// An explicit empty list declares that a stage has no
+			// dependencies
+			"empty depends_on",
+			[]Stage{{Name: "a"}, {Name: "b", DependsOn: []string{}}},
+			[][]string{{"a", "b"}},
+			false,
+		},
+		{
+			"later dependency",
+			[]Stage{{Name: "image", DependsOn: []string{"build"}}, {Name: "build"}},
+			[][]string{{"build"}, {"image"}},
+			false,
+		},
+		{
+			"cycle",
+			[]Stage{{Name: "a", DependsOn: []string{"b"}}, {Name: "b", DependsOn: []string{"a"}}},
+			nil,
+			true,
+		},
+		{
+			"unknown dependency",
+			[]Stage{{Name: "a"}, {Name: "b", DependsOn: []string{"missing"}}},
+			[][]string{{"a"}},
+			true,
+		},
+	}
+	for _, tt := range tests {
+		levels, err := stageLevels(tt.stages)
+		if (err != nil) != tt.err || !reflect.DeepEqual(levels, tt.want) {
+			t.Errorf("%s: stageLevels = %v, %v; want %v (error %v)", tt.name, levels, err, tt.want, tt.err)
+		}
+		if issues := checkDependencies(&Pipeline{Stages: tt.stages}); (len(issues) > 0) != tt.err {
+			t.Errorf("%s: checkDependencies = %v", tt.name, issues)
+		}
+	}
+}
+
+func TestRunStagesJobs(t *testing.T) {
+	// b and c both depend only on a; the log shows whether they overlapped
+	stages := func(log string) []Stage {
+		step := func(name string) []Step {
+			return []Step{{Name: name, Shell: "sh",
+				Command: "echo start " + name + " >> " + log + "; sleep 0.3; echo end " + name + " >> " + log}}
+		}
+		return []Stage{
+			{Name: "a", Steps: step("a")},
+			{Name: "b", DependsOn: []string{"a"}, Steps: step("b")},
+			{Name: "c", DependsOn: []string{"a"}, Steps: step("c")},
+			{Name: "d", DependsOn: []string{"b", "c"}, Steps: step("d")},
+		}
+	}
+
+	for _, tt := range []struct {
+		jobs       int
+		overlapped bool
+	}{
+		{1, false},
+		{2, true},
+	} {
+		log := filepath.Join(t.TempDir(), "log")
+		r := newRunner(&Pipeline{Name: "jobs", Stages: stages(log)}, tt.jobs)
+		result := &PipelineResult{StageResults: make(map[string][]ExecutionResult)}
+		if !r.runStages(result) {
+			t.Fatalf("--jobs=%d: run failed: %+v", tt.jobs, result.StageResults)
+		}
+
+		data, err := os.ReadFile(log)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+		if len(lines) != 8 || lines[0] != "start a" || lines[1] != "end a" || lines[6] != "start d" {
+			t.Fatalf("--jobs=%d: log %q", tt.jobs, lines)
+		}
+		// With one job the middle stages run one after the other
+		overlapped := strings.HasPrefix(lines[3], "start")
+		if overlapped != tt.overlapped {
+			t.Errorf("--jobs=%d: middle stages %q, overlapped=%v", tt.jobs, lines[2:6], overlapped)
+		}
+	}
+}
+
+func TestRunStagesFailure(t *testing.T) {
+	// A failed stage cancels its dependents, not independent stages
+	dir := t.TempDir()
+	marker := func(name string) Step {
+		return Step{Name: name, Shell: "sh", Command: "touch " + filepath.Join(dir, name)}
+	}
+	pipeline := &Pipeline{Name: "failure", Stages: []Stage{
+		{Name: "a", Steps: []Step{marker("a")}},
+		{Name: "broken", DependsOn: []string{"a"}, Steps: []Step{{Name: "fail", Shell: "sh", Command: "exit 1"}}},
+		{Name: "after", DependsOn: []string{"broken"}, Steps: []Step{marker("after")}},
+		{Name: "other", DependsOn: []string{"a"}, Steps: []Step{marker("other")}},
+	}}
+	r := newRunner(pipeline, 2)
+	result := &PipelineResult{StageResults: make(map[string][]ExecutionResult)}
+	if r.runStages(result) {
+		t.Fatal("run succeeded with a failing stage")
+	}
+	if r.failedStage != "broken" {
+		t.Errorf("failed stage = %q, want broken", r.failedStage)
+	}
+	for name, want := range map[string]bool{"a": true, "after": false, "other": true} {
+		if _, err := os.Stat(filepath.Join(dir, name)); (err == nil) != want {
+			t.Errorf("stage %s ran = %v, want %v", name, err == nil, want)
+		}
+	}
+}
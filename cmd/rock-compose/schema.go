@@ -0,0 +1,222 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// pipelineSchemaJSON is the published JSON Schema of pipeline files,
+// printed by `rock-compose schema`
+//
+//go:embed pipeline.schema.json
+var pipelineSchemaJSON []byte
+
+// schema is the subset of JSON Schema (draft-07) that pipeline.schema.json
+// uses: type, properties, additionalProperties, required, items, enum,
+// minimum and local $refs
+type schema struct {
+	Ref                  string             `json:"$ref"`
+	Type                 schemaTypes        `json:"type"`
+	Properties           map[string]*schema `json:"properties"`
+	AdditionalProperties *schemaOrBool      `json:"additionalProperties"`
+	Required             []string           `json:"required"`
+	Items                *schema            `json:"items"`
+	Enum                 []interface{}      `json:"enum"`
+	Minimum              *float64           `json:"minimum"`
+	Definitions          map[string]*schema `json:"definitions"`
+}
+
+// schemaTypes is "type": a single name or a list of names
+type schemaTypes []string
+
+func (t *schemaTypes) UnmarshalJSON(data []byte) error {
+	var one string
+	if err := json.Unmarshal(data, &one); err == nil {
+		*t = schemaTypes{one}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(t))
+}
+
+// schemaOrBool is "additionalProperties": false, or a schema for them
+type schemaOrBool struct {
+	allowed bool
+	schema  *schema
+}
+
+func (s *schemaOrBool) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &s.allowed); err == nil {
+		return nil
+	}
+	s.allowed = true
+	return json.Unmarshal(data, &s.schema)
+}
+
+// loadPipelineSchema decodes the embedded schema
+func loadPipelineSchema() (*schema, error) {
+	var s schema
+	if err := json.Unmarshal(pipelineSchemaJSON, &s); err != nil {
+		return nil, fmt.Errorf("invalid pipeline schema: %w", err)
+	}
+	return &s, nil
+}
+
+// schemaChecker validates a YAML (or JSON) document against a schema,
+// reporting issues at the line and column of the offending node
+type schemaChecker struct {
+	root   *schema
+	file   string
+	issues []Issue
+}
+
+// check validates node against s; path names the node in messages
+func (c *schemaChecker) check(node *yaml.Node, s *schema, path string) {
+	for node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+	if node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	s = c.resolve(s)
+
+	if len(s.Type) > 0 && !matchesType(node, s.Type) {
+		c.report(node, "%s: expected %s, got %s", where(path), strings.Join(s.Type, " or "), nodeType(node))
+		return
+	}
+	if len(s.Enum) > 0 && !matchesEnum(node, s.Enum) {
+		values := make([]string, len(s.Enum))
+		for i, v := range s.Enum {
+			values[i] = fmt.Sprint(v)
+		}
+		c.report(node, "%s: %q is not one of %s", where(path), node.Value, strings.Join(values, ", "))
+		return
+	}
+	if s.Minimum != nil && node.Kind == yaml.ScalarNode {
+		if value, err := strconv.ParseFloat(node.Value, 64); err == nil && value < *s.Minimum {
+			c.report(node, "%s: %s is less than %v", where(path), node.Value, *s.Minimum)
+		}
+	}
+
+	switch node.Kind {
+	case yaml.MappingNode:
+		present := make(map[string]bool)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			present[key.Value] = true
+			child := joinPath(path, key.Value)
+			if prop, ok := s.Properties[key.Value]; ok {
+				c.check(value, prop, child)
+				continue
+			}
+			switch {
+			case s.AdditionalProperties == nil:
+			case !s.AdditionalProperties.allowed:
+				c.report(key, "%s: unknown field %q", where(path), key.Value)
+			case s.AdditionalProperties.schema != nil:
+				c.check(value, s.AdditionalProperties.schema, child)
+			}
+		}
+		for _, name := range s.Required {
+			if !present[name] {
+				c.report(node, "%s: missing required field %q", where(path), name)
+			}
+		}
+
+	case yaml.SequenceNode:
+		if s.Items != nil {
+			for i, item := range node.Content {
+				c.check(item, s.Items, fmt.Sprintf("%s[%d]", path, i))
+			}
+		}
+	}
+}
+
+// resolve follows $ref to a definition in the root schema
+func (c *schemaChecker) resolve(s *schema) *schema {
+	for s.Ref != "" {
+		name := strings.TrimPrefix(s.Ref, "#/definitions/")
+		def, ok := c.root.Definitions[name]
+		if !ok {
+			// The embedded schema is fixed; a bad $ref is a bug in it
+			panic(fmt.Sprintf("pipeline schema: unknown $ref %s", s.Ref))
+		}
+		s = def
+	}
+	return s
+}
+
+// report records an issue at node
+func (c *schemaChecker) report(node *yaml.Node, format string, args ...interface{}) {
+	c.issues = append(c.issues, Issue{
+		Pos:     Position{File: c.file, Line: node.Line, Column: node.Column},
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// joinPath extends a path like stages[0] with a field name
+func joinPath(path, field string) string {
+	if path == "" {
+		return field
+	}
+	return path + "." + field
+}
+
+// where names a path in messages
+func where(path string) string {
+	if path == "" {
+		return "pipeline"
+	}
+	return path
+}
+
+// nodeType returns the JSON Schema type name of a node
+func nodeType(node *yaml.Node) string {
+	switch node.Kind {
+	case yaml.MappingNode:
+		return "object"
+	case yaml.SequenceNode:
+		return "array"
+	}
+	switch node.ShortTag() {
+	case "!!str":
+		return "string"
+	case "!!int":
+		return "integer"
+	case "!!float":
+		return "number"
+	case "!!bool":
+		return "boolean"
+	case "!!null":
+		return "null"
+	}
+	return node.ShortTag()
+}
+
+// matchesType reports whether a node is one of the given types
+func matchesType(node *yaml.Node, types []string) bool {
+	actual := nodeType(node)
+	for _, t := range types {
+		if t == actual || (t == "number" && actual == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesEnum reports whether a scalar node equals one of the values
+func matchesEnum(node *yaml.Node, values []interface{}) bool {
+	if node.Kind != yaml.ScalarNode {
+		return false
+	}
+	for _, v := range values {
+		if fmt.Sprint(v) == node.Value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,563 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Pipelines are expanded as they are loaded, so run, validate and dry-run
+// all work on the same flat list of stages:
+//
+//	include:  other pipeline files are merged in first
+//	template: the stage is a copy of a template from templates:, with
+//	          ${params.<name>} replaced by the stage's with: values
+//	matrix:   the stage becomes one stage per combination of values, with
+//	          ${matrix.<axis>} replaced and each axis set as a variable
+
+// MatrixAxis is one dimension of a matrix
+type MatrixAxis struct {
+	Name   string
+	Values []string
+}
+
+// Matrix lists its axes in the order they are written; instances are
+// generated with the last axis varying fastest
+type Matrix []MatrixAxis
+
+// matrixValue is the value of one axis in an expanded stage
+type matrixValue struct {
+	axis, value string
+}
+
+// UnmarshalJSON decodes {"axis": [values...]} keeping the axis order
+func (m *Matrix) UnmarshalJSON(data []byte) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	if tok, err := decoder.Token(); err != nil || tok != json.Delim('{') {
+		return fmt.Errorf("matrix must be an object of axis: [values]")
+	}
+	*m = nil
+	for decoder.More() {
+		tok, err := decoder.Token()
+		if err != nil {
+			return err
+		}
+		axis := MatrixAxis{Name: tok.(string)}
+		if err := decoder.Decode(&axis.Values); err != nil {
+			return fmt.Errorf("matrix axis %s: %v", axis.Name, err)
+		}
+		*m = append(*m, axis)
+	}
+	_, err := decoder.Token()
+	return err
+}
+
+// MarshalJSON encodes the matrix as an object in axis order
+func (m Matrix) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, axis := range m {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		name, _ := json.Marshal(axis.Name)
+		values, err := json.Marshal(axis.Values)
+		if err != nil {
+			return nil, err
+		}
+		b.Write(name)
+		b.WriteByte(':')
+		b.Write(values)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+// UnmarshalYAML decodes a mapping of axis: [values...] keeping the axis order
+func (m *Matrix) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind != yaml.MappingNode {
+		return fmt.Errorf("line %d: matrix must be a mapping of axis: [values]", node.Line)
+	}
+	*m = nil
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		axis := MatrixAxis{Name: node.Content[i].Value}
+		if err := node.Content[i+1].Decode(&axis.Values); err != nil {
+			return fmt.Errorf("matrix axis %s: %v", axis.Name, err)
+		}
+		*m = append(*m, axis)
+	}
+	return nil
+}
+
+// parsePipelineFile reads a pipeline file without expanding it
+func parsePipelineFile(path string) (*Pipeline, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch filepath.Ext(path) {
+	case ".yaml", ".yml":
+		return parseYAMLPipeline(data)
+	}
+	return parseJSONPipeline(data)
+}
+
+// includePipelines merges the files listed in include: into pipeline.
+// Paths are relative to dir. seen holds the files being included, to catch
+// cycles. Later definitions win: the including pipeline's variables and
+// templates override included ones, and its stages replace included stages
+// of the same name.
+func includePipelines(pipeline *Pipeline, dir string, seen map[string]bool) error {
+	if len(pipeline.Include) == 0 {
+		return nil
+	}
+
+	merged := &Pipeline{}
+	for _, include := range pipeline.Include {
+		path := include
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return fmt.Errorf("include %s: %v", include, err)
+		}
+		if seen[abs] {
+			return fmt.Errorf("include %s: include cycle", include)
+		}
+
+		included, err := parsePipelineFile(path)
+		if err != nil {
+			return fmt.Errorf("include %s: %v", include, err)
+		}
+		seen[abs] = true
+		err = includePipelines(included, filepath.Dir(path), seen)
+		delete(seen, abs)
+		if err != nil {
+			return fmt.Errorf("include %s: %v", include, err)
+		}
+		mergePipeline(merged, included)
+	}
+	mergePipeline(merged, pipeline)
+
+	merged.Include = pipeline.Include
+	*pipeline = *merged
+	return nil
+}
+
+// mergePipeline adds src to dst, src taking precedence
+func mergePipeline(dst, src *Pipeline) {
+	if src.Name != "" {
+		dst.Name = src.Name
+	}
+	if src.Version != "" {
+		dst.Version = src.Version
+	}
+	if src.Description != "" {
+		dst.Description = src.Description
+	}
+
+	for key, value := range src.Variables {
+		if dst.Variables == nil {
+			dst.Variables = make(map[string]string)
+		}
+		dst.Variables[key] = value
+	}
+	for name, template := range src.Templates {
+		if dst.Templates == nil {
+			dst.Templates = make(map[string]StageTemplate)
+		}
+		dst.Templates[name] = template
+	}
+	for key, value := range src.Settings {
+		if dst.Settings == nil {
+			dst.Settings = make(map[string]interface{})
+		}
+		dst.Settings[key] = value
+	}
+
+Stages:
+	for _, stage := range src.Stages {
+		for i := range dst.Stages {
+			if dst.Stages[i].Name == stage.Name {
+				dst.Stages[i] = stage
+				continue Stages
+			}
+		}
+		dst.Stages = append(dst.Stages, stage)
+	}
+	dst.OnSuccess = append(dst.OnSuccess, src.OnSuccess...)
+	dst.OnFailure = append(dst.OnFailure, src.OnFailure...)
+	dst.Finally = append(dst.Finally, src.Finally...)
+}
+
+// expandStages instantiates templates and expands matrix stages.
+// Dependencies on a matrix stage become dependencies on its instances: the
+// one with the same values for the axes both stages share, or all of them.
+// References to the outputs of an instance's steps follow the same match,
+// when it is a single instance.
+func expandStages(pipeline *Pipeline) error {
+	var stages []Stage
+	var origins []string // Matrix stages, in order
+	instances := make(map[string][]Stage)
+
+	for _, stage := range pipeline.Stages {
+		if stage.Template != "" {
+			template, ok := pipeline.Templates[stage.Template]
+			if !ok {
+				return fmt.Errorf("stage %s: unknown template %s", stage.Name, stage.Template)
+			}
+			var err error
+			if stage, err = instantiate(stage, template); err != nil {
+				return fmt.Errorf("stage %s: %v", stage.Name, err)
+			}
+		}
+
+		if len(stage.Matrix) == 0 {
+			stages = append(stages, stage)
+			continue
+		}
+		expanded, err := expandMatrix(stage)
+		if err != nil {
+			return fmt.Errorf("stage %s: %v", stage.Name, err)
+		}
+		origins = append(origins, stage.Name)
+		instances[stage.Name] = expanded
+		stages = append(stages, expanded...)
+	}
+
+	for i := range stages {
+		if stages[i].DependsOn == nil {
+			continue
+		}
+		deps := []string{}
+		for _, dep := range stages[i].DependsOn {
+			expanded, ok := instances[dep]
+			if !ok {
+				deps = append(deps, dep)
+				continue
+			}
+			matching := matchingInstances(stages[i], expanded)
+			if len(matching) == 0 {
+				matching = expanded
+			}
+			for _, instance := range matching {
+				deps = append(deps, instance.Name)
+			}
+		}
+		stages[i].DependsOn = deps
+	}
+
+	for i := range stages {
+		var replacements []string
+		for _, origin := range origins {
+			if origin == stages[i].origin {
+				continue // renameOutputSteps handled the stage's own steps
+			}
+			if matching := matchingInstances(stages[i], instances[origin]); len(matching) == 1 {
+				replacements = append(replacements, outputRenames(matching[0])...)
+			}
+		}
+		if len(replacements) > 0 {
+			stages[i] = mapStage(stages[i], strings.NewReplacer(replacements...).Replace)
+		}
+	}
+
+	pipeline.Stages = stages
+	return nil
+}
+
+// instantiate builds a stage from a template. Fields set on the stage
+// override the template's; variables are merged.
+func instantiate(stage Stage, template StageTemplate) (Stage, error) {
+	if template.Template != "" {
+		return stage, fmt.Errorf("template %s uses another template", stage.Template)
+	}
+	if len(stage.Steps) > 0 {
+		return stage, fmt.Errorf("has both steps and a template")
+	}
+
+	params := make(map[string]string, len(template.Params))
+	for name, value := range template.Params {
+		params[name] = value
+	}
+	for name, value := range stage.With {
+		if _, ok := template.Params[name]; !ok {
+			return stage, fmt.Errorf("template %s has no parameter %s", stage.Template, name)
+		}
+		params[name] = value
+	}
+
+	instance := template.Stage
+	instance.Name = stage.Name
+	instance.Template = stage.Template
+	instance.With = stage.With
+	instance.Parallel = instance.Parallel || stage.Parallel
+	if stage.Description != "" {
+		instance.Description = stage.Description
+	}
+	if stage.DependsOn != nil {
+		instance.DependsOn = stage.DependsOn
+	}
+	if stage.Condition != "" {
+		instance.Condition = stage.Condition
+	}
+	if len(stage.Matrix) > 0 {
+		instance.Matrix = stage.Matrix
+	}
+	if len(stage.Variables) > 0 {
+		instance.Variables = make(map[string]string)
+		for key, value := range template.Variables {
+			instance.Variables[key] = value
+		}
+		for key, value := range stage.Variables {
+			instance.Variables[key] = value
+		}
+	}
+
+	// A flat template's step is named after the stage using it
+	instance.Steps = append([]Step(nil), instance.Steps...)
+	for i := range instance.Steps {
+		if instance.Steps[i].Name == "" {
+			instance.Steps[i].Name = stage.Name
+		}
+	}
+
+	return substituteStage(instance, "params", params)
+}
+
+// expandMatrix returns one stage per combination of matrix values. An
+// instance is named after the stage and its values, unless the stage name
+// uses ${matrix.<axis>} itself. Steps with outputs get the same suffix on
+// their ID, so instances do not collide.
+func expandMatrix(stage Stage) ([]Stage, error) {
+	combinations := [][]matrixValue{nil}
+	for _, axis := range stage.Matrix {
+		if len(axis.Values) == 0 {
+			return nil, fmt.Errorf("matrix axis %s has no values", axis.Name)
+		}
+		var next [][]matrixValue
+		for _, combination := range combinations {
+			for _, value := range axis.Values {
+				extended := append(append([]matrixValue(nil), combination...), matrixValue{axis.Name, value})
+				next = append(next, extended)
+			}
+		}
+		combinations = next
+	}
+
+	var stages []Stage
+	names := make(map[string]bool)
+	for _, combination := range combinations {
+		values := make(map[string]string, len(combination))
+		for _, v := range combination {
+			values[v.axis] = v.value
+		}
+		suffix := matrixSuffix(combination)
+
+		instance, err := substituteStage(stage, "matrix", values)
+		if err != nil {
+			return nil, err
+		}
+		if instance.Name == stage.Name {
+			instance.Name = stage.Name + "-" + suffix
+		}
+		if names[instance.Name] {
+			return nil, fmt.Errorf("matrix produces stage %s more than once", instance.Name)
+		}
+		names[instance.Name] = true
+
+		instance.Matrix = nil
+		instance.instance = combination
+		instance.origin = stage.Name
+		variables := instance.Variables
+		instance.Variables = make(map[string]string)
+		for key, value := range variables {
+			instance.Variables[key] = value
+		}
+		for _, v := range combination {
+			instance.Variables[v.axis] = v.value
+		}
+
+		stages = append(stages, renameOutputSteps(instance, "-"+suffix))
+	}
+	return stages, nil
+}
+
+// renameOutputSteps appends suffix to the ID of every step with outputs,
+// and to references to them within the stage
+func renameOutputSteps(stage Stage, suffix string) Stage {
+	var replacements []string
+	for i := range stage.Steps {
+		step := &stage.Steps[i]
+		if len(step.Outputs) == 0 {
+			continue
+		}
+		id := stepID(*step)
+		step.ID = id + suffix
+		replacements = append(replacements, "steps."+id+".", "steps."+step.ID+".")
+	}
+	if len(replacements) == 0 {
+		return stage
+	}
+
+	replacer := strings.NewReplacer(replacements...)
+	for i := range stage.Steps {
+		stage.Steps[i] = mapStep(stage.Steps[i], replacer.Replace)
+	}
+	return stage
+}
+
+// matrixSuffix joins the values of a matrix combination, as appended to
+// instance names and output step IDs
+func matrixSuffix(combination []matrixValue) string {
+	parts := make([]string, len(combination))
+	for i, v := range combination {
+		parts[i] = v.value
+	}
+	return strings.Join(parts, "-")
+}
+
+// outputRenames returns old and new "steps.<id>." prefixes, for a
+// strings.Replacer, of the steps renameOutputSteps renamed in an instance
+func outputRenames(instance Stage) []string {
+	suffix := "-" + matrixSuffix(instance.instance)
+	var renames []string
+	for _, step := range instance.Steps {
+		if len(step.Outputs) > 0 && strings.HasSuffix(step.ID, suffix) {
+			renames = append(renames, "steps."+strings.TrimSuffix(step.ID, suffix)+".", "steps."+step.ID+".")
+		}
+	}
+	return renames
+}
+
+// matchingInstances returns the instances of a matrix stage whose values
+// agree with stage's on every axis they share, or nil if they share none
+func matchingInstances(stage Stage, instances []Stage) []Stage {
+	values := make(map[string]string)
+	for _, v := range stage.instance {
+		values[v.axis] = v.value
+	}
+
+	var matching []Stage
+	shared := false
+	for _, instance := range instances {
+		match := true
+		for _, v := range instance.instance {
+			if value, ok := values[v.axis]; ok {
+				shared = true
+				match = match && value == v.value
+			}
+		}
+		if match {
+			matching = append(matching, instance)
+		}
+	}
+	if !shared {
+		return nil
+	}
+	return matching
+}
+
+// substituteStage replaces ${<kind>.<name>} throughout a stage. A reference
+// to a name missing from values is an error.
+func substituteStage(stage Stage, kind string, values map[string]string) (Stage, error) {
+	pattern := regexp.MustCompile(`\$\{` + kind + `\.([A-Za-z0-9_.-]+)\}`)
+	var missing []string
+	replace := func(s string) string {
+		return pattern.ReplaceAllStringFunc(s, func(ref string) string {
+			name := pattern.FindStringSubmatch(ref)[1]
+			value, ok := values[name]
+			if !ok {
+				missing = append(missing, ref)
+				return ref
+			}
+			return value
+		})
+	}
+
+	stage = mapStage(stage, replace)
+	if len(missing) > 0 {
+		return stage, fmt.Errorf("undefined %s %s", strings.TrimSuffix(kind, "s"), strings.Join(unique(missing), ", "))
+	}
+	return stage, nil
+}
+
+// mapStage returns a copy of stage with f applied to every string a user
+// can write in it
+func mapStage(stage Stage, f func(string) string) Stage {
+	stage.Name = f(stage.Name)
+	stage.Description = f(stage.Description)
+	stage.Condition = f(stage.Condition)
+	stage.DependsOn = mapStrings(stage.DependsOn, f)
+	stage.Variables = mapValues(stage.Variables, f)
+	stage.With = mapValues(stage.With, f)
+
+	steps := make([]Step, len(stage.Steps))
+	for i, step := range stage.Steps {
+		steps[i] = mapStep(step, f)
+	}
+	if stage.Steps != nil {
+		stage.Steps = steps
+	}
+	return stage
+}
+
+// mapStep returns a copy of step with f applied to its strings
+func mapStep(step Step, f func(string) string) Step {
+	step.Name = f(step.Name)
+	step.ID = f(step.ID)
+	step.Tool = f(step.Tool)
+	step.Command = f(step.Command)
+	step.WorkDir = f(step.WorkDir)
+	step.Host = f(step.Host)
+	step.Condition = f(step.Condition)
+	step.Args = mapStrings(step.Args, f)
+	step.Environment = mapValues(step.Environment, f)
+	step.Outputs = mapValues(step.Outputs, f)
+	step.Artifacts = mapStrings(step.Artifacts, f)
+	step.Inputs = mapStrings(step.Inputs, f)
+	return step
+}
+
+func mapStrings(list []string, f func(string) string) []string {
+	if list == nil {
+		return nil
+	}
+	mapped := make([]string, len(list))
+	for i, s := range list {
+		mapped[i] = f(s)
+	}
+	return mapped
+}
+
+func mapValues(m map[string]string, f func(string) string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	mapped := make(map[string]string, len(m))
+	for key, value := range m {
+		mapped[key] = f(value)
+	}
+	return mapped
+}
+
+// unique returns list without repeated entries, keeping the first
+func unique(list []string) []string {
+	seen := make(map[string]bool)
+	var result []string
+	for _, s := range list {
+		if !seen[s] {
+			seen[s] = true
+			result = append(result, s)
+		}
+	}
+	return result
+}
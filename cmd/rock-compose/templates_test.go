@@ -0,0 +1,117 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestExpandStages(t *testing.T) {
+	pipeline, err := parseYAMLPipeline([]byte(`
+name: matrix
+templates:
+  image:
+    params: {mode: debug, out: image.cpio.gz}
+    steps:
+      - name: create
+        tool: rock-image
+        args: [create, "--mode=${params.mode}", "${params.out}"]
+        outputs: {path: image.path}
+      - name: verify
+        tool: rock-verify
+        args: [integration, "${steps.create.outputs.path}"]
+stages:
+  - name: prepare
+    command: mkdir -p out
+  - name: build
+    command: make ${matrix.platform}
+    depends_on: [prepare]
+    variables:
+      TARGET: ${matrix.platform}-linux
+    matrix:
+      platform: [qemu, vultr]
+  - name: image
+    template: image
+    depends_on: [build]
+    matrix:
+      platform: [qemu, vultr]
+      mode: [debug, production]
+    with:
+      mode: ${matrix.mode}
+      out: ${matrix.platform}.cpio.gz
+  - name: boot
+    depends_on: [image]
+    matrix:
+      platform: [qemu, vultr]
+      mode: [debug, production]
+    tool: rock-verify
+    args: [boot, "${steps.create.outputs.path}"]
+  - name: publish
+    depends_on: [image]
+    command: publish
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := expandStages(pipeline); err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	stages := make(map[string]Stage)
+	for _, stage := range pipeline.Stages {
+		names = append(names, stage.Name)
+		stages[stage.Name] = stage
+	}
+	want := "prepare build-qemu build-vultr image-qemu-debug image-qemu-production image-vultr-debug image-vultr-production boot-qemu-debug boot-qemu-production boot-vultr-debug boot-vultr-production publish"
+	if got := strings.Join(names, " "); got != want {
+		t.Fatalf("stages = %s\nwant %s", got, want)
+	}
+
+	image := stages["image-vultr-production"]
+	if got := strings.Join(image.DependsOn, ","); got != "build-vultr" {
+		t.Errorf("image-vultr-production depends on %s, want build-vultr", got)
+	}
+	if image.Variables["platform"] != "vultr" || image.Variables["mode"] != "production" {
+		t.Errorf("matrix variables = %v", image.Variables)
+	}
+	if got := strings.Join(image.Steps[0].Args, " "); got != "create --mode=production vultr.cpio.gz" {
+		t.Errorf("create args = %s", got)
+	}
+	if image.Steps[0].ID != "create-vultr-production" || image.Steps[1].Args[1] != "${steps.create-vultr-production.outputs.path}" {
+		t.Errorf("output step not renamed: id %s, ref %s", image.Steps[0].ID, image.Steps[1].Args[1])
+	}
+	// A dependent instance refers to the outputs of the matching instance
+	if got := stages["boot-qemu-production"].Steps[0].Args[1]; got != "${steps.create-qemu-production.outputs.path}" {
+		t.Errorf("boot-qemu-production refers to %s", got)
+	}
+	if got := len(stages["publish"].DependsOn); got != 4 {
+		t.Errorf("publish depends on %d stages, want 4", got)
+	}
+	if got := stages["build-vultr"].Variables["TARGET"]; got != "vultr-linux" {
+		t.Errorf("build-vultr TARGET = %q, want vultr-linux", got)
+	}
+
+	// Instances of one stage run side by side
+	levels, err := stageLevels(pipeline.Stages)
+	if err != nil || len(levels) < 2 || strings.Join(levels[1], " ") != "build-qemu build-vultr" {
+		t.Errorf("levels = %v, %v; want build instances together after prepare", levels, err)
+	}
+
+	if issues := validatePipeline(pipeline); len(issues) > 0 {
+		t.Errorf("expanded pipeline has issues: %v", issues)
+	}
+}
+
+func TestMatrixOrder(t *testing.T) {
+	var m Matrix
+	if err := m.UnmarshalJSON([]byte(`{"platform": ["qemu", "vultr"], "mode": ["debug"]}`)); err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != 2 || m[0].Name != "platform" || m[1].Name != "mode" || len(m[0].Values) != 2 {
+		t.Errorf("matrix = %+v", m)
+	}
+	data, err := m.MarshalJSON()
+	if err != nil || string(data) != `{"platform":["qemu","vultr"],"mode":["debug"]}` {
+		t.Errorf("MarshalJSON = %s, %v", data, err)
+	}
+}
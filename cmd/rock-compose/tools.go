@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// ToolResolver finds rock-* tool binaries. Directories are searched in
+// order: the pipeline's tools_dir setting, ROCK_TOOLS_DIR, bin/$GOOS, and
+// finally $PATH.
+type ToolResolver struct {
+	dirs []string
+}
+
+// newToolResolver builds the search path for a pipeline; tools_dir may
+// reference pipeline variables
+func newToolResolver(pipeline *Pipeline, scope *Scope) *ToolResolver {
+	r := &ToolResolver{}
+	if dir, ok := pipeline.Settings["tools_dir"].(string); ok && dir != "" {
+		if expanded, err := scope.Expand(dir); err == nil {
+			dir = expanded
+		}
+		r.dirs = append(r.dirs, dir)
+	}
+	if dir := os.Getenv("ROCK_TOOLS_DIR"); dir != "" {
+		r.dirs = append(r.dirs, dir)
+	}
+	r.dirs = append(r.dirs, filepath.Join("bin", runtime.GOOS))
+	return r
+}
+
+// normalizeToolName returns the binary name for a tool, so "build" and
+// "rock-build" both resolve to rock-build
+func normalizeToolName(tool string) string {
+	if strings.HasPrefix(tool, "rock-") {
+		return tool
+	}
+	return "rock-" + tool
+}
+
+// isShellTool reports whether a tool name means "run command in a shell"
+func isShellTool(tool string) bool {
+	return tool == "bash" || tool == "sh"
+}
+
+// Resolve returns the path of the binary for a tool
+func (r *ToolResolver) Resolve(tool string) (string, error) {
+	name := normalizeToolName(tool)
+
+	for _, dir := range r.dirs {
+		path := filepath.Join(dir, name)
+		if info, err := os.Stat(path); err == nil && !info.IsDir() && info.Mode()&0111 != 0 {
+			return path, nil
+		}
+	}
+
+	if path, err := exec.LookPath(name); err == nil {
+		return path, nil
+	}
+
+	return "", fmt.Errorf("tool %s not found in %s or $PATH", name, strings.Join(r.dirs, ", "))
+}
+
+// prepareSteps normalizes shell steps: a bash or sh tool runs its command
+// as a script in that shell
+func prepareSteps(pipeline *Pipeline) error {
+	prepare := func(steps []Step) error {
+		for i := range steps {
+			step := &steps[i]
+			if !isShellTool(step.Tool) {
+				continue
+			}
+			if len(step.Args) > 0 {
+				return fmt.Errorf("step %s: %s steps take a script in command, not args", step.Name, step.Tool)
+			}
+			step.Shell = step.Tool
+			step.Tool = ""
+		}
+		return nil
+	}
+
+	for _, stage := range pipeline.Stages {
+		if err := prepare(stage.Steps); err != nil {
+			return fmt.Errorf("stage %s: %v", stage.Name, err)
+		}
+	}
+	if err := prepare(pipeline.OnSuccess); err != nil {
+		return fmt.Errorf("on_success: %v", err)
+	}
+	if err := prepare(pipeline.OnFailure); err != nil {
+		return fmt.Errorf("on_failure: %v", err)
+	}
+	if err := prepare(pipeline.Finally); err != nil {
+		return fmt.Errorf("finally: %v", err)
+	}
+	return nil
+}
+
+// unresolvedTools returns an issue for every local tool step whose binary
+// cannot be found. Remote steps find their tools on their hosts.
+func unresolvedTools(pipeline *Pipeline, tools *ToolResolver) []Issue {
+	var issues []Issue
+	check := func(stage string, steps []Step) {
+		for _, step := range steps {
+			if step.Tool == "" || step.Host != "" {
+				continue
+			}
+			if _, err := tools.Resolve(step.Tool); err != nil {
+				issues = append(issues, Issue{Stage: stage, Step: step.Name,
+					Message: fmt.Sprintf("%s: %v", stepWhere(stage, step.Name), err)})
+			}
+		}
+	}
+
+	for _, stage := range pipeline.Stages {
+		check(stage.Name, stage.Steps)
+	}
+	check(hookOnSuccess, pipeline.OnSuccess)
+	check(hookOnFailure, pipeline.OnFailure)
+	check(hookFinally, pipeline.Finally)
+	return issues
+}
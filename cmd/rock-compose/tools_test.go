@@ -0,0 +1,94 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestToolResolverOrder(t *testing.T) {
+	dir := t.TempDir()
+	install := func(sub string, tools ...string) string {
+		path := filepath.Join(dir, sub)
+		if err := os.MkdirAll(path, 0755); err != nil {
+			t.Fatal(err)
+		}
+		for _, tool := range tools {
+			if err := os.WriteFile(filepath.Join(path, tool), []byte("#!/bin/sh\n"), 0755); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return path
+	}
+	settings := install("settings", "rock-build")
+	env := install("env", "rock-build", "rock-image")
+	install(filepath.Join("bin", runtime.GOOS), "rock-build", "rock-image", "rock-deps")
+	path := install("path", "rock-build", "rock-image", "rock-deps", "rock-kernel")
+	// Not executable, so it is skipped
+	if err := os.WriteFile(filepath.Join(settings, "rock-image"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(cwd)
+	t.Setenv("ROCK_TOOLS_DIR", env)
+	t.Setenv("PATH", path)
+
+	pipeline := &Pipeline{Settings: map[string]interface{}{"tools_dir": "${TOOLS}"}}
+	scope := newScope(&Scope{vars: map[string]string{}, literal: true}, map[string]string{"TOOLS": settings})
+	tools := newToolResolver(pipeline, scope)
+
+	for _, test := range []struct {
+		tool, want string
+	}{
+		{"rock-build", filepath.Join(settings, "rock-build")},
+		{"build", filepath.Join(settings, "rock-build")},
+		{"image", filepath.Join(env, "rock-image")},
+		{"rock-deps", filepath.Join("bin", runtime.GOOS, "rock-deps")},
+		{"kernel", filepath.Join(path, "rock-kernel")},
+	} {
+		got, err := tools.Resolve(test.tool)
+		if err != nil || got != test.want {
+			t.Errorf("Resolve(%s) = %q, %v; want %q", test.tool, got, err, test.want)
+		}
+	}
+
+	if _, err := tools.Resolve("verify"); err == nil || !strings.Contains(err.Error(), "tool rock-verify not found") {
+		t.Errorf("Resolve(verify) error = %v", err)
+	}
+}
+
+func TestPrepareShellSteps(t *testing.T) {
+	pipeline := &Pipeline{
+		Stages: []Stage{{Name: "a", Steps: []Step{
+			{Name: "script", Tool: "bash", Command: "echo hi"},
+			{Name: "tool", Tool: "rock-build"},
+		}}},
+		Finally: []Step{{Name: "cleanup", Tool: "sh", Command: "rm -rf out"}},
+	}
+	if err := prepareSteps(pipeline); err != nil {
+		t.Fatal(err)
+	}
+	if step := pipeline.Stages[0].Steps[0]; step.Shell != "bash" || step.Tool != "" {
+		t.Errorf("bash step = %+v", step)
+	}
+	if step := pipeline.Stages[0].Steps[1]; step.Shell != "" || step.Tool != "rock-build" {
+		t.Errorf("tool step = %+v", step)
+	}
+	if step := pipeline.Finally[0]; step.Shell != "sh" {
+		t.Errorf("finally step = %+v", step)
+	}
+
+	pipeline = &Pipeline{Stages: []Stage{{Name: "a", Steps: []Step{{Name: "s", Tool: "sh", Args: []string{"x"}}}}}}
+	if err := prepareSteps(pipeline); err == nil || !strings.Contains(err.Error(), "take a script in command") {
+		t.Errorf("sh step with args: error %v", err)
+	}
+}
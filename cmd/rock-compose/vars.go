@@ -0,0 +1,435 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Scope is one layer of variables. Lookups fall back to the parent, so the
+// chain for a step is: step env -> stage variables -> pipeline variables ->
+// process environment.
+type Scope struct {
+	vars    map[string]string
+	parent  *Scope
+	literal bool                             // Values are used as is (the process environment)
+	dynamic func(name string) (string, bool) // Computed lookups instead of vars (step outputs)
+}
+
+// varRef identifies a variable definition, for cycle detection
+type varRef struct {
+	name  string
+	scope *Scope
+}
+
+// newScope creates a scope whose values may reference outer scopes
+func newScope(parent *Scope, vars map[string]string) *Scope {
+	s := &Scope{vars: make(map[string]string, len(vars)), parent: parent}
+	for key, value := range vars {
+		s.vars[key] = value
+	}
+	return s
+}
+
+// environScope returns the process environment as the outermost scope
+func environScope() *Scope {
+	s := &Scope{vars: make(map[string]string), literal: true}
+	for _, env := range os.Environ() {
+		if key, value, ok := strings.Cut(env, "="); ok {
+			s.vars[key] = value
+		}
+	}
+	return s
+}
+
+// pipelineScope returns the scope holding a pipeline's variables. Step
+// outputs resolve through outputs and sit between the pipeline variables
+// and the process environment.
+func pipelineScope(pipeline *Pipeline, outputs func(id, key string) (string, bool)) *Scope {
+	return newScope(outputsScope(environScope(), outputs), pipeline.Variables)
+}
+
+// lookup finds the innermost definition of name
+func (s *Scope) lookup(name string) (string, *Scope, bool) {
+	for cur := s; cur != nil; cur = cur.parent {
+		if cur.dynamic != nil {
+			if value, ok := cur.dynamic(name); ok {
+				return value, cur, true
+			}
+			continue
+		}
+		if value, ok := cur.vars[name]; ok {
+			return value, cur, true
+		}
+	}
+	return "", nil, false
+}
+
+// Expand substitutes variable references in str:
+//
+//	${VAR}          value of VAR; an error if VAR is undefined
+//	${VAR:-default} value of VAR, or default if VAR is unset or empty
+//	${VAR:?message} value of VAR, or an error with message if unset or empty
+//	$VAR            value of VAR; left as is if undefined, for the shell
+//	$$              a literal $
+//
+// ${steps.<id>.outputs.<key>} refers to an output of a step that has run.
+//
+// Values are expanded recursively in the scope that defines them, so a
+// variable may reference one defined later or in an outer scope. A variable
+// that references itself (PATH: ${PATH}:/opt/bin) sees the outer value.
+func (s *Scope) Expand(str string) (string, error) {
+	return expand(str, s, "", nil)
+}
+
+// Lookup returns the expanded value of name
+func (s *Scope) Lookup(name string) (string, bool, error) {
+	return resolve(name, s, "", nil)
+}
+
+// Environ returns every variable visible from s as sorted KEY=value pairs,
+// suitable for exec.Cmd.Env. Variables defined in s itself must resolve;
+// those of outer scopes that do not resolve yet, such as one referring to
+// the output of a step that has not run, are left out.
+func (s *Scope) Environ() ([]string, error) {
+	return s.pairs(func(*Scope) bool { return true })
+}
+
+// Defined is like Environ but leaves out the process environment and step
+// outputs, so it holds only what the pipeline itself defines
+func (s *Scope) Defined() ([]string, error) {
+	return s.pairs(func(cur *Scope) bool { return !cur.literal && cur.dynamic == nil })
+}
+
+// pairs returns the variables of the scopes in the chain from s that
+// include selects, as sorted KEY=value pairs
+func (s *Scope) pairs(include func(*Scope) bool) ([]string, error) {
+	own := make(map[string]bool) // Whether a name is defined in s itself
+	for cur := s; cur != nil; cur = cur.parent {
+		if !include(cur) {
+			continue
+		}
+		for name := range cur.vars {
+			if _, ok := own[name]; !ok {
+				own[name] = cur == s
+			}
+		}
+	}
+
+	sorted := make([]string, 0, len(own))
+	for name := range own {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	pairs := make([]string, 0, len(sorted))
+	for _, name := range sorted {
+		value, _, err := s.Lookup(name)
+		if err != nil {
+			if own[name] {
+				return nil, err
+			}
+			continue
+		}
+		pairs = append(pairs, name+"="+value)
+	}
+	return pairs, nil
+}
+
+// expandOutputs substitutes the ${steps.<id>.outputs.<key>} references in
+// a shell script and leaves every other $ to the shell
+func expandOutputs(script string, scope *Scope) (string, error) {
+	var b strings.Builder
+	for {
+		i := strings.Index(script, "${steps.")
+		if i < 0 {
+			b.WriteString(script)
+			return b.String(), nil
+		}
+		end := closingBrace(script, i+1)
+		if end < 0 {
+			return "", fmt.Errorf("unterminated ${ in %q", script)
+		}
+		value, err := expandReference(script[i+2:end], scope, "", nil)
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(script[:i])
+		b.WriteString(value)
+		script = script[end+1:]
+	}
+}
+
+// expand expands str in scope. self is the variable whose value str is;
+// references to it resolve in the parent scope.
+func expand(str string, scope *Scope, self string, stack []varRef) (string, error) {
+	if !strings.Contains(str, "$") {
+		return str, nil
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(str); {
+		if str[i] != '$' || i+1 == len(str) {
+			b.WriteByte(str[i])
+			i++
+			continue
+		}
+
+		switch next := str[i+1]; {
+		case next == '$':
+			b.WriteByte('$')
+			i += 2
+
+		case next == '{':
+			end := closingBrace(str, i+1)
+			if end < 0 {
+				return "", fmt.Errorf("unterminated ${ in %q", str)
+			}
+			value, err := expandReference(str[i+2:end], scope, self, stack)
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(value)
+			i = end + 1
+
+		case isNameStart(next):
+			end := i + 1
+			for end < len(str) && isNameChar(str[end]) {
+				end++
+			}
+			name := str[i+1 : end]
+			value, ok, err := resolve(name, scope, self, stack)
+			if err != nil {
+				return "", err
+			}
+			if ok {
+				b.WriteString(value)
+			} else {
+				b.WriteString(str[i:end])
+			}
+			i = end
+
+		default:
+			b.WriteByte('$')
+			i++
+		}
+	}
+	return b.String(), nil
+}
+
+// expandReference expands the inside of a ${...} reference
+func expandReference(ref string, scope *Scope, self string, stack []varRef) (string, error) {
+	name, op, arg := ref, "", ""
+	if i := strings.IndexByte(ref, ':'); i >= 0 {
+		name = ref[:i]
+		if len(ref) < i+2 || (ref[i+1] != '-' && ref[i+1] != '?') {
+			return "", fmt.Errorf("bad substitution ${%s}", ref)
+		}
+		op, arg = ref[i:i+2], ref[i+2:]
+	}
+	if !validVarName(name) {
+		return "", fmt.Errorf("bad substitution ${%s}", ref)
+	}
+
+	value, ok, err := resolve(name, scope, self, stack)
+	if err != nil {
+		return "", err
+	}
+
+	switch op {
+	case ":-":
+		if !ok || value == "" {
+			return expand(arg, scope, self, stack)
+		}
+	case ":?":
+		if !ok || value == "" {
+			message, err := expand(arg, scope, self, stack)
+			if err != nil {
+				return "", err
+			}
+			if message == "" {
+				message = "not set"
+			}
+			return "", fmt.Errorf("%s: %s", name, message)
+		}
+	default:
+		if !ok {
+			return "", fmt.Errorf("undefined variable %s", name)
+		}
+	}
+	return value, nil
+}
+
+// resolve looks up name and expands its value where it is defined
+func resolve(name string, scope *Scope, self string, stack []varRef) (string, bool, error) {
+	from := scope
+	if name == self && scope != nil {
+		from = scope.parent
+	}
+
+	value, def, ok := from.lookup(name)
+	if !ok {
+		return "", false, nil
+	}
+	if def.literal {
+		return value, true, nil
+	}
+
+	ref := varRef{name, def}
+	for i, seen := range stack {
+		if seen == ref {
+			var cycle []string
+			for _, r := range stack[i:] {
+				cycle = append(cycle, r.name)
+			}
+			return "", true, fmt.Errorf("variable cycle: %s -> %s", strings.Join(cycle, " -> "), name)
+		}
+	}
+
+	expanded, err := expand(value, def, name, append(stack, ref))
+	return expanded, true, err
+}
+
+// closingBrace returns the index of the } matching the { at open,
+// allowing nested ${...} in defaults
+func closingBrace(str string, open int) int {
+	depth := 0
+	for i := open; i < len(str); i++ {
+		switch str[i] {
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// validVarName reports whether name can be referenced as ${name}
+func validVarName(name string) bool {
+	if name == "" || !isNameStart(name[0]) {
+		return false
+	}
+	for i := 1; i < len(name); i++ {
+		if !isNameChar(name[i]) && name[i] != '.' && name[i] != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+func isNameStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isNameChar(c byte) bool {
+	return isNameStart(c) || (c >= '0' && c <= '9')
+}
+
+// checkVariables expands every string the runner will expand and reports
+// references that cannot be resolved. Shell scripts are left to the shell,
+// apart from their step output references. A step's references to outputs
+// must be to steps that finish before it starts.
+func checkVariables(pipeline *Pipeline) []Issue {
+	// ready, while a stage's step is checked, reports whether the outputs
+	// of step id are available to it; late is set to a step referenced
+	// too early
+	var ready func(id string) bool
+	var late string
+	declared := declaredOutputs(pipeline)
+	outputs := func(id, key string) (string, bool) {
+		value, ok := declared(id, key)
+		if ok && ready != nil && !ready(id) {
+			late = id
+			return "", false
+		}
+		return value, ok
+	}
+
+	var issues []Issue
+	seen := make(map[string]bool)
+	report := func(issue Issue, where string, err error) {
+		if late != "" {
+			err = fmt.Errorf("%v: step %s does not run before it", err, late)
+		}
+		issue.Message = fmt.Sprintf("%s: %v", where, err)
+		if !seen[issue.Message] {
+			seen[issue.Message] = true
+			issues = append(issues, issue)
+		}
+	}
+
+	// checkDefinitions expands each variable defined in scope
+	checkDefinitions := func(issue Issue, where string, scope *Scope) {
+		names := make([]string, 0, len(scope.vars))
+		for name := range scope.vars {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			late = ""
+			if _, _, err := scope.Lookup(name); err != nil {
+				issue.Variable = name
+				report(issue, where+" "+name, err)
+			}
+		}
+	}
+
+	// checkSteps checks steps in scope; finished, unless nil, reports
+	// whether step id has finished when the step at index starts
+	checkSteps := func(stage string, scope *Scope, steps []Step, finished func(id string, index int) bool) {
+		for i, step := range steps {
+			ready = nil
+			if finished != nil {
+				i := i
+				ready = func(id string) bool { return finished(id, i) }
+			}
+			stepScope := newScope(scope, step.Environment)
+			issue := Issue{Stage: stage, Step: step.Name}
+			checkDefinitions(issue, stepWhere(stage, step.Name)+" env", stepScope)
+
+			fields := []string{step.WorkDir}
+			if step.Shell == "" {
+				fields = append(fields, step.Command)
+			} else {
+				late = ""
+				if _, err := expandOutputs(step.Command, stepScope); err != nil {
+					report(issue, stepWhere(stage, step.Name), err)
+				}
+			}
+			fields = append(fields, step.Args...)
+			for _, field := range fields {
+				late = ""
+				if _, err := stepScope.Expand(field); err != nil {
+					report(issue, stepWhere(stage, step.Name), err)
+				}
+			}
+		}
+		ready = nil
+	}
+
+	finished := stepsFinished(pipeline)
+	scope := pipelineScope(pipeline, outputs)
+	checkDefinitions(Issue{}, "Variable", scope)
+	for _, stage := range pipeline.Stages {
+		stage := stage
+		stageScope := newScope(scope, stage.Variables)
+		checkDefinitions(Issue{Stage: stage.Name}, "Stage "+stage.Name+" variable", stageScope)
+		checkSteps(stage.Name, stageScope, stage.Steps, func(id string, index int) bool { return finished(id, stage, index) })
+	}
+	checkSteps(hookOnSuccess, hookScope(scope, StepSucceeded, ""), pipeline.OnSuccess, nil)
+	checkSteps(hookOnFailure, hookScope(scope, StepFailed, "<stage>"), pipeline.OnFailure, nil)
+	checkSteps(hookFinally, hookScope(scope, StepFailed, "<stage>"), pipeline.Finally, nil)
+
+	return issues
+}
+
+// hookScope adds the variables available to hooks: how the run ended
+// (succeeded, failed or cancelled) and the first stage that failed
+func hookScope(scope *Scope, status, failedStage string) *Scope {
+	return newScope(scope, map[string]string{"PIPELINE_STATUS": status, "FAILED_STAGE": failedStage})
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestScopeExpand(t *testing.T) {
+	base := &Scope{vars: map[string]string{"HOME": "/root", "PATH": "/bin"}, literal: true}
+	pipeline := newScope(base, map[string]string{
+		"OUT":   "${BASE}/out", // defined before BASE
+		"BASE":  "/tmp/rock",
+		"MODE":  "${BUILD_MODE:-debug}",
+		"PATH":  "${PATH}:/opt/rock/bin",
+		"PRICE": "$$5",
+	})
+	step := newScope(pipeline, map[string]string{"OUT": "${OUT}/step"})
+
+	tests := []struct {
+		in, want string
+	}{
+		{"${OUT}", "/tmp/rock/out/step"},
+		{"${MODE}", "debug"},
+		{"${PATH}", "/bin:/opt/rock/bin"},
+		{"$HOME/.rock $UNSET", "/root/.rock $UNSET"},
+		{"${UNSET:-${BASE}/default}", "/tmp/rock/default"},
+		{"${PRICE}", "$5"},
+	}
+	for _, tt := range tests {
+		got, err := step.Expand(tt.in)
+		if err != nil || got != tt.want {
+			t.Errorf("Expand(%q) = %q, %v; want %q", tt.in, got, err, tt.want)
+		}
+	}
+
+	errors := map[string]string{
+		"${UNSET}":              "undefined variable UNSET",
+		"${UNSET:?set it}":      "UNSET: set it",
+		"${OUT":                 "unterminated",
+		"${OUT:+alt}":           "bad substitution",
+		"${A}":                  "variable cycle: A -> B -> A",
+		"prefix ${UNSET} after": "undefined variable UNSET",
+	}
+	cyclic := newScope(step, map[string]string{"A": "${B}", "B": "${A}"})
+	for in, want := range errors {
+		if _, err := cyclic.Expand(in); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Expand(%q) error = %v, want %q", in, err, want)
+		}
+	}
+}
+
+func TestScopeEnviron(t *testing.T) {
+	// No step has run, so IMAGE does not resolve yet, and REQUIRED is
+	// unset; neither stops a step that does not use them
+	outputs := outputsScope(&Scope{vars: map[string]string{"HOME": "/root"}, literal: true},
+		func(id, key string) (string, bool) { return "", false })
+	pipeline := newScope(outputs, map[string]string{
+		"IMAGE":    "${steps.mk.outputs.path}",
+		"REQUIRED": "${UNSET:?set it}",
+		"OUT":      "${HOME}/out",
+	})
+	step := newScope(pipeline, map[string]string{"MODE": "debug"})
+
+	env, err := step.Environ()
+	if got := strings.Join(env, " "); err != nil || got != "HOME=/root MODE=debug OUT=/root/out" {
+		t.Errorf("Environ() = %s, %v", got, err)
+	}
+	defined, err := step.Defined()
+	if got := strings.Join(defined, " "); err != nil || got != "MODE=debug OUT=/root/out" {
+		t.Errorf("Defined() = %s, %v", got, err)
+	}
+
+	// The step's own variables must resolve
+	step = newScope(pipeline, map[string]string{"DISK": "${IMAGE}"})
+	if _, err := step.Environ(); err == nil || !strings.Contains(err.Error(), "undefined variable steps.mk.outputs.path") {
+		t.Errorf("Environ() error = %v", err)
+	}
+}
+
+func TestCheckVariablesOrder(t *testing.T) {
+	pipeline := &Pipeline{
+		Variables: map[string]string{"IMAGE": "${steps.mk.outputs.path}"},
+		Stages: []Stage{
+			{Name: "image", Steps: []Step{
+				{Name: "mk", Command: "mk ${steps.mk.outputs.path}", Outputs: map[string]string{"path": "path"}},
+				{Name: "use", Command: "use ${IMAGE}"},
+				{Name: "list", Shell: "bash", Command: `ls "${steps.mk.outputs.path}" "$IMAGE"`},
+			}},
+			{Name: "early", DependsOn: []string{}, Steps: []Step{
+				{Name: "peek", Command: "true", Environment: map[string]string{"DISK": "${IMAGE}"}},
+				{Name: "sh", Shell: "sh", Command: "test -f ${steps.mk.outputs.path}"},
+			}},
+			{Name: "late", DependsOn: []string{"image"}, Steps: []Step{
+				{Name: "boot", Command: "boot ${steps.mk.outputs.path}"},
+				{Name: "typo", Shell: "bash", Command: "boot ${steps.mk.output.path}"},
+			}},
+		},
+		Finally: []Step{{Name: "report", Command: "echo ${IMAGE}"}},
+	}
+
+	want := map[string]string{
+		"image/mk":   "step mk does not run before it",
+		"early/peek": "step mk does not run before it",
+		"early/sh":   "step mk does not run before it",
+		"late/typo":  "undefined variable steps.mk.output.path",
+	}
+	issues := checkVariables(pipeline)
+	for _, issue := range issues {
+		where := issue.Stage + "/" + issue.Step
+		if !strings.Contains(issue.Message, want[where]) || want[where] == "" {
+			t.Errorf("unexpected issue at %s: %s", where, issue.Message)
+		}
+	}
+	if len(issues) != len(want) {
+		t.Errorf("got %d issues, want %d: %v", len(issues), len(want), issues)
+	}
+}
+
+func TestExpandOutputs(t *testing.T) {
+	outputs := map[string]string{"mk.path": "/tmp/rock.img"}
+	scope := newScope(outputsScope(nil, func(id, key string) (string, bool) {
+		value, ok := outputs[id+"."+key]
+		return value, ok
+	}), map[string]string{"IMAGE": "unused"})
+
+	got, err := expandOutputs(`ls ${steps.mk.outputs.path} "$IMAGE" ${HOME} ${steps.mk.outputs.size:-0} $$`, scope)
+	if want := `ls /tmp/rock.img "$IMAGE" ${HOME} 0 $$`; err != nil || got != want {
+		t.Errorf("expandOutputs = %q, %v; want %q", got, err, want)
+	}
+	if _, err := expandOutputs("ls ${steps.typo.outputs.path}", scope); err == nil || !strings.Contains(err.Error(), "undefined variable steps.typo.outputs.path") {
+		t.Errorf("unknown output: error = %v", err)
+	}
+}
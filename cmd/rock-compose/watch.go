@@ -0,0 +1,440 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/rock-os/tools/pkg/cpio"
+)
+
+const (
+	// watchDebounce is how long changes must settle before a rebuild starts,
+	// so that saving many files at once triggers one rebuild
+	watchDebounce = 500 * time.Millisecond
+	// defaultSourceRoot is where rock-build looks for component sources
+	// when ROCK_SOURCE_ROOT is not set
+	defaultSourceRoot = "../"
+	// smokeTestStage is the stage watch mode appends to boot the image
+	smokeTestStage = "watch-smoke-test"
+)
+
+// rockBuildSources maps rock-build commands to the source directories,
+// relative to ROCK_SOURCE_ROOT, of the components they build
+var rockBuildSources = map[string][]string{
+	"init":    {"rock-init"},
+	"manager": {"rock-manager"},
+	"agent":   {"volcano-agent"},
+	"all":     {"rock-init", "rock-manager", "volcano-agent"},
+}
+
+// watchIgnored names directories whose changes never trigger a rebuild:
+// build output and version control metadata
+var watchIgnored = map[string]bool{
+	".git":         true,
+	"target":       true,
+	"node_modules": true,
+}
+
+// watchTarget is a file or directory tree whose changes rerun a stage
+type watchTarget struct {
+	Stage string
+	Path  string // Absolute
+}
+
+// watchTargets returns the sources the pipeline's stages read: component
+// trees built by rock-build, rootfs overlays packed by rock-image, config
+// files passed to rock-config, and declared step inputs
+func watchTargets(pipeline *Pipeline) []watchTarget {
+	scope := pipelineScope(pipeline, declaredOutputs(pipeline))
+	var targets []watchTarget
+	for _, stage := range pipeline.Stages {
+		stageScope := newScope(scope, stage.Variables)
+		for _, step := range stage.Steps {
+			for _, path := range stepSources(step, newScope(stageScope, step.Environment)) {
+				targets = append(targets, watchTarget{Stage: stage.Name, Path: path})
+			}
+		}
+	}
+	return targets
+}
+
+// stepSources returns the files and directories a step reads. Values that
+// do not expand, such as outputs of steps that have not run, are skipped.
+func stepSources(step Step, scope *Scope) []string {
+	dir, _ := scope.Expand(step.WorkDir)
+	expandAll := func(values []string) []string {
+		var expanded []string
+		for _, value := range values {
+			if value, err := scope.Expand(value); err == nil {
+				expanded = append(expanded, value)
+			}
+		}
+		return expanded
+	}
+
+	var paths []string
+	words := expandAll(toolWords(step))
+	switch {
+	case runsTool(step, "rock-build"):
+		root, ok, _ := scope.Lookup("ROCK_SOURCE_ROOT")
+		if !ok || root == "" {
+			root = defaultSourceRoot
+		}
+		command := ""
+		if len(words) > 0 {
+			command = words[0]
+		}
+		for _, source := range rockBuildSources[command] {
+			paths = append(paths, filepath.Join(root, source))
+		}
+	case runsTool(step, "rock-image", "cpio", "create"):
+		// The operand is the rootfs to pack
+		if rootfs, _ := imageCreateArgs(words[2:]); rootfs != "" {
+			paths = append(paths, rootfs)
+		}
+	case runsTool(step, "rock-config"):
+		// Files the step writes are not sources
+		var values []string
+		for _, word := range words {
+			if !strings.HasPrefix(word, "--output=") {
+				values = append(values, word)
+			}
+		}
+		paths = append(paths, referencedPaths(values, dir)...)
+	}
+
+	// Inputs are globs; watch what they match, or the directory a glob
+	// that matches nothing yet would match in
+	for _, pattern := range expandAll(step.Inputs) {
+		if !filepath.IsAbs(pattern) && dir != "" {
+			pattern = filepath.Join(dir, pattern)
+		}
+		matches, _ := filepath.Glob(pattern)
+		if len(matches) == 0 {
+			matches = []string{filepath.Dir(pattern)}
+		}
+		paths = append(paths, matches...)
+	}
+
+	var sources []string
+	for _, path := range paths {
+		if !filepath.IsAbs(path) && dir != "" {
+			path = filepath.Join(dir, path)
+		}
+		if abs, err := filepath.Abs(path); err == nil {
+			sources = append(sources, abs)
+		}
+	}
+	return sources
+}
+
+// affectedStages returns the stages that read a changed path, and every
+// stage downstream of them
+func affectedStages(pipeline *Pipeline, targets []watchTarget, changed []string) map[string]bool {
+	affected := make(map[string]bool)
+	for _, path := range changed {
+		for _, target := range targets {
+			if affected[target.Stage] || !withinPath(path, target.Path) {
+				continue
+			}
+			for stage := range downstream(pipeline.Stages, target.Stage) {
+				affected[stage] = true
+			}
+		}
+	}
+	return affected
+}
+
+// withinPath reports whether path is root or inside it
+func withinPath(path, root string) bool {
+	rel, err := filepath.Rel(root, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// addSmokeTest appends a stage that boots the image the pipeline builds
+// last, unless the pipeline boots it itself or builds none
+func addSmokeTest(pipeline *Pipeline) {
+	image := ""
+	for _, stage := range pipeline.Stages {
+		for _, step := range stage.Steps {
+			if runsTool(step, "rock-verify", "boot") {
+				return
+			}
+			if runsTool(step, "rock-image", "cpio", "create") {
+				image = imageOutput(step)
+			}
+		}
+	}
+	if image == "" {
+		return
+	}
+
+	stage := Stage{
+		Name:        smokeTestStage,
+		Description: "Boot the image in QEMU",
+		Steps:       []Step{{Name: "boot", Tool: "rock-verify", Command: "boot", Args: []string{image}}},
+	}
+	// Without declared dependencies stages run in file order, so the last
+	// stage already runs after all others
+	if declaresDependencies(pipeline.Stages) {
+		for _, other := range pipeline.Stages {
+			stage.DependsOn = append(stage.DependsOn, other.Name)
+		}
+	}
+	pipeline.Stages = append(pipeline.Stages, stage)
+}
+
+// imageCreateFlags are the rock-image cpio create flags that take a value
+var imageCreateFlags = map[string]bool{
+	"--output":   true,
+	"--compress": true,
+	"--level":    true,
+	"--manifest": true,
+}
+
+// imageCreateArgs splits the arguments of rock-image cpio create into the
+// rootfs operand and the values of flags, given as --flag=value or
+// --flag value
+func imageCreateArgs(args []string) (string, map[string]string) {
+	rootfs := ""
+	values := make(map[string]string)
+	for i := 0; i < len(args); i++ {
+		name, value, hasValue := strings.Cut(args[i], "=")
+		switch {
+		case imageCreateFlags[name] && hasValue:
+			values[name] = value
+		case imageCreateFlags[name] && i+1 < len(args):
+			i++
+			values[name] = args[i]
+		case rootfs == "" && !strings.HasPrefix(args[i], "-"):
+			rootfs = args[i]
+		}
+	}
+	return rootfs, values
+}
+
+// imageOutput returns the image a rock-image cpio create step writes
+func imageOutput(step Step) string {
+	_, values := imageCreateArgs(toolWords(step)[2:])
+	output := values["--output"]
+	if output == "" {
+		compression, err := cpio.ParseCompression(values["--compress"])
+		if err != nil {
+			compression = cpio.CompressGzip
+		}
+		output = "initrd.cpio" + compression.Extension()
+	}
+	if step.WorkDir != "" && !filepath.IsAbs(output) {
+		output = filepath.Join(step.WorkDir, output)
+	}
+	return output
+}
+
+// treeWatcher watches files and directory trees for changes
+type treeWatcher struct {
+	watcher *fsnotify.Watcher
+	roots   []string // Watched files and trees
+}
+
+// newTreeWatcher watches paths; directories are watched recursively.
+// Paths that do not exist are reported and skipped.
+func newTreeWatcher(paths []string) (*treeWatcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("failed to start watcher: %w", err)
+	}
+	w := &treeWatcher{watcher: watcher}
+
+	seen := make(map[string]bool)
+	for _, path := range paths {
+		if seen[path] {
+			continue
+		}
+		seen[path] = true
+
+		info, err := os.Stat(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "⚠️  Not watching %s: %v\n", path, err)
+			continue
+		}
+		if info.IsDir() {
+			err = w.addTree(path)
+		} else {
+			// Editors replace files rather than write them, so watch the
+			// directory and pick out the file's events
+			err = watcher.Add(filepath.Dir(path))
+		}
+		if err != nil {
+			watcher.Close()
+			return nil, fmt.Errorf("failed to watch %s: %w", path, err)
+		}
+		w.roots = append(w.roots, path)
+	}
+	return w, nil
+}
+
+// addTree watches dir and every directory below it
+func (w *treeWatcher) addTree(dir string) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return nil
+		}
+		if path != dir && watchIgnored[d.Name()] {
+			return filepath.SkipDir
+		}
+		return w.watcher.Add(path)
+	})
+}
+
+// relevant reports whether a change to path affects a watched root
+func (w *treeWatcher) relevant(path string) bool {
+	for _, root := range w.roots {
+		if !withinPath(path, root) {
+			continue
+		}
+		rel, _ := filepath.Rel(root, path)
+		for _, part := range strings.Split(rel, string(filepath.Separator)) {
+			if watchIgnored[part] {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// wait blocks until watched paths change and then settle, and returns the
+// changed paths. It returns nil if stop receives first.
+func (w *treeWatcher) wait(stop <-chan os.Signal) []string {
+	changed := make(map[string]bool)
+	var settled <-chan time.Time
+	for {
+		select {
+		case event, ok := <-w.watcher.Events:
+			if !ok {
+				return nil
+			}
+			if event.Op == fsnotify.Chmod || !w.relevant(event.Name) {
+				continue
+			}
+			if event.Has(fsnotify.Create) {
+				if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+					w.addTree(event.Name)
+				}
+			}
+			changed[event.Name] = true
+			settled = time.After(watchDebounce)
+		case err, ok := <-w.watcher.Errors:
+			if ok {
+				fmt.Fprintf(os.Stderr, "⚠️  Watch: %v\n", err)
+			}
+		case <-settled:
+			paths := make([]string, 0, len(changed))
+			for path := range changed {
+				paths = append(paths, path)
+			}
+			sort.Strings(paths)
+			return paths
+		case <-stop:
+			return nil
+		}
+	}
+}
+
+// close stops watching
+func (w *treeWatcher) close() {
+	w.watcher.Close()
+}
+
+// cmdWatch runs a pipeline, then reruns it whenever the sources its stages
+// read change. Stages reading a changed source, and the stages after them,
+// run again; the others are reused when their fingerprints are unchanged.
+// Each run ends with a boot smoke test of the image, unless smoke is false.
+func cmdWatch(pipelinePath string, opts runOptions, smoke bool) {
+	// A signal during a run cancels the run; the watch ends after it
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	out := progressOutput()
+	source := pipelineSource(pipelinePath)
+	var previous *RunState
+	var rerun map[string]bool
+	for {
+		pipeline, err := loadPipeline(pipelinePath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading pipeline: %v\n", err)
+			if previous == nil {
+				os.Exit(1)
+			}
+		}
+
+		var targets []watchTarget
+		if pipeline != nil {
+			if smoke {
+				addSmokeTest(pipeline)
+			}
+			targets = watchTargets(pipeline)
+			state := newRunState(pipeline, source)
+			result, err := runPipeline(pipeline, opts, state, previous, nil, rerun)
+			switch {
+			case err != nil:
+				// Like a pipeline that does not load: give up before the
+				// first run, otherwise wait for the fix
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				if previous == nil {
+					os.Exit(1)
+				}
+			case result.Cancelled:
+				os.Exit(130)
+			default:
+				previous = state
+			}
+		}
+
+		// Watch again after every run: the run may have replaced watched
+		// directories, such as a rootfs it recreates
+		paths := []string{}
+		if _, builtin := builtInPipelines[pipelinePath]; !builtin {
+			paths = append(paths, source)
+		}
+		for _, target := range targets {
+			paths = append(paths, target.Path)
+		}
+		watcher, err := newTreeWatcher(paths)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Fprintf(out, "\n👀 Watching %d paths for changes (Ctrl-C to stop)\n", len(watcher.roots))
+		changed := watcher.wait(signals)
+		watcher.close()
+		if changed == nil {
+			fmt.Fprintln(out, "\n🛑 Stopped watching")
+			return
+		}
+
+		fmt.Fprintf(out, "\n🔄 %d changed: %s\n", len(changed), strings.Join(changed, ", "))
+		rerun = nil
+		if pipeline != nil {
+			rerun = affectedStages(pipeline, targets, changed)
+		}
+		if len(rerun) > 0 {
+			stages := make([]string, 0, len(rerun))
+			for _, stage := range pipeline.Stages {
+				if rerun[stage.Name] {
+					stages = append(stages, stage.Name)
+				}
+			}
+			fmt.Fprintf(out, "   Rerunning: %s\n", strings.Join(stages, ", "))
+		}
+	}
+}
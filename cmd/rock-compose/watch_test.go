@@ -0,0 +1,95 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestWatchTargets(t *testing.T) {
+	dir := t.TempDir()
+	for _, sub := range []string{"src/rock-init", "src/rock-manager", "rootfs/etc", "configs"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	config := filepath.Join(dir, "configs", "node.yaml")
+	if err := os.WriteFile(config, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	pipeline := &Pipeline{
+		Variables: map[string]string{"ROCK_SOURCE_ROOT": filepath.Join(dir, "src"), "ROOTFS": filepath.Join(dir, "rootfs")},
+		Stages: []Stage{
+			{Name: "build", Steps: []Step{{Name: "init", Tool: "rock-build", Command: "init"}}},
+			{Name: "config", Steps: []Step{{Name: "check", Tool: "rock-config", Command: "validate", Args: []string{config, "--output=" + config}}}},
+			{Name: "image", Steps: []Step{{Name: "create", Tool: "rock-image", Command: "cpio", Args: []string{"create", "${ROOTFS}"}}}},
+			{Name: "verify", Steps: []Step{{Name: "integration", Tool: "rock-verify", Command: "integration", Args: []string{"initrd.cpio.gz"}}}},
+		},
+	}
+	targets := watchTargets(pipeline)
+	want := []watchTarget{
+		{Stage: "build", Path: filepath.Join(dir, "src", "rock-init")},
+		{Stage: "config", Path: config},
+		{Stage: "image", Path: filepath.Join(dir, "rootfs")},
+	}
+	if !reflect.DeepEqual(targets, want) {
+		t.Fatalf("targets = %v\nwant %v", targets, want)
+	}
+
+	// Stages run in file order, so a change reruns its stage and all after it
+	affected := affectedStages(pipeline, targets, []string{filepath.Join(dir, "rootfs", "etc", "inittab")})
+	if !reflect.DeepEqual(affected, map[string]bool{"image": true, "verify": true}) {
+		t.Errorf("affected = %v", affected)
+	}
+	if affected := affectedStages(pipeline, targets, []string{filepath.Join(dir, "src", "rock-manager", "main.rs")}); len(affected) != 0 {
+		t.Errorf("unbuilt component affected %v", affected)
+	}
+
+	addSmokeTest(pipeline)
+	smoke := pipeline.Stages[len(pipeline.Stages)-1]
+	if smoke.Name != smokeTestStage || !runsTool(smoke.Steps[0], "rock-verify", "boot", "initrd.cpio.gz") {
+		t.Errorf("smoke test stage = %+v", smoke)
+	}
+
+	for _, test := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"create", "rootfs", "--compress=zstd"}, "initrd.cpio.zst"},
+		{[]string{"create", "--output", "out/debug.cpio.gz", "rootfs"}, "out/debug.cpio.gz"},
+		{[]string{"create", "rootfs", "--compress", "none", "--output=out/rock-os.cpio"}, "out/rock-os.cpio"},
+	} {
+		if got := imageOutput(Step{Tool: "rock-image", Command: "cpio", Args: test.args}); got != test.want {
+			t.Errorf("imageOutput(%v) = %s, want %s", test.args, got, test.want)
+		}
+	}
+}
+
+func TestTreeWatcher(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	if err := os.MkdirAll(filepath.Join(src, "target"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	watcher, err := newTreeWatcher([]string{src})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.close()
+
+	go func() {
+		// Build output is ignored; a file in a new directory is not
+		os.WriteFile(filepath.Join(src, "target", "rock-init"), nil, 0644)
+		os.Mkdir(filepath.Join(src, "lib"), 0755)
+		time.Sleep(100 * time.Millisecond)
+		os.WriteFile(filepath.Join(src, "lib", "main.rs"), nil, 0644)
+	}()
+	changed := watcher.wait(nil)
+	want := []string{filepath.Join(src, "lib"), filepath.Join(src, "lib", "main.rs")}
+	if !reflect.DeepEqual(changed, want) {
+		t.Errorf("changed = %v, want %v", changed, want)
+	}
+}
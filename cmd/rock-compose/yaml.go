@@ -0,0 +1,308 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// yamlPipeline is the on-disk form of a pipeline, in YAML or JSON. It
+// accepts the native schema (stages containing steps) as well as the flat
+// schema used by pipelines/*.yaml, where each stage is a single tool
+// invocation.
+type yamlPipeline struct {
+	Name        string                  `yaml:"name" json:"name"`
+	Version     string                  `yaml:"version" json:"version"`
+	Description string                  `yaml:"description" json:"description"`
+	Include     []string                `yaml:"include" json:"include"`
+	Variables   map[string]string       `yaml:"variables" json:"variables"`
+	Env         map[string]string       `yaml:"env" json:"env"`
+	Templates   map[string]yamlTemplate `yaml:"templates" json:"templates"`
+	Stages      []yamlStage             `yaml:"stages" json:"stages"`
+	OnSuccess   []yamlStep              `yaml:"on_success" json:"on_success"`
+	OnFailure   []yamlStep              `yaml:"on_failure" json:"on_failure"`
+	Finally     []yamlStep              `yaml:"finally" json:"finally"`
+	PostActions yamlPostActions         `yaml:"post_actions" json:"post_actions"`
+	Settings    map[string]interface{}  `yaml:"settings" json:"settings"`
+}
+
+// yamlPostActions are shell lines run after the pipeline (flat schema)
+type yamlPostActions struct {
+	Success []string `yaml:"success" json:"success"`
+	Failure []string `yaml:"failure" json:"failure"`
+}
+
+// yamlStage is either a native stage with steps or a flat stage that is
+// itself a step
+type yamlStage struct {
+	Name        string            `yaml:"name" json:"name"`
+	Description string            `yaml:"description" json:"description"`
+	Steps       []yamlStep        `yaml:"steps" json:"steps"`
+	Parallel    bool              `yaml:"parallel" json:"parallel"`
+	DependsOn   []string          `yaml:"depends_on" json:"depends_on"`
+	Depends     []string          `yaml:"depends" json:"depends"`
+	Condition   string            `yaml:"condition" json:"condition"`
+	Variables   map[string]string `yaml:"variables" json:"variables"`
+	Template    string            `yaml:"template" json:"template"`
+	With        map[string]string `yaml:"with" json:"with"`
+	Matrix      Matrix            `yaml:"matrix" json:"matrix"`
+
+	// Flat schema: the stage runs a single step
+	Tool       string            `yaml:"tool" json:"tool"`
+	Command    string            `yaml:"command" json:"command"`
+	Subcommand string            `yaml:"subcommand" json:"subcommand"`
+	Args       []string          `yaml:"args" json:"args"`
+	Env        map[string]string `yaml:"env" json:"env"`
+	WorkDir    string            `yaml:"workdir" json:"workdir"`
+	Host       string            `yaml:"host" json:"host"`
+	OnFailure  string            `yaml:"on_failure" json:"on_failure"`
+	Timeout    int               `yaml:"timeout" json:"timeout"`
+	Retries    int               `yaml:"retries" json:"retries"`
+	RetryDelay int               `yaml:"retry_delay" json:"retry_delay"`
+	Backoff    string            `yaml:"backoff" json:"backoff"`
+	ID         string            `yaml:"id" json:"id"`
+	Outputs    map[string]string `yaml:"outputs" json:"outputs"`
+	Artifacts  []string          `yaml:"artifacts" json:"artifacts"`
+	Inputs     []string          `yaml:"inputs" json:"inputs"`
+}
+
+// yamlTemplate is a stage template: a stage in either schema plus its
+// parameters
+type yamlTemplate struct {
+	yamlStage `yaml:",inline"`
+	Params    map[string]string `yaml:"params" json:"params"`
+}
+
+// yamlStep is a step in the native schema
+type yamlStep struct {
+	Name       string            `yaml:"name" json:"name"`
+	Tool       string            `yaml:"tool" json:"tool"`
+	Command    string            `yaml:"command" json:"command"`
+	Subcommand string            `yaml:"subcommand" json:"subcommand"`
+	Shell      string            `yaml:"shell" json:"shell"`
+	Args       []string          `yaml:"args" json:"args"`
+	Env        map[string]string `yaml:"env" json:"env"`
+	WorkDir    string            `yaml:"workdir" json:"workdir"`
+	Host       string            `yaml:"host" json:"host"`
+	Condition  string            `yaml:"condition" json:"condition"`
+	ContinueOn string            `yaml:"continue_on" json:"continue_on"`
+	OnFailure  string            `yaml:"on_failure" json:"on_failure"`
+	Timeout    int               `yaml:"timeout" json:"timeout"`
+	Retries    int               `yaml:"retries" json:"retries"`
+	RetryDelay int               `yaml:"retry_delay" json:"retry_delay"`
+	Backoff    string            `yaml:"backoff" json:"backoff"`
+	ID         string            `yaml:"id" json:"id"`
+	Outputs    map[string]string `yaml:"outputs" json:"outputs"`
+	Artifacts  []string          `yaml:"artifacts" json:"artifacts"`
+	Inputs     []string          `yaml:"inputs" json:"inputs"`
+}
+
+// parseYAMLPipeline decodes a YAML pipeline in either schema
+func parseYAMLPipeline(data []byte) (*Pipeline, error) {
+	var raw yamlPipeline
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		if typeErr, ok := err.(*yaml.TypeError); ok {
+			return nil, fmt.Errorf("invalid YAML: %s", strings.Join(typeErr.Errors, "; "))
+		}
+		return nil, fmt.Errorf("invalid YAML: %v", err)
+	}
+	return raw.toPipeline()
+}
+
+// parseJSONPipeline decodes a JSON pipeline; it has the same fields as YAML
+func parseJSONPipeline(data []byte) (*Pipeline, error) {
+	var raw yamlPipeline
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %v", err)
+	}
+	return raw.toPipeline()
+}
+
+// toPipeline converts a decoded pipeline file
+func (raw yamlPipeline) toPipeline() (*Pipeline, error) {
+	if raw.Name == "" && len(raw.Stages) == 0 && len(raw.Templates) == 0 && len(raw.Include) == 0 {
+		return nil, fmt.Errorf("no pipeline definition found")
+	}
+
+	pipeline := &Pipeline{
+		Name:        raw.Name,
+		Version:     raw.Version,
+		Description: raw.Description,
+		Include:     raw.Include,
+		Settings:    raw.Settings,
+	}
+
+	// env is the flat-schema name for variables
+	if len(raw.Env) > 0 || len(raw.Variables) > 0 {
+		pipeline.Variables = make(map[string]string)
+		for key, value := range raw.Env {
+			pipeline.Variables[key] = value
+		}
+		for key, value := range raw.Variables {
+			pipeline.Variables[key] = value
+		}
+	}
+
+	for name, rt := range raw.Templates {
+		stage, err := rt.toStage()
+		if err != nil {
+			return nil, fmt.Errorf("template %s: %v", name, err)
+		}
+		if pipeline.Templates == nil {
+			pipeline.Templates = make(map[string]StageTemplate)
+		}
+		pipeline.Templates[name] = StageTemplate{Stage: stage, Params: rt.Params}
+	}
+
+	for i, rs := range raw.Stages {
+		stage, err := rs.toStage()
+		if err != nil {
+			name := rs.Name
+			if name == "" {
+				name = fmt.Sprintf("#%d", i+1)
+			}
+			return nil, fmt.Errorf("stage %s: %v", name, err)
+		}
+		pipeline.Stages = append(pipeline.Stages, stage)
+	}
+
+	var err error
+	if pipeline.OnSuccess, err = convertSteps(raw.OnSuccess); err != nil {
+		return nil, fmt.Errorf("on_success: %v", err)
+	}
+	if pipeline.OnFailure, err = convertSteps(raw.OnFailure); err != nil {
+		return nil, fmt.Errorf("on_failure: %v", err)
+	}
+	if pipeline.Finally, err = convertSteps(raw.Finally); err != nil {
+		return nil, fmt.Errorf("finally: %v", err)
+	}
+	pipeline.OnSuccess = append(pipeline.OnSuccess, shellSteps(raw.PostActions.Success)...)
+	pipeline.OnFailure = append(pipeline.OnFailure, shellSteps(raw.PostActions.Failure)...)
+
+	return pipeline, nil
+}
+
+// toStage converts a YAML stage, turning a flat stage into a one-step stage
+func (rs yamlStage) toStage() (Stage, error) {
+	stage := Stage{
+		Name:        rs.Name,
+		Description: rs.Description,
+		Parallel:    rs.Parallel,
+		Condition:   rs.Condition,
+		Variables:   rs.Variables,
+		Template:    rs.Template,
+		With:        rs.With,
+		Matrix:      rs.Matrix,
+	}
+	// An explicit empty list declares a stage without dependencies
+	if rs.DependsOn != nil || rs.Depends != nil {
+		stage.DependsOn = append(append([]string{}, rs.DependsOn...), rs.Depends...)
+	}
+
+	flat := rs.Tool != "" || rs.Command != "" || len(rs.Args) > 0
+	if flat && len(rs.Steps) > 0 {
+		return stage, fmt.Errorf("has both steps and a tool/command")
+	}
+
+	if !flat {
+		steps, err := convertSteps(rs.Steps)
+		if err != nil {
+			return stage, err
+		}
+		stage.Steps = steps
+		return stage, nil
+	}
+
+	step, err := yamlStep{
+		Name:       rs.Name,
+		Tool:       rs.Tool,
+		Command:    rs.Command,
+		Subcommand: rs.Subcommand,
+		Args:       rs.Args,
+		Env:        rs.Env,
+		WorkDir:    rs.WorkDir,
+		Host:       rs.Host,
+		OnFailure:  rs.OnFailure,
+		Timeout:    rs.Timeout,
+		Retries:    rs.Retries,
+		RetryDelay: rs.RetryDelay,
+		Backoff:    rs.Backoff,
+		ID:         rs.ID,
+		Outputs:    rs.Outputs,
+		Artifacts:  rs.Artifacts,
+		Inputs:     rs.Inputs,
+	}.toStep()
+	if err != nil {
+		return stage, err
+	}
+	stage.Steps = []Step{step}
+	return stage, nil
+}
+
+// convertSteps converts a list of YAML steps
+func convertSteps(raw []yamlStep) ([]Step, error) {
+	var steps []Step
+	for _, rs := range raw {
+		step, err := rs.toStep()
+		if err != nil {
+			return nil, fmt.Errorf("step %s: %v", rs.Name, err)
+		}
+		steps = append(steps, step)
+	}
+	return steps, nil
+}
+
+// toStep converts a YAML step; a subcommand is passed before the other args
+func (rs yamlStep) toStep() (Step, error) {
+	step := Step{
+		Name:        rs.Name,
+		Tool:        rs.Tool,
+		Command:     rs.Command,
+		Shell:       rs.Shell,
+		Environment: rs.Env,
+		WorkDir:     rs.WorkDir,
+		Host:        rs.Host,
+		Condition:   rs.Condition,
+		ContinueOn:  rs.ContinueOn,
+		Timeout:     rs.Timeout,
+		Retries:     rs.Retries,
+		RetryDelay:  rs.RetryDelay,
+		Backoff:     rs.Backoff,
+		ID:          rs.ID,
+		Outputs:     rs.Outputs,
+		Artifacts:   rs.Artifacts,
+		Inputs:      rs.Inputs,
+	}
+
+	if rs.Subcommand != "" {
+		step.Args = append(step.Args, rs.Subcommand)
+	}
+	step.Args = append(step.Args, rs.Args...)
+
+	switch rs.OnFailure {
+	case "", "stop":
+	case "continue":
+		step.ContinueOn = ContinueOnFailure
+	case "warn":
+		step.ContinueOn = ContinueOnWarning
+	default:
+		return step, fmt.Errorf("unknown on_failure %q (use stop, continue or warn)", rs.OnFailure)
+	}
+
+	return step, nil
+}
+
+// shellSteps turns post-action lines into shell steps
+func shellSteps(lines []string) []Step {
+	var steps []Step
+	for _, line := range lines {
+		steps = append(steps, Step{
+			Name:    strings.TrimSpace(line),
+			Command: line,
+			Shell:   "sh",
+		})
+	}
+	return steps
+}
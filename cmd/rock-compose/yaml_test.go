@@ -0,0 +1,106 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseYAMLFlatPipeline(t *testing.T) {
+	pipeline, err := parseYAMLPipeline([]byte(`
+name: build
+env:
+  BUILD_DIR: /tmp/build
+variables:
+  MODE: debug
+stages:
+  - name: fetch
+    tool: rock-kernel
+    subcommand: fetch
+    args: [alpine:5.10.186]
+    depends_on: []
+    on_failure: continue
+  - name: deps
+    tool: bash
+    command: |
+      mkdir -p ${BUILD_DIR}/lib
+      rock-deps copy ${BUILD_DIR}/lib
+    depends: [fetch]
+    on_failure: warn
+  - name: image
+    depends_on: [fetch]
+    depends: [deps]
+    steps:
+      - {name: create, tool: image, args: [cpio, create]}
+post_actions:
+  failure: ["echo failed"]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{"BUILD_DIR": "/tmp/build", "MODE": "debug"}
+	if !reflect.DeepEqual(pipeline.Variables, want) {
+		t.Errorf("variables = %v, want %v", pipeline.Variables, want)
+	}
+	if len(pipeline.Stages) != 3 {
+		t.Fatalf("got %d stages, want 3", len(pipeline.Stages))
+	}
+
+	fetch := pipeline.Stages[0].Steps[0]
+	if fetch.Tool != "rock-kernel" || !reflect.DeepEqual(fetch.Args, []string{"fetch", "alpine:5.10.186"}) ||
+		fetch.ContinueOn != ContinueOnFailure {
+		t.Errorf("fetch = %+v", fetch)
+	}
+
+	if deps := pipeline.Stages[0].DependsOn; deps == nil || len(deps) != 0 {
+		t.Errorf("fetch depends on %#v, want an explicit empty list", deps)
+	}
+
+	deps := pipeline.Stages[1]
+	if deps.Steps[0].ContinueOn != ContinueOnWarning || !strings.Contains(deps.Steps[0].Command, "\nrock-deps copy") {
+		t.Errorf("deps = %+v", deps.Steps[0])
+	}
+	if !reflect.DeepEqual(deps.DependsOn, []string{"fetch"}) {
+		t.Errorf("deps depends on %v, want [fetch]", deps.DependsOn)
+	}
+	if image := pipeline.Stages[2]; !reflect.DeepEqual(image.DependsOn, []string{"fetch", "deps"}) || len(image.Steps) != 1 {
+		t.Errorf("image = %+v", image)
+	}
+	if len(pipeline.OnFailure) != 1 || pipeline.OnFailure[0].Shell != "sh" {
+		t.Errorf("post_actions.failure = %+v", pipeline.OnFailure)
+	}
+}
+
+func TestParseYAMLPipelineErrors(t *testing.T) {
+	for _, test := range []struct {
+		yaml, want string
+	}{
+		{"description: nothing", "no pipeline definition"},
+		{"name: x\nstages: [{name: a, tool: x, steps: [{name: s}]}]", "stage a: has both steps and a tool/command"},
+		{"name: x\nstages: [{name: a, tool: x, on_failure: retry}]", `unknown on_failure "retry"`},
+		{"name: x\nstages: {a: 1}", "invalid YAML"},
+	} {
+		_, err := parseYAMLPipeline([]byte(test.yaml))
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%q: error %v, want %q", test.yaml, err, test.want)
+		}
+	}
+}
+
+func TestYAMLStageDependsDoesNotAlias(t *testing.T) {
+	// Spare capacity in depends_on must not be shared between conversions
+	rs := yamlStage{Name: "a", DependsOn: make([]string, 1, 4), Depends: []string{"b"}}
+	rs.DependsOn[0] = "x"
+	first, err := rs.toStage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs.Depends = []string{"c"}
+	if _, err := rs.toStage(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(first.DependsOn, []string{"x", "b"}) {
+		t.Errorf("first stage depends on %v, want [x b]", first.DependsOn)
+	}
+}
@@ -0,0 +1,474 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rock-os/tools/pkg/cpio"
+	"github.com/rock-os/tools/pkg/rootfs"
+)
+
+// The kernel unpacks every archive concatenated into an initramfs, in
+// order, so per-node files can ship as small overlays on an unchanged
+// base image. A first, uncompressed segment is also where the early
+// microcode loader looks for kernel/x86/microcode/*.bin.
+
+// composeValueFlags are the compose flags that take a value, given as
+// --flag=value or --flag value
+var composeValueFlags = map[string]bool{
+	"--output":   true,
+	"--early":    true,
+	"--overlay":  true,
+	"--compress": true,
+	"--level":    true,
+}
+
+// ComposeOptions controls how ComposeImage builds an image
+type ComposeOptions struct {
+	Output   string   // Image path; required
+	Early    string   // Directory or uncompressed CPIO placed first, uncompressed
+	Overlays []string // Directories, rootfs manifests or archives, each a segment after the base
+
+	// Compression and Level select the compressor for overlays
+	Compression cpio.Compression
+	Level       int
+
+	Reproducible bool // Fixed timestamps in the early segment and overlays
+	ModTime      time.Time
+	NoVerify     bool // Skip checking the merged tree against the contract
+	JSON         bool // Print the ComposeResult as JSON on stdout
+}
+
+// parseComposeArgs parses "<base-image> --output=FILE [--early=PATH]
+// [--overlay=PATH]... [--compress=NAME] [--level=N] [--reproducible]
+// [--no-verify] [--json]"
+func parseComposeArgs(args []string) (string, ComposeOptions, error) {
+	opts := ComposeOptions{Compression: cpio.CompressGzip, Level: cpio.DefaultLevel}
+	base := ""
+	reproducible := false
+
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		name, value, hasValue := strings.Cut(arg, "=")
+		if composeValueFlags[name] && !hasValue {
+			if i+1 == len(args) {
+				return "", opts, fmt.Errorf("%s requires a value", name)
+			}
+			i++
+			value = args[i]
+		}
+
+		var err error
+		switch {
+		case name == "--output":
+			opts.Output = value
+		case name == "--early":
+			opts.Early = value
+		case name == "--overlay":
+			opts.Overlays = append(opts.Overlays, value)
+		case name == "--compress":
+			opts.Compression, err = cpio.ParseCompression(value)
+		case name == "--level":
+			if opts.Level, err = strconv.Atoi(value); err != nil {
+				err = fmt.Errorf("invalid --level value: %s", value)
+			}
+		case arg == "--reproducible":
+			reproducible = true
+		case arg == "--no-verify":
+			opts.NoVerify = true
+		case arg == "--json":
+			opts.JSON = true
+		case strings.HasPrefix(arg, "-"):
+			err = fmt.Errorf("unknown option: %s", arg)
+		case base == "":
+			base = arg
+		default:
+			err = fmt.Errorf("unexpected argument: %s", arg)
+		}
+		if err != nil {
+			return "", opts, err
+		}
+	}
+
+	if base == "" {
+		return "", opts, fmt.Errorf("missing base image")
+	}
+	if opts.Output == "" {
+		return "", opts, fmt.Errorf("missing --output")
+	}
+	if err := opts.Compression.CheckLevel(opts.Level); err != nil {
+		return "", opts, err
+	}
+	if os.Getenv("ROCK_OUTPUT") == "json" {
+		opts.JSON = true
+	}
+
+	epoch, err := reproducibleOptions(reproducible)
+	if err != nil {
+		return "", opts, err
+	}
+	opts.Reproducible = epoch.Reproducible
+	opts.ModTime = epoch.ModTime
+	return base, opts, nil
+}
+
+// SegmentInfo describes one segment of an image
+type SegmentInfo struct {
+	Role        string `json:"role,omitempty"`   // early, base or overlay
+	Source      string `json:"source,omitempty"` // What compose built it from
+	Offset      int64  `json:"offset"`
+	Size        int64  `json:"size"`
+	Compression string `json:"compression"`
+	Entries     int    `json:"entries"`
+}
+
+// ComposeResult describes a composed image; --json prints it on stdout
+type ComposeResult struct {
+	Image    ImageInfo     `json:"image"`
+	Segments []SegmentInfo `json:"segments"`
+	Verified bool          `json:"verified"`
+}
+
+// ComposeImage concatenates an early segment, the base image and overlay
+// segments into one initramfs. The base is copied byte for byte, so a
+// signature made for it still verifies against the bytes in the image.
+func ComposeImage(basePath string, opts ComposeOptions, out io.Writer) (*ComposeResult, error) {
+	var image bytes.Buffer
+	var roles, sources []string
+	lz4Source := ""
+	add := func(data []byte, role, source string, segments int, last cpio.Compression) error {
+		// The kernel cannot tell where lz4 data ends
+		if lz4Source != "" {
+			return fmt.Errorf("%s is lz4 compressed, which only the last segment can be", lz4Source)
+		}
+		if last == cpio.CompressLz4 {
+			lz4Source = source
+		}
+		image.Write(data)
+		// Uncompressed headers must start 4-byte aligned; the kernel
+		// skips the zeros
+		for image.Len()%4 != 0 {
+			image.WriteByte(0)
+		}
+		for i := 0; i < segments; i++ {
+			roles = append(roles, role)
+			sources = append(sources, source)
+		}
+		return nil
+	}
+
+	if opts.Reproducible {
+		fmt.Fprintf(out, "Reproducible build: timestamps %s\n\n", opts.ModTime.Format(time.RFC3339))
+	}
+
+	if opts.Early != "" {
+		fmt.Fprintf(out, "Step 1: Early segment (uncompressed): %s\n", opts.Early)
+		data, err := buildEarlySegment(opts.Early, opts.ModTime)
+		if err != nil {
+			return nil, fmt.Errorf("early segment: %w", err)
+		}
+		if err := add(data, "early", opts.Early, 1, cpio.CompressNone); err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(out, "✅ %s\n", formatSize(int64(len(data))))
+	} else {
+		fmt.Fprintln(out, "Step 1: No early segment")
+	}
+
+	fmt.Fprintf(out, "\nStep 2: Base image: %s\n", basePath)
+	base, err := os.ReadFile(basePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read base image: %w", err)
+	}
+	baseSegments, err := cpio.ReadSegments(base)
+	if err != nil {
+		return nil, fmt.Errorf("base image: %w", err)
+	}
+	if err := checkBaseSignature(basePath, base, out); err != nil {
+		return nil, err
+	}
+	if err := add(base, "base", basePath, len(baseSegments), baseSegments[len(baseSegments)-1].Compression); err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(out, "✅ %s, %d segment(s), included unchanged\n", formatSize(int64(len(base))), len(baseSegments))
+
+	fmt.Fprintf(out, "\nStep 3: Overlays (%s)\n", opts.Compression)
+	for _, overlay := range opts.Overlays {
+		data, count, err := buildOverlaySegment(overlay, opts)
+		if err != nil {
+			return nil, fmt.Errorf("overlay %s: %w", overlay, err)
+		}
+		if err := add(data, "overlay", overlay, 1, cpio.DetectCompression(data)); err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(out, "  ✅ %s: %d entries, %s\n", overlay, count, formatSize(int64(len(data))))
+	}
+	if len(opts.Overlays) == 0 {
+		fmt.Fprintln(out, "  (none)")
+	}
+
+	// Read the result back the way the kernel will
+	segments, err := cpio.ReadSegments(image.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("composed image is unreadable: %w", err)
+	}
+	if len(segments) != len(roles) {
+		return nil, fmt.Errorf("composed image has %d segments, want %d", len(segments), len(roles))
+	}
+
+	sum := sha256.Sum256(image.Bytes())
+	result := &ComposeResult{
+		Image: ImageInfo{
+			Path:        opts.Output,
+			Size:        int64(image.Len()),
+			SHA256:      hex.EncodeToString(sum[:]),
+			Compression: "multi-segment",
+		},
+		Segments: segmentInfos(segments),
+	}
+	for i := range result.Segments {
+		result.Segments[i].Role = roles[i]
+		result.Segments[i].Source = sources[i]
+	}
+
+	if !opts.NoVerify {
+		fmt.Fprintln(out, "\nStep 4: Verifying the merged tree...")
+		if err := verifyArchive(cpio.MergeSegments(segments), out); err != nil {
+			return nil, fmt.Errorf("verification failed: %w", err)
+		}
+		result.Verified = true
+	}
+
+	if err := writeFileAtomic(opts.Output, image.Bytes()); err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(out, "\n✅ Composed %d segments into %s (%s)\n", len(segments), opts.Output, formatSize(int64(image.Len())))
+	return result, nil
+}
+
+// buildEarlySegment returns the early segment: a directory archived
+// uncompressed, or an existing uncompressed archive as is. A non-zero
+// modTime replaces every mtime.
+func buildEarlySegment(source string, modTime time.Time) ([]byte, error) {
+	info, err := os.Stat(source)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		var buf bytes.Buffer
+		_, err := cpio.WriteTree(&buf, source, cpio.TreeOptions{Format: cpio.FormatNewc, ModTime: modTime})
+		return buf.Bytes(), err
+	}
+
+	data, err := os.ReadFile(source)
+	if err != nil {
+		return nil, err
+	}
+	segments, err := cpio.ReadSegments(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(segments) != 1 || segments[0].Compression != cpio.CompressNone {
+		return nil, fmt.Errorf("must be a single uncompressed archive: the early loader does not decompress")
+	}
+	return data, nil
+}
+
+// buildOverlaySegment archives a directory or a rootfs manifest as a
+// compressed segment and returns it with its entry count. An overlay
+// manifest leaves out the contract layout unless it asks for it, as the
+// base image already has it. An archive, compressed or not, is included
+// as is.
+func buildOverlaySegment(source string, opts ComposeOptions) ([]byte, int, error) {
+	info, err := os.Stat(source)
+	if err != nil {
+		return nil, 0, err
+	}
+	if !info.IsDir() {
+		data, err := os.ReadFile(source)
+		if err != nil {
+			return nil, 0, err
+		}
+		if _, isArchive := cpio.DetectFormat(data); isArchive || cpio.DetectCompression(data) != cpio.CompressNone {
+			segments, err := cpio.ReadSegments(data)
+			if err != nil {
+				return nil, 0, err
+			}
+			if len(segments) != 1 {
+				return nil, 0, fmt.Errorf("holds %d segments; an overlay archive must be a single one", len(segments))
+			}
+			return data, len(segments[0].Archive.Entries), nil
+		}
+	}
+
+	var buf bytes.Buffer
+	compressor, err := cpio.NewCompressor(&buf, opts.Compression, opts.Level)
+	if err != nil {
+		return nil, 0, err
+	}
+	treeOpts := cpio.TreeOptions{Format: cpio.FormatNewc, ModTime: opts.ModTime}
+	dir := source
+	if !info.IsDir() {
+		manifest, err := rootfs.Load(source)
+		if err != nil {
+			return nil, 0, err
+		}
+		if manifest.Contract == nil {
+			manifest.Contract = new(bool)
+		}
+		if treeOpts.Overlay, err = manifest.Entries(); err != nil {
+			return nil, 0, err
+		}
+		dir = ""
+	}
+	count, err := cpio.WriteTree(compressor, dir, treeOpts)
+	if closeErr := compressor.Close(); err == nil {
+		err = closeErr
+	}
+	return buf.Bytes(), count, err
+}
+
+// checkBaseSignature compares the base image with the hash recorded in
+// its rock-security signature file, if there is one. Checking the
+// signature itself needs the public key: use rock-security verify.
+func checkBaseSignature(basePath string, data []byte, out io.Writer) error {
+	sigData, err := os.ReadFile(basePath + ".sig")
+	if os.IsNotExist(err) {
+		fmt.Fprintln(out, "  ⚠️  No signature file; the base image is unsigned")
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read signature: %w", err)
+	}
+
+	var sig struct {
+		Hash  string `json:"hash"`
+		KeyID string `json:"key_id"`
+	}
+	if err := json.Unmarshal(sigData, &sig); err != nil {
+		return fmt.Errorf("failed to parse signature %s.sig: %w", basePath, err)
+	}
+	sum := sha256.Sum256(data)
+	if hex.EncodeToString(sum[:]) != sig.Hash {
+		return fmt.Errorf("base image does not match its signature %s.sig: it changed after signing", basePath)
+	}
+	fmt.Fprintf(out, "  🔏 Matches %s.sig (key %s)\n", basePath, sig.KeyID)
+	return nil
+}
+
+// segmentInfos describes segments in image order
+func segmentInfos(segments []cpio.Segment) []SegmentInfo {
+	infos := make([]SegmentInfo, len(segments))
+	for i, segment := range segments {
+		infos[i] = SegmentInfo{
+			Offset:      segment.Offset,
+			Size:        segment.Size,
+			Compression: string(segment.Compression),
+			Entries:     len(segment.Archive.Entries),
+		}
+	}
+	return infos
+}
+
+// TreeEntry is an entry of the merged tree, with the segment it comes
+// from and the earlier segments whose entry it replaces (numbered from 1)
+type TreeEntry struct {
+	ManifestEntry
+	Segment  int   `json:"segment"`
+	Replaces []int `json:"replaces,omitempty"`
+}
+
+// InspectResult describes an image; --json prints it on stdout
+type InspectResult struct {
+	Image    ImageInfo     `json:"image"`
+	Segments []SegmentInfo `json:"segments"`
+	Tree     []TreeEntry   `json:"tree"`
+}
+
+// InspectImage lists the segments of an image and the tree the kernel
+// unpacks from them
+func InspectImage(imagePath string, out io.Writer) (*InspectResult, error) {
+	data, err := os.ReadFile(imagePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open image: %w", err)
+	}
+	segments, err := cpio.ReadSegments(data)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(data)
+	compression := string(segments[0].Compression)
+	if len(segments) > 1 {
+		compression = "multi-segment"
+	}
+	result := &InspectResult{
+		Image:    ImageInfo{Path: imagePath, Size: int64(len(data)), SHA256: hex.EncodeToString(sum[:]), Compression: compression},
+		Segments: segmentInfos(segments),
+	}
+
+	// Entries of the merged tree, in the order the kernel first creates them
+	merged := cpio.MergeSegments(segments)
+	manifest := newManifest(result.Image, merged)
+	index := make(map[string]int, len(merged.Entries))
+	for i, name := range merged.Names() {
+		index[name] = i
+		result.Tree = append(result.Tree, TreeEntry{ManifestEntry: manifest.Entries[i]})
+	}
+	for n, segment := range segments {
+		for _, name := range segment.Archive.Names() {
+			entry := &result.Tree[index[name]]
+			if entry.Segment != 0 {
+				entry.Replaces = append(entry.Replaces, entry.Segment)
+			}
+			entry.Segment = n + 1
+		}
+	}
+
+	fmt.Fprintf(out, "Image: %s (%s)\n", imagePath, formatSize(result.Image.Size))
+	fmt.Fprintf(out, "SHA256: %s\n", result.Image.SHA256)
+	fmt.Fprintf(out, "\nSegments (%d):\n", len(segments))
+	for i, segment := range result.Segments {
+		fmt.Fprintf(out, "  [%d] offset %-10d %-10s %-5s %d entries\n", i+1, segment.Offset, formatSize(segment.Size), segment.Compression, segment.Entries)
+	}
+
+	fmt.Fprintf(out, "\nMerged tree (%d entries):\n", len(result.Tree))
+	for _, entry := range result.Tree {
+		line := fmt.Sprintf("  [%d] %-7s %s %d:%d %s", entry.Segment, entry.Type, entry.Mode, entry.UID, entry.GID, entry.Name)
+		switch {
+		case entry.Link != "":
+			line += " -> " + entry.Link
+		case entry.Device != "":
+			line += " (" + entry.Device + ")"
+		case entry.Type == "file":
+			line += " (" + formatSize(entry.Size) + ")"
+		}
+		if len(entry.Replaces) > 0 {
+			line += fmt.Sprintf("  replaces %v", entry.Replaces)
+		}
+		fmt.Fprintln(out, line)
+	}
+	return result, nil
+}
+
+// formatSize formats a byte count for display
+func formatSize(bytes int64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+	div, exp := int64(unit), 0
+	for n := bytes / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(bytes)/float64(div), "KMGTPE"[exp])
+}
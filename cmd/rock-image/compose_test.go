@@ -0,0 +1,172 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rock-os/tools/pkg/cpio"
+)
+
+func TestParseComposeArgs(t *testing.T) {
+	t.Setenv("SOURCE_DATE_EPOCH", "")
+	t.Setenv("ROCK_OUTPUT", "")
+
+	tests := []struct {
+		args []string
+		base string
+		opts ComposeOptions
+	}{
+		{
+			[]string{"rock.cpio.gz", "--output=node.cpio.gz"},
+			"rock.cpio.gz", ComposeOptions{Compression: cpio.CompressGzip, Level: cpio.DefaultLevel, Output: "node.cpio.gz"},
+		},
+		{
+			[]string{"--output", "node.img", "--early", "ucode", "rock.cpio.gz", "--overlay", "node1", "--overlay=node1.yaml", "--compress", "xz", "--level", "6", "--no-verify", "--json"},
+			"rock.cpio.gz", ComposeOptions{
+				Compression: cpio.CompressXz, Level: 6, Output: "node.img", Early: "ucode",
+				Overlays: []string{"node1", "node1.yaml"}, NoVerify: true, JSON: true,
+			},
+		},
+		{
+			[]string{"rock.cpio.gz", "--output=node.img", "--reproducible"},
+			"rock.cpio.gz", ComposeOptions{Compression: cpio.CompressGzip, Level: cpio.DefaultLevel, Output: "node.img", Reproducible: true, ModTime: time.Unix(0, 0).UTC()},
+		},
+	}
+	for _, test := range tests {
+		base, opts, err := parseComposeArgs(test.args)
+		if err != nil {
+			t.Errorf("parseComposeArgs(%v): %v", test.args, err)
+			continue
+		}
+		if base != test.base || !reflect.DeepEqual(opts, test.opts) {
+			t.Errorf("parseComposeArgs(%v) = %s, %+v; want %s, %+v", test.args, base, opts, test.base, test.opts)
+		}
+	}
+
+	errors := map[string][]string{
+		"unknown option: --manifest=x": {"rock.cpio.gz", "--output=node.img", "--manifest=x"},
+		"unexpected argument: extra":   {"rock.cpio.gz", "--output=node.img", "extra"},
+		"--overlay requires a value":   {"rock.cpio.gz", "--output=node.img", "--overlay"},
+		"invalid --level value: 1.5":   {"rock.cpio.gz", "--output=node.img", "--level=1.5"},
+		"missing base image":           {"--output=node.img"},
+		"missing --output":             {"rock.cpio.gz"},
+	}
+	for want, args := range errors {
+		if _, _, err := parseComposeArgs(args); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("parseComposeArgs(%v) error = %v, want %q", args, err, want)
+		}
+	}
+}
+
+func TestComposeInspect(t *testing.T) {
+	dir := t.TempDir()
+	epoch := time.Unix(0, 0).UTC()
+
+	// The base image, built from a manifest
+	manifest := writeTestManifest(t, dir, "generated:\n  - {path: /etc/hostname, content: \"rock\\n\"}\n")
+	base := filepath.Join(dir, "rock.cpio.zst")
+	if _, err := CreateCPIO(manifest, CreateOptions{Compression: cpio.CompressZstd, Level: cpio.DefaultLevel, Output: base, Reproducible: true, ModTime: epoch}, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+
+	// An early microcode directory, an overlay directory replacing the
+	// hostname, and an overlay manifest adding a device node
+	early := filepath.Join(dir, "early")
+	node := filepath.Join(dir, "node1")
+	for path, data := range map[string]string{
+		filepath.Join(early, "kernel", "x86", "microcode", "GenuineIntel.bin"): "ucode",
+		filepath.Join(node, "etc", "hostname"):                                 "node1\n",
+	} {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	devices := filepath.Join(dir, "devices.yaml")
+	if err := os.WriteFile(devices, []byte("devices:\n  - {path: /dev/ttyS0, major: 4, minor: 64, mode: \"0620\"}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	output := filepath.Join(dir, "out", "node1.img")
+	opts := ComposeOptions{
+		Output: output, Early: early, Overlays: []string{node, devices},
+		Compression: cpio.CompressXz, Level: cpio.DefaultLevel, Reproducible: true, ModTime: epoch,
+	}
+	composed, err := ComposeImage(base, opts, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !composed.Verified {
+		t.Error("composed image not verified")
+	}
+	var roles []string
+	for _, segment := range composed.Segments {
+		roles = append(roles, segment.Role+":"+segment.Compression)
+	}
+	if got := strings.Join(roles, " "); got != "early:none base:zstd overlay:xz overlay:xz" {
+		t.Errorf("segments = %s", got)
+	}
+
+	// Inspect reads back what compose wrote
+	inspected, err := InspectImage(output, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inspected.Image.SHA256 != composed.Image.SHA256 || len(inspected.Segments) != 4 {
+		t.Errorf("inspect = %+v, compose = %+v", inspected.Image, composed.Image)
+	}
+	tree := make(map[string]TreeEntry)
+	for _, entry := range inspected.Tree {
+		tree[entry.Name] = entry
+	}
+	if hostname := tree["etc/hostname"]; hostname.Segment != 3 || !reflect.DeepEqual(hostname.Replaces, []int{2}) {
+		t.Errorf("etc/hostname = %+v, want segment 3 replacing 2", hostname)
+	}
+	if ttyS0 := tree["dev/ttyS0"]; ttyS0.Segment != 4 || ttyS0.Device != "4:64" {
+		t.Errorf("dev/ttyS0 = %+v", ttyS0)
+	}
+	if ucode := tree["kernel/x86/microcode/GenuineIntel.bin"]; ucode.Segment != 1 {
+		t.Errorf("microcode = %+v", ucode)
+	}
+
+	// The merged tree is what verify checks, and the kernel sees the
+	// overlay's hostname
+	archive, err := cpio.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyArchive(archive, io.Discard); err != nil {
+		t.Error(err)
+	}
+	if hostname, ok := archive.Lstat("etc/hostname"); !ok || string(hostname.Data) != "node1\n" {
+		t.Errorf("merged etc/hostname = %+v", hostname)
+	}
+
+	// Composing again gives the same bytes
+	again, err := ComposeImage(base, opts, io.Discard)
+	if err != nil || again.Image.SHA256 != composed.Image.SHA256 {
+		t.Errorf("recomposed image differs: %v", err)
+	}
+
+	// A base that changed since it was signed is refused
+	if err := os.WriteFile(base+".sig", []byte(`{"hash": "0000", "key_id": "test"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ComposeImage(base, opts, io.Discard); err == nil || !strings.Contains(err.Error(), "does not match its signature") {
+		t.Errorf("tampered base: error = %v", err)
+	}
+	os.Remove(base + ".sig")
+
+	// lz4 data can only come last
+	opts.Compression = cpio.CompressLz4
+	if _, err := ComposeImage(base, opts, io.Discard); err == nil || !strings.Contains(err.Error(), "only the last segment") {
+		t.Errorf("lz4 overlay before another: error = %v", err)
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/rock-os/tools/pkg/cpio"
+)
+
+// createValueFlags are the cpio create flags that take a value, given as
+// --flag=value or --flag value
+var createValueFlags = map[string]bool{
+	"--output":   true,
+	"--compress": true,
+	"--level":    true,
+	"--manifest": true,
+}
+
+// parseCreateArgs parses "<rootfs-dir|manifest> [--output=FILE] [--compress=NAME]
+// [--level=N] [--manifest=FILE] [--reproducible] [--no-verify] [--json]"
+func parseCreateArgs(args []string) (string, CreateOptions, error) {
+	opts := CreateOptions{Compression: cpio.CompressGzip, Level: cpio.DefaultLevel}
+	rootfs := ""
+	reproducible := false
+
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		name, value, hasValue := strings.Cut(arg, "=")
+		if createValueFlags[name] && !hasValue {
+			if i+1 == len(args) {
+				return "", opts, fmt.Errorf("%s requires a value", name)
+			}
+			i++
+			value = args[i]
+		}
+
+		var err error
+		switch {
+		case name == "--output":
+			opts.Output = value
+		case name == "--compress":
+			opts.Compression, err = cpio.ParseCompression(value)
+		case name == "--level":
+			if opts.Level, err = strconv.Atoi(value); err != nil {
+				err = fmt.Errorf("invalid --level value: %s", value)
+			}
+		case name == "--manifest":
+			opts.Manifest = value
+		case arg == "--reproducible":
+			reproducible = true
+		case arg == "--no-verify":
+			opts.NoVerify = true
+		case arg == "--json":
+			opts.JSON = true
+		case strings.HasPrefix(arg, "-"):
+			err = fmt.Errorf("unknown option: %s", arg)
+		case rootfs == "":
+			rootfs = arg
+		default:
+			err = fmt.Errorf("unexpected argument: %s", arg)
+		}
+		if err != nil {
+			return "", opts, err
+		}
+	}
+
+	if rootfs == "" {
+		return "", opts, fmt.Errorf("missing rootfs directory or manifest")
+	}
+	if opts.Output == "" {
+		opts.Output = "initrd.cpio" + opts.Compression.Extension()
+	}
+	if err := opts.Compression.CheckLevel(opts.Level); err != nil {
+		return "", opts, err
+	}
+	if os.Getenv("ROCK_OUTPUT") == "json" {
+		opts.JSON = true
+	}
+
+	epoch, err := reproducibleOptions(reproducible)
+	if err != nil {
+		return "", opts, err
+	}
+	opts.Reproducible = epoch.Reproducible
+	opts.ModTime = epoch.ModTime
+	return rootfs, opts, nil
+}
+
+// ImageInfo identifies an image file
+type ImageInfo struct {
+	Path        string `json:"path"`
+	Size        int64  `json:"size"`
+	SHA256      string `json:"sha256"`
+	Compression string `json:"compression"`
+}
+
+// CreateResult describes a created image; --json prints it on stdout
+type CreateResult struct {
+	Image        ImageInfo `json:"image"`
+	Entries      int       `json:"entries"`
+	ArchiveSize  int64     `json:"archive_size"` // Uncompressed
+	Reproducible bool      `json:"reproducible"`
+	Verified     bool      `json:"verified"`
+	Manifest     string    `json:"manifest,omitempty"`
+}
+
+// Manifest lists the contents of an image, written by --manifest
+type Manifest struct {
+	Image   ImageInfo       `json:"image"`
+	Entries []ManifestEntry `json:"entries"`
+}
+
+// ManifestEntry describes one archive entry in a Manifest
+type ManifestEntry struct {
+	Name   string `json:"name"`
+	Type   string `json:"type"` // dir, file, symlink, char, block, fifo or socket
+	Mode   string `json:"mode"` // Permission bits in octal
+	UID    uint32 `json:"uid"`
+	GID    uint32 `json:"gid"`
+	Size   int64  `json:"size,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+	Link   string `json:"link,omitempty"`
+	Device string `json:"device,omitempty"` // major:minor
+}
+
+// entryType names the type of an archive entry
+func entryType(entry *cpio.Entry) string {
+	switch entry.Type() {
+	case cpio.TypeDir:
+		return "dir"
+	case cpio.TypeReg:
+		return "file"
+	case cpio.TypeSymlink:
+		return "symlink"
+	case cpio.TypeChar:
+		return "char"
+	case cpio.TypeBlock:
+		return "block"
+	case cpio.TypeFifo:
+		return "fifo"
+	case cpio.TypeSocket:
+		return "socket"
+	}
+	return fmt.Sprintf("%06o", entry.Type())
+}
+
+// newManifest lists the entries of an archive in archive order
+func newManifest(image ImageInfo, archive *cpio.Archive) *Manifest {
+	manifest := &Manifest{Image: image, Entries: make([]ManifestEntry, 0, len(archive.Entries))}
+	for i := range archive.Entries {
+		entry := &archive.Entries[i]
+		item := ManifestEntry{
+			Name: entry.Name,
+			Type: entryType(entry),
+			Mode: fmt.Sprintf("%04o", entry.Perm()),
+			UID:  entry.UID,
+			GID:  entry.GID,
+			Link: entry.Linkname,
+		}
+		switch {
+		case entry.IsRegular():
+			sum := sha256.Sum256(entry.Data)
+			item.Size = int64(len(entry.Data))
+			item.SHA256 = hex.EncodeToString(sum[:])
+		case entry.IsCharDevice() || entry.IsBlockDevice():
+			item.Device = fmt.Sprintf("%d:%d", entry.RDevMajor, entry.RDevMinor)
+		}
+		manifest.Entries = append(manifest.Entries, item)
+	}
+	return manifest
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames
+// it into place, so readers never see a partial file
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %w", dir, err)
+	}
+	tmp, err := os.CreateTemp(dir, ".rock-image-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// writeManifest writes the manifest of an archive as JSON
+func writeManifest(path string, image ImageInfo, archive *cpio.Archive) error {
+	data, err := json.MarshalIndent(newManifest(image, archive), "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, append(data, '\n'))
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rock-os/tools/pkg/cpio"
+)
+
+func TestParseCreateArgs(t *testing.T) {
+	t.Setenv("SOURCE_DATE_EPOCH", "")
+	t.Setenv("ROCK_OUTPUT", "")
+
+	tests := []struct {
+		args   []string
+		rootfs string
+		opts   CreateOptions
+	}{
+		{
+			[]string{"rootfs"},
+			"rootfs", CreateOptions{Compression: cpio.CompressGzip, Level: cpio.DefaultLevel, Output: "initrd.cpio.gz"},
+		},
+		{
+			[]string{"rootfs.yaml", "--output=out/rock.cpio.zst", "--compress=zstd", "--level=19", "--manifest=out/rock.json", "--no-verify", "--json"},
+			"rootfs.yaml", CreateOptions{Compression: cpio.CompressZstd, Level: 19, Output: "out/rock.cpio.zst", Manifest: "out/rock.json", NoVerify: true, JSON: true},
+		},
+		{
+			[]string{"--output", "rock.cpio", "--compress", "none", "rootfs", "--manifest", "rock.json"},
+			"rootfs", CreateOptions{Compression: cpio.CompressNone, Level: cpio.DefaultLevel, Output: "rock.cpio", Manifest: "rock.json"},
+		},
+		{
+			[]string{"rootfs", "--reproducible"},
+			"rootfs", CreateOptions{Compression: cpio.CompressGzip, Level: cpio.DefaultLevel, Output: "initrd.cpio.gz", Reproducible: true, ModTime: time.Unix(0, 0).UTC()},
+		},
+	}
+	for _, test := range tests {
+		rootfs, opts, err := parseCreateArgs(test.args)
+		if err != nil {
+			t.Errorf("parseCreateArgs(%v): %v", test.args, err)
+			continue
+		}
+		if rootfs != test.rootfs || !reflect.DeepEqual(opts, test.opts) {
+			t.Errorf("parseCreateArgs(%v) = %s, %+v; want %s, %+v", test.args, rootfs, opts, test.rootfs, test.opts)
+		}
+	}
+
+	errors := map[string][]string{
+		"unknown option: --fast":     {"rootfs", "--fast"},
+		"unknown option: --outptu=x": {"rootfs", "--outptu=x"},
+		"unexpected argument: extra": {"rootfs", "extra"},
+		"--output requires a value":  {"rootfs", "--output"},
+		"invalid --level value: max": {"rootfs", "--level=max"},
+		"missing rootfs":             {"--output=rock.cpio"},
+		"unknown compression":        {"rootfs", "--compress=bz2"},
+	}
+	for want, args := range errors {
+		if _, _, err := parseCreateArgs(args); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("parseCreateArgs(%v) error = %v, want %q", args, err, want)
+		}
+	}
+
+	t.Setenv("SOURCE_DATE_EPOCH", "x")
+	if _, _, err := parseCreateArgs([]string{"rootfs"}); err == nil || !strings.Contains(err.Error(), "invalid SOURCE_DATE_EPOCH") {
+		t.Errorf("SOURCE_DATE_EPOCH=x: error = %v", err)
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "out", "rock.json")
+
+	for _, data := range []string{"first", "second"} {
+		if err := writeFileAtomic(path, []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := os.ReadFile(path); err != nil || string(got) != data {
+			t.Errorf("read %q, %v; want %q", got, err, data)
+		}
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0644 {
+		t.Errorf("mode = %v, %v; want 0644", info.Mode(), err)
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(path)); len(entries) != 1 {
+		t.Errorf("temp files left behind: %v", entries)
+	}
+}
+
+// writeTestManifest writes a rootfs manifest whose contract binaries are
+// stubs holding their own names, plus extra lines, and returns its path
+func writeTestManifest(t *testing.T, dir, extra string) string {
+	t.Helper()
+	bin := filepath.Join(dir, "bin")
+	if err := os.MkdirAll(bin, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"rock-init", "rock-manager", "volcano-agent", "busybox"} {
+		if err := os.WriteFile(filepath.Join(bin, name), []byte(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	manifest := filepath.Join(dir, "rootfs.yaml")
+	if err := os.WriteFile(manifest, []byte("binaries: bin\n"+extra), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return manifest
+}
+
+func TestCreateCPIOManifest(t *testing.T) {
+	dir := t.TempDir()
+	manifest := writeTestManifest(t, dir, "generated:\n  - {path: /etc/hostname, content: \"rock\\n\"}\n")
+	output := filepath.Join(dir, "out", "rock.cpio.gz")
+	listing := filepath.Join(dir, "out", "rock.json")
+
+	result, err := CreateCPIO(manifest, CreateOptions{
+		Compression:  cpio.CompressGzip,
+		Level:        cpio.DefaultLevel,
+		Output:       output,
+		Manifest:     listing,
+		Reproducible: true,
+		ModTime:      time.Unix(0, 0).UTC(),
+	}, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Verified || !result.Reproducible || result.Manifest != listing {
+		t.Errorf("result = %+v", result)
+	}
+	sum, err := fileDigest(output)
+	if err != nil || sum != result.Image.SHA256 {
+		t.Errorf("image sha256 = %s, %v; result says %s", sum, err, result.Image.SHA256)
+	}
+	// Only the image is left in the output directory, next to the listing
+	if entries, _ := os.ReadDir(filepath.Dir(output)); len(entries) != 2 {
+		t.Errorf("output directory holds %v", entries)
+	}
+
+	data, err := os.ReadFile(listing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var written Manifest
+	if err := json.Unmarshal(data, &written); err != nil {
+		t.Fatal(err)
+	}
+	if written.Image != result.Image || len(written.Entries) != result.Entries {
+		t.Errorf("manifest image %+v with %d entries; result %+v with %d", written.Image, len(written.Entries), result.Image, result.Entries)
+	}
+	entries := make(map[string]ManifestEntry)
+	for _, entry := range written.Entries {
+		entries[entry.Name] = entry
+	}
+	if init := entries["sbin/init"]; init.Type != "file" || init.Mode != "0755" || init.Size != int64(len("rock-init")) || init.SHA256 == "" {
+		t.Errorf("sbin/init = %+v", init)
+	}
+	if console := entries["dev/console"]; console.Type != "char" || console.Device != "5:1" {
+		t.Errorf("dev/console = %+v", console)
+	}
+
+	// The image is a valid initramfs
+	archive, err := cpio.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyArchive(archive, io.Discard); err != nil {
+		t.Error(err)
+	}
+	if hostname, ok := archive.Lstat("etc/hostname"); !ok || string(hostname.Data) != "rock\n" {
+		t.Errorf("etc/hostname = %+v", hostname)
+	}
+
+	// A manifest missing a contract binary fails without touching the
+	// output
+	os.Remove(filepath.Join(dir, "bin", "rock-manager"))
+	if _, err := CreateCPIO(manifest, CreateOptions{Output: output}, io.Discard); err == nil {
+		t.Error("created an image without rock-manager")
+	}
+	if sum, _ := fileDigest(output); sum != result.Image.SHA256 {
+		t.Error("failed build replaced the image")
+	}
+}
@@ -5,28 +5,42 @@
 //
 // Usage:
 //   rock-image cpio create <rootfs-dir>    - Create initramfs from directory
+//   rock-image cpio create <manifest.yaml> - Create initramfs from a rootfs manifest
+//       [--output=FILE] [--compress=gzip|zstd|xz|lz4|none] [--level=N]
+//       [--manifest=FILE] [--reproducible] [--no-verify] [--json]
 //   rock-image cpio extract <image.cpio.gz> - Extract for inspection
 //   rock-image cpio verify <image.cpio.gz>  - Verify rock-init integration
+//   rock-image diff <image-a> <image-b>     - Check two builds are identical
+//   rock-image compose <base-image> --output=FILE [--early=PATH]
+//       [--overlay=PATH]... [--compress=NAME] [--level=N]
+//       [--reproducible] [--no-verify] [--json]
+//                                           - Concatenate early, base and overlay segments
+//   rock-image inspect <image> [--json]     - List segments and the merged tree
 //   rock-image structure                    - Show required structure
 //
 // Build:
-//   go build -o rock-image cmd/rock-image/main.go
+//   go build -o rock-image ./cmd/rock-image
 //
 // CRITICAL: This tool MUST use the paths from pkg/integration
 
 package main
 
 import (
+	"bufio"
 	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
+	"time"
 
+	"github.com/rock-os/tools/pkg/cpio"
 	"github.com/rock-os/tools/pkg/integration"
+	"github.com/rock-os/tools/pkg/rootfs"
 )
 
 var (
@@ -35,153 +49,349 @@ var (
 	GitCommit = "unknown"
 )
 
-// CreateCPIO creates a CPIO archive from a rootfs directory
-func CreateCPIO(rootfsPath string) error {
-	// First verify the rootfs structure
-	fmt.Println("Step 1: Verifying rootfs structure...")
-	if err := verifyRootfsStructure(rootfsPath); err != nil {
-		return fmt.Errorf("rootfs verification failed: %w", err)
-	}
-	fmt.Println("✅ Rootfs structure verified")
-
-	// Generate output filename
-	outputPath := "initrd.cpio.gz"
-	fmt.Printf("\nStep 2: Creating CPIO archive: %s\n", outputPath)
+// CreateOptions controls how CreateCPIO builds an image
+type CreateOptions struct {
+	// Reproducible builds the same bytes from the same rootfs: every entry
+	// gets ModTime, entries are sorted, owned by 0:0 and numbered
+	// sequentially. Compressors never record names or times.
+	Reproducible bool
+	ModTime      time.Time
+
+	// Compression and Level select the compressor; an empty Compression
+	// is gzip
+	Compression cpio.Compression
+	Level       int
+
+	Output   string // Image path; initrd.cpio plus the compression's extension by default
+	Manifest string // If set, a JSON listing of the image contents is written here
+	NoVerify bool   // Skip checking the rootfs and the created image
+	JSON     bool   // Print the CreateResult as JSON on stdout
+}
 
-	// Use the system cpio command for compatibility
-	// The newc format is required for Linux initramfs
-	tempCpio := "initrd.cpio"
+// reproducibleOptions returns the options for a reproducible build when
+// requested with --reproducible or by SOURCE_DATE_EPOCH being set. The
+// timestamp is SOURCE_DATE_EPOCH, or 1970-01-01 without it.
+func reproducibleOptions(requested bool) (CreateOptions, error) {
+	epoch, ok, err := cpio.SourceDateEpoch()
+	if err != nil {
+		return CreateOptions{}, err
+	}
+	if !requested && !ok {
+		return CreateOptions{}, nil
+	}
+	if !ok {
+		epoch = time.Unix(0, 0).UTC()
+	}
+	return CreateOptions{Reproducible: true, ModTime: epoch}, nil
+}
 
-	// Build file list
-	var files []string
-	err := filepath.Walk(rootfsPath, func(path string, info os.FileInfo, err error) error {
+// CreateCPIO creates a CPIO archive from a rootfs directory, or from a
+// rootfs manifest (see pkg/rootfs) when rootfsPath is a file. The image is
+// written and verified in a private temp directory next to the output and
+// then renamed into place, so the output path never holds a partial or
+// unverified image and concurrent builds do not collide.
+func CreateCPIO(rootfsPath string, opts CreateOptions, out io.Writer) (*CreateResult, error) {
+	// A manifest is resolved to entries and archived without staging a
+	// directory; it brings its own device nodes. A directory is checked
+	// for the required structure first.
+	var overlay []cpio.Entry
+	if info, err := os.Stat(rootfsPath); err == nil && !info.IsDir() {
+		fmt.Fprintf(out, "Step 1: Resolving rootfs manifest: %s\n", rootfsPath)
+		manifest, err := rootfs.Load(rootfsPath)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		relPath, _ := filepath.Rel(rootfsPath, path)
-		if relPath != "." {
-			files = append(files, relPath)
+		if overlay, err = manifest.Entries(); err != nil {
+			return nil, fmt.Errorf("rootfs manifest: %w", err)
 		}
-		return nil
-	})
-	if err != nil {
-		return fmt.Errorf("failed to walk rootfs: %w", err)
+		fmt.Fprintf(out, "✅ Resolved %d entries\n", len(overlay))
+		rootfsPath = ""
+	} else if opts.NoVerify {
+		fmt.Fprintln(out, "⚠️  Skipping rootfs and image verification (--no-verify)")
+	} else {
+		fmt.Fprintln(out, "Step 1: Verifying rootfs structure...")
+		if err := verifyRootfsStructure(rootfsPath, out); err != nil {
+			return nil, fmt.Errorf("rootfs verification failed: %w", err)
+		}
+		fmt.Fprintln(out, "✅ Rootfs structure verified")
 	}
 
-	// Get absolute path for temp cpio
-	absTempCpio, _ := filepath.Abs(tempCpio)
-
-	// Create CPIO using find and cpio commands
-	// CRITICAL: Use paths without leading "./" for kernel to mount properly
-	// Using find * instead of find . to avoid "./" prefix naturally
-	cmd := exec.Command("sh", "-c",
-		fmt.Sprintf("cd %s && find * -print0 | cpio -o -H newc -0 > %s 2>/dev/null",
-			rootfsPath, absTempCpio))
+	compression := opts.Compression
+	if compression == "" {
+		compression = cpio.CompressGzip
+	}
+	outputPath := opts.Output
+	if outputPath == "" {
+		outputPath = "initrd.cpio" + compression.Extension()
+	}
+	fmt.Fprintf(out, "\nStep 2: Creating CPIO archive (%s): %s\n", compression, outputPath)
 
-	output, err := cmd.CombinedOutput()
+	outputDir := filepath.Dir(outputPath)
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create output directory: %w", err)
+	}
+	tmpDir, err := os.MkdirTemp(outputDir, ".rock-image-")
 	if err != nil {
-		return fmt.Errorf("failed to create cpio: %v\nOutput: %s", err, output)
+		return nil, fmt.Errorf("failed to create temp directory: %w", err)
 	}
+	defer os.RemoveAll(tmpDir)
+	tmpPath := filepath.Join(tmpDir, filepath.Base(outputPath))
 
-	fmt.Printf("  Created CPIO archive (%d files)\n", len(files))
+	outFile, err := os.Create(tmpPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create output file: %w", err)
+	}
+	defer outFile.Close()
 
-	// Compress with gzip
-	fmt.Println("\nStep 3: Compressing with gzip...")
-	cpioData, err := ioutil.ReadFile(absTempCpio)
+	// The archive streams straight into the compressor; the uncompressed
+	// image never exists in full on disk or in memory
+	digest := sha256.New()
+	compressor, err := cpio.NewCompressor(io.MultiWriter(outFile, digest), compression, opts.Level)
+	if err != nil {
+		return nil, err
+	}
+	archive := &countingWriter{w: compressor}
+
+	// Write the archive natively so ownership and device nodes do not
+	// depend on the host cpio binary or on running as root.
+	// CRITICAL: Names are stored without a leading "./" for the kernel.
+	// The newc format is required for Linux initramfs.
+	modTime := time.Now()
+	if opts.Reproducible {
+		modTime = opts.ModTime
+		fmt.Fprintf(out, "  Reproducible build: timestamps %s, owner 0:0, sorted entries\n", modTime.Format(time.RFC3339))
+	}
+	if rootfsPath != "" {
+		overlay = deviceNodeOverlay(modTime)
+	}
+	count, err := cpio.WriteTree(archive, rootfsPath, cpio.TreeOptions{
+		Format:  cpio.FormatNewc,
+		Overlay: overlay,
+		ModTime: opts.ModTime,
+	})
+	if closeErr := compressor.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := outFile.Close(); err == nil {
+		err = closeErr
+	}
 	if err != nil {
-		return fmt.Errorf("failed to read cpio: %w", err)
+		return nil, fmt.Errorf("failed to create cpio: %w", err)
 	}
 
-	outFile, err := os.Create(outputPath)
+	stat, err := os.Stat(tmpPath)
 	if err != nil {
-		return fmt.Errorf("failed to create output file: %w", err)
+		return nil, err
+	}
+	fmt.Fprintf(out, "  Created CPIO archive (%d entries, %.2f MB)\n", count, float64(archive.n)/(1024*1024))
+	fmt.Fprintf(out, "  Compressed size: %.2f MB\n", float64(stat.Size())/(1024*1024))
+
+	result := &CreateResult{
+		Image: ImageInfo{
+			Path:        outputPath,
+			Size:        stat.Size(),
+			SHA256:      hex.EncodeToString(digest.Sum(nil)),
+			Compression: string(compression),
+		},
+		Entries:      count,
+		ArchiveSize:  archive.n,
+		Reproducible: opts.Reproducible,
 	}
-	defer outFile.Close()
 
-	gzWriter := gzip.NewWriter(outFile)
-	defer gzWriter.Close()
+	if !opts.NoVerify || opts.Manifest != "" {
+		image, err := cpio.ReadFile(tmpPath)
+		if err != nil {
+			return nil, err
+		}
+
+		// Verify the created image
+		if !opts.NoVerify {
+			fmt.Fprintln(out, "\nStep 3: Verifying created image...")
+			fmt.Fprintf(out, "Verifying CPIO archive: %s\n", outputPath)
+			fmt.Fprintln(out, "="+strings.Repeat("=", 50))
+			if err := verifyArchive(image, out); err != nil {
+				return nil, fmt.Errorf("verification failed: %w", err)
+			}
+			result.Verified = true
+		}
 
-	if _, err := gzWriter.Write(cpioData); err != nil {
-		return fmt.Errorf("failed to compress: %w", err)
+		if opts.Manifest != "" {
+			if err := writeManifest(opts.Manifest, result.Image, image); err != nil {
+				return nil, fmt.Errorf("failed to write manifest: %w", err)
+			}
+			result.Manifest = opts.Manifest
+			fmt.Fprintf(out, "\n📝 Wrote manifest: %s\n", opts.Manifest)
+		}
 	}
 
-	// Clean up temp file
-	os.Remove(absTempCpio)
+	if err := os.Rename(tmpPath, outputPath); err != nil {
+		return nil, fmt.Errorf("failed to move image into place: %w", err)
+	}
+
+	fmt.Fprintf(out, "\n✅ Successfully created initramfs: %s\n", outputPath)
+	fmt.Fprintln(out, "\nYou can now boot with:")
+	fmt.Fprintf(out, "  qemu-system-x86_64 -kernel vmlinuz -initrd %s\n", outputPath)
+	return result, nil
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
 
-	// Get file size
-	gzWriter.Close()
-	outFile.Close()
-	stat, _ := os.Stat(outputPath)
-	fmt.Printf("  Compressed size: %.2f MB\n", float64(stat.Size())/(1024*1024))
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
 
-	// Verify the created image
-	fmt.Println("\nStep 4: Verifying created image...")
-	if err := VerifyCPIO(outputPath); err != nil {
-		return fmt.Errorf("verification failed: %w", err)
+// deviceNodeOverlay returns the required device nodes as synthetic
+// root-owned char devices, so the image has them without running mknod
+func deviceNodeOverlay(now time.Time) []cpio.Entry {
+	entries := make([]cpio.Entry, 0, len(integration.RequiredDeviceNodes))
+	for _, node := range integration.RequiredDeviceNodes {
+		entries = append(entries, cpio.Entry{Header: cpio.Header{
+			Name:      node.Path,
+			Mode:      cpio.TypeChar | node.Mode,
+			ModTime:   now,
+			RDevMajor: node.Major,
+			RDevMinor: node.Minor,
+		}})
+	}
+	return entries
+}
+
+// DiffImages compares two images and reports whether they are
+// bit-for-bit identical. If they are not, it shows where they differ: in
+// the compressed stream only, or in the archive entries.
+func DiffImages(pathA, pathB string, out io.Writer) (bool, error) {
+	fmt.Fprintln(out, "Comparing images:")
+	sumA, err := fileDigest(pathA)
+	if err != nil {
+		return false, err
+	}
+	sumB, err := fileDigest(pathB)
+	if err != nil {
+		return false, err
+	}
+	fmt.Fprintf(out, "  A: %s  %s\n", sumA, pathA)
+	fmt.Fprintf(out, "  B: %s  %s\n", sumB, pathB)
+	if sumA == sumB {
+		fmt.Fprintln(out, "\n✅ Images are bit-for-bit identical")
+		return true, nil
 	}
 
-	fmt.Printf("\n✅ Successfully created initramfs: %s\n", outputPath)
-	fmt.Println("\nYou can now boot with:")
-	fmt.Printf("  qemu-system-x86_64 -kernel vmlinuz -initrd %s\n", outputPath)
-	return nil
+	archiveA, err := cpio.ReadFile(pathA)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", pathA, err)
+	}
+	archiveB, err := cpio.ReadFile(pathB)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", pathB, err)
+	}
+
+	diffs := cpio.Diff(archiveA, archiveB)
+	if len(diffs) == 0 {
+		fmt.Fprintln(out, "\n❌ Images differ, but their archives are identical")
+		fmt.Fprintln(out, "   The compression differs: check the compressor, its level and header")
+		for _, path := range []string{pathA, pathB} {
+			fmt.Fprintf(out, "   %s: %s\n", path, describeCompression(path))
+		}
+		return false, nil
+	}
+
+	fmt.Fprintf(out, "\n❌ Images differ in %d places:\n", len(diffs))
+	for _, diff := range diffs {
+		fmt.Fprintf(out, "  • %s\n", diff)
+	}
+	return false, nil
 }
 
-// ExtractCPIO extracts a CPIO archive for inspection
-func ExtractCPIO(imagePath string) error {
-	fmt.Printf("Extracting CPIO archive: %s\n", imagePath)
+// fileDigest returns the SHA256 of a file
+func fileDigest(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open image: %w", err)
+	}
+	defer file.Close()
 
-	// Create extraction directory
-	extractDir := strings.TrimSuffix(imagePath, ".cpio.gz") + "_extracted"
-	if err := os.MkdirAll(extractDir, 0755); err != nil {
-		return fmt.Errorf("failed to create extract directory: %w", err)
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", path, err)
 	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
 
-	// Decompress if gzipped
-	var cpioReader io.Reader
-	file, err := os.Open(imagePath)
+// describeCompression names the compression of an image and, for gzip,
+// the header fields that vary between otherwise identical builds
+func describeCompression(path string) string {
+	file, err := os.Open(path)
 	if err != nil {
-		return fmt.Errorf("failed to open image: %w", err)
+		return err.Error()
 	}
 	defer file.Close()
 
-	if strings.HasSuffix(imagePath, ".gz") {
-		gzReader, err := gzip.NewReader(file)
-		if err != nil {
-			return fmt.Errorf("failed to create gzip reader: %w", err)
-		}
-		defer gzReader.Close()
-		cpioReader = gzReader
-	} else {
-		cpioReader = file
+	br := bufio.NewReader(file)
+	magic, _ := br.Peek(8)
+	compression := cpio.DetectCompression(magic)
+	if compression != cpio.CompressGzip {
+		return string(compression)
 	}
 
-	// Write to temp file for cpio extraction
-	tempCpio := filepath.Join(extractDir, "temp.cpio")
-	tempFile, err := os.Create(tempCpio)
+	gz, err := gzip.NewReader(br)
 	if err != nil {
-		return fmt.Errorf("failed to create temp file: %w", err)
+		return fmt.Sprintf("gzip, unreadable header: %v", err)
+	}
+	defer gz.Close()
+	mtime := "0"
+	if !gz.ModTime.IsZero() {
+		mtime = gz.ModTime.UTC().Format(time.RFC3339)
 	}
+	return fmt.Sprintf("gzip, header name %q, mtime %s, os %d", gz.Name, mtime, gz.OS)
+}
 
-	if _, err := io.Copy(tempFile, cpioReader); err != nil {
-		tempFile.Close()
-		return fmt.Errorf("failed to copy cpio data: %w", err)
+// imageStem returns an image path without its compression and .cpio
+// extensions, such as "initrd" for initrd.cpio.zst
+func imageStem(imagePath string) string {
+	for _, compression := range cpio.Compressions {
+		if ext := compression.Extension(); ext != "" && strings.HasSuffix(imagePath, ".cpio"+ext) {
+			return strings.TrimSuffix(imagePath, ".cpio"+ext)
+		}
 	}
-	tempFile.Close()
+	return strings.TrimSuffix(imagePath, ".cpio")
+}
 
-	// Extract using cpio command
-	cmd := exec.Command("sh", "-c",
-		fmt.Sprintf("cd %s && cpio -i -d < temp.cpio 2>/dev/null", extractDir))
+// ExtractCPIO extracts a CPIO archive for inspection
+func ExtractCPIO(imagePath string) error {
+	fmt.Printf("Extracting CPIO archive: %s\n", imagePath)
 
-	if output, err := cmd.CombinedOutput(); err != nil {
-		os.Remove(tempCpio)
-		return fmt.Errorf("failed to extract cpio: %v\nOutput: %s", err, output)
+	archive, err := cpio.ReadFile(imagePath)
+	if err != nil {
+		return err
 	}
 
-	// Clean up temp file
-	os.Remove(tempCpio)
+	// Create extraction directory
+	extractDir := imageStem(imagePath) + "_extracted"
+	if err := os.MkdirAll(extractDir, 0755); err != nil {
+		return fmt.Errorf("failed to create extract directory: %w", err)
+	}
+
+	skipped, err := extractArchive(archive, extractDir)
+	if err != nil {
+		return fmt.Errorf("failed to extract cpio: %w", err)
+	}
 
 	fmt.Printf("✅ Extracted to: %s\n", extractDir)
 
+	// Device nodes need root to create, so list them from the archive instead
+	if len(skipped) > 0 {
+		fmt.Println("\nDevice nodes (not created on disk):")
+		for _, entry := range skipped {
+			fmt.Printf("  %s %s\n", entry.Name, describeEntry(entry))
+		}
+	}
+
 	// List critical files
 	fmt.Println("\nCritical files found:")
 	criticalPaths := []string{
@@ -193,13 +403,11 @@ func ExtractCPIO(imagePath string) error {
 	}
 
 	for _, path := range criticalPaths {
-		fullPath := filepath.Join(extractDir, path)
-		if info, err := os.Lstat(fullPath); err == nil {
-			if info.Mode()&os.ModeSymlink != 0 {
-				target, _ := os.Readlink(fullPath)
-				fmt.Printf("  ✓ %s -> %s\n", path, target)
+		if entry, ok := archive.Lstat(path); ok {
+			if entry.IsSymlink() {
+				fmt.Printf("  ✓ %s -> %s\n", path, entry.Linkname)
 			} else {
-				fmt.Printf("  ✓ %s (%.2f MB)\n", path, float64(info.Size())/(1024*1024))
+				fmt.Printf("  ✓ %s (%.2f MB)\n", path, float64(entry.Size)/(1024*1024))
 			}
 		} else {
 			fmt.Printf("  ✗ %s NOT FOUND\n", path)
@@ -209,124 +417,207 @@ func ExtractCPIO(imagePath string) error {
 	return nil
 }
 
-// VerifyCPIO verifies that a CPIO archive meets rock-init integration requirements
-func VerifyCPIO(imagePath string) error {
-	fmt.Printf("Verifying CPIO archive: %s\n", imagePath)
-	fmt.Println("=" + strings.Repeat("=", 50))
+// extractArchive writes directories, files and symlinks from archive into
+// dir. Device nodes and other special files are returned instead of created.
+// Nothing is written through a symlink, so an archive cannot reach outside
+// dir by extracting a symlink and then entries beneath it.
+func extractArchive(archive *cpio.Archive, dir string) ([]*cpio.Entry, error) {
+	var skipped []*cpio.Entry
+	names := archive.Names()
+	for i := range archive.Entries {
+		entry := &archive.Entries[i]
+		name := names[i]
+		if name == "" {
+			continue // The archive root is dir itself
+		}
 
-	// Create temp directory for extraction
-	tempDir, err := ioutil.TempDir("", "rock-verify-")
-	if err != nil {
-		return fmt.Errorf("failed to create temp dir: %w", err)
-	}
-	defer os.RemoveAll(tempDir)
+		// Refuse names that would escape the extraction directory
+		target := filepath.Join(dir, filepath.FromSlash(name))
+		if !strings.HasPrefix(target, filepath.Clean(dir)+string(os.PathSeparator)) {
+			return nil, fmt.Errorf("unsafe path in archive: %s", entry.Name)
+		}
+		if !entry.IsDir() && !entry.IsRegular() && !entry.IsSymlink() {
+			skipped = append(skipped, entry)
+			continue
+		}
+		if err := makeParents(dir, name); err != nil {
+			return nil, err
+		}
 
-	// Extract the archive
-	file, err := os.Open(imagePath)
-	if err != nil {
-		return fmt.Errorf("failed to open image: %w", err)
-	}
-	defer file.Close()
+		// Like the kernel, a later entry replaces an earlier file or
+		// symlink; removing it first keeps writes off a symlink's target
+		existing, err := os.Lstat(target)
+		if err == nil && !existing.IsDir() {
+			if err := os.Remove(target); err != nil {
+				return nil, err
+			}
+		} else if err == nil && !entry.IsDir() {
+			return nil, fmt.Errorf("%s: refusing to replace a directory", entry.Name)
+		}
 
-	var cpioReader io.Reader = file
-	if strings.HasSuffix(imagePath, ".gz") {
-		gzReader, err := gzip.NewReader(file)
-		if err != nil {
-			return fmt.Errorf("failed to create gzip reader: %w", err)
+		switch {
+		case entry.IsDir():
+			if err := os.MkdirAll(target, os.FileMode(entry.Perm()|0700)); err != nil {
+				return nil, err
+			}
+		case entry.IsRegular():
+			if err := os.WriteFile(target, entry.Data, os.FileMode(entry.Perm())); err != nil {
+				return nil, err
+			}
+		case entry.IsSymlink():
+			if err := os.Symlink(entry.Linkname, target); err != nil {
+				return nil, err
+			}
 		}
-		defer gzReader.Close()
-		cpioReader = gzReader
 	}
+	return skipped, nil
+}
 
-	// Write to temp file and extract
-	tempCpio := filepath.Join(tempDir, "temp.cpio")
-	tempFile, err := os.Create(tempCpio)
-	if err != nil {
-		return fmt.Errorf("failed to create temp file: %w", err)
+// makeParents creates the directories leading to name under dir, one
+// component at a time. A component that is a symlink or a file extracted
+// earlier is an error rather than something to follow or replace.
+func makeParents(dir, name string) error {
+	parent := dir
+	components := strings.Split(name, "/")
+	for i, component := range components[:len(components)-1] {
+		parent = filepath.Join(parent, component)
+		info, err := os.Lstat(parent)
+		switch {
+		case os.IsNotExist(err):
+			if err := os.Mkdir(parent, 0755); err != nil {
+				return err
+			}
+		case err != nil:
+			return err
+		case info.Mode()&os.ModeSymlink != 0:
+			return fmt.Errorf("unsafe path in archive: %s: %s is a symlink", name, strings.Join(components[:i+1], "/"))
+		case !info.IsDir():
+			return fmt.Errorf("unsafe path in archive: %s: %s is not a directory", name, strings.Join(components[:i+1], "/"))
+		}
 	}
+	return nil
+}
 
-	if _, err := io.Copy(tempFile, cpioReader); err != nil {
-		tempFile.Close()
-		return fmt.Errorf("failed to copy cpio data: %w", err)
+// describeEntry returns a short description of an entry's type
+func describeEntry(entry *cpio.Entry) string {
+	switch {
+	case entry.IsCharDevice():
+		return fmt.Sprintf("(char %d:%d, mode %04o)", entry.RDevMajor, entry.RDevMinor, entry.Perm())
+	case entry.IsBlockDevice():
+		return fmt.Sprintf("(block %d:%d, mode %04o)", entry.RDevMajor, entry.RDevMinor, entry.Perm())
+	case entry.IsSymlink():
+		return "-> " + entry.Linkname
+	case entry.IsDir():
+		return fmt.Sprintf("(directory, mode %04o)", entry.Perm())
+	default:
+		return fmt.Sprintf("(mode %06o)", entry.Mode)
 	}
-	tempFile.Close()
+}
 
-	// Extract using cpio
-	cmd := exec.Command("sh", "-c",
-		fmt.Sprintf("cd %s && cpio -i -d < temp.cpio 2>/dev/null", tempDir))
+// VerifyCPIO verifies that a CPIO archive meets rock-init integration requirements
+func VerifyCPIO(imagePath string) error {
+	fmt.Printf("Verifying CPIO archive: %s\n", imagePath)
+	fmt.Println("=" + strings.Repeat("=", 50))
 
-	if _, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("failed to extract for verification: %w", err)
+	// Read the archive in memory; nothing is extracted to disk
+	archive, err := cpio.ReadFile(imagePath)
+	if err != nil {
+		return err
 	}
+	return verifyArchive(archive, os.Stdout)
+}
 
+// verifyArchive checks an image read into memory against the rock-init
+// integration requirements
+func verifyArchive(archive *cpio.Archive, out io.Writer) error {
 	// Verify structure
 	var errors []string
 	var warnings []string
 
-	fmt.Println("\nChecking critical binaries...")
+	fmt.Fprintln(out, "\nChecking critical binaries...")
 	for _, binary := range integration.RequiredBinaries {
-		path := filepath.Join(tempDir, strings.TrimPrefix(binary.Destination, "/"))
-		if info, err := os.Stat(path); err != nil {
+		if entry, ok := archive.Stat(binary.Destination); !ok || !entry.IsRegular() {
 			errors = append(errors, fmt.Sprintf("MISSING: %s", binary.Destination))
 		} else {
 			// Special check for rock-init -> init rename
 			if binary.Source == "rock-init" && binary.Destination == "/sbin/init" {
-				fmt.Printf("  ✅ %s (renamed from %s)\n", binary.Destination, binary.Source)
+				fmt.Fprintf(out, "  ✅ %s (renamed from %s)\n", binary.Destination, binary.Source)
 			} else {
-				fmt.Printf("  ✅ %s (%.2f MB)\n", binary.Destination, float64(info.Size())/(1024*1024))
+				fmt.Fprintf(out, "  ✅ %s (%.2f MB)\n", binary.Destination, float64(entry.Size)/(1024*1024))
 			}
 		}
 	}
 
-	fmt.Println("\nChecking busybox symlinks...")
+	fmt.Fprintln(out, "\nChecking busybox symlinks...")
 	essentialSymlinks := []string{"sh", "ls", "cat", "echo", "mount", "umount"}
 	for _, symlink := range essentialSymlinks {
-		path := filepath.Join(tempDir, "bin", symlink)
-		if info, err := os.Lstat(path); err != nil {
+		if entry, ok := archive.Lstat("bin/" + symlink); !ok {
 			if symlink == "sh" {
 				errors = append(errors, fmt.Sprintf("CRITICAL: /bin/sh missing (shell required)"))
 			} else {
 				warnings = append(warnings, fmt.Sprintf("Missing symlink: /bin/%s", symlink))
 			}
-		} else if info.Mode()&os.ModeSymlink != 0 {
-			target, _ := os.Readlink(path)
+		} else if entry.IsSymlink() {
+			target := entry.Linkname
 			if target == "busybox" || target == "/bin/busybox" {
-				fmt.Printf("  ✅ /bin/%s -> busybox\n", symlink)
+				fmt.Fprintf(out, "  ✅ /bin/%s -> busybox\n", symlink)
 			} else {
 				warnings = append(warnings, fmt.Sprintf("/bin/%s points to %s (expected busybox)", symlink, target))
 			}
 		}
 	}
 
-	fmt.Println("\nChecking required directories...")
+	fmt.Fprintln(out, "\nChecking required directories...")
 	criticalDirs := []string{"/proc", "/sys", "/dev", "/tmp", "/sbin", "/bin", "/usr/bin", "/config"}
 	for _, dir := range criticalDirs {
-		path := filepath.Join(tempDir, strings.TrimPrefix(dir, "/"))
-		if info, err := os.Stat(path); err != nil || !info.IsDir() {
+		if entry, ok := archive.Stat(dir); !ok || !entry.IsDir() {
 			warnings = append(warnings, fmt.Sprintf("Missing directory: %s", dir))
 		} else {
-			fmt.Printf("  ✅ %s/\n", dir)
+			fmt.Fprintf(out, "  ✅ %s/\n", dir)
+		}
+	}
+
+	fmt.Fprintln(out, "\nChecking device nodes...")
+	for _, node := range integration.RequiredDeviceNodes {
+		entry, ok := archive.Lstat(node.Path)
+		switch {
+		case !ok:
+			if node.Path == "/dev/console" {
+				errors = append(errors, "CRITICAL: /dev/console missing (init has no console)")
+			} else {
+				warnings = append(warnings, fmt.Sprintf("Missing device node: %s", node.Path))
+			}
+		case !entry.IsCharDevice() || entry.RDevMajor != node.Major || entry.RDevMinor != node.Minor:
+			problem := fmt.Sprintf("%s is %s, expected char %d:%d",
+				node.Path, describeEntry(entry), node.Major, node.Minor)
+			if node.Path == "/dev/console" {
+				errors = append(errors, "CRITICAL: "+problem)
+			} else {
+				warnings = append(warnings, problem)
+			}
+		default:
+			fmt.Fprintf(out, "  ✅ %s (char %d:%d)\n", node.Path, node.Major, node.Minor)
 		}
 	}
 
 	// Print results
-	fmt.Println("\n" + strings.Repeat("=", 50))
+	fmt.Fprintln(out, "\n"+strings.Repeat("=", 50))
 	if len(errors) == 0 {
-		fmt.Println("✅ INTEGRATION VERIFICATION PASSED")
-		fmt.Println("This image should boot with rock-init!")
+		fmt.Fprintln(out, "✅ INTEGRATION VERIFICATION PASSED")
+		fmt.Fprintln(out, "This image should boot with rock-init!")
 	} else {
-		fmt.Println("❌ INTEGRATION VERIFICATION FAILED")
-		fmt.Println("\nCritical Errors:")
+		fmt.Fprintln(out, "❌ INTEGRATION VERIFICATION FAILED")
+		fmt.Fprintln(out, "\nCritical Errors:")
 		for _, err := range errors {
-			fmt.Printf("  ❌ %s\n", err)
+			fmt.Fprintf(out, "  ❌ %s\n", err)
 		}
-		fmt.Println("\n⚠️  This image will NOT boot with rock-init!")
+		fmt.Fprintln(out, "\n⚠️  This image will NOT boot with rock-init!")
 	}
 
 	if len(warnings) > 0 {
-		fmt.Println("\nWarnings:")
+		fmt.Fprintln(out, "\nWarnings:")
 		for _, warn := range warnings {
-			fmt.Printf("  ⚠️  %s\n", warn)
+			fmt.Fprintf(out, "  ⚠️  %s\n", warn)
 		}
 	}
 
@@ -338,7 +629,7 @@ func VerifyCPIO(imagePath string) error {
 }
 
 // verifyRootfsStructure checks if rootfs has required files before creating CPIO
-func verifyRootfsStructure(rootfsPath string) error {
+func verifyRootfsStructure(rootfsPath string, out io.Writer) error {
 	var errors []string
 
 	// Check critical binaries
@@ -360,13 +651,13 @@ func verifyRootfsStructure(rootfsPath string) error {
 		errors = append(errors, "/bin/sh not found (shell required)")
 	} else if info.Mode()&os.ModeSymlink == 0 {
 		// It exists but not a symlink - still might work but warn
-		fmt.Printf("  ⚠️  /bin/sh exists but is not a symlink to busybox\n")
+		fmt.Fprintf(out, "  ⚠️  /bin/sh exists but is not a symlink to busybox\n")
 	}
 
 	if len(errors) > 0 {
-		fmt.Println("❌ Rootfs structure errors:")
+		fmt.Fprintln(out, "❌ Rootfs structure errors:")
 		for _, err := range errors {
-			fmt.Printf("  • %s\n", err)
+			fmt.Fprintf(out, "  • %s\n", err)
 		}
 		return fmt.Errorf("rootfs does not meet requirements")
 	}
@@ -448,10 +739,7 @@ func ShowRequiredStructure() {
 	fmt.Println("  done")
 	fmt.Println("  cd ../..")
 	fmt.Println()
-	fmt.Println("  # Create device nodes (requires root on Linux)")
-	fmt.Println("  sudo mknod rootfs/dev/null c 1 3")
-	fmt.Println("  sudo mknod rootfs/dev/console c 5 1")
-	fmt.Println("  # ... etc")
+	fmt.Println("  # Device nodes are added by rock-image (no root or mknod needed)")
 	fmt.Println()
 	fmt.Println("  # Create CPIO archive")
 	fmt.Println("  rock-image cpio create rootfs")
@@ -477,6 +765,82 @@ func main() {
 		ShowRequiredStructure()
 		return
 
+	case "diff":
+		if len(os.Args) < 4 {
+			fmt.Fprintln(os.Stderr, "Error: diff requires two images")
+			fmt.Fprintln(os.Stderr, "Usage: rock-image diff <image-a> <image-b>")
+			os.Exit(1)
+		}
+		identical, err := DiffImages(os.Args[2], os.Args[3], os.Stdout)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "\nError: %v\n", err)
+			os.Exit(1)
+		}
+		if !identical {
+			os.Exit(1)
+		}
+
+	case "compose":
+		base, opts, err := parseComposeArgs(os.Args[2:])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			fmt.Fprintln(os.Stderr, "Usage: rock-image compose <base-image> --output=FILE [--early=DIR|CPIO] [--overlay=DIR|MANIFEST|CPIO]...")
+			fmt.Fprintln(os.Stderr, "                          [--compress=NAME] [--level=N] [--reproducible] [--no-verify] [--json]")
+			os.Exit(1)
+		}
+
+		// With --json, stdout carries only the result
+		var progress io.Writer = os.Stdout
+		if opts.JSON {
+			progress = os.Stderr
+		}
+		result, err := ComposeImage(base, opts, progress)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "\nError: %v\n", err)
+			os.Exit(1)
+		}
+		if opts.JSON {
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			encoder.Encode(result)
+		}
+
+	case "inspect":
+		var imagePath string
+		jsonOutput := os.Getenv("ROCK_OUTPUT") == "json"
+		for _, arg := range os.Args[2:] {
+			switch {
+			case arg == "--json":
+				jsonOutput = true
+			case strings.HasPrefix(arg, "-") || imagePath != "":
+				fmt.Fprintf(os.Stderr, "Error: unexpected argument: %s\n", arg)
+				fmt.Fprintln(os.Stderr, "Usage: rock-image inspect <image> [--json]")
+				os.Exit(1)
+			default:
+				imagePath = arg
+			}
+		}
+		if imagePath == "" {
+			fmt.Fprintln(os.Stderr, "Error: missing image path")
+			fmt.Fprintln(os.Stderr, "Usage: rock-image inspect <image> [--json]")
+			os.Exit(1)
+		}
+
+		var progress io.Writer = os.Stdout
+		if jsonOutput {
+			progress = os.Stderr
+		}
+		result, err := InspectImage(imagePath, progress)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "\nError: %v\n", err)
+			os.Exit(1)
+		}
+		if jsonOutput {
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			encoder.Encode(result)
+		}
+
 	case "cpio":
 		if len(os.Args) < 3 {
 			fmt.Fprintln(os.Stderr, "Error: missing cpio subcommand")
@@ -487,15 +851,29 @@ func main() {
 		subcommand := os.Args[2]
 		switch subcommand {
 		case "create":
-			if len(os.Args) < 4 {
-				fmt.Fprintln(os.Stderr, "Error: missing rootfs directory")
-				fmt.Fprintln(os.Stderr, "Usage: rock-image cpio create <rootfs-dir>")
+			rootfs, opts, err := parseCreateArgs(os.Args[3:])
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				fmt.Fprintln(os.Stderr, "Usage: rock-image cpio create <rootfs-dir|manifest> [--output=FILE] [--compress=NAME] [--level=N]")
+				fmt.Fprintln(os.Stderr, "                              [--manifest=FILE] [--reproducible] [--no-verify] [--json]")
 				os.Exit(1)
 			}
-			if err := CreateCPIO(os.Args[3]); err != nil {
+
+			// With --json, stdout carries only the result
+			var progress io.Writer = os.Stdout
+			if opts.JSON {
+				progress = os.Stderr
+			}
+			result, err := CreateCPIO(rootfs, opts, progress)
+			if err != nil {
 				fmt.Fprintf(os.Stderr, "\nError: %v\n", err)
 				os.Exit(1)
 			}
+			if opts.JSON {
+				encoder := json.NewEncoder(os.Stdout)
+				encoder.SetIndent("", "  ")
+				encoder.Encode(result)
+			}
 
 		case "extract":
 			if len(os.Args) < 4 {
@@ -549,8 +927,39 @@ func printUsage() {
 	fmt.Println()
 	fmt.Println("Usage:")
 	fmt.Println("  rock-image cpio create <rootfs-dir>     Create CPIO initramfs")
+	fmt.Println("  rock-image cpio create <manifest.yaml>  Create it from a rootfs manifest: dirs,")
+	fmt.Println("                                          files, symlinks, devices and generated")
+	fmt.Println("                                          files, no staging dir or root needed")
+	fmt.Println("    --output=FILE                         Image path (default initrd.cpio.gz, or")
+	fmt.Println("                                          the extension of --compress)")
+	fmt.Println("    --compress=gzip|zstd|xz|lz4|none      Compressor (default gzip); the kernel")
+	fmt.Println("                                          must be built to unpack it")
+	fmt.Println("    --level=N                             Compression level: gzip 1-9, zstd 1-22,")
+	fmt.Println("                                          xz 0-9")
+	fmt.Println("    --reproducible                        Same rootfs, same bytes: fixed mtimes,")
+	fmt.Println("                                          sorted root-owned entries")
+	fmt.Println("                                          (implied by SOURCE_DATE_EPOCH)")
+	fmt.Println("    --manifest=FILE                       Also write a JSON listing of the image:")
+	fmt.Println("                                          type, mode, owner and SHA256 per entry")
+	fmt.Println("    --no-verify                           Skip the rootfs and image checks")
+	fmt.Println("    --json                                Print the result as JSON; progress goes")
+	fmt.Println("                                          to stderr (also ROCK_OUTPUT=json)")
 	fmt.Println("  rock-image cpio extract <image.cpio.gz> Extract for inspection")
 	fmt.Println("  rock-image cpio verify <image.cpio.gz>  Verify integration")
+	fmt.Println("  rock-image diff <image-a> <image-b>     Check two builds are bit-for-bit")
+	fmt.Println("                                          identical, or show how they differ")
+	fmt.Println("  rock-image compose <base-image>         Concatenate segments into one initramfs;")
+	fmt.Println("                                          the base is included unchanged, so its")
+	fmt.Println("                                          signature still holds")
+	fmt.Println("    --output=FILE                         Image path (required)")
+	fmt.Println("    --early=DIR|CPIO                      Uncompressed first segment, such as")
+	fmt.Println("                                          kernel/x86/microcode/GenuineIntel.bin")
+	fmt.Println("    --overlay=DIR|MANIFEST|CPIO           Segment after the base, repeatable; later")
+	fmt.Println("                                          files replace earlier ones")
+	fmt.Println("    --compress, --level, --reproducible,  As for cpio create; --compress applies")
+	fmt.Println("    --no-verify, --json                   to overlays")
+	fmt.Println("  rock-image inspect <image> [--json]     List segments and the merged tree, with")
+	fmt.Println("                                          the segment each entry comes from")
 	fmt.Println("  rock-image structure                    Show required structure")
 	fmt.Println("  rock-image version                      Show version")
 	fmt.Println()
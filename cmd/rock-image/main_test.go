@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rock-os/tools/pkg/cpio"
+)
+
+// newArchive writes entries to an in-memory newc image and reads it back
+func newArchive(t *testing.T, entries ...cpio.Entry) *cpio.Archive {
+	t.Helper()
+	var buf bytes.Buffer
+	w := cpio.NewWriter(&buf)
+	for _, entry := range entries {
+		entry.Size = int64(len(entry.Data))
+		if err := w.WriteHeader(&entry.Header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(entry.Data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	archive, err := cpio.ReadAll(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return archive
+}
+
+func TestExtractArchive(t *testing.T) {
+	archive := newArchive(t,
+		cpio.Entry{Header: cpio.Header{Name: ".", Mode: cpio.TypeDir | 0755}},
+		cpio.Entry{Header: cpio.Header{Name: "bin/busybox", Mode: cpio.TypeReg | 0755}, Data: []byte("busybox")},
+		cpio.Entry{Header: cpio.Header{Name: "bin/sh", Mode: cpio.TypeSymlink | 0777, Linkname: "busybox"}},
+		cpio.Entry{Header: cpio.Header{Name: "dev/console", Mode: cpio.TypeChar | 0600, RDevMajor: 5, RDevMinor: 1}},
+	)
+
+	dir := t.TempDir()
+	skipped, err := extractArchive(archive, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(skipped) != 1 || skipped[0].Name != "dev/console" {
+		t.Errorf("skipped %v, want dev/console", skipped)
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "bin", "sh")); err != nil || string(data) != "busybox" {
+		t.Errorf("bin/sh: %q %v", data, err)
+	}
+}
+
+func TestExtractArchiveSymlinkParent(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		existing string // Symlink into outside left by an earlier extraction
+		entries  []cpio.Entry
+		want     string
+	}{
+		{
+			"symlink parent", "",
+			[]cpio.Entry{
+				{Header: cpio.Header{Name: "lib64", Mode: cpio.TypeSymlink | 0777, Linkname: "OUTSIDE"}},
+				{Header: cpio.Header{Name: "lib64/x", Mode: cpio.TypeReg | 0644}, Data: []byte("x")},
+			},
+			"lib64 is a symlink",
+		},
+		{
+			"file parent", "",
+			[]cpio.Entry{
+				{Header: cpio.Header{Name: "etc", Mode: cpio.TypeReg | 0644}},
+				{Header: cpio.Header{Name: "etc/passwd", Mode: cpio.TypeReg | 0644}},
+			},
+			"etc is not a directory",
+		},
+		{
+			"symlink replaced by file", "x",
+			[]cpio.Entry{
+				{Header: cpio.Header{Name: "x", Mode: cpio.TypeReg | 0644}, Data: []byte("x")},
+			},
+			"",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			root := t.TempDir()
+			outside := filepath.Join(root, "outside")
+			if err := os.Mkdir(outside, 0755); err != nil {
+				t.Fatal(err)
+			}
+			dir := filepath.Join(root, "extract")
+			if err := os.Mkdir(dir, 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			if test.existing != "" {
+				if err := os.Symlink(filepath.Join(outside, test.existing), filepath.Join(dir, test.existing)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			for i := range test.entries {
+				test.entries[i].Linkname = strings.ReplaceAll(test.entries[i].Linkname, "OUTSIDE", outside)
+			}
+			_, err := extractArchive(newArchive(t, test.entries...), dir)
+			if test.want == "" && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			} else if test.want != "" && (err == nil || !strings.Contains(err.Error(), test.want)) {
+				t.Errorf("error %v, want %q", err, test.want)
+			}
+
+			if written, _ := os.ReadDir(outside); len(written) > 0 {
+				t.Errorf("wrote %s outside the extraction directory", written[0].Name())
+			}
+		})
+	}
+}
+
+func TestDiffImages(t *testing.T) {
+	dir := t.TempDir()
+	build := func(name, hostname string, level int) string {
+		t.Helper()
+		manifest := writeTestManifest(t, filepath.Join(dir, name), "generated:\n  - {path: /etc/hostname, content: \""+hostname+"\"}\n")
+		output := filepath.Join(dir, name+".cpio.gz")
+		opts := CreateOptions{Compression: cpio.CompressGzip, Level: level, Output: output, Reproducible: true, ModTime: time.Unix(0, 0).UTC()}
+		if _, err := CreateCPIO(manifest, opts, io.Discard); err != nil {
+			t.Fatal(err)
+		}
+		return output
+	}
+	a := build("a", "rock", cpio.DefaultLevel)
+
+	tests := []struct {
+		b, want   string
+		identical bool
+	}{
+		{build("b", "rock", cpio.DefaultLevel), "bit-for-bit identical", true},
+		{build("c", "node1", cpio.DefaultLevel), "etc/hostname", false},
+		{build("d", "rock", 1), "their archives are identical", false},
+	}
+	for _, test := range tests {
+		var out strings.Builder
+		identical, err := DiffImages(a, test.b, &out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if identical != test.identical || !strings.Contains(out.String(), test.want) {
+			t.Errorf("diff %s: identical = %v, output:\n%s\nwant %q", filepath.Base(test.b), identical, out.String(), test.want)
+		}
+	}
+
+	if _, err := DiffImages(a, filepath.Join(dir, "missing.cpio.gz"), io.Discard); err == nil {
+		t.Error("diff against a missing image succeeded")
+	}
+}
@@ -405,16 +405,46 @@ func cmdList(args []string) error {
 
 func cmdCmdline(args []string) error {
 	mode := "debug"
-	if len(args) > 0 {
-		mode = args[0]
+	medium := integration.BootInitramfs
+	bootSet := false
+	rootDevice := ""
+
+	for _, arg := range args {
+		switch {
+		case strings.HasPrefix(arg, "--boot="):
+			m, err := integration.ParseBootMedium(strings.TrimPrefix(arg, "--boot="))
+			if err != nil {
+				return err
+			}
+			medium = m
+			bootSet = true
+		case strings.HasPrefix(arg, "--root="):
+			rootDevice = strings.TrimPrefix(arg, "--root=")
+		case strings.HasPrefix(arg, "-"):
+			return fmt.Errorf("unknown cmdline option: %s", arg)
+		default:
+			mode = arg
+		}
+	}
+
+	// A root device implies booting from it; the kernel ignores root= and
+	// init= when running init from the initramfs
+	if rootDevice != "" && !bootSet {
+		medium = integration.BootBlockDevice
+	}
+	if medium == integration.BootBlockDevice && rootDevice == "" {
+		return fmt.Errorf("--boot=block requires --root=<device>")
+	}
+	if medium == integration.BootInitramfs && rootDevice != "" {
+		return fmt.Errorf("--root=%s cannot be used with --boot=initramfs", rootDevice)
 	}
 
 	// Use the integration package to get the correct cmdline
-	// This ensures we ALWAYS use the correct init path
-	cmdline := integration.GetKernelCmdline(mode)
+	// This ensures we ALWAYS use the correct init parameter for the medium
+	cmdline := integration.GetKernelCmdlineFor(mode, medium, rootDevice)
 
 	// Validate the cmdline to ensure it's correct
-	if err := integration.ValidateKernelCmdline(cmdline); err != nil {
+	if err := integration.ValidateKernelCmdlineFor(cmdline, medium); err != nil {
 		return fmt.Errorf("invalid kernel cmdline: %w", err)
 	}
 
@@ -429,7 +459,9 @@ func main() {
 		fmt.Println("  rock-kernel fetch <spec>     Download kernel (e.g., alpine:5.10.186)")
 		fmt.Println("  rock-kernel extract <apk>    Extract vmlinuz from APK")
 		fmt.Println("  rock-kernel list             List cached kernels")
-		fmt.Println("  rock-kernel cmdline [mode]   Get kernel command line")
+		fmt.Println("  rock-kernel cmdline [mode]   Get kernel command line (debug|production)")
+		fmt.Println("      --boot=initramfs|block   Boot medium (default: initramfs, uses rdinit=)")
+		fmt.Println("      --root=<device>          Root block device (implies --boot=block, uses init=)")
 		fmt.Println("\nEnvironment:")
 		fmt.Println("  ROCK_KERNEL_CACHE  Cache directory (default: ~/.rock/kernels)")
 		fmt.Println("  ROCK_OUTPUT=json   Output JSON for scripting")
@@ -19,18 +19,19 @@
 package main
 
 import (
-	"compress/gzip"
+	"bytes"
 	"debug/elf"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"os"
 	"os/exec"
-	"path/filepath"
+	"path"
 	"strings"
 	"time"
 
+	"github.com/rock-os/tools/pkg/cpio"
 	"github.com/rock-os/tools/pkg/integration"
+	"github.com/rock-os/tools/pkg/report"
 )
 
 var (
@@ -64,214 +65,191 @@ type StructureCheck struct {
 	Critical    bool
 }
 
-// ExtractImage extracts a CPIO archive to a temporary directory
-func ExtractImage(imagePath string) (string, error) {
-	// Create temp directory
-	tempDir, err := ioutil.TempDir("", "rock-verify-")
-	if err != nil {
-		return "", fmt.Errorf("failed to create temp dir: %w", err)
-	}
-
-	// Open the image file
-	file, err := os.Open(imagePath)
-	if err != nil {
-		os.RemoveAll(tempDir)
-		return "", fmt.Errorf("failed to open image: %w", err)
-	}
-	defer file.Close()
-
-	// Decompress if gzipped
-	var cpioReader io.Reader = file
-	if strings.HasSuffix(imagePath, ".gz") {
-		gzReader, err := gzip.NewReader(file)
-		if err != nil {
-			os.RemoveAll(tempDir)
-			return "", fmt.Errorf("failed to create gzip reader: %w", err)
-		}
-		defer gzReader.Close()
-		cpioReader = gzReader
-	}
-
-	// Write to temp file
-	tempCpio := filepath.Join(tempDir, "temp.cpio")
-	tempFile, err := os.Create(tempCpio)
-	if err != nil {
-		os.RemoveAll(tempDir)
-		return "", fmt.Errorf("failed to create temp file: %w", err)
-	}
-
-	if _, err := io.Copy(tempFile, cpioReader); err != nil {
-		tempFile.Close()
-		os.RemoveAll(tempDir)
-		return "", fmt.Errorf("failed to copy cpio data: %w", err)
-	}
-	tempFile.Close()
-
-	// Extract using cpio
-	cmd := exec.Command("sh", "-c",
-		fmt.Sprintf("cd %s && cpio -i -d < temp.cpio 2>/dev/null", tempDir))
+// results collects every check for --report and ROCK_OUTPUT=junit|html
+var results = report.New("rock-verify")
 
-	if _, err := cmd.CombinedOutput(); err != nil {
-		os.RemoveAll(tempDir)
-		return "", fmt.Errorf("failed to extract cpio: %w", err)
-	}
-
-	// Remove temp cpio file
-	os.Remove(tempCpio)
+// record adds the outcome of one check to results
+func record(suite, name string, status report.Status, message string) {
+	results.Add(suite, report.Case{Name: name, Status: status, Message: message})
+}
 
-	return tempDir, nil
+// LoadImage reads a CPIO archive into memory for verification.
+// Nothing is extracted to disk, so device nodes are checked even when
+// not running as root.
+func LoadImage(imagePath string) (*cpio.Archive, error) {
+	return cpio.ReadFile(imagePath)
 }
 
 // VerifyIntegration performs complete integration verification
-func VerifyIntegration(imagePath string) error {
-	fmt.Println("COMPREHENSIVE ROCK-INIT INTEGRATION VERIFICATION")
-	fmt.Println("================================================")
-	fmt.Printf("Image: %s\n", imagePath)
-	fmt.Printf("Time: %s\n\n", time.Now().Format("2006-01-02 15:04:05"))
-
-	// Extract the image
-	tempDir, err := ExtractImage(imagePath)
+func VerifyIntegration(imagePath string, out io.Writer) error {
+	fmt.Fprintln(out, "COMPREHENSIVE ROCK-INIT INTEGRATION VERIFICATION")
+	fmt.Fprintln(out, "================================================")
+	fmt.Fprintf(out, "Image: %s\n", imagePath)
+	fmt.Fprintf(out, "Time: %s\n\n", time.Now().Format("2006-01-02 15:04:05"))
+
+	// Load the image
+	archive, err := LoadImage(imagePath)
 	if err != nil {
-		return fmt.Errorf("failed to extract image: %w", err)
+		return fmt.Errorf("failed to load image: %w", err)
 	}
-	defer os.RemoveAll(tempDir)
 
 	var criticalErrors []string
 	var warnings []string
 
 	// 1. Verify critical binaries
-	fmt.Println("1. CRITICAL BINARIES CHECK")
-	fmt.Println("---------------------------")
+	fmt.Fprintln(out, "1. CRITICAL BINARIES CHECK")
+	fmt.Fprintln(out, "---------------------------")
 	for _, binary := range integration.RequiredBinaries {
-		path := filepath.Join(tempDir, strings.TrimPrefix(binary.Destination, "/"))
-		if info, err := os.Stat(path); err != nil {
+		if entry, ok := archive.Stat(binary.Destination); !ok || !entry.IsRegular() {
 			criticalErrors = append(criticalErrors, fmt.Sprintf("MISSING: %s", binary.Destination))
-			fmt.Printf("  ❌ %s - NOT FOUND\n", binary.Destination)
+			record("binaries", binary.Destination, report.Failed, "not found")
+			fmt.Fprintf(out, "  ❌ %s - NOT FOUND\n", binary.Destination)
 		} else {
 			// Check if executable
-			if info.Mode()&0111 == 0 {
+			if entry.Perm()&0111 == 0 {
 				criticalErrors = append(criticalErrors, fmt.Sprintf("NOT EXECUTABLE: %s", binary.Destination))
-				fmt.Printf("  ❌ %s - not executable (mode: %o)\n", binary.Destination, info.Mode())
+				record("binaries", binary.Destination, report.Failed, fmt.Sprintf("not executable (mode: %o)", entry.Perm()))
+				fmt.Fprintf(out, "  ❌ %s - not executable (mode: %o)\n", binary.Destination, entry.Perm())
 			} else {
+				record("binaries", binary.Destination, report.Passed, "")
 				// Special check for rock-init rename
 				if binary.Source == "rock-init" && binary.Destination == "/sbin/init" {
-					fmt.Printf("  ✅ %s (renamed from %s, mode: %o)\n", binary.Destination, binary.Source, info.Mode())
+					fmt.Fprintf(out, "  ✅ %s (renamed from %s, mode: %o)\n", binary.Destination, binary.Source, entry.Perm())
 				} else {
-					fmt.Printf("  ✅ %s (mode: %o, size: %.2f MB)\n", binary.Destination, info.Mode(), float64(info.Size())/(1024*1024))
+					fmt.Fprintf(out, "  ✅ %s (mode: %o, size: %.2f MB)\n", binary.Destination, entry.Perm(), float64(entry.Size)/(1024*1024))
 				}
 			}
 		}
 	}
 
 	// 2. Verify shell symlink
-	fmt.Println("\n2. SHELL CONFIGURATION")
-	fmt.Println("----------------------")
-	shellPath := filepath.Join(tempDir, "bin/sh")
-	if info, err := os.Lstat(shellPath); err != nil {
+	fmt.Fprintln(out, "\n2. SHELL CONFIGURATION")
+	fmt.Fprintln(out, "----------------------")
+	if entry, ok := archive.Lstat("/bin/sh"); !ok {
 		criticalErrors = append(criticalErrors, "CRITICAL: /bin/sh missing")
-		fmt.Printf("  ❌ /bin/sh - NOT FOUND (shell required for init)\n")
-	} else if info.Mode()&os.ModeSymlink != 0 {
-		target, _ := os.Readlink(shellPath)
-		if target == "busybox" || strings.HasSuffix(target, "/busybox") {
-			fmt.Printf("  ✅ /bin/sh -> %s\n", target)
+		record("shell", "/bin/sh", report.Failed, "not found")
+		fmt.Fprintf(out, "  ❌ /bin/sh - NOT FOUND (shell required for init)\n")
+	} else if entry.IsSymlink() {
+		target := entry.Linkname
+		if _, ok := archive.Stat("/bin/sh"); !ok {
+			criticalErrors = append(criticalErrors, fmt.Sprintf("/bin/sh -> %s is a dangling symlink", target))
+			record("shell", "/bin/sh", report.Failed, fmt.Sprintf("dangling symlink to %s", target))
+			fmt.Fprintf(out, "  ❌ /bin/sh -> %s (dangling)\n", target)
+		} else if target == "busybox" || strings.HasSuffix(target, "/busybox") {
+			record("shell", "/bin/sh", report.Passed, "")
+			fmt.Fprintf(out, "  ✅ /bin/sh -> %s\n", target)
 		} else {
 			warnings = append(warnings, fmt.Sprintf("/bin/sh points to %s (expected busybox)", target))
-			fmt.Printf("  ⚠️  /bin/sh -> %s (expected busybox)\n", target)
+			record("shell", "/bin/sh", report.Warning, fmt.Sprintf("points to %s (expected busybox)", target))
+			fmt.Fprintf(out, "  ⚠️  /bin/sh -> %s (expected busybox)\n", target)
 		}
 	} else {
-		fmt.Printf("  ⚠️  /bin/sh exists but is not a symlink\n")
+		record("shell", "/bin/sh", report.Warning, "not a symlink")
+		fmt.Fprintf(out, "  ⚠️  /bin/sh exists but is not a symlink\n")
 	}
 
 	// 3. Directory structure check
-	fmt.Println("\n3. DIRECTORY STRUCTURE")
-	fmt.Println("----------------------")
+	fmt.Fprintln(out, "\n3. DIRECTORY STRUCTURE")
+	fmt.Fprintln(out, "----------------------")
 	criticalDirs := []string{"/proc", "/sys", "/dev", "/sbin", "/bin", "/usr/bin"}
 	optionalDirs := []string{"/tmp", "/run", "/var/log", "/config", "/etc/rock"}
 
 	for _, dir := range criticalDirs {
-		path := filepath.Join(tempDir, strings.TrimPrefix(dir, "/"))
-		if info, err := os.Stat(path); err != nil || !info.IsDir() {
+		if entry, ok := archive.Stat(dir); !ok || !entry.IsDir() {
 			criticalErrors = append(criticalErrors, fmt.Sprintf("Missing critical directory: %s", dir))
-			fmt.Printf("  ❌ %s/ - CRITICAL directory missing\n", dir)
+			record("directories", dir, report.Failed, "missing")
+			fmt.Fprintf(out, "  ❌ %s/ - CRITICAL directory missing\n", dir)
 		} else {
-			fmt.Printf("  ✅ %s/\n", dir)
+			record("directories", dir, report.Passed, "")
+			fmt.Fprintf(out, "  ✅ %s/\n", dir)
 		}
 	}
 
 	for _, dir := range optionalDirs {
-		path := filepath.Join(tempDir, strings.TrimPrefix(dir, "/"))
-		if info, err := os.Stat(path); err != nil || !info.IsDir() {
+		if entry, ok := archive.Stat(dir); !ok || !entry.IsDir() {
 			warnings = append(warnings, fmt.Sprintf("Missing optional directory: %s", dir))
-			fmt.Printf("  ⚠️  %s/ - optional directory missing\n", dir)
+			record("directories", dir, report.Warning, "optional directory missing")
+			fmt.Fprintf(out, "  ⚠️  %s/ - optional directory missing\n", dir)
 		} else {
-			fmt.Printf("  ✅ %s/\n", dir)
+			record("directories", dir, report.Passed, "")
+			fmt.Fprintf(out, "  ✅ %s/\n", dir)
 		}
 	}
 
 	// 4. Device nodes check
-	fmt.Println("\n4. DEVICE NODES")
-	fmt.Println("---------------")
-	// On macOS, we can't check device nodes properly, so just check existence
-	essentialDevices := []string{"/dev/null", "/dev/console", "/dev/zero"}
-	for _, device := range essentialDevices {
-		path := filepath.Join(tempDir, strings.TrimPrefix(device, "/"))
-		if _, err := os.Stat(path); err != nil {
-			warnings = append(warnings, fmt.Sprintf("Missing device node: %s", device))
-			fmt.Printf("  ⚠️  %s - missing (may be created at boot)\n", device)
-		} else {
-			fmt.Printf("  ✅ %s\n", device)
+	fmt.Fprintln(out, "\n4. DEVICE NODES")
+	fmt.Fprintln(out, "---------------")
+	// The archive headers carry the real type and device numbers
+	for _, node := range integration.RequiredDeviceNodes {
+		problem := checkDeviceNode(archive, node)
+		switch {
+		case problem == "":
+			record("device-nodes", node.Path, report.Passed, "")
+			fmt.Fprintf(out, "  ✅ %s (char %d:%d)\n", node.Path, node.Major, node.Minor)
+		case node.Path == "/dev/console":
+			// Without a console the kernel cannot give init stdin/stdout
+			criticalErrors = append(criticalErrors, "CRITICAL: "+problem)
+			record("device-nodes", node.Path, report.Failed, problem)
+			fmt.Fprintf(out, "  ❌ %s\n", problem)
+		default:
+			warnings = append(warnings, problem)
+			record("device-nodes", node.Path, report.Warning, problem)
+			fmt.Fprintf(out, "  ⚠️  %s\n", problem)
 		}
 	}
 
 	// 5. Busybox symlinks check
-	fmt.Println("\n5. BUSYBOX SYMLINKS")
-	fmt.Println("-------------------")
+	fmt.Fprintln(out, "\n5. BUSYBOX SYMLINKS")
+	fmt.Fprintln(out, "-------------------")
 	essentialCommands := []string{"ls", "cat", "echo", "mount", "umount", "mkdir", "ps"}
 	missingCommands := 0
 	for _, cmd := range essentialCommands {
-		path := filepath.Join(tempDir, "bin", cmd)
-		if info, err := os.Lstat(path); err != nil {
+		if entry, ok := archive.Lstat("/bin/" + cmd); !ok {
 			missingCommands++
 			warnings = append(warnings, fmt.Sprintf("Missing busybox command: /bin/%s", cmd))
-		} else if info.Mode()&os.ModeSymlink != 0 {
-			target, _ := os.Readlink(path)
+			record("busybox", "/bin/"+cmd, report.Warning, "missing")
+		} else if entry.IsSymlink() {
+			target := entry.Linkname
 			if target == "busybox" || strings.HasSuffix(target, "/busybox") {
-				// Good
+				record("busybox", "/bin/"+cmd, report.Passed, "")
 			} else {
 				warnings = append(warnings, fmt.Sprintf("/bin/%s points to %s (expected busybox)", cmd, target))
+				record("busybox", "/bin/"+cmd, report.Warning, fmt.Sprintf("points to %s (expected busybox)", target))
 			}
+		} else {
+			record("busybox", "/bin/"+cmd, report.Passed, "")
 		}
 	}
 	if missingCommands == 0 {
-		fmt.Printf("  ✅ All essential commands present\n")
+		fmt.Fprintf(out, "  ✅ All essential commands present\n")
 	} else {
-		fmt.Printf("  ⚠️  Missing %d essential commands\n", missingCommands)
+		fmt.Fprintf(out, "  ⚠️  Missing %d essential commands\n", missingCommands)
 	}
 
 	// Print summary
-	fmt.Println("\n" + strings.Repeat("=", 60))
-	fmt.Println("VERIFICATION SUMMARY")
-	fmt.Println(strings.Repeat("=", 60))
+	fmt.Fprintln(out, "\n"+strings.Repeat("=", 60))
+	fmt.Fprintln(out, "VERIFICATION SUMMARY")
+	fmt.Fprintln(out, strings.Repeat("=", 60))
 
 	if len(criticalErrors) == 0 {
-		fmt.Println("\n✅ VERIFICATION PASSED - Image will boot with rock-init")
+		fmt.Fprintln(out, "\n✅ VERIFICATION PASSED - Image will boot with rock-init")
 		if len(warnings) > 0 {
-			fmt.Printf("\n%d warning(s) found (non-critical):\n", len(warnings))
+			fmt.Fprintf(out, "\n%d warning(s) found (non-critical):\n", len(warnings))
 			for _, warn := range warnings {
-				fmt.Printf("  ⚠️  %s\n", warn)
+				fmt.Fprintf(out, "  ⚠️  %s\n", warn)
 			}
 		}
 		return nil
 	} else {
-		fmt.Println("\n❌ VERIFICATION FAILED - Image will NOT boot")
-		fmt.Printf("\n%d CRITICAL ERROR(S):\n", len(criticalErrors))
+		fmt.Fprintln(out, "\n❌ VERIFICATION FAILED - Image will NOT boot")
+		fmt.Fprintf(out, "\n%d CRITICAL ERROR(S):\n", len(criticalErrors))
 		for _, err := range criticalErrors {
-			fmt.Printf("  ❌ %s\n", err)
+			fmt.Fprintf(out, "  ❌ %s\n", err)
 		}
 		if len(warnings) > 0 {
-			fmt.Printf("\n%d warning(s) also found:\n", len(warnings))
+			fmt.Fprintf(out, "\n%d warning(s) also found:\n", len(warnings))
 			for _, warn := range warnings {
-				fmt.Printf("  ⚠️  %s\n", warn)
+				fmt.Fprintf(out, "  ⚠️  %s\n", warn)
 			}
 		}
 		return fmt.Errorf("verification failed with %d critical errors", len(criticalErrors))
@@ -279,17 +257,16 @@ func VerifyIntegration(imagePath string) error {
 }
 
 // VerifyStructure checks directory structure and device nodes
-func VerifyStructure(imagePath string) error {
-	fmt.Println("STRUCTURE AND FILESYSTEM VERIFICATION")
-	fmt.Println("=====================================")
-	fmt.Printf("Image: %s\n\n", imagePath)
+func VerifyStructure(imagePath string, out io.Writer) error {
+	fmt.Fprintln(out, "STRUCTURE AND FILESYSTEM VERIFICATION")
+	fmt.Fprintln(out, "=====================================")
+	fmt.Fprintf(out, "Image: %s\n\n", imagePath)
 
-	// Extract the image
-	tempDir, err := ExtractImage(imagePath)
+	// Load the image
+	archive, err := LoadImage(imagePath)
 	if err != nil {
-		return fmt.Errorf("failed to extract image: %w", err)
+		return fmt.Errorf("failed to load image: %w", err)
 	}
-	defer os.RemoveAll(tempDir)
 
 	// Define structure checks
 	checks := []StructureCheck{
@@ -326,68 +303,81 @@ func VerifyStructure(imagePath string) error {
 	criticalFailed := 0
 	optionalFailed := 0
 
-	fmt.Println("DIRECTORY STRUCTURE:")
-	fmt.Println("--------------------")
+	fmt.Fprintln(out, "DIRECTORY STRUCTURE:")
+	fmt.Fprintln(out, "--------------------")
 	for _, check := range checks {
 		if check.Type != "dir" {
 			continue
 		}
 
-		path := filepath.Join(tempDir, strings.TrimPrefix(check.Path, "/"))
-		info, err := os.Stat(path)
+		entry, ok := archive.Stat(check.Path)
 
 		status := "✅"
 		message := ""
+		outcome := report.Passed
 
-		if err != nil {
+		if !ok {
 			check.Found = false
 			if check.Critical {
 				status = "❌"
+				outcome = report.Failed
 				criticalFailed++
 				message = "MISSING (CRITICAL)"
 			} else {
 				status = "⚠️ "
+				outcome = report.Warning
 				optionalFailed++
 				message = "missing (optional)"
 			}
-		} else if !info.IsDir() {
+		} else if !entry.IsDir() {
 			check.Found = false
 			status = "❌"
 			message = "exists but not a directory"
 			if check.Critical {
+				outcome = report.Failed
 				criticalFailed++
+			} else {
+				outcome = report.Warning
 			}
 		} else {
 			check.Found = true
-			perms := info.Mode().Perm()
+			perms := entry.Perm()
 			message = fmt.Sprintf("mode: %04o", perms)
+			if check.Permissions != 0 && perms != check.Permissions {
+				status = "⚠️ "
+				outcome = report.Warning
+				message = fmt.Sprintf("mode: %04o (expected %04o)", perms, check.Permissions)
+			}
 		}
 
-		fmt.Printf("  %s %-20s %s\n", status, check.Path+"/", message)
+		record("directories", check.Path, outcome, message)
+		fmt.Fprintf(out, "  %s %-20s %s\n", status, check.Path+"/", message)
 	}
 
-	fmt.Println("\nCRITICAL FILES:")
-	fmt.Println("---------------")
+	fmt.Fprintln(out, "\nCRITICAL FILES:")
+	fmt.Fprintln(out, "---------------")
 	for _, check := range checks {
 		if check.Type != "file" {
 			continue
 		}
 
-		path := filepath.Join(tempDir, strings.TrimPrefix(check.Path, "/"))
-		info, err := os.Stat(path)
+		entry, ok := archive.Stat(check.Path)
 
 		status := "✅"
 		message := ""
+		outcome := report.Passed
 
-		if err != nil {
+		if !ok || !entry.IsRegular() {
 			status = "❌"
 			message = "NOT FOUND"
+			outcome = report.Warning
 			if check.Critical {
+				outcome = report.Failed
 				criticalFailed++
 			}
 		} else {
-			perms := info.Mode().Perm()
-			size := info.Size()
+			perms := entry.Perm()
+			size := entry.Size
 			executable := ""
 			if perms&0111 != 0 {
 				executable = " [executable]"
@@ -395,94 +385,109 @@ func VerifyStructure(imagePath string) error {
 			message = fmt.Sprintf("%.2f KB, mode: %04o%s", float64(size)/1024, perms, executable)
 		}
 
-		fmt.Printf("  %s %-25s %s\n", status, check.Path, message)
+		record("files", check.Path, outcome, message)
+		fmt.Fprintf(out, "  %s %-25s %s\n", status, check.Path, message)
 	}
 
-	fmt.Println("\nSYMLINKS:")
-	fmt.Println("---------")
+	fmt.Fprintln(out, "\nSYMLINKS:")
+	fmt.Fprintln(out, "---------")
 	for _, check := range checks {
 		if check.Type != "symlink" {
 			continue
 		}
 
-		path := filepath.Join(tempDir, strings.TrimPrefix(check.Path, "/"))
-		info, err := os.Lstat(path)
+		entry, ok := archive.Lstat(check.Path)
 
 		status := "✅"
 		message := ""
+		outcome := report.Passed
 
-		if err != nil {
+		if !ok {
 			status = "❌"
 			message = "NOT FOUND"
+			outcome = report.Warning
 			if check.Critical {
+				outcome = report.Failed
 				criticalFailed++
 			}
-		} else if info.Mode()&os.ModeSymlink == 0 {
+		} else if !entry.IsSymlink() {
 			status = "❌"
 			message = "exists but not a symlink"
+			outcome = report.Warning
 			if check.Critical {
+				outcome = report.Failed
 				criticalFailed++
 			}
 		} else {
-			target, _ := os.Readlink(path)
+			target := entry.Linkname
 			if check.Target != "" && target != check.Target && !strings.HasSuffix(target, "/"+check.Target) {
 				status = "⚠️ "
+				outcome = report.Warning
 				message = fmt.Sprintf("-> %s (expected %s)", target, check.Target)
 			} else {
 				message = fmt.Sprintf("-> %s", target)
 			}
 		}
 
-		fmt.Printf("  %s %-20s %s\n", status, check.Path, message)
+		record("symlinks", check.Path, outcome, message)
+		fmt.Fprintf(out, "  %s %-20s %s\n", status, check.Path, message)
 	}
 
-	// Device nodes (limited check on macOS)
-	fmt.Println("\nDEVICE NODES:")
-	fmt.Println("-------------")
+	// Device nodes are read from the archive headers, no root needed
+	fmt.Fprintln(out, "\nDEVICE NODES:")
+	fmt.Fprintln(out, "-------------")
 	for _, node := range integration.RequiredDeviceNodes {
-		path := filepath.Join(tempDir, strings.TrimPrefix(node.Path, "/"))
 		status := "✅"
 		message := ""
+		outcome := report.Passed
 
-		if _, err := os.Stat(path); err != nil {
-			status = "⚠️ "
-			message = "missing (will be created at boot)"
-			optionalFailed++
+		if problem := checkDeviceNode(archive, node); problem != "" {
+			message = strings.TrimPrefix(problem, node.Path+" ")
+			if node.Path == "/dev/console" {
+				status = "❌"
+				outcome = report.Failed
+				criticalFailed++
+			} else {
+				status = "⚠️ "
+				outcome = report.Warning
+				optionalFailed++
+			}
 		} else {
-			message = fmt.Sprintf("present (major:%d minor:%d)", node.Major, node.Minor)
+			message = fmt.Sprintf("char device (major:%d minor:%d, mode: %04o)", node.Major, node.Minor, node.Mode)
 		}
 
-		fmt.Printf("  %s %-20s %s\n", status, node.Path, message)
+		record("device-nodes", node.Path, outcome, message)
+
+		fmt.Fprintf(out, "  %s %-20s %s\n", status, node.Path, message)
 	}
 
 	// Summary
-	fmt.Println("\n" + strings.Repeat("=", 60))
+	fmt.Fprintln(out, "\n"+strings.Repeat("=", 60))
 	if criticalFailed == 0 {
-		fmt.Println("✅ STRUCTURE VERIFICATION PASSED")
+		fmt.Fprintln(out, "✅ STRUCTURE VERIFICATION PASSED")
 		if optionalFailed > 0 {
-			fmt.Printf("   %d optional items missing (non-critical)\n", optionalFailed)
+			fmt.Fprintf(out, "   %d optional items missing (non-critical)\n", optionalFailed)
 		}
 		return nil
 	} else {
-		fmt.Printf("❌ STRUCTURE VERIFICATION FAILED\n")
-		fmt.Printf("   %d critical items failed\n", criticalFailed)
-		fmt.Printf("   %d optional items missing\n", optionalFailed)
+		fmt.Fprintf(out, "❌ STRUCTURE VERIFICATION FAILED\n")
+		fmt.Fprintf(out, "   %d critical items failed\n", criticalFailed)
+		fmt.Fprintf(out, "   %d optional items missing\n", optionalFailed)
 		return fmt.Errorf("structure verification failed with %d critical errors", criticalFailed)
 	}
 }
 
 // VerifyDependencies checks for required shared libraries
-func VerifyDependencies(imagePath string) error {
-	fmt.Println("SHARED LIBRARY DEPENDENCIES VERIFICATION")
-	fmt.Println("========================================")
-	fmt.Printf("Image: %s\n\n", imagePath)
+func VerifyDependencies(imagePath string, out io.Writer) error {
+	fmt.Fprintln(out, "SHARED LIBRARY DEPENDENCIES VERIFICATION")
+	fmt.Fprintln(out, "========================================")
+	fmt.Fprintf(out, "Image: %s\n\n", imagePath)
 
-	// Extract the image
-	tempDir, err := ExtractImage(imagePath)
+	// Load the image
+	archive, err := LoadImage(imagePath)
 	if err != nil {
-		return fmt.Errorf("failed to extract image: %w", err)
+		return fmt.Errorf("failed to load image: %w", err)
 	}
-	defer os.RemoveAll(tempDir)
 
 	// Binaries to check
 	binariesToCheck := []string{
@@ -495,30 +500,32 @@ func VerifyDependencies(imagePath string) error {
 	allDeps := make(map[string]bool)
 	missingDeps := make(map[string][]string)
 
-	fmt.Println("ANALYZING BINARIES:")
-	fmt.Println("-------------------")
+	fmt.Fprintln(out, "ANALYZING BINARIES:")
+	fmt.Fprintln(out, "-------------------")
 
 	for _, binary := range binariesToCheck {
-		binaryPath := filepath.Join(tempDir, binary)
-
-		fmt.Printf("\n%s:\n", binary)
+		fmt.Fprintf(out, "\n%s:\n", binary)
 
 		// Check if file exists
-		if _, err := os.Stat(binaryPath); err != nil {
-			fmt.Printf("  ⚠️  Binary not found\n")
+		entry, ok := archive.Stat(binary)
+		if !ok || !entry.IsRegular() {
+			record("binaries", "/"+binary, report.Skipped, "binary not found")
+			fmt.Fprintf(out, "  ⚠️  Binary not found\n")
 			continue
 		}
 
-		// Try to open as ELF file (Linux binary)
-		file, err := elf.Open(binaryPath)
+		// Try to parse as ELF file (Linux binary)
+		file, err := elf.NewFile(bytes.NewReader(entry.Data))
 		if err != nil {
 			// Might be a script or non-ELF binary
 			// Try to check if it's a script
-			data, _ := ioutil.ReadFile(binaryPath)
+			data := entry.Data
 			if len(data) > 2 && data[0] == '#' && data[1] == '!' {
-				fmt.Printf("  ℹ️  Script file (no library dependencies)\n")
+				record("binaries", "/"+binary, report.Passed, "script file (no library dependencies)")
+				fmt.Fprintf(out, "  ℹ️  Script file (no library dependencies)\n")
 			} else {
-				fmt.Printf("  ⚠️  Not an ELF binary (can't check dependencies)\n")
+				record("binaries", "/"+binary, report.Skipped, "not an ELF binary")
+				fmt.Fprintf(out, "  ⚠️  Not an ELF binary (can't check dependencies)\n")
 			}
 			continue
 		}
@@ -527,12 +534,14 @@ func VerifyDependencies(imagePath string) error {
 		// Check if statically or dynamically linked
 		deps, err := file.DynString(elf.DT_NEEDED)
 		if err != nil || len(deps) == 0 {
-			fmt.Printf("  ✅ Statically linked (no external dependencies)\n")
+			record("binaries", "/"+binary, report.Passed, "statically linked")
+			fmt.Fprintf(out, "  ✅ Statically linked (no external dependencies)\n")
 			continue
 		}
 
 		// List dependencies
-		fmt.Printf("  Dependencies:\n")
+		record("binaries", "/"+binary, report.Passed, fmt.Sprintf("%d dependencies", len(deps)))
+		fmt.Fprintf(out, "  Dependencies:\n")
 		for _, dep := range deps {
 			allDeps[dep] = true
 
@@ -547,10 +556,10 @@ func VerifyDependencies(imagePath string) error {
 			}
 
 			for _, searchPath := range searchPaths {
-				depPath := filepath.Join(tempDir, searchPath, dep)
-				if _, err := os.Stat(depPath); err == nil {
+				if _, ok := archive.Stat(path.Join(searchPath, dep)); ok {
 					found = true
-					fmt.Printf("    ✅ %s (found in /%s/)\n", dep, searchPath)
+					record("libraries", binary+": "+dep, report.Passed, "found in /"+searchPath+"/")
+					fmt.Fprintf(out, "    ✅ %s (found in /%s/)\n", dep, searchPath)
 					break
 				}
 			}
@@ -558,9 +567,11 @@ func VerifyDependencies(imagePath string) error {
 			if !found {
 				// Check if it's a system library that will be provided
 				if strings.HasPrefix(dep, "libc.") || strings.HasPrefix(dep, "ld-") {
-					fmt.Printf("    ℹ️  %s (system library)\n", dep)
+					record("libraries", binary+": "+dep, report.Passed, "system library")
+					fmt.Fprintf(out, "    ℹ️  %s (system library)\n", dep)
 				} else {
-					fmt.Printf("    ❌ %s NOT FOUND\n", dep)
+					record("libraries", binary+": "+dep, report.Failed, "not found")
+					fmt.Fprintf(out, "    ❌ %s NOT FOUND\n", dep)
 					if missingDeps[binary] == nil {
 						missingDeps[binary] = []string{}
 					}
@@ -571,8 +582,8 @@ func VerifyDependencies(imagePath string) error {
 	}
 
 	// Check for common required libraries
-	fmt.Println("\nCOMMON LIBRARIES CHECK:")
-	fmt.Println("-----------------------")
+	fmt.Fprintln(out, "\nCOMMON LIBRARIES CHECK:")
+	fmt.Fprintln(out, "-----------------------")
 
 	commonLibs := []struct {
 		name     string
@@ -594,8 +605,7 @@ func VerifyDependencies(imagePath string) error {
 
 		searchPaths := []string{"lib", "lib64", "usr/lib", "usr/lib64", "lib/x86_64-linux-musl"}
 		for _, searchPath := range searchPaths {
-			libPath := filepath.Join(tempDir, searchPath, lib.name)
-			if _, err := os.Stat(libPath); err == nil {
+			if _, ok := archive.Stat(path.Join(searchPath, lib.name)); ok {
 				found = true
 				foundPath = searchPath
 				foundLibs++
@@ -605,93 +615,116 @@ func VerifyDependencies(imagePath string) error {
 
 		status := "❌"
 		message := "not found"
+		outcome := report.Failed
 		if found {
 			status = "✅"
 			message = fmt.Sprintf("found in /%s/", foundPath)
+			outcome = report.Passed
 		} else if !lib.required {
 			status = "ℹ️ "
 			message = "not found (optional)"
+			outcome = report.Skipped
 		}
 
-		fmt.Printf("  %s %-30s %s - %s\n", status, lib.name, message, lib.desc)
+		record("common-libraries", lib.name, outcome, message)
+
+		fmt.Fprintf(out, "  %s %-30s %s - %s\n", status, lib.name, message, lib.desc)
 	}
 
 	// Check for musl vs glibc
-	fmt.Println("\nC LIBRARY ANALYSIS:")
-	fmt.Println("-------------------")
+	fmt.Fprintln(out, "\nC LIBRARY ANALYSIS:")
+	fmt.Fprintln(out, "-------------------")
 
 	hasMusl := false
 	hasGlibc := false
 
 	muslPaths := []string{
-		filepath.Join(tempDir, "lib/ld-musl-x86_64.so.1"),
-		filepath.Join(tempDir, "lib/libc.musl-x86_64.so.1"),
+		"lib/ld-musl-x86_64.so.1",
+		"lib/libc.musl-x86_64.so.1",
 	}
-	for _, path := range muslPaths {
-		if _, err := os.Stat(path); err == nil {
+	for _, libPath := range muslPaths {
+		if _, ok := archive.Stat(libPath); ok {
 			hasMusl = true
 			break
 		}
 	}
 
 	glibcPaths := []string{
-		filepath.Join(tempDir, "lib/ld-linux-x86-64.so.2"),
-		filepath.Join(tempDir, "lib64/ld-linux-x86-64.so.2"),
-		filepath.Join(tempDir, "lib/libc.so.6"),
+		"lib/ld-linux-x86-64.so.2",
+		"lib64/ld-linux-x86-64.so.2",
+		"lib/libc.so.6",
 	}
-	for _, path := range glibcPaths {
-		if _, err := os.Stat(path); err == nil {
+	for _, libPath := range glibcPaths {
+		if _, ok := archive.Stat(libPath); ok {
 			hasGlibc = true
 			break
 		}
 	}
 
 	if hasMusl {
-		fmt.Println("  ✅ musl libc detected (recommended for minimal size)")
+		fmt.Fprintln(out, "  ✅ musl libc detected (recommended for minimal size)")
 	}
 	if hasGlibc {
-		fmt.Println("  ℹ️  glibc detected (larger but more compatible)")
+		fmt.Fprintln(out, "  ℹ️  glibc detected (larger but more compatible)")
 	}
 	if !hasMusl && !hasGlibc {
-		fmt.Println("  ✅ No C library found (all binaries are statically linked)")
+		fmt.Fprintln(out, "  ✅ No C library found (all binaries are statically linked)")
 	}
 
 	// Summary
-	fmt.Println("\n" + strings.Repeat("=", 60))
+	fmt.Fprintln(out, "\n"+strings.Repeat("=", 60))
 
 	if len(missingDeps) == 0 {
-		fmt.Println("✅ DEPENDENCY VERIFICATION PASSED")
+		fmt.Fprintln(out, "✅ DEPENDENCY VERIFICATION PASSED")
 		if len(allDeps) == 0 {
-			fmt.Println("   All binaries are statically linked (optimal)")
+			fmt.Fprintln(out, "   All binaries are statically linked (optimal)")
 		} else {
-			fmt.Printf("   %d dependencies found and satisfied\n", len(allDeps))
+			fmt.Fprintf(out, "   %d dependencies found and satisfied\n", len(allDeps))
 		}
 		return nil
 	} else {
-		fmt.Println("❌ DEPENDENCY VERIFICATION FAILED")
-		fmt.Println("   Missing critical libraries:")
+		fmt.Fprintln(out, "❌ DEPENDENCY VERIFICATION FAILED")
+		fmt.Fprintln(out, "   Missing critical libraries:")
 		for binary, deps := range missingDeps {
-			fmt.Printf("   %s is missing:\n", binary)
+			fmt.Fprintf(out, "   %s is missing:\n", binary)
 			for _, dep := range deps {
-				fmt.Printf("     - %s\n", dep)
+				fmt.Fprintf(out, "     - %s\n", dep)
 			}
 		}
 		return fmt.Errorf("missing %d critical dependencies", len(missingDeps))
 	}
 }
 
+// checkDeviceNode returns a description of what is wrong with a required
+// device node in the archive, or "" if it is a char device with the
+// expected major:minor
+func checkDeviceNode(archive *cpio.Archive, node integration.DeviceNode) string {
+	entry, ok := archive.Lstat(node.Path)
+	if !ok {
+		return fmt.Sprintf("%s missing", node.Path)
+	}
+	if !entry.IsCharDevice() {
+		return fmt.Sprintf("%s is not a char device (mode: %06o)", node.Path, entry.Mode)
+	}
+	if entry.RDevMajor != node.Major || entry.RDevMinor != node.Minor {
+		return fmt.Sprintf("%s is char %d:%d, expected %d:%d",
+			node.Path, entry.RDevMajor, entry.RDevMinor, node.Major, node.Minor)
+	}
+	return ""
+}
+
 // VerifyBoot performs a quick QEMU boot test
-func VerifyBoot(imagePath string) error {
-	fmt.Println("QEMU BOOT TEST")
-	fmt.Println("==============")
-	fmt.Printf("Image: %s\n\n", imagePath)
+func VerifyBoot(imagePath string, out io.Writer) error {
+	fmt.Fprintln(out, "QEMU BOOT TEST")
+	fmt.Fprintln(out, "==============")
+	fmt.Fprintf(out, "Image: %s\n\n", imagePath)
 
 	// Check if qemu is installed
 	qemuCmd := "qemu-system-x86_64"
 	if _, err := exec.LookPath(qemuCmd); err != nil {
-		fmt.Println("⚠️  QEMU not found. Install with:")
-		fmt.Println("    macOS:  brew install qemu")
-		fmt.Println("    Linux:  apt-get install qemu-system")
+		fmt.Fprintln(out, "⚠️  QEMU not found. Install with:")
+		fmt.Fprintln(out, "    macOS:  brew install qemu")
+		fmt.Fprintln(out, "    Linux:  apt-get install qemu-system")
 		return fmt.Errorf("qemu-system-x86_64 not found in PATH")
 	}
 
@@ -713,16 +746,16 @@ func VerifyBoot(imagePath string) error {
 	}
 
 	if kernelPath == "" {
-		fmt.Println("⚠️  No kernel found. You need a Linux kernel to boot.")
-		fmt.Println("   Try: rock-kernel fetch alpine:latest && rock-kernel extract ...")
+		fmt.Fprintln(out, "⚠️  No kernel found. You need a Linux kernel to boot.")
+		fmt.Fprintln(out, "   Try: rock-kernel fetch alpine:latest && rock-kernel extract ...")
 		return fmt.Errorf("no kernel found for boot test")
 	}
 
-	fmt.Printf("Using kernel: %s\n", kernelPath)
-	fmt.Printf("Using initrd: %s\n", imagePath)
-	fmt.Println("\nStarting QEMU boot test...")
-	fmt.Println("(This will timeout after 10 seconds)")
-	fmt.Println()
+	fmt.Fprintf(out, "Using kernel: %s\n", kernelPath)
+	fmt.Fprintf(out, "Using initrd: %s\n", imagePath)
+	fmt.Fprintln(out, "\nStarting QEMU boot test...")
+	fmt.Fprintln(out, "(This will timeout after 10 seconds)")
+	fmt.Fprintln(out)
 
 	// Prepare QEMU command
 	args := []string{
@@ -730,7 +763,7 @@ func VerifyBoot(imagePath string) error {
 		"-initrd", imagePath,
 		"-m", "256M",
 		"-nographic",
-		"-append", "console=ttyS0 init=/sbin/init panic=1",
+		"-append", integration.GetKernelCmdline("debug") + " panic=1",
 		"-no-reboot",
 	}
 
@@ -772,8 +805,8 @@ func VerifyBoot(imagePath string) error {
 	initStarted := false
 	errorDetected := false
 
-	fmt.Println("Boot log:")
-	fmt.Println("---------")
+	fmt.Fprintln(out, "Boot log:")
+	fmt.Fprintln(out, "---------")
 
 Loop:
 	for {
@@ -783,13 +816,13 @@ Loop:
 				break Loop
 			}
 			output = append(output, chunk...)
-			fmt.Print(string(chunk))
+			fmt.Fprint(out, string(chunk))
 
 			outputStr := string(output)
 
-			// Check for successful init start
-			if strings.Contains(outputStr, "init=/sbin/init") ||
-			   strings.Contains(outputStr, "Run /sbin/init") {
+			// Check for successful init start; the kernel's own message,
+			// since the echoed command line contains rdinit=/sbin/init
+			if strings.Contains(outputStr, "Run /sbin/init as init process") {
 				initStarted = true
 			}
 
@@ -809,7 +842,7 @@ Loop:
 			}
 
 		case <-timeout:
-			fmt.Println("\n\n[Boot test timeout reached]")
+			fmt.Fprintln(out, "\n\n[Boot test timeout reached]")
 			break Loop
 		}
 	}
@@ -819,59 +852,72 @@ Loop:
 	cmd.Wait()
 
 	// Analyze results
-	fmt.Println("\n" + strings.Repeat("=", 60))
-	fmt.Println("BOOT TEST RESULTS:")
-	fmt.Println(strings.Repeat("=", 60))
+	boot := report.Case{Name: "qemu", Output: string(output)}
+	switch {
+	case errorDetected:
+		boot.Status, boot.Message = report.Failed, "kernel panic or critical error detected"
+	case bootSuccess:
+		boot.Status = report.Passed
+	case initStarted:
+		boot.Status, boot.Message = report.Warning, "kernel loaded init but rock-init messages not detected"
+	default:
+		boot.Status, boot.Message = report.Failed, "could not determine if init started properly"
+	}
+	results.Add("boot", boot)
+
+	fmt.Fprintln(out, "\n"+strings.Repeat("=", 60))
+	fmt.Fprintln(out, "BOOT TEST RESULTS:")
+	fmt.Fprintln(out, strings.Repeat("=", 60))
 
 	if errorDetected {
-		fmt.Println("❌ BOOT TEST FAILED")
-		fmt.Println("   Kernel panic or critical error detected")
-		fmt.Println("   Check that rock-init is properly renamed to /sbin/init")
+		fmt.Fprintln(out, "❌ BOOT TEST FAILED")
+		fmt.Fprintln(out, "   Kernel panic or critical error detected")
+		fmt.Fprintln(out, "   Check that rock-init is properly renamed to /sbin/init")
 		return fmt.Errorf("boot test failed with critical error")
 	} else if bootSuccess {
-		fmt.Println("✅ BOOT TEST SUCCESSFUL")
-		fmt.Println("   Rock-init started successfully")
+		fmt.Fprintln(out, "✅ BOOT TEST SUCCESSFUL")
+		fmt.Fprintln(out, "   Rock-init started successfully")
 		return nil
 	} else if initStarted {
-		fmt.Println("⚠️  BOOT TEST PARTIAL SUCCESS")
-		fmt.Println("   Kernel loaded init but rock-init messages not detected")
-		fmt.Println("   This might still work in a full environment")
+		fmt.Fprintln(out, "⚠️  BOOT TEST PARTIAL SUCCESS")
+		fmt.Fprintln(out, "   Kernel loaded init but rock-init messages not detected")
+		fmt.Fprintln(out, "   This might still work in a full environment")
 		return nil
 	} else {
-		fmt.Println("❌ BOOT TEST INCONCLUSIVE")
-		fmt.Println("   Could not determine if init started properly")
-		fmt.Println("   Check the boot log above for issues")
+		fmt.Fprintln(out, "❌ BOOT TEST INCONCLUSIVE")
+		fmt.Fprintln(out, "   Could not determine if init started properly")
+		fmt.Fprintln(out, "   Check the boot log above for issues")
 		return fmt.Errorf("boot test inconclusive")
 	}
 }
 
 // Main command handlers
-func cmdIntegration(args []string) error {
+func cmdIntegration(args []string, out io.Writer) error {
 	if len(args) < 1 {
 		return fmt.Errorf("usage: rock-verify integration <image.cpio.gz>")
 	}
-	return VerifyIntegration(args[0])
+	return VerifyIntegration(args[0], out)
 }
 
-func cmdStructure(args []string) error {
+func cmdStructure(args []string, out io.Writer) error {
 	if len(args) < 1 {
 		return fmt.Errorf("usage: rock-verify structure <image.cpio.gz>")
 	}
-	return VerifyStructure(args[0])
+	return VerifyStructure(args[0], out)
 }
 
-func cmdDependencies(args []string) error {
+func cmdDependencies(args []string, out io.Writer) error {
 	if len(args) < 1 {
 		return fmt.Errorf("usage: rock-verify dependencies <image.cpio.gz>")
 	}
-	return VerifyDependencies(args[0])
+	return VerifyDependencies(args[0], out)
 }
 
-func cmdBoot(args []string) error {
+func cmdBoot(args []string, out io.Writer) error {
 	if len(args) < 1 {
 		return fmt.Errorf("usage: rock-verify boot <image.cpio.gz>")
 	}
-	return VerifyBoot(args[0])
+	return VerifyBoot(args[0], out)
 }
 
 func printUsage() {
@@ -887,6 +933,13 @@ func printUsage() {
 	fmt.Println("  rock-verify boot <image.cpio.gz>        QEMU boot test")
 	fmt.Println("  rock-verify version                      Show version")
 	fmt.Println()
+	fmt.Println("Options:")
+	fmt.Println("  --report <file>  Also write a JUnit (.xml) or HTML (.html) report")
+	fmt.Println()
+	fmt.Println("Environment:")
+	fmt.Println("  ROCK_OUTPUT=junit  JUnit XML report on stdout (check listing on stderr)")
+	fmt.Println("  ROCK_OUTPUT=html   Self-contained HTML report on stdout")
+	fmt.Println()
 	fmt.Println("Examples:")
 	fmt.Println("  # Complete verification (recommended)")
 	fmt.Println("  rock-verify integration initrd.cpio.gz")
@@ -917,22 +970,63 @@ func main() {
 		return
 	}
 
+	// --report <file> may appear anywhere after the command
+	reportPath := ""
+	for i := 0; i < len(args); i++ {
+		switch {
+		case args[i] == "--report" && i+1 < len(args):
+			reportPath = args[i+1]
+			args = append(args[:i:i], args[i+2:]...)
+			i--
+		case strings.HasPrefix(args[i], "--report="):
+			reportPath = strings.TrimPrefix(args[i], "--report=")
+			args = append(args[:i:i], args[i+1:]...)
+			i--
+		}
+	}
+
+	// A report on stdout must not be mixed with the check listing
+	var out io.Writer = os.Stdout
+	output := os.Getenv("ROCK_OUTPUT")
+	if report.IsFormat(output) {
+		out = os.Stderr
+	}
+
+	results.Name = "rock-verify " + command
 	var err error
 	switch command {
 	case "integration":
-		err = cmdIntegration(args)
+		err = cmdIntegration(args, out)
 	case "structure":
-		err = cmdStructure(args)
+		err = cmdStructure(args, out)
 	case "dependencies":
-		err = cmdDependencies(args)
+		err = cmdDependencies(args, out)
 	case "boot":
-		err = cmdBoot(args)
+		err = cmdBoot(args, out)
 	default:
 		fmt.Fprintf(os.Stderr, "Error: unknown command: %s\n\n", command)
 		printUsage()
 		os.Exit(1)
 	}
 
+	// A check that could not run at all still shows up in the report
+	if err != nil && len(results.Suites) == 0 {
+		record(command, command, report.Failed, err.Error())
+	}
+	results.Duration = time.Since(results.Timestamp)
+	if reportPath != "" {
+		if werr := report.WriteFile(reportPath, results); werr != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", werr)
+			os.Exit(1)
+		}
+	}
+	if report.IsFormat(output) {
+		if werr := report.Write(os.Stdout, output, results); werr != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", werr)
+			os.Exit(1)
+		}
+	}
+
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "\nError: %v\n", err)
 		os.Exit(1)
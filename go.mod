@@ -1,5 +1,14 @@
 module github.com/rock-os/tools
 
-go 1.21
+go 1.22
 
 require github.com/mattn/go-sqlite3 v1.14.32
+
+require (
+	github.com/fsnotify/fsnotify v1.8.0
+	github.com/klauspost/compress v1.18.0
+	github.com/ulikunitz/xz v0.5.15
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require golang.org/x/sys v0.13.0 // indirect
@@ -0,0 +1,490 @@
+// Package cache implements the artifact store behind rock-cache.
+//
+// Artifacts are stored under a key with JSON metadata beside them. Keys
+// may be chosen by the caller ("kernel-5.15") or derived from the content
+// itself (PutContent), which lets rock-compose share identical outputs
+// between steps and runs.
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultDir is the cache directory under the user's home
+	DefaultDir = ".rock-cache"
+
+	// Cache subdirectories
+	ArtifactsDir = "artifacts"
+	MetadataDir  = "metadata"
+
+	// DefaultMaxAge is how long Clean keeps artifacts by default (7 days)
+	DefaultMaxAge = 7 * 24 * time.Hour
+
+	// contentPrefix starts the keys of content-addressed artifacts
+	contentPrefix = "sha256-"
+)
+
+// Entry is the metadata of a cached artifact
+type Entry struct {
+	Key         string      `json:"key"`
+	Filename    string      `json:"filename"`
+	Size        int64       `json:"size"`
+	Hash        string      `json:"hash"`
+	Mode        os.FileMode `json:"mode,omitempty"`
+	Timestamp   time.Time   `json:"timestamp"`
+	Description string      `json:"description,omitempty"`
+	Tags        []string    `json:"tags,omitempty"`
+	AccessCount int         `json:"access_count"`
+	LastAccess  time.Time   `json:"last_access"`
+}
+
+// Stats summarizes the contents of a store
+type Stats struct {
+	TotalEntries int       `json:"total_entries"`
+	TotalSize    int64     `json:"total_size"`
+	OldestEntry  time.Time `json:"oldest_entry,omitempty"`
+	NewestEntry  time.Time `json:"newest_entry,omitempty"`
+}
+
+// Store is a cache directory
+type Store struct {
+	Dir       string
+	artifacts string
+	metadata  string
+}
+
+// Dir returns the cache directory from $ROCK_CACHE_DIR, defaulting to
+// ~/.rock-cache
+func Dir() string {
+	if dir := os.Getenv("ROCK_CACHE_DIR"); dir != "" {
+		return dir
+	}
+	homeDir, _ := os.UserHomeDir()
+	return filepath.Join(homeDir, DefaultDir)
+}
+
+// Open opens the store in dir, creating its directories if needed
+func Open(dir string) (*Store, error) {
+	s := &Store{
+		Dir:       dir,
+		artifacts: filepath.Join(dir, ArtifactsDir),
+		metadata:  filepath.Join(dir, MetadataDir),
+	}
+	for _, d := range []string{s.Dir, s.artifacts, s.metadata} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create directory %s: %v", d, err)
+		}
+	}
+	return s, nil
+}
+
+// ValidKey reports whether key can name an artifact: 1 to 255
+// alphanumeric, dash, underscore or dot characters
+func ValidKey(key string) bool {
+	for _, r := range key {
+		if !((r >= 'a' && r <= 'z') ||
+			(r >= 'A' && r <= 'Z') ||
+			(r >= '0' && r <= '9') ||
+			r == '-' || r == '_' || r == '.') {
+			return false
+		}
+	}
+	return len(key) > 0 && len(key) <= 255
+}
+
+// ContentKey returns the key of content with the given SHA256
+func ContentKey(hash string) string {
+	return contentPrefix + hash
+}
+
+// Put stores the file at path under key
+func (s *Store) Put(key, path string) (*Entry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot access file %s: %v", path, err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	entry, err := s.PutReader(key, filepath.Base(path), file)
+	if err != nil {
+		return nil, err
+	}
+	entry.Mode = info.Mode().Perm()
+	if err := s.saveMetadata(entry); err != nil {
+		return nil, fmt.Errorf("failed to save metadata: %w", err)
+	}
+	return entry, nil
+}
+
+// PutReader stores the contents of r under key, recording filename as the
+// default name to restore it to
+func (s *Store) PutReader(key, filename string, r io.Reader) (*Entry, error) {
+	if !ValidKey(key) {
+		return nil, fmt.Errorf("invalid key format. Use alphanumeric, dash, underscore, and dot only")
+	}
+
+	tmp, err := os.CreateTemp(s.artifacts, ".put-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to store artifact: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hash), r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to store artifact: %w", err)
+	}
+
+	now := time.Now()
+	entry := &Entry{
+		Key:        key,
+		Filename:   filename,
+		Size:       size,
+		Hash:       hex.EncodeToString(hash.Sum(nil)),
+		Timestamp:  now,
+		LastAccess: now,
+	}
+
+	// Rename into place so readers never see a partial artifact
+	if err := os.Rename(tmp.Name(), s.artifactPath(key)); err != nil {
+		return nil, fmt.Errorf("failed to store artifact: %w", err)
+	}
+	if err := s.saveMetadata(entry); err != nil {
+		// Clean up artifact if metadata save fails
+		os.Remove(s.artifactPath(key))
+		return nil, fmt.Errorf("failed to save metadata: %w", err)
+	}
+	return entry, nil
+}
+
+// PutContent stores the file at path under a key derived from its
+// contents. Identical files are stored once.
+func (s *Store) PutContent(path string) (*Entry, error) {
+	hash, err := HashFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key := ContentKey(hash)
+	if entry, err := s.Lookup(key); err == nil && entry.Hash == hash {
+		if _, err := os.Stat(s.artifactPath(key)); err == nil {
+			return entry, nil
+		}
+	}
+	return s.Put(key, path)
+}
+
+// Lookup returns the metadata of an artifact
+func (s *Store) Lookup(key string) (*Entry, error) {
+	if !ValidKey(key) {
+		return nil, fmt.Errorf("invalid key format")
+	}
+	entry, err := loadMetadata(s.metadataPath(key))
+	if err != nil {
+		return nil, fmt.Errorf("artifact '%s' not found in cache", key)
+	}
+	return entry, nil
+}
+
+// Get copies an artifact to dest, or to its original file name if dest is
+// empty, and records the access
+func (s *Store) Get(key, dest string) (*Entry, error) {
+	entry, err := s.Lookup(key)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check if artifact exists
+	artifactPath := s.artifactPath(key)
+	if _, err := os.Stat(artifactPath); err != nil {
+		return nil, fmt.Errorf("artifact file missing for '%s'", key)
+	}
+
+	if dest == "" {
+		dest = entry.Filename
+	}
+	mode := entry.Mode
+	if mode == 0 {
+		mode = 0644
+	}
+	if err := copyFile(artifactPath, dest, mode); err != nil {
+		return nil, fmt.Errorf("failed to retrieve artifact: %w", err)
+	}
+
+	// Update access metadata
+	entry.AccessCount++
+	entry.LastAccess = time.Now()
+	s.saveMetadata(entry)
+
+	return entry, nil
+}
+
+// ReadFile returns the contents of an artifact
+func (s *Store) ReadFile(key string) ([]byte, error) {
+	if _, err := s.Lookup(key); err != nil {
+		return nil, err
+	}
+	return os.ReadFile(s.artifactPath(key))
+}
+
+// Remove deletes an artifact and its metadata
+func (s *Store) Remove(key string) (*Entry, error) {
+	entry, err := s.Lookup(key)
+	if err != nil {
+		return nil, fmt.Errorf("artifact '%s' not found", key)
+	}
+	os.Remove(s.artifactPath(key))
+	os.Remove(s.metadataPath(key))
+	return entry, nil
+}
+
+// List returns the metadata of every artifact. Unreadable metadata is
+// skipped.
+func (s *Store) List() ([]*Entry, error) {
+	files, err := os.ReadDir(s.metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []*Entry
+	for _, file := range files {
+		if filepath.Ext(file.Name()) == ".json" {
+			entry, err := loadMetadata(filepath.Join(s.metadata, file.Name()))
+			if err != nil {
+				continue // Skip corrupted metadata
+			}
+			entries = append(entries, entry)
+		}
+	}
+
+	return entries, nil
+}
+
+// Clean removes artifacts stored more than maxAge ago and returns them
+func (s *Store) Clean(maxAge time.Duration) ([]*Entry, error) {
+	entries, err := s.List()
+	if err != nil {
+		return nil, err
+	}
+
+	cutoff := time.Now().Add(-maxAge)
+	var removed []*Entry
+	for _, entry := range entries {
+		if entry.Timestamp.Before(cutoff) {
+			os.Remove(s.artifactPath(entry.Key))
+			os.Remove(s.metadataPath(entry.Key))
+			removed = append(removed, entry)
+		}
+	}
+	return removed, nil
+}
+
+// Stats returns the number, total size and age range of the artifacts
+func (s *Store) Stats() (*Stats, error) {
+	entries, err := s.List()
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &Stats{TotalEntries: len(entries)}
+	for i, entry := range entries {
+		stats.TotalSize += entry.Size
+		if i == 0 || entry.Timestamp.Before(stats.OldestEntry) {
+			stats.OldestEntry = entry.Timestamp
+		}
+		if i == 0 || entry.Timestamp.After(stats.NewestEntry) {
+			stats.NewestEntry = entry.Timestamp
+		}
+	}
+	return stats, nil
+}
+
+// Verify rehashes an artifact and returns its metadata and current hash.
+// The artifact is intact if the hash equals entry.Hash.
+func (s *Store) Verify(key string) (*Entry, string, error) {
+	entry, err := s.Lookup(key)
+	if err != nil {
+		return nil, "", fmt.Errorf("artifact '%s' not found", key)
+	}
+	hash, err := HashFile(s.artifactPath(key))
+	if err != nil {
+		return entry, "", err
+	}
+	return entry, hash, nil
+}
+
+// Export copies the store to dir
+func (s *Store) Export(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create output directory: %w", err)
+	}
+	if err := copyDir(s.artifacts, filepath.Join(dir, ArtifactsDir)); err != nil {
+		return fmt.Errorf("failed to export artifacts: %w", err)
+	}
+	if err := copyDir(s.metadata, filepath.Join(dir, MetadataDir)); err != nil {
+		return fmt.Errorf("failed to export metadata: %w", err)
+	}
+	return nil
+}
+
+// Import copies the artifacts of an exported store into s. Artifacts that
+// cannot be copied are reported through warn and skipped.
+func (s *Store) Import(dir string, warn func(key string, err error)) (int, error) {
+	if _, err := os.Stat(dir); err != nil {
+		return 0, fmt.Errorf("input directory not found: %s", dir)
+	}
+
+	metadataIn := filepath.Join(dir, MetadataDir)
+	files, err := os.ReadDir(metadataIn)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read import directory: %w", err)
+	}
+
+	imported := 0
+	for _, file := range files {
+		if filepath.Ext(file.Name()) != ".json" {
+			continue
+		}
+		key := strings.TrimSuffix(file.Name(), ".json")
+
+		// Copy artifact
+		if err := copyFile(filepath.Join(dir, ArtifactsDir, key), s.artifactPath(key), 0644); err != nil {
+			warn(key, err)
+			continue
+		}
+
+		// Copy metadata
+		if err := copyFile(filepath.Join(metadataIn, file.Name()), s.metadataPath(key), 0644); err != nil {
+			os.Remove(s.artifactPath(key)) // Clean up artifact if metadata fails
+			warn(key, fmt.Errorf("failed to import metadata: %v", err))
+			continue
+		}
+
+		imported++
+	}
+	return imported, nil
+}
+
+// HashFile returns the hex SHA256 of a file's contents
+func HashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func (s *Store) artifactPath(key string) string {
+	return filepath.Join(s.artifacts, key)
+}
+
+func (s *Store) metadataPath(key string) string {
+	return filepath.Join(s.metadata, key+".json")
+}
+
+func (s *Store) saveMetadata(entry *Entry) error {
+	data, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(s.metadataPath(entry.Key), data, 0644)
+}
+
+func loadMetadata(path string) (*Entry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var entry Entry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, err
+	}
+
+	return &entry, nil
+}
+
+// copyFile copies src to dst through a temporary file, so dst is either
+// the old or the complete new file
+func copyFile(src, dst string, mode os.FileMode) error {
+	sourceFile, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer sourceFile.Close()
+
+	// Create destination directory if needed
+	dstDir := filepath.Dir(dst)
+	if err := os.MkdirAll(dstDir, 0755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(dstDir, "."+filepath.Base(dst)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = io.Copy(tmp, sourceFile)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), mode); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
+}
+
+func copyDir(src, dst string) error {
+	// Create destination directory
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		return err
+	}
+
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		srcPath := filepath.Join(src, entry.Name())
+		dstPath := filepath.Join(dst, entry.Name())
+
+		if entry.IsDir() {
+			if err := copyDir(srcPath, dstPath); err != nil {
+				return err
+			}
+		} else {
+			if err := copyFile(srcPath, dstPath, 0644); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
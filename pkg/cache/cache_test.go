@@ -0,0 +1,64 @@
+package cache
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStore(t *testing.T) {
+	dir := t.TempDir()
+	store, err := Open(filepath.Join(dir, "cache"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	src := filepath.Join(dir, "init")
+	if err := os.WriteFile(src, []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	entry, err := store.Put("rock-init", src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Put("bad/key", src); err == nil {
+		t.Error("expected an error for an invalid key")
+	}
+
+	dest := filepath.Join(dir, "out", "init")
+	if _, err := store.Get("rock-init", dest); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(dest)
+	if err != nil || info.Mode().Perm() != 0755 {
+		t.Errorf("restored file mode = %v, %v; want 0755", info.Mode(), err)
+	}
+	if _, hash, err := store.Verify("rock-init"); err != nil || hash != entry.Hash {
+		t.Errorf("Verify = %s, %v; want %s", hash, err, entry.Hash)
+	}
+
+	// Identical content is stored once under its hash
+	first, err := store.PutContent(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := store.PutContent(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Key != ContentKey(entry.Hash) || second.Key != first.Key {
+		t.Errorf("content keys = %s, %s; want %s", first.Key, second.Key, ContentKey(entry.Hash))
+	}
+
+	if stats, err := store.Stats(); err != nil || stats.TotalEntries != 2 {
+		t.Errorf("Stats = %+v, %v; want 2 entries", stats, err)
+	}
+	if removed, err := store.Clean(-time.Hour); err != nil || len(removed) != 2 {
+		t.Errorf("Clean removed %d, %v; want 2", len(removed), err)
+	}
+	if _, err := store.Lookup("rock-init"); err == nil {
+		t.Error("expected rock-init to be cleaned")
+	}
+}
@@ -0,0 +1,215 @@
+package cpio
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// maxSymlinkDepth bounds symlink resolution, like the kernel's MAXSYMLINKS
+const maxSymlinkDepth = 40
+
+// Archive is an in-memory index of a CPIO archive, used to inspect and
+// verify images without extracting them to disk
+type Archive struct {
+	Format  Format
+	Entries []Entry // In archive order
+	index   map[string]int
+}
+
+// ReadAll reads every entry of a CPIO archive from r, including file
+// contents. Hardlinked files share the contents of their last link.
+func ReadAll(r io.Reader) (*Archive, error) {
+	return readArchive(NewReader(r))
+}
+
+// readArchive reads entries from cr up to the trailer
+func readArchive(cr *Reader) (*Archive, error) {
+	a := NewArchive(FormatNewc)
+
+	type linkKey struct{ major, minor, ino uint32 }
+	links := make(map[linkKey][]int)
+
+	for {
+		hdr, err := cr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		a.Format = cr.Format()
+
+		entry := Entry{Header: *hdr}
+		if hdr.IsRegular() {
+			// The size comes from the image, so the buffer grows with
+			// the data actually read rather than being allocated upfront
+			data, err := io.ReadAll(cr)
+			if err != nil {
+				return nil, fmt.Errorf("cpio: %s: %w", hdr.Name, err)
+			}
+			entry.Data = data
+		}
+		a.add(entry)
+
+		if hdr.IsRegular() && hdr.NLink > 1 {
+			key := linkKey{hdr.DevMajor, hdr.DevMinor, hdr.Inode}
+			links[key] = append(links[key], len(a.Entries)-1)
+		}
+	}
+
+	// newc stores hardlinked data once, on the last link
+	for _, group := range links {
+		var data []byte
+		for _, i := range group {
+			if len(a.Entries[i].Data) > 0 {
+				data = a.Entries[i].Data
+			}
+		}
+		for _, i := range group {
+			a.Entries[i].Data = data
+			a.Entries[i].Size = int64(len(data))
+		}
+	}
+	return a, nil
+}
+
+// ReadFile reads a CPIO archive from disk. Compression is detected
+// from the magic bytes, not the file name. An image of several
+// concatenated segments is read as the tree the kernel unpacks from it.
+func ReadFile(imagePath string) (*Archive, error) {
+	data, err := os.ReadFile(imagePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open image: %w", err)
+	}
+	segments, err := ReadSegments(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read archive: %w", err)
+	}
+	return MergeSegments(segments), nil
+}
+
+// OpenImage opens an image file and returns its decompressed contents.
+// Gzip, zstd, xz and lz4 are detected from the magic bytes; anything else
+// is returned as is.
+func OpenImage(imagePath string) (io.ReadCloser, error) {
+	file, err := os.Open(imagePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open image: %w", err)
+	}
+
+	rc, _, err := NewDecompressor(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &imageReader{Reader: rc, closers: []io.Closer{rc, file}}, nil
+}
+
+// imageReader closes the decompressor and the file together
+type imageReader struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (r *imageReader) Close() error {
+	var first error
+	for _, c := range r.closers {
+		if err := c.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// NewArchive creates an empty archive index, for building one from
+// another source such as a tar file
+func NewArchive(format Format) *Archive {
+	return &Archive{Format: format, index: make(map[string]int)}
+}
+
+// Add adds an entry to the index. A later entry with the same name
+// replaces an earlier one, matching how the kernel unpacks.
+func (a *Archive) Add(e Entry) {
+	a.add(e)
+}
+
+// add appends an entry; a later entry with the same name replaces an
+// earlier one, matching how the kernel unpacks
+func (a *Archive) add(e Entry) {
+	name := cleanName(e.Name)
+	if i, ok := a.index[name]; ok {
+		a.Entries[i] = e
+		return
+	}
+	a.index[name] = len(a.Entries)
+	a.Entries = append(a.Entries, e)
+}
+
+// Lstat returns the entry at name without following a final symlink.
+// Symlinks in intermediate directories are followed.
+func (a *Archive) Lstat(name string) (*Entry, bool) {
+	return a.resolve(name, false)
+}
+
+// Stat returns the entry at name, following symlinks
+func (a *Archive) Stat(name string) (*Entry, bool) {
+	return a.resolve(name, true)
+}
+
+// Names returns the cleaned names of all entries in archive order
+func (a *Archive) Names() []string {
+	names := make([]string, len(a.Entries))
+	for i, e := range a.Entries {
+		names[i] = cleanName(e.Name)
+	}
+	return names
+}
+
+// resolve walks name component by component, following symlinks
+func (a *Archive) resolve(name string, followLast bool) (*Entry, bool) {
+	rest := cleanName(name)
+	cur := ""
+
+	for depth := 0; depth <= maxSymlinkDepth; {
+		if rest == "" {
+			if cur == "" {
+				return nil, false // the root itself is not an entry
+			}
+			i, ok := a.index[cur]
+			if !ok {
+				return nil, false
+			}
+			return &a.Entries[i], true
+		}
+
+		comp := rest
+		rest = ""
+		if i := strings.IndexByte(comp, '/'); i >= 0 {
+			comp, rest = comp[:i], comp[i+1:]
+		}
+		next := path.Join(cur, comp)
+
+		i, ok := a.index[next]
+		if !ok {
+			return nil, false
+		}
+		e := &a.Entries[i]
+		if !e.IsSymlink() || (rest == "" && !followLast) {
+			cur = next
+			continue
+		}
+
+		// Restart resolution from the symlink target
+		depth++
+		target := e.Linkname
+		if !strings.HasPrefix(target, "/") {
+			target = path.Join(path.Dir(next), target)
+		}
+		rest = cleanName(path.Join(target, rest))
+		cur = ""
+	}
+	return nil, false
+}
@@ -0,0 +1,175 @@
+package cpio
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// Compression names how an image is compressed
+type Compression string
+
+// Compressions the kernel can unpack an initramfs from
+const (
+	CompressNone Compression = "none"
+	CompressGzip Compression = "gzip"
+	CompressZstd Compression = "zstd"
+	CompressXz   Compression = "xz"
+	CompressLz4  Compression = "lz4"
+)
+
+// Compressions lists every compression, compressed ones first
+var Compressions = []Compression{CompressGzip, CompressZstd, CompressXz, CompressLz4, CompressNone}
+
+// DefaultLevel selects a compressor's default level
+const DefaultLevel = -1
+
+// compressions describes each compression: its file extension, the magic
+// bytes that start its output, and the levels it accepts. A compression
+// with no levels has maxLevel 0.
+var compressions = map[Compression]struct {
+	extension          string
+	magic              []byte
+	minLevel, maxLevel int
+}{
+	CompressNone: {"", nil, 0, 0},
+	CompressGzip: {".gz", []byte{0x1f, 0x8b}, 1, 9},
+	CompressZstd: {".zst", []byte{0x28, 0xb5, 0x2f, 0xfd}, 1, 22},
+	CompressXz:   {".xz", []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}, 0, 9},
+	CompressLz4:  {".lz4", binary.LittleEndian.AppendUint32(nil, lz4LegacyMagic), 0, 0},
+}
+
+// xzDictCaps are the dictionary sizes of xz's presets 0-9
+var xzDictCaps = []int{256 << 10, 1 << 20, 2 << 20, 4 << 20, 4 << 20, 8 << 20, 8 << 20, 16 << 20, 32 << 20, 64 << 20}
+
+// ParseCompression returns the compression with the given name
+func ParseCompression(name string) (Compression, error) {
+	c := Compression(name)
+	if _, ok := compressions[c]; !ok {
+		return "", fmt.Errorf("unknown compression %q (want gzip, zstd, xz, lz4 or none)", name)
+	}
+	return c, nil
+}
+
+// Extension returns the file name extension for the compression, such as
+// ".zst", or "" for none
+func (c Compression) Extension() string {
+	return compressions[c].extension
+}
+
+// CheckLevel reports whether the compression accepts a level
+func (c Compression) CheckLevel(level int) error {
+	info := compressions[c]
+	switch {
+	case level == DefaultLevel:
+		return nil
+	case info.maxLevel == 0:
+		return fmt.Errorf("%s compression has no levels", c)
+	case level < info.minLevel || level > info.maxLevel:
+		return fmt.Errorf("%s compression level must be %d-%d, got %d", c, info.minLevel, info.maxLevel, level)
+	}
+	return nil
+}
+
+// NewCompressor returns a writer compressing to w. The output depends
+// only on the input and level, so reproducible archives stay
+// reproducible: gzip headers carry no name or mtime, and zstd encodes on
+// a single goroutine. Closing it does not close w.
+//
+// Levels follow the command line tools: gzip 1-9, xz 0-9 (xz is written
+// with CRC32 checks, as the kernel requires), and zstd 1-22, which maps
+// onto the encoder's four speeds. lz4 is written in the legacy format the
+// kernel reads and has a single level.
+func NewCompressor(w io.Writer, c Compression, level int) (io.WriteCloser, error) {
+	if err := c.CheckLevel(level); err != nil {
+		return nil, err
+	}
+	switch c {
+	case CompressNone:
+		return nopWriteCloser{w}, nil
+	case CompressGzip:
+		return gzip.NewWriterLevel(w, level)
+	case CompressZstd:
+		speed := zstd.SpeedDefault
+		if level != DefaultLevel {
+			speed = zstd.EncoderLevelFromZstd(level)
+		}
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(speed), zstd.WithEncoderConcurrency(1))
+	case CompressXz:
+		if level == DefaultLevel {
+			level = 6
+		}
+		return xz.WriterConfig{DictCap: xzDictCaps[level], CheckSum: xz.CRC32}.NewWriter(w)
+	case CompressLz4:
+		return newLZ4Writer(w), nil
+	}
+	return nil, fmt.Errorf("unknown compression %q", c)
+}
+
+// nopWriteCloser writes uncompressed output
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+// DetectCompression identifies the compression of data from its first
+// bytes. Anything unrecognised is reported as uncompressed.
+func DetectCompression(magic []byte) Compression {
+	for _, c := range Compressions {
+		if c != CompressNone && bytes.HasPrefix(magic, compressions[c].magic) {
+			return c
+		}
+	}
+	return CompressNone
+}
+
+// errLZ4Frame is returned for lz4 data in the frame format
+var errLZ4Frame = errors.New("lz4 frame format is not supported; the kernel reads only the legacy format (lz4 -l)")
+
+// maxMagicLen is the number of bytes DetectCompression needs
+const maxMagicLen = 6
+
+// NewDecompressor returns the decompressed contents of r, with the
+// compression detected from the magic bytes, and the compression found
+func NewDecompressor(r io.Reader) (io.ReadCloser, Compression, error) {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(maxMagicLen)
+	c := DetectCompression(magic)
+
+	var err error
+	var rc io.ReadCloser
+	switch c {
+	case CompressGzip:
+		rc, err = gzip.NewReader(br)
+	case CompressZstd:
+		var d *zstd.Decoder
+		if d, err = zstd.NewReader(br, zstd.WithDecoderConcurrency(1)); err == nil {
+			rc = d.IOReadCloser()
+		}
+	case CompressXz:
+		var xr *xz.Reader
+		if xr, err = xz.NewReader(br); err == nil {
+			rc = io.NopCloser(xr)
+		}
+	case CompressLz4:
+		var zr *lz4Reader
+		if zr, err = newLZ4Reader(br); err == nil {
+			rc = io.NopCloser(zr)
+		}
+	default:
+		if len(magic) >= 4 && binary.LittleEndian.Uint32(magic) == lz4FrameMagic {
+			return nil, c, errLZ4Frame
+		}
+		rc = io.NopCloser(br)
+	}
+	if err != nil {
+		return nil, c, fmt.Errorf("failed to create %s reader: %w", c, err)
+	}
+	return rc, c, nil
+}
@@ -0,0 +1,146 @@
+// Package cpio implements the SVR4 "newc" and "crc" CPIO formats used by
+// the Linux kernel to unpack an initramfs.
+//
+// Archives are produced natively so that image contents, ownership and
+// device nodes do not depend on the host cpio binary or on running as root.
+package cpio
+
+import (
+	"fmt"
+	"time"
+)
+
+// Format identifies a CPIO header format
+type Format int
+
+const (
+	// FormatNewc is the "new ASCII" format (magic 070701) the kernel expects
+	FormatNewc Format = iota
+	// FormatCRC is newc with a per-file checksum (magic 070702)
+	FormatCRC
+	// FormatODC is the old portable ASCII format (magic 070707).
+	// It can be read but not written.
+	FormatODC
+)
+
+// Header magics
+const (
+	MagicNewc = "070701"
+	MagicCRC  = "070702"
+	MagicODC  = "070707"
+)
+
+// TrailerName marks the end of an archive
+const TrailerName = "TRAILER!!!"
+
+// File type bits stored in Header.Mode (same values as <sys/stat.h>)
+const (
+	TypeMask    = 0170000
+	TypeSocket  = 0140000
+	TypeSymlink = 0120000
+	TypeReg     = 0100000
+	TypeBlock   = 0060000
+	TypeDir     = 0040000
+	TypeChar    = 0020000
+	TypeFifo    = 0010000
+)
+
+// newcHeaderLen is the fixed size of a newc/crc header before the name
+const newcHeaderLen = 110
+
+// String returns the format name
+func (f Format) String() string {
+	switch f {
+	case FormatNewc:
+		return "newc"
+	case FormatCRC:
+		return "crc"
+	case FormatODC:
+		return "odc"
+	default:
+		return fmt.Sprintf("Format(%d)", int(f))
+	}
+}
+
+// Magic returns the header magic for the format
+func (f Format) Magic() string {
+	if f == FormatCRC {
+		return MagicCRC
+	}
+	return MagicNewc
+}
+
+// DetectFormat identifies the CPIO format from the first bytes of an
+// archive
+func DetectFormat(magic []byte) (Format, bool) {
+	if len(magic) < 6 {
+		return 0, false
+	}
+	switch string(magic[:6]) {
+	case MagicNewc:
+		return FormatNewc, true
+	case MagicCRC:
+		return FormatCRC, true
+	case MagicODC:
+		return FormatODC, true
+	}
+	return 0, false
+}
+
+// Header describes a single archive entry
+type Header struct {
+	Name      string    // Path inside the archive, without a leading "/" or "./"
+	Mode      uint32    // Type bits | permission bits
+	UID       uint32    // Owner user id
+	GID       uint32    // Owner group id
+	NLink     uint32    // Number of links (0 means 1, or 2 for directories)
+	ModTime   time.Time // Modification time
+	Size      int64     // Data length; for symlinks, the length of Linkname
+	Inode     uint32    // Inode number (0 means assign sequentially)
+	DevMajor  uint32    // Device containing the file
+	DevMinor  uint32
+	RDevMajor uint32 // Device number for char/block nodes
+	RDevMinor uint32
+	Linkname  string // Symlink target
+	Checksum  uint32 // Sum of data bytes (crc format only)
+}
+
+// Type returns the file type bits of the header mode
+func (h *Header) Type() uint32 {
+	return h.Mode & TypeMask
+}
+
+// Perm returns the permission bits of the header mode
+func (h *Header) Perm() uint32 {
+	return h.Mode &^ TypeMask
+}
+
+// IsDir reports whether the header describes a directory
+func (h *Header) IsDir() bool { return h.Type() == TypeDir }
+
+// IsRegular reports whether the header describes a regular file
+func (h *Header) IsRegular() bool { return h.Type() == TypeReg }
+
+// IsSymlink reports whether the header describes a symbolic link
+func (h *Header) IsSymlink() bool { return h.Type() == TypeSymlink }
+
+// IsCharDevice reports whether the header describes a character device
+func (h *Header) IsCharDevice() bool { return h.Type() == TypeChar }
+
+// IsBlockDevice reports whether the header describes a block device
+func (h *Header) IsBlockDevice() bool { return h.Type() == TypeBlock }
+
+// Checksum returns the crc-format checksum of data: the unsigned 32-bit sum
+// of all bytes
+func Checksum(data []byte) uint32 {
+	var sum uint32
+	for _, b := range data {
+		sum += uint32(b)
+	}
+	return sum
+}
+
+// pad4 returns the number of bytes needed to align n to 4 bytes
+func pad4(n int64) int64 {
+	return (4 - n%4) % 4
+}
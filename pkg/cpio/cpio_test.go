@@ -0,0 +1,443 @@
+package cpio
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteTreeRoundTrip(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "bin"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "bin", "busybox"), []byte("busybox"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("busybox", filepath.Join(root, "bin", "sh")); err != nil {
+		t.Fatal(err)
+	}
+
+	overlay := []Entry{
+		{Header: Header{Name: "/dev/console", Mode: TypeChar | 0620, RDevMajor: 5, RDevMinor: 1}},
+		{Header: Header{Name: "etc/rock/node.yaml", Mode: TypeReg | 0644}, Data: []byte("id: 1\n")},
+	}
+
+	for _, format := range []Format{FormatNewc, FormatCRC} {
+		t.Run(format.String(), func(t *testing.T) {
+			var buf bytes.Buffer
+			count, err := WriteTree(&buf, root, TreeOptions{Format: format, Overlay: overlay})
+			if err != nil {
+				t.Fatalf("WriteTree: %v", err)
+			}
+			if buf.Len()%512 != 0 {
+				t.Errorf("archive length %d is not block aligned", buf.Len())
+			}
+
+			archive, err := ReadAll(&buf)
+			if err != nil {
+				t.Fatalf("ReadAll: %v", err)
+			}
+			if archive.Format != format {
+				t.Errorf("format = %v, want %v", archive.Format, format)
+			}
+			// bin, bin/busybox, bin/sh, dev, dev/console, etc, etc/rock, etc/rock/node.yaml
+			if len(archive.Entries) != count || count != 8 {
+				t.Errorf("got %d entries (wrote %d), want 8: %v", len(archive.Entries), count, archive.Names())
+			}
+
+			console, ok := archive.Lstat("/dev/console")
+			if !ok || !console.IsCharDevice() || console.RDevMajor != 5 || console.RDevMinor != 1 {
+				t.Errorf("dev/console = %+v, want char 5:1", console)
+			}
+			if console != nil && (console.UID != 0 || console.GID != 0) {
+				t.Errorf("dev/console owned by %d:%d, want 0:0", console.UID, console.GID)
+			}
+
+			sh, ok := archive.Lstat("bin/sh")
+			if !ok || !sh.IsSymlink() || sh.Linkname != "busybox" {
+				t.Errorf("bin/sh = %+v, want symlink to busybox", sh)
+			}
+			target, ok := archive.Stat("bin/sh")
+			if !ok || string(target.Data) != "busybox" || target.Perm() != 0755 {
+				t.Errorf("Stat(bin/sh) = %+v, want busybox contents", target)
+			}
+
+			node, ok := archive.Stat("etc/rock/node.yaml")
+			if !ok || string(node.Data) != "id: 1\n" {
+				t.Errorf("etc/rock/node.yaml = %+v", node)
+			}
+			if dir, ok := archive.Stat("etc/rock"); !ok || !dir.IsDir() {
+				t.Errorf("etc/rock parent directory was not synthesized")
+			}
+		})
+	}
+}
+
+func TestWriterLayout(t *testing.T) {
+	// One file and the trailer, laid out as the kernel's unpacker reads them
+	for _, format := range []Format{FormatNewc, FormatCRC} {
+		var buf bytes.Buffer
+		cw := NewWriterFormat(&buf, format)
+		hdr := &Header{
+			Name: "/etc/hostname", Mode: TypeReg | 0644, UID: 1000, GID: 100, Size: 5,
+			ModTime: time.Unix(1700000000, 0), Checksum: Checksum([]byte("rock\n")),
+		}
+		if err := cw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(cw, "rock\n"); err != nil {
+			t.Fatal(err)
+		}
+		if err := cw.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		check := uint32(0)
+		if format == FormatCRC {
+			check = Checksum([]byte("rock\n"))
+		}
+		record := "%s%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%s"
+		want := fmt.Sprintf(record, format.Magic(), 1, TypeReg|0644, 1000, 100, 1, 1700000000, 5, 0, 0, 0, 0, 13, check, "etc/hostname") +
+			"\x00\x00" + "rock\n\x00\x00\x00" +
+			fmt.Sprintf(record, format.Magic(), 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 11, 0, TrailerName) + "\x00\x00\x00\x00"
+		want += strings.Repeat("\x00", 512-len(want))
+		if got := buf.String(); got != want {
+			t.Errorf("%s archive:\n%q\nwant\n%q", format, got, want)
+		}
+	}
+}
+
+func TestWriterRoundTrip(t *testing.T) {
+	entries := []struct {
+		hdr  Header
+		data string
+	}{
+		{Header{Name: "etc", Mode: TypeDir | 0755}, ""},
+		{Header{Name: "/etc/hostname", Mode: TypeReg | 0644, UID: 1000, GID: 100}, "rock\n"},
+		{Header{Name: "./bin/sh", Mode: TypeSymlink | 0777, Linkname: "busybox"}, ""},
+		{Header{Name: "dev/vda", Mode: TypeBlock | 0600, RDevMajor: 254, RDevMinor: 3}, ""},
+	}
+
+	for _, format := range []Format{FormatNewc, FormatCRC} {
+		t.Run(format.String(), func(t *testing.T) {
+			var buf bytes.Buffer
+			cw := NewWriterFormat(&buf, format)
+			for _, e := range entries {
+				hdr := e.hdr
+				hdr.Size = int64(len(e.data))
+				hdr.Checksum = Checksum([]byte(e.data))
+				if err := cw.WriteHeader(&hdr); err != nil {
+					t.Fatalf("WriteHeader(%s): %v", hdr.Name, err)
+				}
+				if _, err := io.WriteString(cw, e.data); err != nil {
+					t.Fatalf("Write(%s): %v", hdr.Name, err)
+				}
+			}
+			if err := cw.Close(); err != nil {
+				t.Fatalf("Close: %v", err)
+			}
+			if !bytes.HasPrefix(buf.Bytes(), []byte(format.Magic())) {
+				t.Errorf("archive starts %q, want %s magic", buf.Bytes()[:6], format)
+			}
+			if buf.Len()%512 != 0 {
+				t.Errorf("archive length %d is not block aligned", buf.Len())
+			}
+
+			cr := NewReader(&buf)
+			for _, e := range entries {
+				hdr, err := cr.Next()
+				if err != nil {
+					t.Fatalf("Next: %v", err)
+				}
+				data, err := io.ReadAll(cr)
+				if err != nil {
+					t.Fatalf("%s: %v", hdr.Name, err)
+				}
+				want := strings.TrimPrefix(strings.TrimPrefix(e.hdr.Name, "./"), "/")
+				if hdr.Name != want || hdr.Mode != e.hdr.Mode || hdr.UID != e.hdr.UID || hdr.GID != e.hdr.GID {
+					t.Errorf("got %s %o %d:%d, want %s %o %d:%d", hdr.Name, hdr.Mode, hdr.UID, hdr.GID,
+						want, e.hdr.Mode, e.hdr.UID, e.hdr.GID)
+				}
+				if hdr.RDevMajor != e.hdr.RDevMajor || hdr.RDevMinor != e.hdr.RDevMinor {
+					t.Errorf("%s: rdev %d:%d, want %d:%d", hdr.Name, hdr.RDevMajor, hdr.RDevMinor,
+						e.hdr.RDevMajor, e.hdr.RDevMinor)
+				}
+				if hdr.IsSymlink() {
+					if hdr.Linkname != e.hdr.Linkname {
+						t.Errorf("%s: link %q, want %q", hdr.Name, hdr.Linkname, e.hdr.Linkname)
+					}
+				} else if string(data) != e.data {
+					t.Errorf("%s: data %q, want %q", hdr.Name, data, e.data)
+				}
+			}
+			if _, err := cr.Next(); err != io.EOF {
+				t.Errorf("expected io.EOF at trailer, got %v", err)
+			}
+		})
+	}
+}
+
+func TestWriterErrors(t *testing.T) {
+	cw := NewWriterFormat(io.Discard, FormatCRC)
+	if err := cw.WriteHeader(&Header{Name: "init", Mode: TypeReg | 0755, Size: 2, Checksum: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cw.Write([]byte("abc")); err != ErrWriteTooLong {
+		t.Errorf("overlong write: got %v, want ErrWriteTooLong", err)
+	}
+	if err := cw.Close(); err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Errorf("bad checksum: got %v", err)
+	}
+
+	cw = NewWriter(io.Discard)
+	if err := cw.WriteHeader(&Header{Name: "init", Mode: TypeReg | 0755, Size: 4}); err != nil {
+		t.Fatal(err)
+	}
+	if err := cw.Close(); err == nil || !strings.Contains(err.Error(), "missing 4 bytes") {
+		t.Errorf("short entry: got %v", err)
+	}
+	if err := NewWriterFormat(io.Discard, FormatODC).WriteHeader(&Header{Name: "x"}); err == nil {
+		t.Error("writing odc should fail")
+	}
+}
+
+func TestReaderODC(t *testing.T) {
+	var buf bytes.Buffer
+	writeODC := func(name string, mode, rdev uint32, data string) {
+		fmt.Fprintf(&buf, "%s%06o%06o%06o%06o%06o%06o%06o%011o%06o%011o%s\x00%s",
+			MagicODC, 0, 1, mode, 0, 0, 1, rdev, 0, len(name)+1, len(data), name, data)
+	}
+	writeODC("dev/console", TypeChar|0600, 5<<8|1, "")
+	writeODC("init", TypeReg|0755, 0, "#!/bin/sh\n")
+	writeODC(TrailerName, 0, 0, "")
+
+	cr := NewReader(&buf)
+	hdr, err := cr.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cr.Format() != FormatODC || !hdr.IsCharDevice() || hdr.RDevMajor != 5 || hdr.RDevMinor != 1 {
+		t.Errorf("got %v %+v, want odc char 5:1", cr.Format(), hdr)
+	}
+
+	hdr, err = cr.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(cr)
+	if err != nil || hdr.Name != "init" || string(data) != "#!/bin/sh\n" {
+		t.Errorf("got %q %q %v", hdr.Name, data, err)
+	}
+
+	if _, err := cr.Next(); err != io.EOF {
+		t.Errorf("expected io.EOF at trailer, got %v", err)
+	}
+}
+
+func TestReaderHugeSize(t *testing.T) {
+	// A truncated image whose header claims 3.75 GiB of data must fail
+	// without allocating it
+	for _, mode := range []uint32{TypeReg | 0644, TypeSymlink | 0777} {
+		image := fmt.Sprintf("%s%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%s\x00\x00",
+			MagicNewc, 1, mode, 0, 0, 1, 0, 0xF0000000, 0, 0, 0, 0, 2, 0, "x")
+
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		_, err := ReadAll(strings.NewReader(image))
+		runtime.ReadMemStats(&after)
+		if err == nil {
+			t.Errorf("mode %o: truncated image accepted", mode)
+		}
+		if grown := after.TotalAlloc - before.TotalAlloc; grown > 1<<20 {
+			t.Errorf("mode %o: allocated %d bytes for a %d-byte image", mode, grown, len(image))
+		}
+	}
+}
+
+func TestWriteTreeReproducible(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "sbin"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	initPath := filepath.Join(root, "sbin", "init")
+	if err := os.WriteFile(initPath, []byte("rock-init"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	epoch := time.Unix(1700000000, 0)
+	build := func() []byte {
+		var buf bytes.Buffer
+		if _, err := WriteTree(&buf, root, TreeOptions{ModTime: epoch}); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+
+	// Touching the rootfs between builds changes nothing
+	first := build()
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(initPath, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if second := build(); !bytes.Equal(first, second) {
+		t.Fatal("rebuilding the same rootfs produced different bytes")
+	}
+
+	// A content change is reported for the entry that changed
+	if err := os.WriteFile(initPath, []byte("rock-init v2"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	a, err := ReadAll(bytes.NewReader(first))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ReadAll(bytes.NewReader(build()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diffs := Diff(a, a); len(diffs) != 0 {
+		t.Errorf("archive differs from itself: %v", diffs)
+	}
+	diffs := Diff(a, b)
+	if len(diffs) != 1 || diffs[0].Name != "sbin/init" || diffs[0].Field != "data" {
+		t.Errorf("diffs = %v, want sbin/init data", diffs)
+	}
+}
+
+func TestCompressionRoundTrip(t *testing.T) {
+	// More than one lz4 chunk, mixing runs, repeats and random bytes
+	var data bytes.Buffer
+	for i := 0; data.Len() < lz4ChunkSize+100000; i++ {
+		fmt.Fprintf(&data, "entry %d of the image\n", i%977)
+		if i%1000 == 0 {
+			data.Write(bytes.Repeat([]byte{'x'}, 300))
+			random := make([]byte, 4096)
+			rand.New(rand.NewSource(int64(i))).Read(random)
+			data.Write(random)
+		}
+	}
+
+	for _, c := range Compressions {
+		t.Run(string(c), func(t *testing.T) {
+			var compressed bytes.Buffer
+			w, err := NewCompressor(&compressed, c, DefaultLevel)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := io.Copy(w, bytes.NewReader(data.Bytes())); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if c != CompressNone && compressed.Len() >= data.Len() {
+				t.Errorf("compressed to %d bytes from %d", compressed.Len(), data.Len())
+			}
+
+			rc, detected, err := NewDecompressor(&compressed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rc.Close()
+			if detected != c {
+				t.Errorf("detected %s, want %s", detected, c)
+			}
+			got, err := io.ReadAll(rc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data.Bytes()) {
+				t.Errorf("round trip changed the data: got %d bytes, want %d", len(got), data.Len())
+			}
+		})
+	}
+
+	if err := CompressLz4.CheckLevel(1); err == nil {
+		t.Error("lz4 accepted a level")
+	}
+	if err := CompressGzip.CheckLevel(10); err == nil {
+		t.Error("gzip accepted level 10")
+	}
+}
+
+func TestReadSegments(t *testing.T) {
+	// One segment per compression, lz4 last as its format requires; each
+	// replaces etc/stage and adds a file of its own
+	var image bytes.Buffer
+	var offsets []int64
+	order := []Compression{CompressNone, CompressGzip, CompressXz, CompressZstd, CompressLz4}
+	for i, c := range order {
+		offsets = append(offsets, int64(image.Len()))
+		w, err := NewCompressor(&image, c, DefaultLevel)
+		if err != nil {
+			t.Fatal(err)
+		}
+		overlay := []Entry{
+			{Header: Header{Name: "etc/stage", Mode: TypeReg | 0644}, Data: []byte(c)},
+			{Header: Header{Name: fmt.Sprintf("segment/%d", i), Mode: TypeReg | 0600}, Data: []byte(c)},
+		}
+		if _, err := WriteTree(w, "", TreeOptions{Overlay: overlay}); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		image.Write(make([]byte, 3)) // Padding, skipped like the kernel does
+	}
+
+	segments, err := ReadSegments(image.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != len(order) {
+		t.Fatalf("got %d segments, want %d", len(segments), len(order))
+	}
+	for i, segment := range segments {
+		if segment.Compression != order[i] || segment.Offset != offsets[i] || len(segment.Archive.Entries) != 4 {
+			t.Errorf("segment %d: %s at %d with %d entries, want %s at %d with 4", i+1,
+				segment.Compression, segment.Offset, len(segment.Archive.Entries), order[i], offsets[i])
+		}
+	}
+
+	merged := MergeSegments(segments)
+	if stage, ok := merged.Lstat("etc/stage"); !ok || string(stage.Data) != string(CompressLz4) {
+		t.Errorf("etc/stage = %v, want the last segment's", stage)
+	}
+	for i := range order {
+		if _, ok := merged.Lstat(fmt.Sprintf("segment/%d", i)); !ok {
+			t.Errorf("segment/%d missing from the merged tree", i)
+		}
+	}
+
+	if _, err := ReadSegments(append(append([]byte(nil), image.Bytes()[:offsets[1]]...), "junk"...)); err == nil || !strings.Contains(err.Error(), "segment 2 at offset") {
+		t.Errorf("trailing junk: error %v", err)
+	}
+
+	// The xz segment ends where its footer says, whatever follows it
+	xzSegment := image.Bytes()[offsets[2]:offsets[3]]
+	if n, err := xzStreamSize(xzSegment); err != nil || n != len(xzSegment)-3 {
+		t.Errorf("xz stream size = %d, %v; want %d", n, err, len(xzSegment)-3)
+	}
+	if _, err := xzStreamSize(xzSegment[:len(xzSegment)-7]); err == nil {
+		t.Error("xz stream without its footer accepted")
+	}
+
+	// Skippable zstd frames are refused by name, after a segment or first
+	skippable := []byte{0x5e, 0x2a, 0x4d, 0x18, 4, 0, 0, 0, 'r', 'o', 'c', 'k'}
+	for _, data := range [][]byte{
+		append(append([]byte(nil), image.Bytes()[:offsets[4]]...), skippable...),
+		skippable,
+	} {
+		if _, err := ReadSegments(data); err == nil || !strings.Contains(err.Error(), "skippable frames are not supported") {
+			t.Errorf("skippable zstd frame: error %v", err)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package cpio
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Difference is one way in which two archives differ
+type Difference struct {
+	Name  string // Entry name; empty for the archive as a whole
+	Field string // What differs: entry, order, type, mode, owner, mtime, inode, nlink, rdev, link, data
+	A, B  string // The values in each archive
+}
+
+func (d Difference) String() string {
+	if d.Name == "" {
+		return fmt.Sprintf("%s: %s != %s", d.Field, d.A, d.B)
+	}
+	return fmt.Sprintf("%s: %s: %s != %s", d.Name, d.Field, d.A, d.B)
+}
+
+// Diff compares two archives entry by entry and returns every difference
+// in their headers, contents and order. Archives without differences
+// produce the same bytes when written in the same format.
+func Diff(a, b *Archive) []Difference {
+	var diffs []Difference
+	if a.Format != b.Format {
+		diffs = append(diffs, Difference{Field: "format", A: a.Format.String(), B: b.Format.String()})
+	}
+
+	namesA, namesB := a.Names(), b.Names()
+	var common []string
+	for _, name := range namesA {
+		if _, ok := b.index[name]; ok {
+			common = append(common, name)
+		} else {
+			diffs = append(diffs, Difference{Name: name, Field: "entry", A: "present", B: "missing"})
+		}
+	}
+	var commonB []string
+	for _, name := range namesB {
+		if _, ok := a.index[name]; ok {
+			commonB = append(commonB, name)
+		} else {
+			diffs = append(diffs, Difference{Name: name, Field: "entry", A: "missing", B: "present"})
+		}
+	}
+	for i := range common {
+		if common[i] != commonB[i] {
+			diffs = append(diffs, Difference{Field: "order", A: common[i], B: commonB[i]})
+			break
+		}
+	}
+
+	for _, name := range common {
+		diffs = append(diffs, diffEntry(name, &a.Entries[a.index[name]], &b.Entries[b.index[name]])...)
+	}
+	return diffs
+}
+
+// diffEntry compares two entries with the same name
+func diffEntry(name string, a, b *Entry) []Difference {
+	var diffs []Difference
+	add := func(field, x, y string) {
+		if x != y {
+			diffs = append(diffs, Difference{Name: name, Field: field, A: x, B: y})
+		}
+	}
+	octal := func(n uint32) string { return fmt.Sprintf("%04o", n) }
+	mtime := func(t time.Time) string {
+		if t.IsZero() {
+			return "0"
+		}
+		return t.UTC().Format(time.RFC3339)
+	}
+
+	add("type", octal(a.Type()), octal(b.Type()))
+	add("mode", octal(a.Perm()), octal(b.Perm()))
+	add("owner", fmt.Sprintf("%d:%d", a.UID, a.GID), fmt.Sprintf("%d:%d", b.UID, b.GID))
+	add("mtime", mtime(a.ModTime), mtime(b.ModTime))
+	add("inode", strconv.FormatUint(uint64(a.Inode), 10), strconv.FormatUint(uint64(b.Inode), 10))
+	add("nlink", strconv.FormatUint(uint64(a.NLink), 10), strconv.FormatUint(uint64(b.NLink), 10))
+	add("rdev", fmt.Sprintf("%d:%d", a.RDevMajor, a.RDevMinor), fmt.Sprintf("%d:%d", b.RDevMajor, b.RDevMinor))
+	add("link", a.Linkname, b.Linkname)
+	if a.IsRegular() && b.IsRegular() {
+		add("data", dataDigest(a.Data), dataDigest(b.Data))
+	}
+	return diffs
+}
+
+// dataDigest describes file contents by size and a short hash
+func dataDigest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return fmt.Sprintf("%d bytes sha256:%s", len(data), hex.EncodeToString(sum[:6]))
+}
+
+// SourceDateEpoch returns the time in SOURCE_DATE_EPOCH, the
+// reproducible-builds convention for the timestamp a build records in
+// place of the current time. ok is false when it is not set.
+func SourceDateEpoch() (epoch time.Time, ok bool, err error) {
+	value := os.Getenv("SOURCE_DATE_EPOCH")
+	if value == "" {
+		return time.Time{}, false, nil
+	}
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || seconds < 0 {
+		return time.Time{}, false, fmt.Errorf("invalid SOURCE_DATE_EPOCH %q: want seconds since 1970", value)
+	}
+	return time.Unix(seconds, 0).UTC(), true, nil
+}
@@ -0,0 +1,283 @@
+package cpio
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// The kernel unpacks lz4 initramfs images only in the legacy format that
+// "lz4 -l" writes: a magic number followed by blocks of at most 8 MiB of
+// input, each prefixed with its compressed size. No lz4 library is needed
+// for that much; this is a plain greedy block compressor.
+const (
+	lz4LegacyMagic = 0x184c2102
+	lz4FrameMagic  = 0x184d2204 // Modern frame format, which the kernel rejects
+	lz4ChunkSize   = 8 << 20
+
+	lz4MinMatch     = 4
+	lz4LastLiterals = 5  // A block ends with at least this many literals
+	lz4MatchLimit   = 12 // No match starts within this many bytes of the end
+	lz4MaxOffset    = 65535
+	lz4HashLog      = 16
+)
+
+// errLZ4Corrupt is returned for a malformed lz4 block
+var errLZ4Corrupt = errors.New("lz4: corrupt block")
+
+// lz4CompressBound is the largest compressed size of n input bytes
+func lz4CompressBound(n int) int {
+	return n + n/255 + 16
+}
+
+// lz4Writer compresses to the lz4 legacy format
+type lz4Writer struct {
+	w      io.Writer
+	buf    []byte // Pending input, up to one chunk
+	out    []byte
+	table  []int32
+	header bool // Magic written
+	closed bool
+	err    error
+}
+
+// newLZ4Writer returns a writer compressing to w in the lz4 legacy format
+func newLZ4Writer(w io.Writer) *lz4Writer {
+	return &lz4Writer{w: w, buf: make([]byte, 0, lz4ChunkSize), table: make([]int32, 1<<lz4HashLog)}
+}
+
+func (z *lz4Writer) Write(p []byte) (int, error) {
+	if z.closed {
+		return 0, ErrWriteAfterClose
+	}
+	written := 0
+	for len(p) > 0 {
+		if z.err != nil {
+			return written, z.err
+		}
+		n := copy(z.buf[len(z.buf):cap(z.buf)], p)
+		z.buf = z.buf[:len(z.buf)+n]
+		p = p[n:]
+		written += n
+		if len(z.buf) == cap(z.buf) {
+			z.flush()
+		}
+	}
+	return written, z.err
+}
+
+// flush compresses and writes the pending chunk
+func (z *lz4Writer) flush() {
+	if z.err != nil {
+		return
+	}
+	if !z.header {
+		z.header = true
+		z.out = binary.LittleEndian.AppendUint32(z.out[:0], lz4LegacyMagic)
+		if _, z.err = z.w.Write(z.out); z.err != nil {
+			return
+		}
+	}
+	if len(z.buf) == 0 {
+		return
+	}
+	for i := range z.table {
+		z.table[i] = 0
+	}
+	z.out = binary.LittleEndian.AppendUint32(z.out[:0], 0)
+	z.out = lz4CompressBlock(z.out, z.buf, z.table)
+	binary.LittleEndian.PutUint32(z.out, uint32(len(z.out)-4))
+	_, z.err = z.w.Write(z.out)
+	z.buf = z.buf[:0]
+}
+
+// Close writes any pending input. It does not close the underlying writer.
+func (z *lz4Writer) Close() error {
+	if !z.closed {
+		z.closed = true
+		z.flush()
+	}
+	return z.err
+}
+
+// lz4CompressBlock appends the lz4 block encoding of src to dst. table
+// holds candidate match positions plus one and must start zeroed.
+func lz4CompressBlock(dst, src []byte, table []int32) []byte {
+	anchor := 0
+	misses := 0
+	for i := 0; i+lz4MatchLimit < len(src); {
+		seq := binary.LittleEndian.Uint32(src[i:])
+		h := (seq * 2654435761) >> (32 - lz4HashLog)
+		ref := int(table[h]) - 1
+		table[h] = int32(i + 1)
+		if ref < 0 || i-ref > lz4MaxOffset || binary.LittleEndian.Uint32(src[ref:]) != seq {
+			// Step faster through data that does not compress
+			i += 1 + misses>>6
+			misses++
+			continue
+		}
+		misses = 0
+
+		for i > anchor && ref > 0 && src[i-1] == src[ref-1] {
+			i--
+			ref--
+		}
+		length := lz4MinMatch
+		for i+length < len(src)-lz4LastLiterals && src[i+length] == src[ref+length] {
+			length++
+		}
+		dst = lz4AppendSequence(dst, src[anchor:i], i-ref, length)
+		i += length
+		anchor = i
+	}
+	return lz4AppendSequence(dst, src[anchor:], 0, 0)
+}
+
+// lz4AppendSequence appends literals followed by a match; a zero length
+// ends the block with the literals alone
+func lz4AppendSequence(dst, literals []byte, offset, length int) []byte {
+	token := byte(min(len(literals), 15)) << 4
+	if length > 0 {
+		token |= byte(min(length-lz4MinMatch, 15))
+	}
+	dst = append(dst, token)
+	dst = lz4AppendLength(dst, len(literals))
+	dst = append(dst, literals...)
+	if length > 0 {
+		dst = append(dst, byte(offset), byte(offset>>8))
+		dst = lz4AppendLength(dst, length-lz4MinMatch)
+	}
+	return dst
+}
+
+// lz4AppendLength appends the extension bytes of a length of 15 or more
+func lz4AppendLength(dst []byte, n int) []byte {
+	if n < 15 {
+		return dst
+	}
+	for n -= 15; n >= 255; n -= 255 {
+		dst = append(dst, 255)
+	}
+	return append(dst, byte(n))
+}
+
+// lz4DecompressBlock appends the decoded contents of an lz4 block to dst
+func lz4DecompressBlock(dst, src []byte) ([]byte, error) {
+	start := len(dst)
+	length := func(i, n int) (int, int, error) {
+		if n < 15 {
+			return i, n, nil
+		}
+		for {
+			if i >= len(src) {
+				return i, 0, errLZ4Corrupt
+			}
+			b := src[i]
+			i++
+			n += int(b)
+			if b != 255 {
+				return i, n, nil
+			}
+		}
+	}
+
+	var literals, matched int
+	var err error
+	for i := 0; i < len(src); {
+		token := src[i]
+		i++
+		i, literals, err = length(i, int(token>>4))
+		if err != nil || literals > len(src)-i {
+			return dst, errLZ4Corrupt
+		}
+		dst = append(dst, src[i:i+literals]...)
+		i += literals
+		if i == len(src) {
+			break
+		}
+
+		if i+2 > len(src) {
+			return dst, errLZ4Corrupt
+		}
+		offset := int(src[i]) | int(src[i+1])<<8
+		i += 2
+		i, matched, err = length(i, int(token&15))
+		if err != nil || offset == 0 || offset > len(dst)-start {
+			return dst, errLZ4Corrupt
+		}
+		matched += lz4MinMatch
+		if len(dst)-start+matched > lz4ChunkSize {
+			return dst, errLZ4Corrupt
+		}
+		from := len(dst) - offset
+		if offset >= matched {
+			dst = append(dst, dst[from:from+matched]...)
+		} else {
+			// Overlapping match: repeats the last offset bytes
+			for k := 0; k < matched; k++ {
+				dst = append(dst, dst[from+k])
+			}
+		}
+	}
+	return dst, nil
+}
+
+// lz4Reader decompresses the lz4 legacy format. Concatenated streams are
+// read as one, as the kernel does, and zero padding ends the stream.
+type lz4Reader struct {
+	r     io.Reader
+	block []byte
+	out   []byte
+	pos   int
+}
+
+// newLZ4Reader returns a reader decompressing r, which must start with
+// the legacy magic number
+func newLZ4Reader(r io.Reader) (*lz4Reader, error) {
+	var magic [4]byte
+	if _, err := io.ReadFull(r, magic[:]); err != nil {
+		return nil, fmt.Errorf("lz4: %w", err)
+	}
+	if binary.LittleEndian.Uint32(magic[:]) != lz4LegacyMagic {
+		return nil, errors.New("lz4: not in legacy format")
+	}
+	return &lz4Reader{r: r}, nil
+}
+
+func (z *lz4Reader) Read(p []byte) (int, error) {
+	for z.pos == len(z.out) {
+		var size [4]byte
+		if _, err := io.ReadFull(z.r, size[:]); err != nil {
+			if err == io.ErrUnexpectedEOF && binary.LittleEndian.Uint32(size[:]) != 0 {
+				return 0, errLZ4Corrupt
+			}
+			return 0, io.EOF // Including zero padding after the last block
+		}
+		n := binary.LittleEndian.Uint32(size[:])
+		if n == lz4LegacyMagic {
+			continue
+		}
+		if n == 0 {
+			return 0, io.EOF
+		}
+		if int64(n) > int64(lz4CompressBound(lz4ChunkSize)) {
+			return 0, errLZ4Corrupt
+		}
+		if cap(z.block) < int(n) {
+			z.block = make([]byte, n)
+		}
+		z.block = z.block[:n]
+		if _, err := io.ReadFull(z.r, z.block); err != nil {
+			return 0, errLZ4Corrupt
+		}
+		var err error
+		if z.out, err = lz4DecompressBlock(z.out[:0], z.block); err != nil {
+			return 0, err
+		}
+		z.pos = 0
+	}
+	n := copy(p, z.out[z.pos:])
+	z.pos += n
+	return n, nil
+}
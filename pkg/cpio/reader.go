@@ -0,0 +1,272 @@
+package cpio
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// odcHeaderLen is the fixed size of an odc header before the name
+const odcHeaderLen = 76
+
+// maxLinkLen bounds symlink targets, like the kernel's PATH_MAX
+const maxLinkLen = 4096
+
+// ErrHeader is returned when the archive contains an invalid header
+var ErrHeader = errors.New("cpio: invalid header")
+
+// Reader reads entries from a newc, crc or odc CPIO archive sequentially.
+// Call Next to advance to each entry and Read to get its contents.
+type Reader struct {
+	r       io.Reader
+	format  Format
+	remain  int64 // data bytes left in the current entry
+	pad     int64 // padding after the current entry's data
+	sum     uint32
+	want    uint32
+	checked bool
+	offset  int64 // bytes consumed from r
+	done    bool
+}
+
+// NewReader creates a Reader reading from r
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: r}
+}
+
+// Format returns the format of the most recently read header
+func (cr *Reader) Format() Format {
+	return cr.format
+}
+
+// Offset returns the number of bytes consumed from the underlying reader
+func (cr *Reader) Offset() int64 {
+	return cr.offset
+}
+
+// Next advances to the next entry and returns its header.
+// It returns io.EOF once the trailer has been read.
+func (cr *Reader) Next() (*Header, error) {
+	if cr.done {
+		return nil, io.EOF
+	}
+	if err := cr.skipEntry(); err != nil {
+		return nil, err
+	}
+
+	magic := make([]byte, 6)
+	if err := cr.readFull(magic); err != nil {
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	var hdr *Header
+	var err error
+	switch string(magic) {
+	case MagicNewc:
+		cr.format = FormatNewc
+		hdr, err = cr.readNewc()
+	case MagicCRC:
+		cr.format = FormatCRC
+		hdr, err = cr.readNewc()
+	case MagicODC:
+		cr.format = FormatODC
+		hdr, err = cr.readODC()
+	default:
+		return nil, fmt.Errorf("%w: bad magic %q at offset %d", ErrHeader, magic, cr.offset-6)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if hdr.Name == TrailerName {
+		cr.done = true
+		cr.remain, cr.pad = 0, 0
+		return nil, io.EOF
+	}
+
+	if hdr.IsSymlink() {
+		if cr.remain > maxLinkLen {
+			return nil, fmt.Errorf("%w: %s: link target of %d bytes", ErrHeader, hdr.Name, cr.remain)
+		}
+		target := make([]byte, cr.remain)
+		if _, err := io.ReadFull(cr, target); err != nil {
+			return nil, fmt.Errorf("cpio: %s: reading link target: %w", hdr.Name, err)
+		}
+		hdr.Linkname = string(target)
+	}
+	return hdr, nil
+}
+
+// Read reads from the current entry's data
+func (cr *Reader) Read(p []byte) (int, error) {
+	if cr.remain <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > cr.remain {
+		p = p[:cr.remain]
+	}
+	n, err := cr.r.Read(p)
+	cr.offset += int64(n)
+	cr.remain -= int64(n)
+	if cr.checked {
+		for _, b := range p[:n] {
+			cr.sum += uint32(b)
+		}
+	}
+	if err == io.EOF && cr.remain > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	if err == nil && cr.remain == 0 && cr.checked && cr.sum != cr.want {
+		err = fmt.Errorf("cpio: checksum mismatch: header %08x, data %08x", cr.want, cr.sum)
+	}
+	return n, err
+}
+
+// skipEntry discards unread data and padding of the current entry
+func (cr *Reader) skipEntry() error {
+	if cr.remain > 0 {
+		cr.checked = false
+		if _, err := io.CopyN(io.Discard, cr, cr.remain); err != nil {
+			return err
+		}
+	}
+	if cr.pad > 0 {
+		if err := cr.readFull(make([]byte, cr.pad)); err != nil {
+			return err
+		}
+		cr.pad = 0
+	}
+	return nil
+}
+
+// readNewc parses the rest of a newc/crc header after the magic
+func (cr *Reader) readNewc() (*Header, error) {
+	buf := make([]byte, newcHeaderLen-6)
+	if err := cr.readFull(buf); err != nil {
+		return nil, unexpected(err)
+	}
+
+	var fields [13]uint32
+	for i := range fields {
+		v, err := strconv.ParseUint(string(buf[i*8:(i+1)*8]), 16, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%w: bad field at offset %d", ErrHeader, cr.offset-int64(len(buf)))
+		}
+		fields[i] = uint32(v)
+	}
+
+	namesize := int64(fields[11])
+	name, err := cr.readName(namesize)
+	if err != nil {
+		return nil, err
+	}
+	if err := cr.readFull(make([]byte, pad4(newcHeaderLen+namesize))); err != nil {
+		return nil, unexpected(err)
+	}
+
+	hdr := &Header{
+		Inode:     fields[0],
+		Mode:      fields[1],
+		UID:       fields[2],
+		GID:       fields[3],
+		NLink:     fields[4],
+		ModTime:   time.Unix(int64(fields[5]), 0),
+		Size:      int64(fields[6]),
+		DevMajor:  fields[7],
+		DevMinor:  fields[8],
+		RDevMajor: fields[9],
+		RDevMinor: fields[10],
+		Checksum:  fields[12],
+		Name:      name,
+	}
+
+	cr.remain = hdr.Size
+	cr.pad = pad4(hdr.Size)
+	cr.sum = 0
+	cr.want = hdr.Checksum
+	cr.checked = cr.format == FormatCRC
+	return hdr, nil
+}
+
+// readODC parses the rest of an odc header after the magic
+func (cr *Reader) readODC() (*Header, error) {
+	buf := make([]byte, odcHeaderLen-6)
+	if err := cr.readFull(buf); err != nil {
+		return nil, unexpected(err)
+	}
+
+	// dev ino mode uid gid nlink rdev mtime namesize filesize
+	widths := []int{6, 6, 6, 6, 6, 6, 6, 11, 6, 11}
+	fields := make([]uint64, len(widths))
+	pos := 0
+	for i, w := range widths {
+		v, err := strconv.ParseUint(string(buf[pos:pos+w]), 8, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: bad odc field at offset %d", ErrHeader, cr.offset-int64(len(buf))+int64(pos))
+		}
+		fields[i] = v
+		pos += w
+	}
+
+	name, err := cr.readName(int64(fields[8]))
+	if err != nil {
+		return nil, err
+	}
+
+	dev, rdev := uint32(fields[0]), uint32(fields[6])
+	hdr := &Header{
+		DevMajor:  dev >> 8,
+		DevMinor:  dev & 0xff,
+		Inode:     uint32(fields[1]),
+		Mode:      uint32(fields[2]),
+		UID:       uint32(fields[3]),
+		GID:       uint32(fields[4]),
+		NLink:     uint32(fields[5]),
+		RDevMajor: rdev >> 8,
+		RDevMinor: rdev & 0xff,
+		ModTime:   time.Unix(int64(fields[7]), 0),
+		Size:      int64(fields[9]),
+		Name:      name,
+	}
+
+	// odc has no alignment padding
+	cr.remain = hdr.Size
+	cr.pad = 0
+	cr.checked = false
+	return hdr, nil
+}
+
+// readName reads a NUL-terminated entry name of namesize bytes
+func (cr *Reader) readName(namesize int64) (string, error) {
+	if namesize < 1 || namesize > 4096 {
+		return "", fmt.Errorf("%w: bad name size %d", ErrHeader, namesize)
+	}
+	name := make([]byte, namesize)
+	if err := cr.readFull(name); err != nil {
+		return "", unexpected(err)
+	}
+	if name[namesize-1] != 0 {
+		return "", fmt.Errorf("%w: name not NUL terminated", ErrHeader)
+	}
+	return string(name[:namesize-1]), nil
+}
+
+// readFull reads exactly len(buf) bytes from the underlying reader
+func (cr *Reader) readFull(buf []byte) error {
+	n, err := io.ReadFull(cr.r, buf)
+	cr.offset += int64(n)
+	return err
+}
+
+// unexpected converts io.EOF in the middle of a header into ErrUnexpectedEOF
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
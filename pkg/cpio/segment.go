@@ -0,0 +1,235 @@
+package cpio
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// Segment is one archive of a multi-segment image. The kernel unpacks
+// archives concatenated into one initramfs in order, each compressed or
+// not, skipping zero padding between them. The early microcode loader
+// reads only a first, uncompressed segment.
+type Segment struct {
+	Offset      int64 // Position in the image
+	Size        int64 // Length in the image, excluding padding
+	Compression Compression
+	Archive     *Archive
+}
+
+// ReadSegments splits an image into its segments. A compressed segment
+// ends where its compressed stream ends, except lz4: the legacy format
+// has no end marker, so an lz4 segment runs to the end of the image or
+// to zero padding.
+func ReadSegments(data []byte) ([]Segment, error) {
+	var segments []Segment
+	for offset := 0; offset < len(data); {
+		if data[offset] == 0 {
+			offset++
+			continue
+		}
+
+		rest := data[offset:]
+		segment := Segment{Offset: int64(offset), Compression: DetectCompression(rest)}
+		var err error
+		if segment.Compression == CompressNone {
+			if _, ok := DetectFormat(rest); !ok {
+				err = errUnknownData(rest)
+			} else {
+				cr := NewReader(bytes.NewReader(rest))
+				segment.Archive, err = readArchive(cr)
+				segment.Size = cr.Offset()
+			}
+		} else {
+			var content []byte
+			if content, segment.Size, err = decompressSegment(rest, segment.Compression); err == nil {
+				segment.Archive, err = ReadAll(bytes.NewReader(content))
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("segment %d at offset %d: %w", len(segments)+1, offset, err)
+		}
+		segments = append(segments, segment)
+		offset += int(segment.Size)
+	}
+	if len(segments) == 0 {
+		return nil, errors.New("cpio: image is empty")
+	}
+	return segments, nil
+}
+
+// MergeSegments returns the tree the kernel ends up with after unpacking
+// every segment in order: a later entry replaces an earlier one with the
+// same name
+func MergeSegments(segments []Segment) *Archive {
+	if len(segments) == 1 {
+		return segments[0].Archive
+	}
+	merged := NewArchive(segments[0].Archive.Format)
+	for _, segment := range segments {
+		for _, entry := range segment.Archive.Entries {
+			merged.add(entry)
+		}
+	}
+	return merged
+}
+
+// errUnknownData describes data that starts no segment
+func errUnknownData(data []byte) error {
+	if len(data) >= 4 && binary.LittleEndian.Uint32(data) == lz4FrameMagic {
+		return errLZ4Frame
+	}
+	if isZstdSkippable(data) {
+		return errZstdSkippable
+	}
+	return fmt.Errorf("neither a cpio archive nor gzip, zstd, xz or lz4 data (magic %q)", data[:min(len(data), 6)])
+}
+
+// decompressSegment decompresses the stream at the start of data and
+// returns its contents and the number of compressed bytes it spans
+func decompressSegment(data []byte, c Compression) ([]byte, int64, error) {
+	// The gzip reader consumes exactly its stream when given an
+	// io.ByteReader, so what is left of br is the rest of the image
+	br := bytes.NewReader(data)
+	var content []byte
+	var err error
+	switch c {
+	case CompressGzip:
+		var zr *gzip.Reader
+		if zr, err = gzip.NewReader(br); err != nil {
+			break
+		}
+		zr.Multistream(false)
+		content, err = io.ReadAll(zr)
+	case CompressXz:
+		// A single-stream reader rejects anything after the stream, so it
+		// only gets the stream
+		var n int
+		if n, err = xzStreamSize(data); err != nil {
+			break
+		}
+		var xr *xz.Reader
+		if xr, err = (xz.ReaderConfig{SingleStream: true}).NewReader(bytes.NewReader(data[:n])); err != nil {
+			break
+		}
+		content, err = io.ReadAll(xr)
+		br.Seek(int64(n), io.SeekStart)
+	case CompressZstd:
+		var n int
+		if n, err = zstdFrameSize(data); err != nil {
+			break
+		}
+		var d *zstd.Decoder
+		if d, err = zstd.NewReader(nil, zstd.WithDecoderConcurrency(1)); err != nil {
+			break
+		}
+		content, err = d.DecodeAll(data[:n], nil)
+		d.Close()
+		br.Seek(int64(n), io.SeekStart)
+	case CompressLz4:
+		var zr *lz4Reader
+		if zr, err = newLZ4Reader(br); err == nil {
+			content, err = io.ReadAll(zr)
+		}
+	default:
+		err = fmt.Errorf("unknown compression %q", c)
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("%s: %w", c, err)
+	}
+	return content, int64(len(data) - br.Len()), nil
+}
+
+// errXzTruncated is returned for an xz stream without its footer
+var errXzTruncated = errors.New("xz: truncated stream")
+
+// xzStreamSize returns the length of the xz stream at the start of data.
+// A stream is a multiple of 4 bytes long and ends with a 12-byte footer:
+// the CRC32 of the next 6 bytes, the size of the index before the footer,
+// the stream flags of the header, and "YZ".
+func xzStreamSize(data []byte) (int, error) {
+	if len(data) < 12 {
+		return 0, errXzTruncated
+	}
+	flags := data[6:8]
+	for end := 24; end <= len(data); end += 4 {
+		footer := data[end-12 : end]
+		if footer[10] != 'Y' || footer[11] != 'Z' || !bytes.Equal(footer[8:10], flags) {
+			continue
+		}
+		if crc32.ChecksumIEEE(footer[4:10]) != binary.LittleEndian.Uint32(footer) {
+			continue
+		}
+		// The index starts with a zero byte
+		index := end - 12 - (int(binary.LittleEndian.Uint32(footer[4:]))+1)*4
+		if index >= 12 && data[index] == 0 {
+			return end, nil
+		}
+	}
+	return 0, errXzTruncated
+}
+
+// Errors for zstd data the kernel cannot unpack
+var (
+	errZstdTruncated = errors.New("zstd: truncated frame")
+	errZstdSkippable = errors.New("zstd skippable frames are not supported; the kernel unpacks only regular zstd frames (recompress without skippable or seekable-format metadata)")
+)
+
+// isZstdSkippable reports whether data starts with a zstd skippable
+// frame, magic 0x184D2A50 to 0x184D2A5F
+func isZstdSkippable(data []byte) bool {
+	return len(data) >= 4 && binary.LittleEndian.Uint32(data)&^0xf == 0x184d2a50
+}
+
+// zstdFrameSize returns the length of the zstd frame at the start of
+// data, found by walking its block headers without decompressing
+func zstdFrameSize(data []byte) (int, error) {
+	if isZstdSkippable(data) {
+		return 0, errZstdSkippable
+	}
+	if len(data) < 5 {
+		return 0, errZstdTruncated
+	}
+	descriptor := data[4]
+	singleSegment := descriptor&0x20 != 0
+	pos := 5
+	if !singleSegment {
+		pos++ // Window descriptor
+	}
+	pos += []int{0, 1, 2, 4}[descriptor&3]  // Dictionary id
+	pos += []int{0, 2, 4, 8}[descriptor>>6] // Content size
+	if singleSegment && descriptor>>6 == 0 {
+		pos++
+	}
+
+	for last := false; !last; {
+		if pos+3 > len(data) {
+			return 0, errZstdTruncated
+		}
+		header := int(data[pos]) | int(data[pos+1])<<8 | int(data[pos+2])<<16
+		pos += 3
+		last = header&1 != 0
+		size := header >> 3
+		switch (header >> 1) & 3 {
+		case 1: // RLE: one byte, repeated
+			size = 1
+		case 3:
+			return 0, errors.New("zstd: reserved block type")
+		}
+		pos += size
+	}
+	if descriptor&0x04 != 0 {
+		pos += 4 // Content checksum
+	}
+	if pos > len(data) {
+		return 0, errZstdTruncated
+	}
+	return pos, nil
+}
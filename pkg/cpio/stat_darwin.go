@@ -0,0 +1,24 @@
+package cpio
+
+import (
+	"os"
+	"syscall"
+)
+
+// deviceNumber returns the major/minor numbers of a device node
+func deviceNumber(info os.FileInfo) (uint32, uint32) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0
+	}
+	dev := uint32(st.Rdev)
+	return (dev >> 24) & 0xff, dev & 0xffffff
+}
+
+// fileOwner returns the uid and gid of a host file
+func fileOwner(info os.FileInfo) (uint32, uint32) {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return st.Uid, st.Gid
+	}
+	return 0, 0
+}
@@ -0,0 +1,26 @@
+package cpio
+
+import (
+	"os"
+	"syscall"
+)
+
+// deviceNumber returns the major/minor numbers of a device node
+func deviceNumber(info os.FileInfo) (uint32, uint32) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0
+	}
+	dev := uint64(st.Rdev)
+	major := uint32((dev>>8)&0xfff) | uint32((dev>>32)&^uint64(0xfff))
+	minor := uint32(dev&0xff) | uint32((dev>>12)&^uint64(0xff))
+	return major, minor
+}
+
+// fileOwner returns the uid and gid of a host file
+func fileOwner(info os.FileInfo) (uint32, uint32) {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return st.Uid, st.Gid
+	}
+	return 0, 0
+}
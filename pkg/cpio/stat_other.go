@@ -0,0 +1,15 @@
+//go:build !linux && !darwin
+
+package cpio
+
+import "os"
+
+// deviceNumber is not available on this platform
+func deviceNumber(info os.FileInfo) (uint32, uint32) {
+	return 0, 0
+}
+
+// fileOwner is not available on this platform; entries are owned by root
+func fileOwner(info os.FileInfo) (uint32, uint32) {
+	return 0, 0
+}
@@ -0,0 +1,280 @@
+package cpio
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Entry is an archive entry together with the source of its contents
+type Entry struct {
+	Header
+	Data   []byte // In-memory contents of a regular file
+	Source string // Host file to read contents from when Data is nil
+}
+
+// TreeOptions controls how a directory tree is archived
+type TreeOptions struct {
+	Format Format
+
+	// PreserveOwner keeps the host uid/gid of rootfs files.
+	// By default every entry is owned by root (0:0), which is what the
+	// kernel expects and does not depend on who ran the build.
+	PreserveOwner bool
+
+	// Overlay entries are added to the rootfs, replacing any rootfs entry
+	// with the same name. Use it for synthetic entries such as device nodes.
+	Overlay []Entry
+
+	// ModTime, when set, replaces the mtime of every entry. Entries are
+	// always sorted and numbered sequentially, so with root ownership a
+	// fixed ModTime makes the archive depend only on the rootfs contents.
+	ModTime time.Time
+}
+
+// WriteTree writes the contents of rootfs plus opts.Overlay to w as a
+// complete archive, including the trailer. rootfs may be empty to archive
+// only the overlay. It returns the number of entries written.
+func WriteTree(w io.Writer, rootfs string, opts TreeOptions) (int, error) {
+	var entries []Entry
+	if rootfs != "" {
+		scanned, err := ScanDir(rootfs, opts.PreserveOwner)
+		if err != nil {
+			return 0, err
+		}
+		entries = scanned
+	}
+	entries = Merge(entries, opts.Overlay...)
+	if !opts.ModTime.IsZero() {
+		for i := range entries {
+			entries[i].ModTime = opts.ModTime
+		}
+	}
+
+	cw := NewWriterFormat(w, opts.Format)
+	if err := WriteEntries(cw, entries); err != nil {
+		return 0, err
+	}
+	if err := cw.Close(); err != nil {
+		return 0, err
+	}
+	return len(entries), nil
+}
+
+// ScanDir walks root and returns an entry for everything below it.
+// Symlinks are recorded, not followed. Names are relative to root.
+func ScanDir(root string, preserveOwner bool) ([]Entry, error) {
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", root)
+	}
+
+	var entries []Entry
+	err = filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+
+		entry, err := entryFromFileInfo(p, filepath.ToSlash(rel), info, preserveOwner)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan %s: %w", root, err)
+	}
+	return entries, nil
+}
+
+// entryFromFileInfo converts a host file into an archive entry
+func entryFromFileInfo(hostPath, name string, info os.FileInfo, preserveOwner bool) (Entry, error) {
+	entry := Entry{Header: Header{
+		Name:    name,
+		Mode:    uint32(info.Mode().Perm()),
+		ModTime: info.ModTime(),
+	}}
+
+	mode := info.Mode()
+	if mode&os.ModeSetuid != 0 {
+		entry.Mode |= 04000
+	}
+	if mode&os.ModeSetgid != 0 {
+		entry.Mode |= 02000
+	}
+	if mode&os.ModeSticky != 0 {
+		entry.Mode |= 01000
+	}
+
+	switch {
+	case mode.IsDir():
+		entry.Mode |= TypeDir
+	case mode&os.ModeSymlink != 0:
+		target, err := os.Readlink(hostPath)
+		if err != nil {
+			return entry, err
+		}
+		entry.Mode |= TypeSymlink
+		entry.Linkname = target
+		entry.Size = int64(len(target))
+	case mode&os.ModeDevice != 0:
+		if mode&os.ModeCharDevice != 0 {
+			entry.Mode |= TypeChar
+		} else {
+			entry.Mode |= TypeBlock
+		}
+		entry.RDevMajor, entry.RDevMinor = deviceNumber(info)
+	case mode&os.ModeNamedPipe != 0:
+		entry.Mode |= TypeFifo
+	case mode&os.ModeSocket != 0:
+		entry.Mode |= TypeSocket
+	case mode.IsRegular():
+		entry.Mode |= TypeReg
+		entry.Size = info.Size()
+		entry.Source = hostPath
+	default:
+		return entry, fmt.Errorf("%s: unsupported file type %v", hostPath, mode.Type())
+	}
+
+	if preserveOwner {
+		entry.UID, entry.GID = fileOwner(info)
+	}
+	return entry, nil
+}
+
+// Merge combines base with overlay entries. An overlay entry replaces a
+// base entry with the same name; missing parent directories of overlay
+// entries are created with mode 0755. The result is sorted so that every
+// directory precedes its contents.
+func Merge(base []Entry, overlay ...Entry) []Entry {
+	byName := make(map[string]Entry, len(base)+len(overlay))
+	for _, e := range base {
+		e.Name = cleanName(e.Name)
+		byName[e.Name] = e
+	}
+	for _, e := range overlay {
+		e.Name = cleanName(e.Name)
+		byName[e.Name] = e
+
+		for dir := path.Dir(e.Name); dir != "." && dir != "/"; dir = path.Dir(dir) {
+			if _, ok := byName[dir]; ok {
+				continue
+			}
+			byName[dir] = Entry{Header: Header{
+				Name:    dir,
+				Mode:    TypeDir | 0755,
+				ModTime: e.ModTime,
+			}}
+		}
+	}
+
+	merged := make([]Entry, 0, len(byName))
+	for _, e := range byName {
+		merged = append(merged, e)
+	}
+	sort.Slice(merged, func(i, j int) bool {
+		return merged[i].Name < merged[j].Name
+	})
+	return merged
+}
+
+// WriteEntries writes each entry's header and contents to cw.
+// It does not write the trailer.
+func WriteEntries(cw *Writer, entries []Entry) error {
+	for i := range entries {
+		if err := writeEntry(cw, &entries[i]); err != nil {
+			return fmt.Errorf("failed to write %s: %w", entries[i].Name, err)
+		}
+	}
+	return nil
+}
+
+// writeEntry writes a single entry, reading its contents if needed
+func writeEntry(cw *Writer, e *Entry) error {
+	hdr := e.Header
+	if !hdr.IsRegular() {
+		return cw.WriteHeader(&hdr)
+	}
+
+	if e.Data != nil || e.Source == "" {
+		hdr.Size = int64(len(e.Data))
+		if cw.Format() == FormatCRC {
+			hdr.Checksum = Checksum(e.Data)
+		}
+		if err := cw.WriteHeader(&hdr); err != nil {
+			return err
+		}
+		_, err := cw.Write(e.Data)
+		return err
+	}
+
+	f, err := os.Open(e.Source)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	hdr.Size = info.Size()
+
+	if cw.Format() == FormatCRC {
+		// The checksum precedes the data, so it needs a first pass
+		sum, err := readChecksum(f)
+		if err != nil {
+			return err
+		}
+		hdr.Checksum = sum
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+	}
+
+	if err := cw.WriteHeader(&hdr); err != nil {
+		return err
+	}
+	if _, err := io.CopyN(cw, f, hdr.Size); err != nil {
+		return fmt.Errorf("%s changed while archiving: %w", e.Source, err)
+	}
+	return nil
+}
+
+// readChecksum computes the crc-format checksum of r's contents
+func readChecksum(r io.Reader) (uint32, error) {
+	var sum uint32
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := r.Read(buf)
+		sum += Checksum(buf[:n])
+		if err == io.EOF {
+			return sum, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// cleanName normalizes an archive name to a relative slash path
+func cleanName(name string) string {
+	name = path.Clean("/" + filepath.ToSlash(name))
+	return strings.TrimPrefix(name, "/")
+}
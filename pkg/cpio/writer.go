@@ -0,0 +1,212 @@
+package cpio
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+var (
+	// ErrWriteTooLong is returned when more data is written than Header.Size
+	ErrWriteTooLong = errors.New("cpio: write too long")
+	// ErrWriteAfterClose is returned when writing to a closed archive
+	ErrWriteAfterClose = errors.New("cpio: write after close")
+)
+
+// Writer writes a newc or crc CPIO archive sequentially.
+// Call WriteHeader to begin an entry, Write to supply its data, and Close
+// to emit the trailer.
+type Writer struct {
+	w        io.Writer
+	format   Format
+	written  int64  // bytes written to w
+	remain   int64  // data bytes still owed for the current entry
+	pad      int64  // alignment padding owed after the current entry
+	sum      uint32 // running checksum of the current entry
+	want     uint32 // checksum declared in the current header
+	nextIno  uint32
+	closed   bool
+	checkSum bool
+}
+
+// NewWriter creates a newc Writer writing to w
+func NewWriter(w io.Writer) *Writer {
+	return NewWriterFormat(w, FormatNewc)
+}
+
+// NewWriterFormat creates a Writer for the given format writing to w
+func NewWriterFormat(w io.Writer, format Format) *Writer {
+	return &Writer{w: w, format: format, nextIno: 1}
+}
+
+// Format returns the format the writer produces
+func (cw *Writer) Format() Format {
+	return cw.format
+}
+
+// WriteHeader writes hdr and prepares to accept the entry's data.
+// For symlinks the Linkname is written as the entry data automatically.
+// In crc format, hdr.Checksum must hold Checksum() of the data that follows.
+func (cw *Writer) WriteHeader(hdr *Header) error {
+	if cw.closed {
+		return ErrWriteAfterClose
+	}
+	if cw.format == FormatODC {
+		return fmt.Errorf("cpio: writing %s format is not supported", cw.format)
+	}
+	if err := cw.finishEntry(); err != nil {
+		return err
+	}
+
+	name := strings.TrimPrefix(strings.TrimPrefix(hdr.Name, "./"), "/")
+	if name == "" {
+		return fmt.Errorf("cpio: empty entry name")
+	}
+
+	size := hdr.Size
+	var linkData []byte
+	if hdr.IsSymlink() {
+		linkData = []byte(hdr.Linkname)
+		size = int64(len(linkData))
+	} else if !hdr.IsRegular() {
+		size = 0
+	}
+	if size < 0 || size > 0xffffffff {
+		return fmt.Errorf("cpio: %s: size %d out of range", name, size)
+	}
+
+	nlink := hdr.NLink
+	if nlink == 0 {
+		nlink = 1
+		if hdr.IsDir() {
+			nlink = 2
+		}
+	}
+
+	ino := hdr.Inode
+	if ino == 0 {
+		ino = cw.nextIno
+		cw.nextIno++
+	}
+
+	var mtime int64
+	if !hdr.ModTime.IsZero() {
+		mtime = hdr.ModTime.Unix()
+	}
+	if mtime < 0 {
+		mtime = 0
+	}
+
+	check := uint32(0)
+	if cw.format == FormatCRC {
+		check = hdr.Checksum
+		if hdr.IsSymlink() {
+			check = Checksum(linkData)
+		}
+	}
+
+	if err := cw.writeRaw(ino, hdr.Mode, hdr.UID, hdr.GID, nlink, uint32(mtime), uint32(size),
+		hdr.DevMajor, hdr.DevMinor, hdr.RDevMajor, hdr.RDevMinor, name, check); err != nil {
+		return err
+	}
+
+	cw.remain = size
+	cw.pad = pad4(size)
+	cw.sum = 0
+	cw.want = check
+	cw.checkSum = cw.format == FormatCRC
+
+	if linkData != nil {
+		if _, err := cw.Write(linkData); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Write writes data for the current entry
+func (cw *Writer) Write(p []byte) (int, error) {
+	if cw.closed {
+		return 0, ErrWriteAfterClose
+	}
+	overflow := false
+	if int64(len(p)) > cw.remain {
+		p = p[:cw.remain]
+		overflow = true
+	}
+	n, err := cw.w.Write(p)
+	cw.written += int64(n)
+	cw.remain -= int64(n)
+	if cw.checkSum {
+		for _, b := range p[:n] {
+			cw.sum += uint32(b)
+		}
+	}
+	if err == nil && overflow {
+		err = ErrWriteTooLong
+	}
+	return n, err
+}
+
+// Close writes the trailer and pads the archive to a 512-byte boundary.
+// It does not close the underlying writer.
+func (cw *Writer) Close() error {
+	if cw.closed {
+		return nil
+	}
+	if err := cw.finishEntry(); err != nil {
+		return err
+	}
+	if err := cw.writeRaw(0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, TrailerName, 0); err != nil {
+		return err
+	}
+	cw.closed = true
+
+	// Pad like GNU cpio so the archive is block aligned
+	if rem := cw.written % 512; rem != 0 {
+		if _, err := cw.w.Write(make([]byte, 512-rem)); err != nil {
+			return err
+		}
+		cw.written += 512 - rem
+	}
+	return nil
+}
+
+// finishEntry checks the previous entry was fully written and emits padding
+func (cw *Writer) finishEntry() error {
+	if cw.remain > 0 {
+		return fmt.Errorf("cpio: missing %d bytes of entry data", cw.remain)
+	}
+	if cw.checkSum && cw.sum != cw.want {
+		return fmt.Errorf("cpio: checksum mismatch: header %08x, data %08x", cw.want, cw.sum)
+	}
+	cw.checkSum = false
+	if cw.pad > 0 {
+		if _, err := cw.w.Write(make([]byte, cw.pad)); err != nil {
+			return err
+		}
+		cw.written += cw.pad
+		cw.pad = 0
+	}
+	return nil
+}
+
+// writeRaw writes a header record followed by the padded name
+func (cw *Writer) writeRaw(ino, mode, uid, gid, nlink, mtime, size, devMajor, devMinor,
+	rdevMajor, rdevMinor uint32, name string, check uint32) error {
+	namesize := int64(len(name) + 1)
+	hdr := fmt.Sprintf("%s%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x",
+		cw.format.Magic(), ino, mode, uid, gid, nlink, mtime, size,
+		devMajor, devMinor, rdevMajor, rdevMinor, namesize, check)
+
+	buf := make([]byte, 0, newcHeaderLen+namesize+4)
+	buf = append(buf, hdr...)
+	buf = append(buf, name...)
+	buf = append(buf, 0)
+	buf = append(buf, make([]byte, pad4(newcHeaderLen+namesize))...)
+
+	n, err := cw.w.Write(buf)
+	cw.written += int64(n)
+	return err
+}
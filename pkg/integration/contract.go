@@ -5,6 +5,21 @@ import (
 	"strings"
 )
 
+// ContractVersion is the current integration contract version
+//
+// Migration notes:
+//
+//	1.0 -> 2.0: The kernel init parameter now depends on the boot medium.
+//	  Initramfs boots (the default, and how every ROCK-OS image boots today)
+//	  use "rdinit=/sbin/init"; "init=" is only read after a root= block
+//	  device is mounted. 1.0 always emitted "init=/sbin/init" and rejected
+//	  "rdinit=", which made the kernel look for /init in the initramfs and
+//	  then fall back to mounting a root device that does not exist.
+//	  KernelParameters.InitPath is now the bare path ("/sbin/init") and
+//	  InitParam() builds the parameter. Callers of GetKernelCmdline get the
+//	  initramfs form; use GetKernelCmdlineFor for block-device boots.
+const ContractVersion = "2.0"
+
 // IntegrationContract defines the complete contract between rock-os-tools and rock-init
 // This is the source of truth for all integration requirements
 type IntegrationContract struct {
@@ -15,23 +30,54 @@ type IntegrationContract struct {
 	KernelParams KernelParameters
 }
 
+// BootMedium identifies where the kernel finds the root filesystem
+type BootMedium string
+
+const (
+	// BootInitramfs runs init straight from the unpacked initramfs (rdinit=)
+	BootInitramfs BootMedium = "initramfs"
+	// BootBlockDevice mounts a root= block device and runs init from it (init=)
+	BootBlockDevice BootMedium = "block"
+)
+
+// ParseBootMedium converts a user-supplied name into a BootMedium
+func ParseBootMedium(name string) (BootMedium, error) {
+	switch strings.ToLower(name) {
+	case "", "initramfs", "initrd":
+		return BootInitramfs, nil
+	case "block", "root", "disk":
+		return BootBlockDevice, nil
+	default:
+		return "", fmt.Errorf("unknown boot medium %q (use initramfs or block)", name)
+	}
+}
+
 // KernelParameters defines required kernel command line parameters
 type KernelParameters struct {
-	InitPath      string   // Must be "init=/sbin/init" NOT "rdinit="
-	RequiredFlags []string // Additional required flags
-	DebugFlags    []string // Flags for debug mode
+	InitPath        string   // Path of rock-init inside the root filesystem
+	RequiredFlags   []string // Additional required flags
+	DebugFlags      []string // Flags for debug mode
 	ProductionFlags []string // Flags for production mode
 }
 
+// InitParam returns the init parameter for a boot medium:
+// "rdinit=/sbin/init" for initramfs, "init=/sbin/init" for a root block device
+func (k KernelParameters) InitParam(medium BootMedium) string {
+	if medium == BootBlockDevice {
+		return "init=" + k.InitPath
+	}
+	return "rdinit=" + k.InitPath
+}
+
 // GetContract returns the current integration contract
 func GetContract() *IntegrationContract {
 	return &IntegrationContract{
-		Version:     "1.0",
+		Version:     ContractVersion,
 		Binaries:    RequiredBinaries,
 		Directories: RequiredDirectories,
 		DeviceNodes: RequiredDeviceNodes,
 		KernelParams: KernelParameters{
-			InitPath: KernelCmdlineInit,
+			InitPath: RockInitPath,
 			RequiredFlags: []string{
 				"net.ifnames=0", // Predictable network interface names
 			},
@@ -48,48 +94,166 @@ func GetContract() *IntegrationContract {
 }
 
 // GetKernelCmdline returns the correct kernel command line for a given mode
+// when booting from an initramfs
 func GetKernelCmdline(mode string) string {
+	return GetKernelCmdlineFor(mode, BootInitramfs, "")
+}
+
+// GetKernelCmdlineFor returns the kernel command line for a mode and boot
+// medium. rootDevice is required for BootBlockDevice and ignored otherwise.
+func GetKernelCmdlineFor(mode string, medium BootMedium, rootDevice string) string {
 	contract := GetContract()
 
-	// CRITICAL: Always start with the correct init path
-	cmdline := contract.KernelParams.InitPath
+	// CRITICAL: Always start with the correct init parameter for the medium
+	params := []string{contract.KernelParams.InitParam(medium)}
+	if medium == BootBlockDevice && rootDevice != "" {
+		params = append(params, "root="+rootDevice)
+	}
 
 	// Add required flags
-	for _, flag := range contract.KernelParams.RequiredFlags {
-		cmdline += " " + flag
-	}
+	params = append(params, contract.KernelParams.RequiredFlags...)
 
 	// Add mode-specific flags
 	switch mode {
-	case "debug":
-		for _, flag := range contract.KernelParams.DebugFlags {
-			cmdline += " " + flag
-		}
 	case "production":
-		for _, flag := range contract.KernelParams.ProductionFlags {
-			cmdline += " " + flag
-		}
+		params = append(params, contract.KernelParams.ProductionFlags...)
 	default:
 		// Default to debug mode for safety
-		for _, flag := range contract.KernelParams.DebugFlags {
-			cmdline += " " + flag
+		params = append(params, contract.KernelParams.DebugFlags...)
+	}
+
+	return strings.Join(params, " ")
+}
+
+// KernelParam is a single kernel command line token
+type KernelParam struct {
+	Key      string
+	Value    string
+	HasValue bool // true for key=value, false for bare flags such as "quiet"
+}
+
+// String returns the parameter as it appears on the command line
+func (p KernelParam) String() string {
+	if !p.HasValue {
+		return p.Key
+	}
+	if strings.ContainsAny(p.Value, " \t") {
+		return p.Key + `="` + p.Value + `"`
+	}
+	return p.Key + "=" + p.Value
+}
+
+// ParseKernelCmdline splits a kernel command line into parameters.
+// Like the kernel, it splits on whitespace outside double quotes and strips
+// the quotes from values. Everything after a bare "--" belongs to init and
+// is not returned.
+func ParseKernelCmdline(cmdline string) []KernelParam {
+	var params []KernelParam
+	var token strings.Builder
+	inQuote, inToken := false, false
+
+	flush := func() {
+		if !inToken {
+			return
+		}
+		raw := token.String()
+		token.Reset()
+		inToken = false
+
+		param := KernelParam{Key: raw}
+		if i := strings.IndexByte(raw, '='); i >= 0 {
+			param = KernelParam{Key: raw[:i], Value: raw[i+1:], HasValue: true}
 		}
+		params = append(params, param)
 	}
 
-	return cmdline
+	for _, r := range cmdline {
+		switch {
+		case r == '"':
+			inQuote = !inQuote
+			inToken = true
+		case !inQuote && (r == ' ' || r == '\t' || r == '\n'):
+			flush()
+		default:
+			token.WriteRune(r)
+			inToken = true
+		}
+	}
+	flush()
+
+	for i, p := range params {
+		if p.Key == "--" && !p.HasValue {
+			return params[:i]
+		}
+	}
+	return params
+}
+
+// lookupParam returns the last value of key, which is the one the kernel uses
+func lookupParam(params []KernelParam, key string) (string, bool) {
+	value, found := "", false
+	for _, p := range params {
+		if p.Key == key && p.HasValue {
+			value, found = p.Value, true
+		}
+	}
+	return value, found
 }
 
-// ValidateKernelCmdline checks if a kernel command line is correct
+// ValidateKernelCmdline checks if a kernel command line is correct.
+// The boot medium is inferred: a root= parameter means a block device boot,
+// otherwise the image is booted as an initramfs.
 func ValidateKernelCmdline(cmdline string) error {
-	// Check for the critical init parameter
-	if !strings.Contains(cmdline, "init=/sbin/init") {
-		return fmt.Errorf("kernel cmdline missing required 'init=/sbin/init' parameter")
+	medium := BootInitramfs
+	if _, ok := lookupParam(ParseKernelCmdline(cmdline), "root"); ok {
+		medium = BootBlockDevice
 	}
+	return ValidateKernelCmdlineFor(cmdline, medium)
+}
 
-	// Check for incorrect rdinit parameter
-	if strings.Contains(cmdline, "rdinit=") {
-		return fmt.Errorf("kernel cmdline uses 'rdinit=' which is incorrect; must use 'init='")
+// ValidateKernelCmdlineFor checks a kernel command line for a boot medium
+func ValidateKernelCmdlineFor(cmdline string, medium BootMedium) error {
+	params := ParseKernelCmdline(cmdline)
+	initPath := GetContract().KernelParams.InitPath
+
+	rdinit, hasRdinit := lookupParam(params, "rdinit")
+	init, hasInit := lookupParam(params, "init")
+
+	switch medium {
+	case BootInitramfs:
+		// Check for the critical rdinit parameter
+		if !hasRdinit {
+			if hasInit {
+				return fmt.Errorf("kernel cmdline uses 'init=%s' but initramfs boots read 'rdinit='; use 'rdinit=%s'", init, initPath)
+			}
+			return fmt.Errorf("kernel cmdline missing required 'rdinit=%s' parameter", initPath)
+		}
+		if rdinit != initPath {
+			return fmt.Errorf("kernel cmdline has 'rdinit=%s'; rock-init is at %s", rdinit, initPath)
+		}
+		if hasInit && init != initPath {
+			return fmt.Errorf("kernel cmdline has conflicting 'init=%s'", init)
+		}
+
+	case BootBlockDevice:
+		if _, ok := lookupParam(params, "root"); !ok {
+			return fmt.Errorf("kernel cmdline missing 'root=' for a block device boot")
+		}
+		// Check for the critical init parameter
+		if !hasInit {
+			return fmt.Errorf("kernel cmdline missing required 'init=%s' parameter", initPath)
+		}
+		if init != initPath {
+			return fmt.Errorf("kernel cmdline has 'init=%s'; rock-init is at %s", init, initPath)
+		}
+		// rdinit= would run init from the initramfs instead of the root device
+		if hasRdinit {
+			return fmt.Errorf("kernel cmdline uses 'rdinit=' which bypasses the root device; use 'init='")
+		}
+
+	default:
+		return fmt.Errorf("unknown boot medium %q", medium)
 	}
 
 	return nil
-}
\ No newline at end of file
+}
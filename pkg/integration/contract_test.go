@@ -0,0 +1,49 @@
+package integration
+
+import "testing"
+
+func TestKernelCmdlineForMedium(t *testing.T) {
+	tests := []struct {
+		mode   string
+		medium BootMedium
+		root   string
+		want   string
+	}{
+		{"debug", BootInitramfs, "", "rdinit=/sbin/init net.ifnames=0 console=ttyS0 debug"},
+		{"production", BootInitramfs, "", "rdinit=/sbin/init net.ifnames=0 quiet security=selinux"},
+		{"debug", BootBlockDevice, "/dev/vda1", "init=/sbin/init root=/dev/vda1 net.ifnames=0 console=ttyS0 debug"},
+	}
+	for _, tt := range tests {
+		got := GetKernelCmdlineFor(tt.mode, tt.medium, tt.root)
+		if got != tt.want {
+			t.Errorf("GetKernelCmdlineFor(%s, %s) = %q, want %q", tt.mode, tt.medium, got, tt.want)
+		}
+		if err := ValidateKernelCmdline(got); err != nil {
+			t.Errorf("generated cmdline %q does not validate: %v", got, err)
+		}
+	}
+}
+
+func TestValidateKernelCmdline(t *testing.T) {
+	tests := []struct {
+		cmdline string
+		valid   bool
+	}{
+		// The documented Vultr cmdline must be accepted
+		{"console=ttyS0,115200n8 earlyprintk=ttyS0 rdinit=/sbin/init", true},
+		{`rdinit=/sbin/init dyndbg="file init.c +p" quiet`, true},
+		{"console=ttyS0 init=/sbin/init", false},      // initramfs boot needs rdinit=
+		{"rdinit=/init console=ttyS0", false},         // wrong init path
+		{"rdinit=/sbin/init init=/bin/sh", false},     // conflicting fallback
+		{"root=/dev/vda1 init=/sbin/init", true},      // block device boot
+		{"root=/dev/vda1 rdinit=/sbin/init", false},   // rdinit bypasses the root device
+		{"console=ttyS0 -- rdinit=/sbin/init", false}, // args after -- go to init
+		{"xrdinit=/sbin/init", false},                 // no substring matching
+	}
+	for _, tt := range tests {
+		err := ValidateKernelCmdline(tt.cmdline)
+		if (err == nil) != tt.valid {
+			t.Errorf("ValidateKernelCmdline(%q) = %v, want valid=%v", tt.cmdline, err, tt.valid)
+		}
+	}
+}
@@ -24,8 +24,8 @@ const (
 	// ShellPath must be a symlink to busybox
 	ShellPath = "/bin/sh"
 
-	// KernelCmdlineInit is the correct kernel parameter
-	// Must use "init=" NOT "rdinit="
+	// KernelCmdlineInit is the init parameter when booting from a
+	// root= block device; it is ignored by initramfs boots
 	KernelCmdlineInit = "init=/sbin/init"
 )
 
@@ -2,12 +2,16 @@ package integration
 
 import (
 	"archive/tar"
-	"compress/gzip"
+	"bufio"
+	"bytes"
 	"fmt"
 	"io"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
+
+	"github.com/rock-os/tools/pkg/cpio"
 )
 
 // VerificationError contains details about a verification failure
@@ -28,83 +32,229 @@ type VerificationResult struct {
 	Warnings []string
 }
 
-// VerifyImage verifies that an initramfs image meets rock-init integration requirements
-func VerifyImage(imagePath string) (*VerificationResult, error) {
-	result := &VerificationResult{Success: true}
+// Archive formats recognised by DetectImageFormat
+const (
+	FormatNewc = "newc"
+	FormatCRC  = "crc"
+	FormatODC  = "odc"
+	FormatTar  = "tar"
+)
+
+// DetectImageFormat identifies an uncompressed archive from its magic bytes:
+// newc (070701), crc (070702), odc (070707) or tar ("ustar" at offset 257)
+func DetectImageFormat(header []byte) (string, error) {
+	if format, ok := cpio.DetectFormat(header); ok {
+		return format.String(), nil
+	}
+	if len(header) >= 262 && string(header[257:262]) == "ustar" {
+		return FormatTar, nil
+	}
+	return "", fmt.Errorf("unrecognised archive format (magic %q)", header[:min(len(header), 6)])
+}
 
-	// Open the image file
-	file, err := os.Open(imagePath)
+// VerifyImage verifies that an initramfs image meets rock-init integration requirements.
+// The archive format is detected from the content, not the file name.
+func VerifyImage(imagePath string) (*VerificationResult, error) {
+	data, err := os.ReadFile(imagePath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open image: %w", err)
 	}
-	defer file.Close()
 
-	// Determine if it's compressed
-	var reader io.Reader = file
-	if strings.HasSuffix(imagePath, ".gz") {
-		gzReader, err := gzip.NewReader(file)
+	// Only the start of the first stream is decompressed to find the
+	// format; a tar archive is then read from the same stream
+	rc, _, err := cpio.NewDecompressor(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	reader := bufio.NewReaderSize(rc, 512)
+	header, err := reader.Peek(262)
+	if err != nil && len(header) < 6 {
+		return nil, fmt.Errorf("failed to read archive header: %w", err)
+	}
+
+	format, err := DetectImageFormat(header)
+	if err != nil {
+		return nil, err
+	}
+
+	var archive *cpio.Archive
+	if format == FormatTar {
+		archive, err = readTarIndex(reader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s archive: %w", format, err)
+		}
+	} else {
+		// Every segment of a composed image, as the kernel unpacks it
+		segments, err := cpio.ReadSegments(data)
 		if err != nil {
-			return nil, fmt.Errorf("failed to create gzip reader: %w", err)
+			return nil, fmt.Errorf("failed to read archive: %w", err)
 		}
-		defer gzReader.Close()
-		reader = gzReader
+		archive = cpio.MergeSegments(segments)
 	}
 
-	// Create tar reader if it's a tar archive
-	var files = make(map[string]bool)
-	if strings.Contains(imagePath, ".tar") || strings.Contains(imagePath, ".cpio") {
-		// For cpio, we'd need a different reader, but for now assume tar
-		tarReader := tar.NewReader(reader)
-		for {
-			header, err := tarReader.Next()
-			if err == io.EOF {
-				break
-			}
-			if err != nil {
-				return nil, fmt.Errorf("failed to read archive: %w", err)
-			}
-			files[header.Name] = true
+	return VerifyArchive(archive, GetContract()), nil
+}
 
-			// Normalize path (remove leading ./)
-			normalizedPath := strings.TrimPrefix(header.Name, ".")
-			files[normalizedPath] = true
-		}
+// VerifyArchive checks an in-memory archive against the integration contract
+func VerifyArchive(archive *cpio.Archive, contract *IntegrationContract) *VerificationResult {
+	result := &VerificationResult{Success: true}
+	fail := func(path, reason, details string) {
+		result.Success = false
+		result.Errors = append(result.Errors, VerificationError{
+			Path:    path,
+			Reason:  reason,
+			Details: details,
+		})
 	}
 
-	// Check required binaries
-	for _, binary := range RequiredBinaries {
+	// Check required binaries: present, regular files, correct mode
+	for _, binary := range contract.Binaries {
 		path := binary.Destination
-		if !checkPathExists(files, path) {
-			result.Success = false
-			result.Errors = append(result.Errors, VerificationError{
-				Path:    path,
-				Reason:  fmt.Sprintf("%s must be at this exact location", binary.Source),
-				Details: "This path is hardcoded in rock-init",
-			})
+		entry, ok := archive.Stat(path)
+		switch {
+		case !ok:
+			fail(path, fmt.Sprintf("%s must be at this exact location", binary.Source),
+				"This path is hardcoded in rock-init")
+		case !entry.IsRegular():
+			fail(path, fmt.Sprintf("%s is not a regular file", binary.Source),
+				fmt.Sprintf("Archive mode is %06o", entry.Mode))
+		case entry.Perm()&0111 == 0:
+			fail(path, fmt.Sprintf("%s is not executable", binary.Source),
+				fmt.Sprintf("Mode is %04o, expected %04o", entry.Perm(), binary.Permissions))
+		case binary.Permissions != 0 && entry.Perm()&0777 != binary.Permissions:
+			result.Warnings = append(result.Warnings,
+				fmt.Sprintf("%s has mode %04o (expected %04o)", path, entry.Perm()&0777, binary.Permissions))
+		}
+	}
+
+	// Special check for shell: must exist and resolve to busybox
+	if entry, ok := archive.Lstat(ShellPath); !ok {
+		fail(ShellPath, "Shell is required for rock-init", "Must be a symlink to busybox")
+	} else if entry.IsSymlink() {
+		if _, ok := archive.Stat(ShellPath); !ok {
+			fail(ShellPath, "Shell symlink is dangling",
+				fmt.Sprintf("Points to %s, which is not in the image", entry.Linkname))
+		} else if !isBusyboxTarget(entry.Linkname) {
+			result.Warnings = append(result.Warnings,
+				fmt.Sprintf("%s points to %s (expected busybox)", ShellPath, entry.Linkname))
 		}
+	} else {
+		result.Warnings = append(result.Warnings,
+			fmt.Sprintf("%s is not a symlink to busybox", ShellPath))
 	}
 
 	// Check busybox symlinks
 	for _, symlink := range BusyboxSymlinks {
-		path := filepath.Join("/bin", symlink)
-		if !checkPathExists(files, path) {
+		name := path.Join("/bin", symlink)
+		if name == ShellPath {
+			continue
+		}
+		entry, ok := archive.Lstat(name)
+		if !ok {
 			// This is a warning, not an error
 			result.Warnings = append(result.Warnings,
-				fmt.Sprintf("Missing busybox symlink: %s", path))
+				fmt.Sprintf("Missing busybox symlink: %s", name))
+		} else if entry.IsSymlink() && !isBusyboxTarget(entry.Linkname) {
+			result.Warnings = append(result.Warnings,
+				fmt.Sprintf("%s points to %s (expected busybox)", name, entry.Linkname))
 		}
 	}
 
-	// Special check for shell
-	if !checkPathExists(files, ShellPath) {
-		result.Success = false
-		result.Errors = append(result.Errors, VerificationError{
-			Path:    ShellPath,
-			Reason:  "Shell is required for rock-init",
-			Details: "Must be a symlink to busybox",
-		})
+	// Check required directories
+	for _, dir := range contract.Directories {
+		entry, ok := archive.Stat(dir)
+		if !ok {
+			result.Warnings = append(result.Warnings,
+				fmt.Sprintf("Missing directory: %s", dir))
+		} else if !entry.IsDir() {
+			fail(dir, "Required directory is not a directory",
+				fmt.Sprintf("Archive mode is %06o", entry.Mode))
+		}
 	}
 
-	return result, nil
+	// Check device nodes: type, major:minor and mode
+	for _, node := range contract.DeviceNodes {
+		entry, ok := archive.Lstat(node.Path)
+		switch {
+		case !ok:
+			result.Warnings = append(result.Warnings,
+				fmt.Sprintf("Missing device node: %s", node.Path))
+		case !entry.IsCharDevice():
+			fail(node.Path, "Device node is not a character device",
+				fmt.Sprintf("Archive mode is %06o", entry.Mode))
+		case entry.RDevMajor != node.Major || entry.RDevMinor != node.Minor:
+			fail(node.Path, fmt.Sprintf("Device node is %d:%d", entry.RDevMajor, entry.RDevMinor),
+				fmt.Sprintf("Expected char %d:%d", node.Major, node.Minor))
+		case entry.Perm()&0777 != node.Mode:
+			result.Warnings = append(result.Warnings,
+				fmt.Sprintf("%s has mode %04o (expected %04o)", node.Path, entry.Perm()&0777, node.Mode))
+		}
+	}
+
+	return result
+}
+
+// readTarIndex builds an archive index from tar headers. File contents
+// are not needed for verification and are skipped.
+func readTarIndex(r io.Reader) (*cpio.Archive, error) {
+	archive := cpio.NewArchive(cpio.FormatNewc)
+	tarReader := tar.NewReader(r)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// Normalize path (remove leading ./)
+		name := strings.TrimPrefix(header.Name, "./")
+		if name == "" || name == "." {
+			continue
+		}
+
+		entry := cpio.Entry{Header: cpio.Header{
+			Name:      name,
+			Mode:      uint32(header.Mode) &^ cpio.TypeMask,
+			UID:       uint32(header.Uid),
+			GID:       uint32(header.Gid),
+			ModTime:   header.ModTime,
+			Size:      header.Size,
+			Linkname:  header.Linkname,
+			RDevMajor: uint32(header.Devmajor),
+			RDevMinor: uint32(header.Devminor),
+		}}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			entry.Mode |= cpio.TypeDir
+		case tar.TypeSymlink:
+			entry.Mode |= cpio.TypeSymlink
+		case tar.TypeChar:
+			entry.Mode |= cpio.TypeChar
+		case tar.TypeBlock:
+			entry.Mode |= cpio.TypeBlock
+		case tar.TypeFifo:
+			entry.Mode |= cpio.TypeFifo
+		case tar.TypeLink:
+			// Hardlinks share the target's header
+			if target, ok := archive.Lstat(header.Linkname); ok {
+				entry.Header = target.Header
+				entry.Name = name
+			}
+		default:
+			entry.Mode |= cpio.TypeReg
+		}
+		archive.Add(entry)
+	}
+	return archive, nil
+}
+
+// isBusyboxTarget reports whether a symlink target points at busybox
+func isBusyboxTarget(target string) bool {
+	return target == "busybox" || strings.HasSuffix(target, "/busybox")
 }
 
 // VerifyRootfs verifies a rootfs directory structure
@@ -159,26 +309,6 @@ func VerifyRootfs(rootfsPath string) (*VerificationResult, error) {
 	return result, nil
 }
 
-// checkPathExists checks if a path exists in the file map
-func checkPathExists(files map[string]bool, path string) bool {
-	// Check exact path
-	if files[path] {
-		return true
-	}
-
-	// Check without leading slash
-	if files[strings.TrimPrefix(path, "/")] {
-		return true
-	}
-
-	// Check with leading ./
-	if files["." + path] {
-		return true
-	}
-
-	return false
-}
-
 // PrintVerificationResult prints the verification result in a formatted way
 func PrintVerificationResult(result *VerificationResult) {
 	if result.Success {
@@ -0,0 +1,178 @@
+package integration
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rock-os/tools/pkg/cpio"
+)
+
+// contractEntries returns archive entries that satisfy the contract
+func contractEntries() []cpio.Entry {
+	var entries []cpio.Entry
+	for _, dir := range RequiredDirectories {
+		entries = append(entries, cpio.Entry{Header: cpio.Header{Name: dir, Mode: cpio.TypeDir | 0755}})
+	}
+	for _, binary := range RequiredBinaries {
+		entries = append(entries, cpio.Entry{
+			Header: cpio.Header{Name: binary.Destination, Mode: cpio.TypeReg | binary.Permissions},
+			Data:   []byte("\x7fELF"),
+		})
+	}
+	for _, name := range BusyboxSymlinks {
+		entries = append(entries, cpio.Entry{Header: cpio.Header{
+			Name: "/bin/" + name, Mode: cpio.TypeSymlink | 0777, Linkname: "busybox",
+		}})
+	}
+	for _, node := range RequiredDeviceNodes {
+		entries = append(entries, cpio.Entry{Header: cpio.Header{
+			Name: node.Path, Mode: cpio.TypeChar | node.Mode, RDevMajor: node.Major, RDevMinor: node.Minor,
+		}})
+	}
+	return entries
+}
+
+// writeImage writes entries as a gzipped newc archive under a name that
+// deliberately does not say "cpio"
+func writeImage(t *testing.T, entries []cpio.Entry) string {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := cpio.WriteTree(gz, "", cpio.TreeOptions{Overlay: entries}); err != nil {
+		t.Fatal(err)
+	}
+	gz.Close()
+
+	path := filepath.Join(t.TempDir(), "initramfs.img")
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestVerifyImageCPIO(t *testing.T) {
+	result, err := VerifyImage(writeImage(t, contractEntries()))
+	if err != nil {
+		t.Fatalf("VerifyImage: %v", err)
+	}
+	if !result.Success || len(result.Warnings) != 0 {
+		t.Errorf("expected clean pass, got errors %v warnings %v", result.Errors, result.Warnings)
+	}
+}
+
+func TestVerifyImageWrongConsole(t *testing.T) {
+	entries := contractEntries()
+	for i := range entries {
+		if entries[i].Name == "/dev/console" {
+			entries[i].RDevMinor = 64 // ttyS0, not the console
+		}
+	}
+
+	result, err := VerifyImage(writeImage(t, entries))
+	if err != nil {
+		t.Fatalf("VerifyImage: %v", err)
+	}
+	if result.Success || len(result.Errors) != 1 || result.Errors[0].Path != "/dev/console" {
+		t.Errorf("expected a /dev/console error, got %v", result.Errors)
+	}
+}
+
+func TestVerifyImageSegments(t *testing.T) {
+	// The console node comes from an uncompressed overlay appended to
+	// the gzipped base
+	var base, overlay []cpio.Entry
+	for _, entry := range contractEntries() {
+		if entry.Name == "/dev/console" {
+			overlay = append(overlay, entry)
+		} else {
+			base = append(base, entry)
+		}
+	}
+	path := writeImage(t, base)
+	var buf bytes.Buffer
+	if _, err := cpio.WriteTree(&buf, "", cpio.TreeOptions{Overlay: overlay}); err != nil {
+		t.Fatal(err)
+	}
+	image, _ := os.ReadFile(path)
+	image = append(image, make([]byte, (4-len(image)%4)%4)...)
+	if err := os.WriteFile(path, append(image, buf.Bytes()...), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := VerifyImage(path)
+	if err != nil {
+		t.Fatalf("VerifyImage: %v", err)
+	}
+	if !result.Success {
+		t.Errorf("expected the merged tree to pass, got %v", result.Errors)
+	}
+}
+
+func TestVerifyImageTar(t *testing.T) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	// tar lists the parents of nested directories too
+	for _, dir := range []string{"etc", "usr", "var"} {
+		tw.WriteHeader(&tar.Header{Name: dir, Mode: 0755, Typeflag: tar.TypeDir})
+	}
+	for _, entry := range contractEntries() {
+		header := &tar.Header{Name: strings.TrimPrefix(entry.Name, "/"), Mode: int64(entry.Perm())}
+		switch {
+		case entry.IsDir():
+			header.Typeflag = tar.TypeDir
+		case entry.IsSymlink():
+			header.Typeflag, header.Linkname = tar.TypeSymlink, entry.Linkname
+		case entry.IsCharDevice():
+			header.Typeflag, header.Devmajor, header.Devminor = tar.TypeChar, int64(entry.RDevMajor), int64(entry.RDevMinor)
+		default:
+			header.Typeflag, header.Size = tar.TypeReg, int64(len(entry.Data))
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write(entry.Data)
+	}
+	tw.Close()
+	gz.Close()
+
+	path := filepath.Join(t.TempDir(), "rootfs.tar.gz")
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	result, err := VerifyImage(path)
+	if err != nil {
+		t.Fatalf("VerifyImage: %v", err)
+	}
+	if !result.Success {
+		t.Errorf("expected the tar image to pass, got %v", result.Errors)
+	}
+}
+
+func TestDetectImageFormat(t *testing.T) {
+	tarHeader := make([]byte, 512)
+	copy(tarHeader[257:], "ustar")
+
+	tests := []struct {
+		header []byte
+		want   string
+	}{
+		{[]byte("070701000000"), FormatNewc},
+		{[]byte("070702000000"), FormatCRC},
+		{[]byte("070707000000"), FormatODC},
+		{tarHeader, FormatTar},
+	}
+	for _, tt := range tests {
+		if got, err := DetectImageFormat(tt.header); err != nil || got != tt.want {
+			t.Errorf("DetectImageFormat(%q) = %q, %v; want %q", tt.header[:6], got, err, tt.want)
+		}
+	}
+	if _, err := DetectImageFormat([]byte("PK\x03\x04zz")); err == nil {
+		t.Error("expected an error for a zip header")
+	}
+}
@@ -0,0 +1,87 @@
+package report
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"time"
+)
+
+// htmlTemplate is a single page with inline styles and no external
+// resources, so it can be archived as a CI artifact and opened anywhere
+var htmlTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"seconds": func(d time.Duration) string { return fmt.Sprintf("%.2fs", d.Seconds()) },
+	"icon": func(s Status) string {
+		switch s {
+		case Passed:
+			return "✅"
+		case Failed:
+			return "❌"
+		case Warning:
+			return "⚠️"
+		}
+		return "⏭️"
+	},
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>{{.Report.Name}} report</title>
+<style>
+body { font-family: -apple-system, "Segoe UI", Helvetica, Arial, sans-serif; margin: 2em; color: #222; }
+h1 { margin-bottom: 0.2em; }
+.meta { color: #666; margin-bottom: 1.5em; }
+.summary span { display: inline-block; padding: 0.3em 0.8em; margin-right: 0.5em; border-radius: 4px; font-weight: bold; }
+.passed { background: #e6f4ea; color: #137333; }
+.failed { background: #fce8e6; color: #c5221f; }
+.skipped { background: #f1f3f4; color: #5f6368; }
+.warning { background: #fef7e0; color: #b06000; }
+table { border-collapse: collapse; width: 100%; margin-bottom: 2em; }
+th, td { text-align: left; padding: 0.4em 0.6em; border-bottom: 1px solid #ddd; vertical-align: top; }
+th { background: #f8f9fa; }
+td.status { white-space: nowrap; }
+pre { background: #f8f9fa; padding: 0.6em; overflow-x: auto; max-height: 30em; }
+</style>
+</head>
+<body>
+<h1>{{if .Passed}}✅{{else}}❌{{end}} {{.Report.Name}}</h1>
+<div class="meta">{{.Report.Timestamp.Format "2006-01-02 15:04:05 MST"}} · {{seconds .Report.Duration}}</div>
+<div class="summary">
+<span class="passed">{{.PassedCount}} passed</span>
+<span class="failed">{{.Failures}} failed</span>
+<span class="warning">{{.Warnings}} warnings</span>
+<span class="skipped">{{.Skipped}} skipped</span>
+</div>
+{{range .Report.Suites}}
+<h2>{{.Name}}</h2>
+<table>
+<tr><th>Status</th><th>Name</th><th>Time</th><th>Message</th></tr>
+{{range .Cases}}
+<tr class="{{.Status}}">
+<td class="status">{{icon .Status}} {{.Status}}</td>
+<td>{{.Name}}</td>
+<td>{{seconds .Duration}}</td>
+<td>{{.Message}}{{if .Details}}<br><small>{{.Details}}</small>{{end}}
+{{if .Output}}<details><summary>Output</summary><pre>{{.Output}}</pre></details>{{end}}</td>
+</tr>
+{{end}}
+</table>
+{{end}}
+</body>
+</html>
+`))
+
+// WriteHTML renders the report as a self-contained HTML page
+func WriteHTML(w io.Writer, r *Report) error {
+	tests, failures, skipped, warnings := r.Counts()
+	data := struct {
+		Report                                   *Report
+		Passed                                   bool
+		PassedCount, Failures, Skipped, Warnings int
+	}{r, failures == 0, tests - failures - skipped - warnings, failures, skipped, warnings}
+
+	if err := htmlTemplate.Execute(w, data); err != nil {
+		return fmt.Errorf("failed to write HTML report: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package report
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"time"
+)
+
+// JUnit XML elements, in the layout Jenkins, GitLab and GitHub accept
+
+type junitTestSuites struct {
+	XMLName   xml.Name         `xml:"testsuites"`
+	Name      string           `xml:"name,attr"`
+	Tests     int              `xml:"tests,attr"`
+	Failures  int              `xml:"failures,attr"`
+	Errors    int              `xml:"errors,attr"`
+	Skipped   int              `xml:"skipped,attr"`
+	Time      string           `xml:"time,attr"`
+	Timestamp string           `xml:"timestamp,attr"`
+	Suites    []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Errors    int             `xml:"errors,attr"`
+	Skipped   int             `xml:"skipped,attr"`
+	Time      string          `xml:"time,attr"`
+	Timestamp string          `xml:"timestamp,attr"`
+	Cases     []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitMessage `xml:"failure,omitempty"`
+	Skipped   *junitMessage `xml:"skipped,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitMessage struct {
+	Message string `xml:"message,attr,omitempty"`
+	Type    string `xml:"type,attr,omitempty"`
+	Text    string `xml:",chardata"`
+}
+
+// WriteJUnit renders the report as JUnit XML. Warnings pass; their message
+// is included in the case's system-out.
+func WriteJUnit(w io.Writer, r *Report) error {
+	tests, failures, skipped, _ := r.Counts()
+	doc := junitTestSuites{
+		Name:      r.Name,
+		Tests:     tests,
+		Failures:  failures,
+		Skipped:   skipped,
+		Time:      seconds(r.Duration),
+		Timestamp: r.Timestamp.Format(time.RFC3339),
+	}
+
+	for _, s := range r.Suites {
+		tests, failures, skipped, _ := s.Counts()
+		suite := junitTestSuite{
+			Name:      s.Name,
+			Tests:     tests,
+			Failures:  failures,
+			Skipped:   skipped,
+			Time:      seconds(s.Duration),
+			Timestamp: s.Timestamp.Format(time.RFC3339),
+		}
+		for _, c := range s.Cases {
+			tc := junitTestCase{
+				Name:      c.Name,
+				ClassName: c.ClassName,
+				Time:      seconds(c.Duration),
+				SystemOut: c.Output,
+			}
+			switch c.Status {
+			case Failed:
+				tc.Failure = &junitMessage{Message: c.Message, Type: "failure", Text: c.Details}
+			case Skipped:
+				tc.Skipped = &junitMessage{Message: c.Message}
+			case Warning:
+				tc.SystemOut = "warning: " + c.Message + "\n" + c.Output
+			}
+			suite.Cases = append(suite.Cases, tc)
+		}
+		doc.Suites = append(doc.Suites, suite)
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(doc); err != nil {
+		return fmt.Errorf("failed to write JUnit report: %w", err)
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// seconds formats a duration the way JUnit expects
+func seconds(d time.Duration) string {
+	return fmt.Sprintf("%.3f", d.Seconds())
+}
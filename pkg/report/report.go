@@ -0,0 +1,157 @@
+// Package report renders the results of pipeline runs and image
+// verification as JUnit XML, for CI dashboards, or as a self-contained
+// HTML page.
+//
+// Results are modelled the way JUnit sees them: a Report holds suites
+// (pipeline stages, verification categories) of test cases (steps,
+// required paths, device nodes and libraries).
+package report
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Status is the outcome of a test case
+type Status string
+
+const (
+	Passed  Status = "passed"
+	Failed  Status = "failed"
+	Skipped Status = "skipped"
+	Warning Status = "warning" // Passed, with a problem worth reporting
+)
+
+// Output formats
+const (
+	FormatJUnit = "junit"
+	FormatHTML  = "html"
+)
+
+// Case is a single check or step
+type Case struct {
+	Name      string
+	ClassName string // Dotted path of the suite, for JUnit consumers
+	Status    Status
+	Duration  time.Duration
+	Message   string // One-line reason for a failure, skip or warning
+	Details   string // Longer explanation
+	Output    string // Captured output
+}
+
+// Suite groups related cases
+type Suite struct {
+	Name      string
+	Timestamp time.Time
+	Duration  time.Duration
+	Cases     []Case
+}
+
+// Report is the complete result of a run
+type Report struct {
+	Name      string
+	Timestamp time.Time
+	Duration  time.Duration
+	Suites    []*Suite
+}
+
+// New creates an empty report started now
+func New(name string) *Report {
+	return &Report{Name: name, Timestamp: time.Now()}
+}
+
+// Suite returns the suite with the given name, adding it if needed
+func (r *Report) Suite(name string) *Suite {
+	for _, s := range r.Suites {
+		if s.Name == name {
+			return s
+		}
+	}
+	s := &Suite{Name: name, Timestamp: time.Now()}
+	r.Suites = append(r.Suites, s)
+	return s
+}
+
+// Add appends a case to the named suite
+func (r *Report) Add(suite string, c Case) {
+	s := r.Suite(suite)
+	if c.ClassName == "" {
+		c.ClassName = strings.ReplaceAll(r.Name, " ", ".") + "." + suite
+	}
+	s.Cases = append(s.Cases, c)
+}
+
+// Counts tallies the cases of a suite by outcome
+func (s *Suite) Counts() (tests, failures, skipped, warnings int) {
+	for _, c := range s.Cases {
+		tests++
+		switch c.Status {
+		case Failed:
+			failures++
+		case Skipped:
+			skipped++
+		case Warning:
+			warnings++
+		}
+	}
+	return
+}
+
+// Counts tallies every case in the report by outcome
+func (r *Report) Counts() (tests, failures, skipped, warnings int) {
+	for _, s := range r.Suites {
+		t, f, sk, w := s.Counts()
+		tests, failures, skipped, warnings = tests+t, failures+f, skipped+sk, warnings+w
+	}
+	return
+}
+
+// Passed reports whether no case failed
+func (r *Report) Passed() bool {
+	_, failures, _, _ := r.Counts()
+	return failures == 0
+}
+
+// Write renders the report in the given format
+func Write(w io.Writer, format string, r *Report) error {
+	switch format {
+	case FormatJUnit:
+		return WriteJUnit(w, r)
+	case FormatHTML:
+		return WriteHTML(w, r)
+	}
+	return fmt.Errorf("unknown report format %q (use junit or html)", format)
+}
+
+// FormatForPath picks the format of a report file from its extension:
+// .html and .htm are HTML, anything else is JUnit XML
+func FormatForPath(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".html", ".htm":
+		return FormatHTML
+	}
+	return FormatJUnit
+}
+
+// WriteFile renders the report to path, choosing the format from the
+// extension
+func WriteFile(path string, r *Report) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create report: %w", err)
+	}
+	if err := Write(file, FormatForPath(path), r); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// IsFormat reports whether a ROCK_OUTPUT value selects a report format
+func IsFormat(output string) bool {
+	return output == FormatJUnit || output == FormatHTML
+}
@@ -0,0 +1,71 @@
+package report
+
+import (
+	"bytes"
+	"encoding/xml"
+	"strings"
+	"testing"
+)
+
+func testReport() *Report {
+	r := New("rock-verify integration")
+	r.Add("binaries", Case{Name: "/sbin/init", Status: Passed})
+	r.Add("binaries", Case{Name: "/usr/bin/volcano-agent", Status: Failed, Message: "not found"})
+	r.Add("directories", Case{Name: "/run", Status: Warning, Message: "optional <directory> missing"})
+	r.Add("directories", Case{Name: "/config", Status: Skipped, Message: "not checked"})
+	return r
+}
+
+func TestWriteJUnit(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Write(&buf, FormatJUnit, testReport()); err != nil {
+		t.Fatal(err)
+	}
+
+	var doc junitTestSuites
+	if err := xml.Unmarshal(buf.Bytes(), &doc); err != nil {
+		t.Fatalf("invalid XML: %v\n%s", err, buf.String())
+	}
+	if doc.Tests != 4 || doc.Failures != 1 || doc.Skipped != 1 || len(doc.Suites) != 2 {
+		t.Errorf("totals = %d tests, %d failures, %d skipped, %d suites", doc.Tests, doc.Failures, doc.Skipped, len(doc.Suites))
+	}
+
+	cases := doc.Suites[0].Cases
+	if cases[1].Failure == nil || cases[1].Failure.Message != "not found" {
+		t.Errorf("missing failure for %s", cases[1].Name)
+	}
+	if cases[0].ClassName != "rock-verify.integration.binaries" {
+		t.Errorf("classname = %q", cases[0].ClassName)
+	}
+	if warn := doc.Suites[1].Cases[0]; warn.Failure != nil || !strings.Contains(warn.SystemOut, "optional <directory> missing") {
+		t.Errorf("warning case = %+v", warn)
+	}
+}
+
+func TestWriteHTML(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Write(&buf, FormatHTML, testReport()); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+
+	for _, want := range []string{"<!DOCTYPE html>", "1 passed", "1 failed", "1 warnings", "/usr/bin/volcano-agent", "optional &lt;directory&gt; missing"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("HTML report lacks %q", want)
+		}
+	}
+	if strings.Contains(out, "<link") || strings.Contains(out, "<script src") {
+		t.Error("HTML report is not self-contained")
+	}
+}
+
+func TestFormatForPath(t *testing.T) {
+	for path, want := range map[string]string{"report.xml": FormatJUnit, "out/REPORT.HTML": FormatHTML, "report": FormatJUnit} {
+		if got := FormatForPath(path); got != want {
+			t.Errorf("FormatForPath(%q) = %q, want %q", path, got, want)
+		}
+	}
+	if err := Write(&bytes.Buffer{}, "pdf", testReport()); err == nil {
+		t.Error("expected an error for an unknown format")
+	}
+}
@@ -0,0 +1,434 @@
+// Package rootfs assembles an initramfs from a declarative manifest
+// instead of a staged rootfs directory.
+//
+// A manifest lists directories, files copied from the host under a new
+// name and mode, symlinks, device nodes and generated files. Unless it
+// opts out, it also gets the layout the integration contract requires:
+// the required directories, busybox symlinks and device nodes, and the
+// contract binaries, found by their source names in the binaries
+// directory. The result is a list of archive entries built in memory, so
+// nothing is staged on disk and device nodes and root ownership need no
+// privileges.
+//
+// Example:
+//
+//	binaries: ${BUILD_DIR}
+//	directories:
+//	  - /lib
+//	  - {path: /var/lib/rock, mode: "0700"}
+//	files:
+//	  - {source: "${BUILD_DIR}/lib", path: /lib, optional: true}
+//	  - {source: "${BUILD_DIR}/config.yaml", path: /etc/rock/config.yaml, mode: "0600"}
+//	symlinks:
+//	  - {path: /bin/ps, target: busybox}
+//	devices:
+//	  - {path: /dev/ttyS0, type: char, major: 4, minor: 64, mode: "0620"}
+//	generated:
+//	  - {path: /etc/hostname, content: "rock\n"}
+//	  - {path: /etc/rock/build-info, command: [git, describe, --always]}
+package rootfs
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rock-os/tools/pkg/cpio"
+	"github.com/rock-os/tools/pkg/integration"
+	"gopkg.in/yaml.v3"
+)
+
+// Manifest describes the contents of a rootfs. Paths inside the rootfs
+// are absolute or relative to its root; host paths may use ${VAR} from
+// the environment and are relative to the manifest's directory.
+type Manifest struct {
+	// Contract includes the layout of integration.GetContract(); it
+	// defaults to true
+	Contract *bool `yaml:"contract"`
+	// Binaries is the host directory holding the contract binaries under
+	// their source names: rock-init, rock-manager, volcano-agent, busybox
+	Binaries string `yaml:"binaries"`
+
+	Directories []Directory `yaml:"directories"`
+	Files       []File      `yaml:"files"`
+	Symlinks    []Symlink   `yaml:"symlinks"`
+	Devices     []Device    `yaml:"devices"`
+	Generated   []Generated `yaml:"generated"`
+
+	dir string // Directory of the manifest file
+}
+
+// Mode is a permission mode, always read as octal: "0755", 0755 and 755
+// are the same mode. Zero selects the default.
+type Mode uint32
+
+func (m *Mode) UnmarshalYAML(node *yaml.Node) error {
+	n, err := strconv.ParseUint(strings.TrimPrefix(node.Value, "0o"), 8, 32)
+	if err != nil || n > 07777 {
+		return fmt.Errorf("line %d: invalid mode %q: want octal, such as 0755", node.Line, node.Value)
+	}
+	*m = Mode(n)
+	return nil
+}
+
+// Owner is the owner of an entry; root by default
+type Owner struct {
+	UID uint32 `yaml:"uid"`
+	GID uint32 `yaml:"gid"`
+}
+
+// Directory is a directory; it may be written as just its path
+type Directory struct {
+	Path  string `yaml:"path"`
+	Mode  Mode   `yaml:"mode"` // Default 0755
+	Owner `yaml:",inline"`
+}
+
+func (d *Directory) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		d.Path = node.Value
+		return nil
+	}
+	type plain Directory
+	return node.Decode((*plain)(d))
+}
+
+// File copies a host file into the rootfs at Path. A directory source is
+// copied with everything below it, keeping the permissions of its
+// contents. An optional file is left out when its source does not exist,
+// such as libraries collected only for dynamically linked binaries.
+type File struct {
+	Source   string `yaml:"source"`
+	Path     string `yaml:"path"`
+	Mode     Mode   `yaml:"mode"` // Default: the source's permissions
+	Optional bool   `yaml:"optional"`
+	Owner    `yaml:",inline"`
+}
+
+// Symlink is a symbolic link
+type Symlink struct {
+	Path   string `yaml:"path"`
+	Target string `yaml:"target"`
+}
+
+// Device is a device node
+type Device struct {
+	Path  string `yaml:"path"`
+	Type  string `yaml:"type"` // char (default) or block
+	Major uint32 `yaml:"major"`
+	Minor uint32 `yaml:"minor"`
+	Mode  Mode   `yaml:"mode"` // Default 0600
+	Owner `yaml:",inline"`
+}
+
+// Generated is a file whose contents are given inline, or are the
+// standard output of a command run in the manifest's directory
+type Generated struct {
+	Path    string   `yaml:"path"`
+	Content string   `yaml:"content"`
+	Command []string `yaml:"command"`
+	Mode    Mode     `yaml:"mode"` // Default 0644
+	Owner   `yaml:",inline"`
+}
+
+// Load reads a manifest from a YAML or JSON file
+func Load(manifestPath string) (*Manifest, error) {
+	data, err := os.ReadFile(manifestPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+	m, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", manifestPath, err)
+	}
+	m.dir = filepath.Dir(manifestPath)
+	return m, nil
+}
+
+// Parse decodes a YAML or JSON manifest. Relative host paths are resolved
+// against the working directory. Unknown fields are rejected, so that a
+// misspelt key does not silently drop part of the rootfs.
+func Parse(data []byte) (*Manifest, error) {
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	var m Manifest
+	if err := decoder.Decode(&m); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("invalid manifest: %w", err)
+	}
+	return &m, nil
+}
+
+// Entries resolves the manifest into archive entries, sorted so that
+// every directory precedes its contents. A manifest entry replaces a
+// contract entry with the same path; listing a path twice is an error.
+// Host files are checked to exist but read only when archived, and
+// generated files run their commands now.
+func (m *Manifest) Entries() ([]cpio.Entry, error) {
+	now := time.Now()
+
+	// Entries copied from host directory trees sit between the contract
+	// and the entries the manifest lists by path
+	var listed, trees []cpio.Entry
+	kinds := make(map[string]string)
+	add := func(kind string, entry cpio.Entry) error {
+		name := cleanPath(entry.Name)
+		if name == "" {
+			return fmt.Errorf("%s: missing path", kind)
+		}
+		if other, ok := kinds[name]; ok {
+			return fmt.Errorf("/%s is listed twice (%s and %s)", name, other, kind)
+		}
+		kinds[name] = kind
+		entry.Name = name
+		listed = append(listed, entry)
+		return nil
+	}
+
+	for _, d := range m.Directories {
+		entry := header(d.Path, cpio.TypeDir, d.Mode, 0755, d.Owner, now)
+		if err := add("directory", entry); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, f := range m.Files {
+		source, err := m.hostPath(f.Source)
+		if err != nil {
+			return nil, fmt.Errorf("file /%s: %w", cleanPath(f.Path), err)
+		}
+		info, err := os.Stat(source)
+		if f.Optional && os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("file /%s: %w", cleanPath(f.Path), err)
+		}
+
+		if !info.IsDir() {
+			entry := header(f.Path, cpio.TypeReg, f.Mode, uint32(info.Mode().Perm()), f.Owner, info.ModTime())
+			entry.Size = info.Size()
+			entry.Source = source
+			if err := add("file", entry); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		entry := header(f.Path, cpio.TypeDir, f.Mode, uint32(info.Mode().Perm()), f.Owner, info.ModTime())
+		if err := add("file", entry); err != nil {
+			return nil, err
+		}
+		scanned, err := cpio.ScanDir(source, false)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range scanned {
+			e.Name = path.Join(entry.Name, e.Name)
+			e.UID, e.GID = f.UID, f.GID
+			trees = append(trees, e)
+		}
+	}
+
+	for _, s := range m.Symlinks {
+		if s.Target == "" {
+			return nil, fmt.Errorf("symlink /%s: missing target", cleanPath(s.Path))
+		}
+		if err := add("symlink", symlink(s.Path, s.Target, now)); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, d := range m.Devices {
+		var kind uint32
+		switch d.Type {
+		case "", "char":
+			kind = cpio.TypeChar
+		case "block":
+			kind = cpio.TypeBlock
+		default:
+			return nil, fmt.Errorf("device /%s: unknown type %q (want char or block)", cleanPath(d.Path), d.Type)
+		}
+		entry := header(d.Path, kind, d.Mode, 0600, d.Owner, now)
+		entry.RDevMajor, entry.RDevMinor = d.Major, d.Minor
+		if err := add("device", entry); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, g := range m.Generated {
+		data, err := m.generate(g)
+		if err != nil {
+			return nil, fmt.Errorf("generated /%s: %w", cleanPath(g.Path), err)
+		}
+		entry := header(g.Path, cpio.TypeReg, g.Mode, 0644, g.Owner, now)
+		entry.Data = data
+		entry.Size = int64(len(data))
+		if err := add("generated file", entry); err != nil {
+			return nil, err
+		}
+	}
+
+	var contract []cpio.Entry
+	if m.Contract == nil || *m.Contract {
+		var err error
+		if contract, err = m.contractEntries(kinds, now); err != nil {
+			return nil, err
+		}
+	}
+	return cpio.Merge(contract, append(trees, listed...)...), nil
+}
+
+// contractEntries returns the layout integration.GetContract() requires.
+// Binaries the manifest lists itself need not be in the binaries
+// directory.
+func (m *Manifest) contractEntries(listed map[string]string, now time.Time) ([]cpio.Entry, error) {
+	contract := integration.GetContract()
+	var entries []cpio.Entry
+
+	for _, dir := range contract.Directories {
+		entries = append(entries, header(dir, cpio.TypeDir, 0, 0755, Owner{}, now))
+	}
+
+	binaries := ""
+	if m.Binaries != "" {
+		var err error
+		if binaries, err = m.hostPath(m.Binaries); err != nil {
+			return nil, fmt.Errorf("binaries: %w", err)
+		}
+	}
+	var missing []string
+	for _, binary := range contract.Binaries {
+		if _, ok := listed[cleanPath(binary.Destination)]; ok {
+			continue
+		}
+		source := filepath.Join(binaries, binary.Source)
+		info, err := os.Stat(source)
+		if binaries == "" || err != nil || info.IsDir() {
+			missing = append(missing, fmt.Sprintf("%s (%s)", binary.Destination, binary.Source))
+			continue
+		}
+		entry := header(binary.Destination, cpio.TypeReg, Mode(binary.Permissions), 0755, Owner{}, info.ModTime())
+		entry.Size = info.Size()
+		entry.Source = source
+		entries = append(entries, entry)
+	}
+	if len(missing) > 0 {
+		where := "no binaries directory is set"
+		if binaries != "" {
+			where = "not found in " + binaries
+		}
+		return nil, fmt.Errorf("contract binaries %s: %s; set binaries or list them under files", strings.Join(missing, ", "), where)
+	}
+
+	for _, name := range integration.BusyboxSymlinks {
+		entries = append(entries, symlink(path.Join(path.Dir(integration.BusyboxPath), name), path.Base(integration.BusyboxPath), now))
+	}
+
+	for _, node := range contract.DeviceNodes {
+		entry := header(node.Path, cpio.TypeChar, Mode(node.Mode), 0600, Owner{}, now)
+		entry.RDevMajor, entry.RDevMinor = node.Major, node.Minor
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// generate returns the contents of a generated file
+func (m *Manifest) generate(g Generated) ([]byte, error) {
+	if len(g.Command) == 0 {
+		return []byte(g.Content), nil
+	}
+	if g.Content != "" {
+		return nil, fmt.Errorf("content and command are mutually exclusive")
+	}
+
+	args := make([]string, len(g.Command))
+	for i, arg := range g.Command {
+		expanded, err := expand(arg)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = expanded
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Dir = m.dir
+	cmd.Stderr = os.Stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", strings.Join(args, " "), err)
+	}
+	return output, nil
+}
+
+// hostPath expands a host path and resolves it against the manifest's
+// directory
+func (m *Manifest) hostPath(value string) (string, error) {
+	if value == "" {
+		return "", fmt.Errorf("missing source")
+	}
+	expanded, err := expand(value)
+	if err != nil {
+		return "", err
+	}
+	if !filepath.IsAbs(expanded) && m.dir != "" {
+		expanded = filepath.Join(m.dir, expanded)
+	}
+	return expanded, nil
+}
+
+// expand substitutes ${VAR} and $VAR from the environment. An unset
+// variable is an error rather than an empty string, which would silently
+// turn ${BUILD_DIR}/rock-init into /rock-init.
+func expand(value string) (string, error) {
+	var missing string
+	expanded := os.Expand(value, func(name string) string {
+		v, ok := os.LookupEnv(name)
+		if !ok && missing == "" {
+			missing = name
+		}
+		return v
+	})
+	if missing != "" {
+		return "", fmt.Errorf("%s: %s is not set", value, missing)
+	}
+	return expanded, nil
+}
+
+// header returns an entry of the given type, with mode or, when mode is
+// zero, the default permissions
+func header(name string, kind uint32, mode Mode, defaultPerm uint32, owner Owner, modTime time.Time) cpio.Entry {
+	perm := uint32(mode)
+	if perm == 0 {
+		perm = defaultPerm
+	}
+	return cpio.Entry{Header: cpio.Header{
+		Name:    name,
+		Mode:    kind | perm,
+		UID:     owner.UID,
+		GID:     owner.GID,
+		ModTime: modTime,
+	}}
+}
+
+// symlink returns a root-owned symlink entry
+func symlink(name, target string, modTime time.Time) cpio.Entry {
+	return cpio.Entry{Header: cpio.Header{
+		Name:     name,
+		Mode:     cpio.TypeSymlink | 0777,
+		ModTime:  modTime,
+		Size:     int64(len(target)),
+		Linkname: target,
+	}}
+}
+
+// cleanPath normalizes a rootfs path to the relative form archive names
+// use; "" means the path was empty or the root itself
+func cleanPath(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
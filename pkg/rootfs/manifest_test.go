@@ -0,0 +1,155 @@
+package rootfs
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rock-os/tools/pkg/cpio"
+	"github.com/rock-os/tools/pkg/integration"
+)
+
+func TestManifestEntries(t *testing.T) {
+	dir := t.TempDir()
+	build := filepath.Join(dir, "build")
+	if err := os.MkdirAll(filepath.Join(build, "lib", "x86_64"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"rock-init", "rock-manager", "volcano-agent", "busybox", "lib/x86_64/libc.so.6"} {
+		if err := os.WriteFile(filepath.Join(build, name), []byte(name), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("TEST_BUILD_DIR", build)
+
+	manifest := filepath.Join(dir, "rootfs.yaml")
+	if err := os.WriteFile(manifest, []byte(`
+binaries: ${TEST_BUILD_DIR}
+directories:
+  - /var/lib/rock
+  - {path: /config, mode: "0700"}
+files:
+  - {source: build/lib, path: /lib}
+  - {source: build/rock-init, path: /etc/rock/init.bak, mode: 0600, uid: 1000}
+symlinks:
+  - {path: /bin/ps, target: busybox}
+devices:
+  - {path: /dev/console, major: 5, minor: 1, mode: "0600"}
+  - {path: /dev/vda, type: block, major: 254, minor: 0}
+generated:
+  - {path: /etc/hostname, content: "rock\n"}
+  - {path: /etc/rock/build, command: [echo, "${TEST_BUILD_DIR}"]}
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := Load(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := m.Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if _, err := cpio.WriteTree(&buf, "", cpio.TreeOptions{Overlay: entries}); err != nil {
+		t.Fatal(err)
+	}
+	archive, err := cpio.ReadAll(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result := integration.VerifyArchive(archive, integration.GetContract()); !result.Success {
+		t.Errorf("archive does not meet the contract: %+v", result.Errors)
+	}
+
+	for _, test := range []struct {
+		name string
+		mode uint32
+		data string
+	}{
+		{"sbin/init", cpio.TypeReg | 0755, "rock-init"},
+		{"lib/x86_64/libc.so.6", cpio.TypeReg | 0700, "lib/x86_64/libc.so.6"},
+		{"etc/rock/init.bak", cpio.TypeReg | 0600, "rock-init"},
+		{"etc/hostname", cpio.TypeReg | 0644, "rock\n"},
+		{"etc/rock/build", cpio.TypeReg | 0644, build + "\n"},
+		{"config", cpio.TypeDir | 0700, ""},
+		{"var/lib/rock", cpio.TypeDir | 0755, ""},
+		{"dev/console", cpio.TypeChar | 0600, ""},
+		{"dev/vda", cpio.TypeBlock | 0600, ""},
+		{"dev/null", cpio.TypeChar | 0666, ""},
+		{"bin/ps", cpio.TypeSymlink | 0777, ""},
+		{"bin/sh", cpio.TypeSymlink | 0777, ""},
+	} {
+		entry, ok := archive.Lstat(test.name)
+		if !ok {
+			t.Errorf("%s: missing", test.name)
+			continue
+		}
+		if entry.Mode != test.mode || string(entry.Data) != test.data {
+			t.Errorf("%s: mode %o data %q, want %o %q", test.name, entry.Mode, entry.Data, test.mode, test.data)
+		}
+	}
+	if entry, _ := archive.Lstat("etc/rock/init.bak"); entry != nil && entry.UID != 1000 {
+		t.Errorf("etc/rock/init.bak uid = %d, want 1000", entry.UID)
+	}
+}
+
+func TestManifestErrors(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("TEST_BUILD_DIR", dir)
+	os.Unsetenv("TEST_UNSET_DIR")
+
+	for _, test := range []struct {
+		manifest string
+		want     string
+	}{
+		{"binaries: ${TEST_BUILD_DIR}", "contract binaries /sbin/init (rock-init)"},
+		{"contract: false\nfiles: [{source: \"${TEST_UNSET_DIR}/x\", path: /x}]", "TEST_UNSET_DIR is not set"},
+		{"contract: false\nsymlinks: [{path: /x, target: y}]\ndirectories: [/x]", "/x is listed twice"},
+		{"contract: false\ndevices: [{path: /dev/x, type: pipe}]", `unknown type "pipe"`},
+		{"contract: false\ndirectories: [{path: /x, mode: rwx}]", "invalid mode"},
+		{"contract: false\nfile: []", "field file not found"},
+		{"contract: false\nfiles: [{source: \"${TEST_BUILD_DIR}/lib\", path: /lib}]", "no such file or directory"},
+	} {
+		m, err := Parse([]byte(test.manifest))
+		if err == nil {
+			_, err = m.Entries()
+		}
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%q: error %v, want %q", test.manifest, err, test.want)
+		}
+	}
+}
+
+func TestManifestOptionalFile(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("TEST_BUILD_DIR", dir)
+	if err := os.WriteFile(filepath.Join(dir, "config.yaml"), []byte("node: rock\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := Parse([]byte(`
+contract: false
+files:
+  - {source: "${TEST_BUILD_DIR}/lib", path: /lib, optional: true}
+  - {source: "${TEST_BUILD_DIR}/config.yaml", path: /etc/rock/config.yaml, optional: true}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := m.Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name)
+	}
+	if got := strings.Join(names, " "); strings.Contains(got, "lib") || !strings.Contains(got, "etc/rock/config.yaml") {
+		t.Errorf("entries = %s, want the config without /lib", got)
+	}
+}
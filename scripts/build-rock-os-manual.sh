@@ -204,13 +204,15 @@ echo ""
 echo -e "${YELLOW}  chmod +x scripts/test-boot.sh${NC}"
 echo -e "${YELLOW}  ./scripts/test-boot.sh $OUTPUT_DIR/vmlinuz $OUTPUT_DIR/rock-os.cpio.gz${NC}"
 echo ""
+# Get kernel cmdline from rock-kernel tool (rdinit for initramfs)
+CMDLINE=$(rock-kernel cmdline debug 2>/dev/null || echo "rdinit=/sbin/init console=ttyS0 debug")
 echo "Or manually with:"
 echo ""
 echo -e "${YELLOW}  qemu-system-x86_64 \\${NC}"
 echo -e "${YELLOW}    -m 512 \\${NC}"
 echo -e "${YELLOW}    -kernel $OUTPUT_DIR/vmlinuz \\${NC}"
 echo -e "${YELLOW}    -initrd $OUTPUT_DIR/rock-os.cpio.gz \\${NC}"
-echo -e "${YELLOW}    -append \"init=/sbin/init console=ttyS0 debug\" \\${NC}"
+echo -e "${YELLOW}    -append \"$CMDLINE\" \\${NC}"
 echo -e "${YELLOW}    -nographic -serial mon:stdio${NC}"
 echo ""
 echo "Press Ctrl-A X to exit QEMU"
\ No newline at end of file
@@ -151,5 +151,7 @@ echo ""
 echo "Test boot with:"
 echo -e "${YELLOW}./scripts/test-boot.sh $OUTPUT_DIR/vmlinuz $OUTPUT_DIR/rock-os.cpio.gz${NC}"
 echo ""
+# Get kernel cmdline from rock-kernel tool (rdinit for initramfs)
+CMDLINE=$(rock-kernel cmdline debug 2>/dev/null || echo "rdinit=/sbin/init console=ttyS0 debug")
 echo "Or manually:"
-echo -e "${YELLOW}qemu-system-x86_64 -m 512 -kernel $OUTPUT_DIR/vmlinuz -initrd $OUTPUT_DIR/rock-os.cpio.gz -append \"init=/sbin/init console=ttyS0 debug\" -nographic -serial mon:stdio${NC}"
\ No newline at end of file
+echo -e "${YELLOW}qemu-system-x86_64 -m 512 -kernel $OUTPUT_DIR/vmlinuz -initrd $OUTPUT_DIR/rock-os.cpio.gz -append \"$CMDLINE\" -nographic -serial mon:stdio${NC}"
\ No newline at end of file